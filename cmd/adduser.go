@@ -4,6 +4,7 @@ import (
 	"github.com/triargos/webdav/pkg/config"
 	"github.com/triargos/webdav/pkg/environment"
 	"github.com/triargos/webdav/pkg/fs"
+	"github.com/triargos/webdav/pkg/helper"
 	"github.com/triargos/webdav/pkg/user"
 	"log/slog"
 	"os"
@@ -23,6 +24,14 @@ var adduserCmd = &cobra.Command{
 		jailed, _ := cmd.Flags().GetBool("jailed")
 		fsService := fs.NewOsFileSystemService()
 		subdirectories, _ := cmd.Flags().GetStringArray("subdirs")
+		authTypes, _ := cmd.Flags().GetStringSlice("authtypes")
+		quotaValue := cmd.Flag("quota").Value.String()
+		if quotaValue != "" {
+			if _, parseErr := helper.ParseSize(quotaValue); parseErr != nil {
+				slog.Error("invalid quota", "error", parseErr.Error())
+				os.Exit(1)
+			}
+		}
 		configService := config.NewConfigService(environment.NewOsEnvironmentService(), fsService)
 
 		userService := user.NewOsUserService(configService, fsService)
@@ -32,6 +41,8 @@ var adduserCmd = &cobra.Command{
 			SubDirectories: subdirectories,
 			Jail:           jailed,
 			Root:           dir,
+			AuthTypes:      authTypes,
+			Quota:          quotaValue,
 		})
 		if addUserErr != nil {
 			slog.Error("failed to add user", "error", addUserErr.Error())
@@ -48,4 +59,6 @@ func init() {
 	adduserCmd.Flags().BoolP("jailed", "j", false, "Is the user jailed")
 	adduserCmd.Flags().StringP("dir", "d", "", "Directory of the user to add")
 	adduserCmd.Flags().StringArrayP("subdirs", "s", []string{}, "Subdirectories of the user to add")
+	adduserCmd.Flags().String("quota", "", "Quota of the user's root, e.g. 10G")
+	adduserCmd.Flags().StringSlice("authtypes", []string{}, "Authentication schemes the user may use (basic, digest). Defaults to all schemes of the server")
 }
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/triargos/webdav/pkg/certificate"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/environment"
+	"github.com/triargos/webdav/pkg/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var gencertCmd = &cobra.Command{
+	Use:   "gencert",
+	Short: "Generate a self-signed TLS certificate",
+	Long: "Generate a self-signed TLS certificate for the given host names and IP addresses. If no certificate is " +
+		"configured yet, the configuration is updated to serve HTTPS with it.",
+	Run: func(cmd *cobra.Command, args []string) {
+		hosts, _ := cmd.Flags().GetStringSlice("host")
+		days, _ := cmd.Flags().GetInt("days")
+		configService := config.NewConfigService(environment.NewOsEnvironmentService(), fs.NewOsFileSystemService())
+		certFile, _ := cmd.Flags().GetString("cert")
+		if certFile == "" {
+			certFile = configService.StatePath("cert.pem")
+		}
+		keyFile, _ := cmd.Flags().GetString("key")
+		if keyFile == "" {
+			keyFile = configService.StatePath("key.pem")
+		}
+		if len(hosts) == 0 {
+			hosts = []string{"localhost", "127.0.0.1", "::1"}
+			if hostname, hostnameErr := os.Hostname(); hostnameErr == nil {
+				hosts = append(hosts, hostname)
+			}
+		}
+		certPEM, keyPEM, generateErr := certificate.Generate(hosts, time.Duration(days)*24*time.Hour)
+		if generateErr != nil {
+			slog.Error("Failed to generate certificate", "error", generateErr.Error())
+			os.Exit(1)
+		}
+		if writeErr := os.WriteFile(keyFile, keyPEM, 0600); writeErr != nil {
+			slog.Error("Failed to write certificate key", "error", writeErr.Error())
+			os.Exit(1)
+		}
+		if writeErr := os.WriteFile(certFile, certPEM, 0644); writeErr != nil {
+			slog.Error("Failed to write certificate", "error", writeErr.Error())
+			os.Exit(1)
+		}
+		slog.Info("Generated self-signed certificate", "cert", certFile, "key", keyFile, "hosts", hosts)
+		tlsConfig := &configService.Get().Network.TLS
+		if tlsConfig.Cert == "" && tlsConfig.Key == "" {
+			// The server may be started from another working directory
+			tlsConfig.Cert, _ = filepath.Abs(certFile)
+			tlsConfig.Key, _ = filepath.Abs(keyFile)
+			if writeErr := configService.Write(); writeErr != nil {
+				slog.Error("Failed to write configuration file", "error", writeErr.Error())
+				os.Exit(1)
+			}
+			slog.Info("Configured the server to use the certificate. Please restart the service for changes to take effect")
+		}
+	},
+}
+
+// newTLSConfig creates the TLS configuration of the server, or nil if no certificate is configured.
+func newTLSConfig(configService config.Service) (*tls.Config, error) {
+	tlsConfig := configService.Get().Network.TLS
+	clientCerts := configService.Get().Security.ClientCerts
+	if tlsConfig.Cert == "" && tlsConfig.Key == "" {
+		if clientCerts.CA != "" {
+			return nil, fmt.Errorf("client certificates require TLS")
+		}
+		return nil, nil
+	}
+	if tlsConfig.Cert == "" || tlsConfig.Key == "" {
+		return nil, fmt.Errorf("both a certificate and a key must be configured")
+	}
+	minVersion, err := certificate.ParseVersion(tlsConfig.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := certificate.ParseCipherSuites(tlsConfig.Ciphers)
+	if err != nil {
+		return nil, err
+	}
+	loader, err := certificate.NewFileLoader(tlsConfig.Cert, tlsConfig.Key)
+	if err != nil {
+		return nil, err
+	}
+	serverConfig := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		GetCertificate: loader.GetCertificate,
+	}
+	if clientCerts.CA != "" {
+		switch clientCerts.Mode {
+		case "", "optional":
+			serverConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		case "required":
+			serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		default:
+			return nil, fmt.Errorf("unsupported client certificate mode %q, must be optional or required", clientCerts.Mode)
+		}
+		caPEM, readErr := os.ReadFile(clientCerts.CA)
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read client CA: %w", readErr)
+		}
+		serverConfig.ClientCAs = x509.NewCertPool()
+		if !serverConfig.ClientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in client CA %s", clientCerts.CA)
+		}
+	}
+	return serverConfig, nil
+}
+
+func init() {
+	rootCmd.AddCommand(gencertCmd)
+	gencertCmd.Flags().StringSlice("host", nil, "Host names and IP addresses of the certificate, localhost and the host name by default")
+	gencertCmd.Flags().Int("days", 365, "Number of days the certificate is valid")
+	gencertCmd.Flags().String("cert", "", "File to write the certificate to, cert.pem next to the configuration by default")
+	gencertCmd.Flags().String("key", "", "File to write the key to, key.pem next to the configuration by default")
+}
@@ -22,7 +22,7 @@ var genconfigCmd = &cobra.Command{
 		authType, _ := cmd.Flags().GetString("type")
 		isValidAuthType := helper.ValidateAuthType(authType)
 		if !isValidAuthType {
-			slog.Error("Auth type must be either 'basic' or 'digest'")
+			slog.Error("Auth type must be either 'basic', 'digest' or 'any'")
 			os.Exit(1)
 		}
 		configValue := config.Config{
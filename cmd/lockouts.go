@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/environment"
+	"github.com/triargos/webdav/pkg/fs"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var lockoutsCmd = &cobra.Command{
+	Use:   "lockouts",
+	Short: "Manage clients and users locked out after too many failed logins",
+}
+
+var lockoutsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List active lockouts",
+	Run: func(cmd *cobra.Command, args []string) {
+		configService := config.NewConfigService(environment.NewOsEnvironmentService(), fs.NewOsFileSystemService())
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "KEY\tUNTIL")
+		for _, lockout := range newLimiter(configService).Lockouts() {
+			fmt.Fprintf(writer, "%s\t%s\n", lockout.Key, lockout.Until.Format(time.RFC3339))
+		}
+		writer.Flush()
+	},
+}
+
+var lockoutsClearCmd = &cobra.Command{
+	Use:   "clear [key]",
+	Short: "Lift a lockout, e.g. ip:203.0.113.7 or user:alice. Without a key, every lockout is lifted",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		configService := config.NewConfigService(environment.NewOsEnvironmentService(), fs.NewOsFileSystemService())
+		key := ""
+		if len(args) == 1 {
+			key = args[0]
+		}
+		clearErr := newLimiter(configService).Clear(key)
+		if clearErr != nil {
+			slog.Error("failed to clear lockouts", "error", clearErr.Error())
+			os.Exit(1)
+		}
+		slog.Info("Cleared lockouts. A running server picks up the change within a few seconds")
+	},
+}
+
+func newLimiter(configService config.Service) *auth.SlidingWindowLimiter {
+	bruteForceConfig := configService.Get().Security.BruteForce
+	return auth.NewSlidingWindowLimiter(auth.LimiterOptions{
+		Window:       time.Duration(bruteForceConfig.Window) * time.Second,
+		BackoffAfter: bruteForceConfig.BackoffAfter,
+		MaxFailures:  bruteForceConfig.MaxFailures,
+		Lockout:      time.Duration(bruteForceConfig.Lockout) * time.Second,
+		StatePath:    configService.StatePath("lockouts.json"),
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(lockoutsCmd)
+	lockoutsCmd.AddCommand(lockoutsListCmd, lockoutsClearCmd)
+}
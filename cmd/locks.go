@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/environment"
+	"github.com/triargos/webdav/pkg/fs"
+	"github.com/triargos/webdav/pkg/lock"
+	"golang.org/x/net/webdav"
+	"log/slog"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+var locksCmd = &cobra.Command{
+	Use:   "locks",
+	Short: "Manage the WebDAV locks clients hold on files",
+}
+
+var locksListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List active locks",
+	Run: func(cmd *cobra.Command, args []string) {
+		configService := config.NewConfigService(environment.NewOsEnvironmentService(), fs.NewOsFileSystemService())
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "TOKEN\tSHARE\tPATH\tDEPTH\tOWNER\tEXPIRES")
+		for _, share := range lockSystems(configService) {
+			for _, activeLock := range share.lockSystem.Locks() {
+				depth := "infinity"
+				if activeLock.ZeroDepth {
+					depth = "0"
+				}
+				expires := "never"
+				if !activeLock.Expires.IsZero() {
+					expires = activeLock.Expires.Format(time.RFC3339)
+				}
+				fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", activeLock.Token, share.name, activeLock.Root, depth, activeLock.OwnerXML, expires)
+			}
+		}
+		writer.Flush()
+	},
+}
+
+var locksBreakCmd = &cobra.Command{
+	Use:   "break <token>",
+	Short: "Break a lock, e.g. one left behind by a client that crashed",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		configService := config.NewConfigService(environment.NewOsEnvironmentService(), fs.NewOsFileSystemService())
+		var breakErr error
+		for _, share := range lockSystems(configService) {
+			if breakErr = share.lockSystem.Break(args[0]); !errors.Is(breakErr, webdav.ErrNoSuchLock) {
+				break
+			}
+		}
+		if breakErr != nil {
+			slog.Error("failed to break lock", "error", breakErr.Error())
+			os.Exit(1)
+		}
+		slog.Info("Broke lock. A running server picks up the change with the next request")
+	},
+}
+
+func newLockSystem(configService config.Service) *lock.FileLockSystem {
+	return lock.NewFileLockSystem(configService.StatePath("locks.json"))
+}
+
+// newShareLockSystem keeps the locks of a share apart from the ones of the content directory, since
+// the same paths exist in both.
+func newShareLockSystem(configService config.Service, name string) *lock.FileLockSystem {
+	return lock.NewFileLockSystem(configService.StatePath("locks-" + name + ".json"))
+}
+
+type namedLockSystem struct {
+	// name is the name of the share, or - for the content directory
+	name       string
+	lockSystem *lock.FileLockSystem
+}
+
+// lockSystems returns the lock systems of the content directory and of the shares.
+func lockSystems(configService config.Service) []namedLockSystem {
+	lockSystems := []namedLockSystem{{name: "-", lockSystem: newLockSystem(configService)}}
+	names := make([]string, 0, len(configService.Get().Shares))
+	for name := range configService.Get().Shares {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lockSystems = append(lockSystems, namedLockSystem{name: name, lockSystem: newShareLockSystem(configService, name)})
+	}
+	return lockSystems
+}
+
+func init() {
+	rootCmd.AddCommand(locksCmd)
+	locksCmd.AddCommand(locksListCmd, locksBreakCmd)
+}
@@ -1,17 +1,28 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"github.com/spf13/cobra"
 	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/checksum"
 	"github.com/triargos/webdav/pkg/config"
 	"github.com/triargos/webdav/pkg/environment"
+	"github.com/triargos/webdav/pkg/etag"
 	"github.com/triargos/webdav/pkg/fs"
 	"github.com/triargos/webdav/pkg/handler"
+	"github.com/triargos/webdav/pkg/helper"
+	"github.com/triargos/webdav/pkg/metrics"
+	"github.com/triargos/webdav/pkg/property"
+	"github.com/triargos/webdav/pkg/quota"
 	"github.com/triargos/webdav/pkg/server"
+	"github.com/triargos/webdav/pkg/upload"
 	"github.com/triargos/webdav/pkg/user"
 	"golang.org/x/net/webdav"
 	"log/slog"
 	"os"
+	"sort"
+	"time"
 )
 
 // startCmd represents the start command
@@ -50,28 +61,220 @@ var startCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		validateACLErr := auth.ValidateACL(configService.Get().ACL)
+		if validateACLErr != nil {
+			slog.Error("Invalid acl configuration", "error", validateACLErr.Error())
+			os.Exit(1)
+		}
+
 		slog.Info("Starting webdav server...")
-		authService := auth.New(userService)
-		webdavFileSystem := handler.NewWebdavFs(webdav.Dir(configService.Get().Content.Dir), authService)
-		if webdavFileSystem == nil {
-			slog.Error("Failed to create webdav filesystem")
+		authOptions := auth.Options{}
+		if cacheConfig := configService.Get().Security.CredentialCache; cacheConfig.Enabled {
+			authOptions.CredentialCache = auth.NewCredentialCache(time.Duration(cacheConfig.TTL)*time.Second, cacheConfig.MaxEntries)
+		}
+		caseInsensitive, probeErr := fs.IsCaseInsensitive(contentDir)
+		if probeErr != nil {
+			slog.Error("Failed to detect case sensitivity of content directory", "error", probeErr.Error())
+			os.Exit(1)
+		}
+		if caseInsensitive {
+			slog.Info("Content directory is case-insensitive, comparing paths case-insensitively")
+		}
+		authOptions.CaseInsensitivePaths = caseInsensitive
+		authService := auth.NewWithOptions(userService, authOptions)
+		symlinkPolicy, parsePolicyErr := handler.ParseSymlinkPolicy(configService.Get().Security.Symlinks)
+		if parsePolicyErr != nil {
+			slog.Error("Invalid symlink policy", "error", parsePolicyErr.Error())
+			os.Exit(1)
+		}
+		safeDir, safeDirErr := handler.NewSafeDir(contentDir, symlinkPolicy)
+		if safeDirErr != nil {
+			slog.Error("Failed to create webdav filesystem", "error", safeDirErr.Error())
+			os.Exit(1)
+		}
+		validateQuotaErr := quota.Validate(userService)
+		if validateQuotaErr != nil {
+			slog.Error("Invalid quota configuration", "error", validateQuotaErr.Error())
 			os.Exit(1)
 		}
-		digestAuthenticator := auth.NewDigestAuthenticator(userService)
+		removedUploads, removeUploadsErr := handler.RemoveUploads(context.Background(), safeDir, "/")
+		if removeUploadsErr != nil {
+			slog.Error("Failed to remove interrupted uploads", "error", removeUploadsErr.Error())
+		} else if removedUploads > 0 {
+			slog.Info("Removed interrupted uploads", "count", removedUploads)
+		}
+		fsOptions := handler.FsOptions{
+			Fsync: configService.Get().Content.Fsync,
+		}
+		properties, propertiesErr := newPropertyStore(configService, safeDir)
+		if propertiesErr != nil {
+			slog.Error("Invalid property store", "error", propertiesErr.Error())
+			os.Exit(1)
+		}
+		fsOptions.Properties = properties
+		switch configService.Get().Content.ETags {
+		case "", "mtime":
+		case "content":
+			fsOptions.ETags = etag.NewHashCache(safeDir, etag.DefaultMaxEntries)
+		default:
+			slog.Error("Invalid ETag mode", "etags", configService.Get().Content.ETags)
+			os.Exit(1)
+		}
+		fsOptions.Checksums = checksum.DefaultAlgorithms
+		if configured := configService.Get().Content.Checksums; len(configured) > 0 {
+			fsOptions.Checksums = nil
+			for _, name := range configured {
+				algorithm, algorithmErr := checksum.ParseAlgorithm(name)
+				if algorithmErr != nil {
+					slog.Error("Invalid checksum algorithm", "error", algorithmErr.Error())
+					os.Exit(1)
+				}
+				fsOptions.Checksums = append(fsOptions.Checksums, algorithm)
+			}
+		}
+		if configService.Get().Content.Trash.Enabled {
+			fsOptions.Trash = newTrashService(configService, safeDir, fsOptions.Properties)
+		}
+		fsOptions.Quota = quota.NewQuotaService(safeDir, userService, fsOptions.Trash, authService.ContainsPath, quota.DefaultUsageTTL)
+		if configService.Get().Content.Versions.Enabled {
+			versionService, versionErr := newVersionService(configService, safeDir)
+			if versionErr != nil {
+				slog.Error("Invalid versions configuration", "error", versionErr.Error())
+				os.Exit(1)
+			}
+			fsOptions.Versions = versionService
+		}
+		webdavFileSystem := handler.NewWebdavFsWithOptions(safeDir, authService, fsOptions)
+		lockSystem := newLockSystem(configService)
+		var uploadsHandler *handler.UploadsHandler
+		if uploadsConfig := configService.Get().Content.Uploads; uploadsConfig.Enabled {
+			var maxSize int64
+			if uploadsConfig.MaxSize != "" {
+				var parseErr error
+				if maxSize, parseErr = helper.ParseSize(uploadsConfig.MaxSize); parseErr != nil {
+					slog.Error("Invalid maximum upload size", "error", parseErr.Error())
+					os.Exit(1)
+				}
+			}
+			uploadService := upload.NewUploadService(safeDir, time.Duration(uploadsConfig.Expiry)*time.Hour)
+			uploadsHandler = handler.NewUploadsHandler(uploadService, webdavFileSystem, lockSystem, maxSize)
+		}
+		nonceLifetime := time.Duration(configService.Get().Security.NonceLifetime) * time.Second
+		digestAuthenticator := auth.NewDigestAuthenticator(userService, auth.NewMemoryNonceStore(nonceLifetime), auth.DigestOptions{
+			Algorithms: configService.Get().Security.DigestAlgorithms,
+			Userhash:   configService.Get().Security.DigestUserhash,
+		})
+		var limiter auth.Limiter
+		if configService.Get().Security.BruteForce.Enabled {
+			limiter = newLimiter(configService)
+		}
+		tlsConfig, tlsErr := newTLSConfig(configService)
+		if tlsErr != nil {
+			slog.Error("Invalid TLS configuration", "error", tlsErr.Error())
+			os.Exit(1)
+		}
+		var certificateAuthenticator *auth.CertificateAuthenticator
+		if configService.Get().Security.ClientCerts.CA != "" {
+			authenticator, authenticatorErr := auth.NewCertificateAuthenticator(userService, configService.Get().Security.ClientCerts.Identity)
+			if authenticatorErr != nil {
+				slog.Error("Invalid client certificate configuration", "error", authenticatorErr.Error())
+				os.Exit(1)
+			}
+			certificateAuthenticator = &authenticator
+		}
+		shares, sharesErr := newShares(configService, fsService, userService, authService, safeDir, symlinkPolicy, fsOptions)
+		if sharesErr != nil {
+			slog.Error("Invalid shares configuration", "error", sharesErr.Error())
+			os.Exit(1)
+		}
+		var serverMetrics *metrics.Metrics
+		if metricsConfig := configService.Get().Metrics; metricsConfig.Enabled {
+			for _, username := range metricsConfig.Users {
+				if !userService.HasUser(username) {
+					slog.Error("Invalid metrics configuration", "error", "unknown user "+username)
+					os.Exit(1)
+				}
+			}
+			serverMetrics = metrics.New()
+		}
 		startServerErr := server.StartWebdavServer(server.StartWebdavServerContainer{
-			ConfigService:       configService,
-			WebdavFileSystem:    webdavFileSystem,
-			AuthService:         authService,
-			FsService:           fsService,
-			DigestAuthenticator: digestAuthenticator,
+			ConfigService:            configService,
+			WebdavFileSystem:         webdavFileSystem,
+			AuthService:              authService,
+			FsService:                fsService,
+			UserService:              userService,
+			DigestAuthenticator:      digestAuthenticator,
+			Limiter:                  limiter,
+			Trash:                    fsOptions.Trash,
+			Versions:                 fsOptions.Versions,
+			Uploads:                  uploadsHandler,
+			LockSystem:               lockSystem,
+			TLSConfig:                tlsConfig,
+			CertificateAuthenticator: certificateAuthenticator,
+			Shares:                   shares,
+			Metrics:                  serverMetrics,
 		})
 		if startServerErr != nil {
-			slog.Error("Failed to start webdav server", "error", startServerErr.Error())
+			slog.Error("Webdav server failed", "error", startServerErr.Error())
 			os.Exit(1)
 		}
 	},
 }
 
+// newShares creates the file systems and authorizers of the shares. Shares keep properties, ETags and
+// checksums like the content directory does, but have no trash, versions or quotas.
+func newShares(configService config.Service, fsService fs.Service, userService user.Service, authService auth.Service, contentDir webdav.FileSystem, symlinkPolicy handler.SymlinkPolicy, contentOptions handler.FsOptions) ([]server.Share, error) {
+	configuredShares := configService.Get().Shares
+	contentNames, err := helper.ReadDirNames(context.Background(), contentDir, "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the content directory: %w", err)
+	}
+	prefixes, err := server.SharePrefixes(configService.Get().Network.Prefix, configuredShares, contentNames)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(configuredShares))
+	for name := range configuredShares {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var shares []server.Share
+	for _, name := range names {
+		share := configuredShares[name]
+		if err := fsService.CreateDirectories(share.Dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory of share %s: %w", name, err)
+		}
+		caseInsensitive, err := fs.IsCaseInsensitive(share.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to detect case sensitivity of share %s: %w", name, err)
+		}
+		safeDir, err := handler.NewSafeDir(share.Dir, symlinkPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create filesystem of share %s: %w", name, err)
+		}
+		if _, err := handler.RemoveUploads(context.Background(), safeDir, "/"); err != nil {
+			slog.Error("Failed to remove interrupted uploads", "share", name, "error", err.Error())
+		}
+		options := handler.FsOptions{Fsync: contentOptions.Fsync, Checksums: contentOptions.Checksums}
+		if contentOptions.Properties != nil {
+			options.Properties = property.NewFileStore(safeDir)
+		}
+		if contentOptions.ETags != nil {
+			options.ETags = etag.NewHashCache(safeDir, etag.DefaultMaxEntries)
+		}
+		shareAuthService := auth.NewShareService(authService, userService, share, caseInsensitive)
+		shares = append(shares, server.Share{
+			Name:        name,
+			Prefix:      prefixes[name],
+			ReadOnly:    share.ReadOnly,
+			FileSystem:  handler.NewWebdavFsWithOptions(safeDir, shareAuthService, options),
+			AuthService: shareAuthService,
+			LockSystem:  newShareLockSystem(configService, name),
+		})
+	}
+	return shares, nil
+}
+
 func init() {
 	rootCmd.AddCommand(startCmd)
 }
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/environment"
+	"github.com/triargos/webdav/pkg/fs"
+	"github.com/triargos/webdav/pkg/user"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage app passwords of a user",
+}
+
+var tokenCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create an app password for a user",
+	Run: func(cmd *cobra.Command, args []string) {
+		username, _ := cmd.Flags().GetString("username")
+		name, _ := cmd.Flags().GetString("name")
+		expiresIn, _ := cmd.Flags().GetDuration("expires")
+		readOnly, _ := cmd.Flags().GetBool("readonly")
+		paths, _ := cmd.Flags().GetStringArray("path")
+		token := config.Token{Name: name, ReadOnly: readOnly, Paths: paths}
+		if expiresIn > 0 {
+			expires := time.Now().UTC().Add(expiresIn)
+			token.Expires = &expires
+		}
+		secret, addTokenErr := newUserService().AddToken(username, token)
+		if addTokenErr != nil {
+			slog.Error("failed to create token", "error", addTokenErr.Error())
+			os.Exit(1)
+		}
+		slog.Info("Created token. It will not be shown again. Please restart the service for changes to take effect", "username", username, "name", name)
+		fmt.Println(secret)
+	},
+}
+
+var tokenListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the app passwords of a user",
+	Run: func(cmd *cobra.Command, args []string) {
+		username, _ := cmd.Flags().GetString("username")
+		userService := newUserService()
+		if !userService.HasUser(username) {
+			slog.Error("failed to list tokens", "error", "user does not exist")
+			os.Exit(1)
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "NAME\tCREATED\tEXPIRES\tLAST USED\tSCOPE")
+		for _, token := range userService.GetUser(username).Tokens {
+			expires := "never"
+			if token.Expires != nil {
+				expires = token.Expires.Format(time.RFC3339)
+			}
+			lastUsed := "never"
+			if lastUsedAt, ok := userService.GetTokenLastUsed(username, token.Name); ok {
+				lastUsed = lastUsedAt.Format(time.RFC3339)
+			}
+			scope := "read-write"
+			if token.ReadOnly {
+				scope = "read-only"
+			}
+			if len(token.Paths) > 0 {
+				scope += " " + strings.Join(token.Paths, ",")
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", token.Name, token.Created.Format(time.RFC3339), expires, lastUsed, scope)
+		}
+		writer.Flush()
+	},
+}
+
+var tokenRevokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "Revoke an app password of a user",
+	Run: func(cmd *cobra.Command, args []string) {
+		username, _ := cmd.Flags().GetString("username")
+		name, _ := cmd.Flags().GetString("name")
+		removeTokenErr := newUserService().RemoveToken(username, name)
+		if removeTokenErr != nil {
+			slog.Error("failed to revoke token", "error", removeTokenErr.Error())
+			os.Exit(1)
+		}
+		slog.Info("Revoked token successfully. Please restart the service for changes to take effect", "username", username, "name", name)
+	},
+}
+
+func newUserService() user.Service {
+	fsService := fs.NewOsFileSystemService()
+	configService := config.NewConfigService(environment.NewOsEnvironmentService(), fsService)
+	return user.NewOsUserService(configService, fsService)
+}
+
+func init() {
+	rootCmd.AddCommand(tokenCmd)
+	tokenCmd.AddCommand(tokenCreateCmd, tokenListCmd, tokenRevokeCmd)
+	tokenCmd.PersistentFlags().StringP("username", "u", "", "Username of the token owner")
+
+	tokenCreateCmd.Flags().StringP("name", "n", "", "Name of the token, e.g. the device it is used on")
+	tokenCreateCmd.Flags().Duration("expires", 0, "Lifetime of the token, e.g. 720h. Tokens do not expire by default")
+	tokenCreateCmd.Flags().Bool("readonly", false, "Only allow read access with the token")
+	tokenCreateCmd.Flags().StringArray("path", []string{}, "Limit the token to a path and everything below it")
+
+	tokenRevokeCmd.Flags().StringP("name", "n", "", "Name of the token to revoke")
+}
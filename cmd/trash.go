@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/environment"
+	"github.com/triargos/webdav/pkg/fs"
+	"github.com/triargos/webdav/pkg/handler"
+	"github.com/triargos/webdav/pkg/property"
+	"github.com/triargos/webdav/pkg/trash"
+	"golang.org/x/net/webdav"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var trashCmd = &cobra.Command{
+	Use:   "trash",
+	Short: "Manage the recycle bins of users",
+}
+
+var trashListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the deleted files of a user",
+	Run: func(cmd *cobra.Command, args []string) {
+		username, _ := cmd.Flags().GetString("username")
+		entries, listErr := openTrashService().List(context.Background(), username)
+		if listErr != nil {
+			slog.Error("failed to list trash", "error", listErr.Error())
+			os.Exit(1)
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "ID\tDELETED\tPATH")
+		for _, entry := range entries {
+			entryPath := entry.Path
+			if entry.Dir {
+				entryPath += "/"
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", entry.ID, entry.Deleted.Local().Format(time.RFC3339), entryPath)
+		}
+		writer.Flush()
+	},
+}
+
+var trashRestoreCmd = &cobra.Command{
+	Use:   "restore <id>",
+	Short: "Restore a deleted file of a user to its original path",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		username, _ := cmd.Flags().GetString("username")
+		entry, restoreErr := openTrashService().Restore(context.Background(), username, args[0])
+		if restoreErr != nil {
+			slog.Error("failed to restore from trash", "error", restoreErr.Error())
+			os.Exit(1)
+		}
+		slog.Info("Restored from trash", "path", entry.Path)
+	},
+}
+
+var trashEmptyCmd = &cobra.Command{
+	Use:   "empty",
+	Short: "Delete the files in the trash for good. Without a username, the trash of every user is emptied",
+	Run: func(cmd *cobra.Command, args []string) {
+		username, _ := cmd.Flags().GetString("username")
+		olderThan, _ := cmd.Flags().GetInt("older-than")
+		var before time.Time
+		if olderThan > 0 {
+			before = time.Now().AddDate(0, 0, -olderThan)
+		}
+		removed, emptyErr := openTrashService().Empty(context.Background(), username, before)
+		if emptyErr != nil {
+			slog.Error("failed to empty trash", "error", emptyErr.Error())
+			os.Exit(1)
+		}
+		slog.Info("Emptied trash", "removed", removed)
+	},
+}
+
+// openTrashService opens the trash in the content directory for the commands.
+func openTrashService() trash.Service {
+	configService := config.NewConfigService(environment.NewOsEnvironmentService(), fs.NewOsFileSystemService())
+	contentDir := openContentDir(configService)
+	properties, propertiesErr := newPropertyStore(configService, contentDir)
+	if propertiesErr != nil {
+		slog.Error("Invalid property store", "error", propertiesErr.Error())
+		os.Exit(1)
+	}
+	return newTrashService(configService, contentDir, properties)
+}
+
+// openContentDir opens the content directory for commands that work on it directly.
+func openContentDir(configService config.Service) webdav.FileSystem {
+	symlinkPolicy, parsePolicyErr := handler.ParseSymlinkPolicy(configService.Get().Security.Symlinks)
+	if parsePolicyErr != nil {
+		slog.Error("Invalid symlink policy", "error", parsePolicyErr.Error())
+		os.Exit(1)
+	}
+	safeDir, safeDirErr := handler.NewSafeDir(configService.Get().Content.Dir, symlinkPolicy)
+	if safeDirErr != nil {
+		slog.Error("Failed to open content directory", "error", safeDirErr.Error())
+		os.Exit(1)
+	}
+	return safeDir
+}
+
+func newTrashService(configService config.Service, fileSystem webdav.FileSystem, properties property.Store) trash.Service {
+	retention := time.Duration(configService.Get().Content.Trash.Retention) * 24 * time.Hour
+	return trash.NewTrashService(fileSystem, properties, retention)
+}
+
+// newPropertyStore creates the configured property store of the content directory, or none.
+func newPropertyStore(configService config.Service, fileSystem webdav.FileSystem) (property.Store, error) {
+	switch store := configService.Get().Content.Properties; store {
+	case "", "sidecar":
+		return property.NewFileStore(fileSystem), nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown property store %q", store)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(trashCmd)
+	trashCmd.AddCommand(trashListCmd, trashRestoreCmd, trashEmptyCmd)
+	for _, command := range []*cobra.Command{trashListCmd, trashRestoreCmd} {
+		command.Flags().StringP("username", "u", "", "The user whose trash to use")
+		command.MarkFlagRequired("username")
+	}
+	trashEmptyCmd.Flags().StringP("username", "u", "", "The user whose trash to empty")
+	trashEmptyCmd.Flags().Int("older-than", 0, "Only delete files deleted more than this many days ago")
+}
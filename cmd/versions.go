@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/environment"
+	"github.com/triargos/webdav/pkg/fs"
+	"github.com/triargos/webdav/pkg/helper"
+	"github.com/triargos/webdav/pkg/version"
+	"golang.org/x/net/webdav"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var versionsCmd = &cobra.Command{
+	Use:   "versions",
+	Short: "Manage the earlier versions of files",
+}
+
+var versionsListCmd = &cobra.Command{
+	Use:   "list <path>",
+	Short: "List the versions of a file, by its path in the content directory",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		versions, listErr := openVersionService().List(context.Background(), args[0])
+		if listErr != nil {
+			slog.Error("failed to list versions", "error", listErr.Error())
+			os.Exit(1)
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "ID\tREPLACED\tBY\tSIZE")
+		for _, listed := range versions {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", listed.ID, listed.Created.Local().Format(time.RFC3339), listed.Username, helper.FormatSize(listed.Size))
+		}
+		writer.Flush()
+	},
+}
+
+var versionsRestoreCmd = &cobra.Command{
+	Use:   "restore <path> <id>",
+	Short: "Restore a version of a file. The current content is kept as a version",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		username, _ := cmd.Flags().GetString("username")
+		restored, restoreErr := openVersionService().Restore(context.Background(), username, args[0], args[1])
+		if restoreErr != nil {
+			slog.Error("failed to restore version", "error", restoreErr.Error())
+			os.Exit(1)
+		}
+		slog.Info("Restored version", "path", restored.Path, "id", restored.ID)
+	},
+}
+
+// openVersionService opens the versions in the content directory for the commands.
+func openVersionService() version.Service {
+	configService := config.NewConfigService(environment.NewOsEnvironmentService(), fs.NewOsFileSystemService())
+	versionService, versionErr := newVersionService(configService, openContentDir(configService))
+	if versionErr != nil {
+		slog.Error("Invalid versions configuration", "error", versionErr.Error())
+		os.Exit(1)
+	}
+	return versionService
+}
+
+func newVersionService(configService config.Service, fileSystem webdav.FileSystem) (version.Service, error) {
+	versionsConfig := configService.Get().Content.Versions
+	retention := version.Retention{
+		Keep:   versionsConfig.Keep,
+		Thin:   versionsConfig.Thin,
+		MaxAge: time.Duration(versionsConfig.MaxAge) * 24 * time.Hour,
+		Quota: func(username string) int64 {
+			// Quotas are validated on startup
+			quota, _ := helper.ParseSize(configService.Get().Users[username].Quota)
+			return quota
+		},
+	}
+	if versionsConfig.MaxSize != "" {
+		maxSize, parseErr := helper.ParseSize(versionsConfig.MaxSize)
+		if parseErr != nil {
+			return nil, fmt.Errorf("invalid maximum size: %w", parseErr)
+		}
+		retention.MaxSize = maxSize
+	}
+	return version.NewVersionService(fileSystem, retention), nil
+}
+
+func init() {
+	rootCmd.AddCommand(versionsCmd)
+	versionsCmd.AddCommand(versionsListCmd, versionsRestoreCmd)
+	versionsRestoreCmd.Flags().StringP("username", "u", "", "The user the replaced content is kept for")
+	versionsRestoreCmd.MarkFlagRequired("username")
+}
@@ -1,32 +1,62 @@
 package mocks
 
-import "github.com/triargos/webdav/pkg/config"
+import (
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/user"
+	"time"
+)
 
 // MockUserService is a mock implementation of the Service interface for testing
 type MockUserService struct {
 	AddUserFn               func(username string, user config.User) error
 	GetUserFn               func(username string) config.User
 	GetUsersFn              func() map[string]config.User
+	GetGroupsFn             func() map[string]config.Group
+	GetACLFn                func() []config.ACLRule
 	HasUserFn               func(username string) bool
 	RemoveUserFn            func(username string) error
 	InitializeDirectoriesFn func() error
 	HashPasswordsFn         func() error
+	AddTokenFn              func(username string, token config.Token) (string, error)
+	RemoveTokenFn           func(username, name string) error
+	TouchTokenFn            func(username, name string)
+	GetTokenLastUsedFn      func(username, name string) (time.Time, bool)
+	OnUserChangeFn          func(listener func(username string))
+	VirtualRootFn           func(username string) (user.VirtualRoot, bool)
+
+	// Listeners holds the listeners registered with OnUserChange
+	Listeners []func(username string)
+	// Groups and ACL are returned by the default GetGroupsFn and GetACLFn
+	Groups map[string]config.Group
+	ACL    []config.ACLRule
+	// VirtualRoots enables virtual roots for the default VirtualRootFn
+	VirtualRoots bool
 
 	AddUserCalls               int
 	GetUserCalls               int
 	GetUsersCalls              int
+	GetGroupsCalls             int
+	GetACLCalls                int
 	HasUserCalls               int
 	RemoveUserCalls            int
 	InitializeDirectoriesCalls int
 	HashPasswordsCalls         int
+	AddTokenCalls              int
+	RemoveTokenCalls           int
+	TouchTokenCalls            int
+	GetTokenLastUsedCalls      int
+	OnUserChangeCalls          int
+	VirtualRootCalls           int
 }
 
 func NewMockUserService(users map[string]config.User) *MockUserService {
-
-	return &MockUserService{
-		AddUserFn:  func(username string, user config.User) error { return nil },
-		GetUserFn:  func(username string) config.User { return users[username] },
-		GetUsersFn: func() map[string]config.User { return users },
+	mock := &MockUserService{}
+	*mock = MockUserService{
+		AddUserFn:   func(username string, user config.User) error { return nil },
+		GetUserFn:   func(username string) config.User { return users[username] },
+		GetUsersFn:  func() map[string]config.User { return users },
+		GetGroupsFn: func() map[string]config.Group { return mock.Groups },
+		GetACLFn:    func() []config.ACLRule { return mock.ACL },
 		HasUserFn: func(username string) bool {
 			_, ok := users[username]
 			return ok
@@ -34,7 +64,18 @@ func NewMockUserService(users map[string]config.User) *MockUserService {
 		RemoveUserFn:            func(username string) error { return nil },
 		InitializeDirectoriesFn: func() error { return nil },
 		HashPasswordsFn:         func() error { return nil },
+		AddTokenFn:              func(username string, token config.Token) (string, error) { return "", nil },
+		RemoveTokenFn:           func(username, name string) error { return nil },
+		TouchTokenFn:            func(username, name string) {},
+		GetTokenLastUsedFn:      func(username, name string) (time.Time, bool) { return time.Time{}, false },
+		OnUserChangeFn: func(listener func(username string)) {
+			mock.Listeners = append(mock.Listeners, listener)
+		},
+		VirtualRootFn: func(username string) (user.VirtualRoot, bool) {
+			return mock.virtualRoot(username)
+		},
 	}
+	return mock
 }
 
 func (m *MockUserService) AddUser(username string, user config.User) error {
@@ -52,6 +93,16 @@ func (m *MockUserService) GetUsers() map[string]config.User {
 	return m.GetUsersFn()
 }
 
+func (m *MockUserService) GetGroups() map[string]config.Group {
+	m.GetGroupsCalls++
+	return m.GetGroupsFn()
+}
+
+func (m *MockUserService) GetACL() []config.ACLRule {
+	m.GetACLCalls++
+	return m.GetACLFn()
+}
+
 func (m *MockUserService) HasUser(username string) bool {
 	m.HasUserCalls++
 	return m.HasUserFn(username)
@@ -72,21 +123,82 @@ func (m *MockUserService) HashPasswords() error {
 	return m.HashPasswordsFn()
 }
 
+func (m *MockUserService) AddToken(username string, token config.Token) (string, error) {
+	m.AddTokenCalls++
+	return m.AddTokenFn(username, token)
+}
+
+func (m *MockUserService) RemoveToken(username, name string) error {
+	m.RemoveTokenCalls++
+	return m.RemoveTokenFn(username, name)
+}
+
+func (m *MockUserService) TouchToken(username, name string) {
+	m.TouchTokenCalls++
+	m.TouchTokenFn(username, name)
+}
+
+func (m *MockUserService) GetTokenLastUsed(username, name string) (time.Time, bool) {
+	m.GetTokenLastUsedCalls++
+	return m.GetTokenLastUsedFn(username, name)
+}
+
+func (m *MockUserService) OnUserChange(listener func(username string)) {
+	m.OnUserChangeCalls++
+	m.OnUserChangeFn(listener)
+}
+
+func (m *MockUserService) VirtualRoot(username string) (user.VirtualRoot, bool) {
+	m.VirtualRootCalls++
+	return m.VirtualRootFn(username)
+}
+
+func (m *MockUserService) virtualRoot(username string) (user.VirtualRoot, bool) {
+	if !m.VirtualRoots || !m.HasUserFn(username) {
+		return user.VirtualRoot{}, false
+	}
+	return user.NewVirtualRoot(username, m.GetUserFn(username).Root, m.GetGroupsFn()), true
+}
+
+// NotifyUserChange calls the registered listeners like the user service does when a user changes
+func (m *MockUserService) NotifyUserChange(username string) {
+	for _, listener := range m.Listeners {
+		listener(username)
+	}
+}
+
 // Reset resets all function implementations and call counters
 func (m *MockUserService) Reset() {
 	m.AddUserFn = func(username string, user config.User) error { return nil }
 	m.GetUserFn = func(username string) config.User { return config.User{} }
 	m.GetUsersFn = func() map[string]config.User { return make(map[string]config.User) }
+	m.GetGroupsFn = func() map[string]config.Group { return m.Groups }
+	m.GetACLFn = func() []config.ACLRule { return m.ACL }
 	m.HasUserFn = func(username string) bool { return true }
 	m.RemoveUserFn = func(username string) error { return nil }
 	m.InitializeDirectoriesFn = func() error { return nil }
 	m.HashPasswordsFn = func() error { return nil }
+	m.AddTokenFn = func(username string, token config.Token) (string, error) { return "", nil }
+	m.RemoveTokenFn = func(username, name string) error { return nil }
+	m.TouchTokenFn = func(username, name string) {}
+	m.GetTokenLastUsedFn = func(username, name string) (time.Time, bool) { return time.Time{}, false }
+	m.OnUserChangeFn = func(listener func(username string)) { m.Listeners = append(m.Listeners, listener) }
+	m.VirtualRootFn = m.virtualRoot
+	m.Listeners = nil
 
 	m.AddUserCalls = 0
 	m.GetUserCalls = 0
 	m.GetUsersCalls = 0
+	m.GetGroupsCalls = 0
+	m.GetACLCalls = 0
 	m.HasUserCalls = 0
 	m.RemoveUserCalls = 0
 	m.InitializeDirectoriesCalls = 0
 	m.HashPasswordsCalls = 0
+	m.AddTokenCalls = 0
+	m.RemoveTokenCalls = 0
+	m.TouchTokenCalls = 0
+	m.GetTokenLastUsedCalls = 0
+	m.OnUserChangeCalls = 0
+	m.VirtualRootCalls = 0
 }
@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/triargos/webdav/pkg/config"
+	"path"
+	"strings"
+)
+
+type Permission string
+
+const (
+	PermissionRead   Permission = "read"
+	PermissionList   Permission = "list"
+	PermissionWrite  Permission = "write"
+	PermissionMkdir  Permission = "mkdir"
+	PermissionDelete Permission = "delete"
+	PermissionMove   Permission = "move"
+	PermissionLock   Permission = "lock"
+)
+
+// permissionAll can be used in rules as a shorthand for every permission.
+const permissionAll = "all"
+
+var Permissions = []Permission{PermissionRead, PermissionList, PermissionWrite, PermissionMkdir, PermissionDelete, PermissionMove, PermissionLock}
+
+// Rules for a user beat rules for a group, which beat rules for everyone.
+const (
+	subjectEveryone = iota
+	subjectGroup
+	subjectUser
+)
+
+// ValidateACL checks that every rule has a valid path pattern and only names known permissions.
+func ValidateACL(rules []config.ACLRule) error {
+	for i, rule := range rules {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("acl rule %d: path %q must be absolute", i, rule.Path)
+		}
+		for _, segment := range splitPath(rule.Path) {
+			if _, matchErr := path.Match(segment, ""); matchErr != nil {
+				return fmt.Errorf("acl rule %d: invalid path pattern %q: %w", i, rule.Path, matchErr)
+			}
+		}
+		for _, permission := range append(append([]string{}, rule.Allow...), rule.Deny...) {
+			if !isKnownPermission(permission) {
+				return fmt.Errorf("acl rule %d: unknown permission %q", i, permission)
+			}
+		}
+	}
+	return nil
+}
+
+// evaluateACL decides a permission from the rules that match a path and a user. Of the rules that
+// mention the permission, the one with the most specific subject wins (user before group before
+// everyone), then the one with the most specific path. Deny wins over allow on a tie. The second
+// result is false if no rule mentions the permission.
+func evaluateACL(rules []config.ACLRule, requestPath string, username string, groups []string, permission Permission) (allowed bool, decided bool) {
+	bestSubject, bestSpecificity := -1, -1
+	for _, rule := range rules {
+		allows, denies := mentionsPermission(rule.Allow, permission), mentionsPermission(rule.Deny, permission)
+		if !allows && !denies {
+			continue
+		}
+		subject, applies := ruleSubject(rule, username, groups)
+		if !applies || !matchGlob(rule.Path, requestPath) {
+			continue
+		}
+		specificity := pathSpecificity(rule.Path)
+		better := subject > bestSubject || subject == bestSubject && specificity > bestSpecificity
+		tie := subject == bestSubject && specificity == bestSpecificity
+		switch {
+		case better:
+			bestSubject, bestSpecificity = subject, specificity
+			allowed, decided = !denies, true
+		case tie && denies:
+			allowed = false
+		}
+	}
+	return allowed, decided
+}
+
+func ruleSubject(rule config.ACLRule, username string, groups []string) (int, bool) {
+	if len(rule.Users) == 0 && len(rule.Groups) == 0 {
+		return subjectEveryone, true
+	}
+	for _, ruleUser := range rule.Users {
+		if ruleUser == username {
+			return subjectUser, true
+		}
+	}
+	for _, ruleGroup := range rule.Groups {
+		for _, group := range groups {
+			if ruleGroup == group {
+				return subjectGroup, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func mentionsPermission(permissions []string, permission Permission) bool {
+	for _, candidate := range permissions {
+		if candidate == string(permission) || candidate == permissionAll {
+			return true
+		}
+	}
+	return false
+}
+
+func isKnownPermission(permission string) bool {
+	if permission == permissionAll {
+		return true
+	}
+	for _, known := range Permissions {
+		if string(known) == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches a path against a pattern of path segments. Segments are matched with path.Match,
+// and a "**" segment matches any number of segments, including none.
+func matchGlob(pattern, requestPath string) bool {
+	return matchSegments(splitPath(pattern), splitPath(requestPath))
+}
+
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for skip := 0; skip <= len(segments); skip++ {
+				if matchSegments(pattern[1:], segments[skip:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], segments[0]); !matched {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// pathSpecificity ranks patterns by their literal segments, so /projects/archive/** is more
+// specific than /projects/** and /projects/*.
+func pathSpecificity(pattern string) int {
+	specificity := 0
+	for _, segment := range splitPath(pattern) {
+		switch {
+		case segment == "**":
+		case strings.ContainsAny(segment, "*?["):
+			specificity += 1
+		default:
+			specificity += 2
+		}
+	}
+	return specificity
+}
+
+func splitPath(p string) []string {
+	cleaned := strings.Trim(path.Clean("/"+p), "/")
+	if cleaned == "" {
+		return nil
+	}
+	return strings.Split(cleaned, "/")
+}
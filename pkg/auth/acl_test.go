@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/pkg/config"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		path     string
+		expected bool
+	}{
+		{pattern: "/projects", path: "/projects", expected: true},
+		{pattern: "/projects", path: "/projects/", expected: true},
+		{pattern: "/projects", path: "/projects/a", expected: false},
+		{pattern: "/projects/*", path: "/projects/a", expected: true},
+		{pattern: "/projects/*", path: "/projects/a/b", expected: false},
+		{pattern: "/projects/**", path: "/projects", expected: true},
+		{pattern: "/projects/**", path: "/projects/a/b/c", expected: true},
+		{pattern: "/projects/**/*.pdf", path: "/projects/a/b/report.pdf", expected: true},
+		{pattern: "/projects/**/*.pdf", path: "/projects/report.pdf", expected: true},
+		{pattern: "/projects/**/*.pdf", path: "/projects/a/report.txt", expected: false},
+		{pattern: "/**", path: "/", expected: true},
+		{pattern: "/Users/*/drop/**", path: "/Users/alice/drop/file", expected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.expected, matchGlob(tt.pattern, tt.path))
+		})
+	}
+}
+
+func TestEvaluateACL(t *testing.T) {
+	rules := []config.ACLRule{
+		{Path: "/archive/**", Allow: []string{"read", "list"}, Deny: []string{"write", "delete", "move", "mkdir"}},
+		{Path: "/archive/**", Groups: []string{"archivists"}, Allow: []string{"write", "mkdir"}},
+		{Path: "/archive/**", Users: []string{"bob"}, Deny: []string{"write"}},
+		{Path: "/drop/**", Deny: []string{"read", "list"}, Allow: []string{"write"}},
+		{Path: "/drop/public/**", Allow: []string{"list"}},
+		{Path: "/conflict", Allow: []string{"all"}},
+		{Path: "/conflict", Deny: []string{"lock"}},
+	}
+
+	tests := []struct {
+		name            string
+		path            string
+		username        string
+		groups          []string
+		permission      Permission
+		expectedAllowed bool
+		expectedDecided bool
+	}{
+		{name: "Everyone rule allows", path: "/archive/2020/report.pdf", username: "alice", permission: PermissionRead, expectedAllowed: true, expectedDecided: true},
+		{name: "Everyone rule denies", path: "/archive/2020/report.pdf", username: "alice", permission: PermissionWrite, expectedAllowed: false, expectedDecided: true},
+		{name: "Group rule beats everyone rule", path: "/archive/2020/report.pdf", username: "alice", groups: []string{"archivists"}, permission: PermissionWrite, expectedAllowed: true, expectedDecided: true},
+		{name: "User rule beats group rule", path: "/archive/2020/report.pdf", username: "bob", groups: []string{"archivists"}, permission: PermissionWrite, expectedAllowed: false, expectedDecided: true},
+		{name: "Group rule does not apply to others", path: "/archive/2020/report.pdf", username: "alice", groups: []string{"staff"}, permission: PermissionMkdir, expectedAllowed: false, expectedDecided: true},
+		{name: "Write-only drop folder", path: "/drop/upload.zip", username: "alice", permission: PermissionWrite, expectedAllowed: true, expectedDecided: true},
+		{name: "Drop folder cannot be read", path: "/drop/upload.zip", username: "alice", permission: PermissionRead, expectedAllowed: false, expectedDecided: true},
+		{name: "More specific path wins", path: "/drop/public/file", username: "alice", permission: PermissionList, expectedAllowed: true, expectedDecided: true},
+		{name: "Deny wins on a tie", path: "/conflict", username: "alice", permission: PermissionLock, expectedAllowed: false, expectedDecided: true},
+		{name: "All shorthand", path: "/conflict", username: "alice", permission: PermissionDelete, expectedAllowed: true, expectedDecided: true},
+		{name: "No matching rule", path: "/elsewhere", username: "alice", permission: PermissionDelete, expectedAllowed: false, expectedDecided: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, decided := evaluateACL(rules, tt.path, tt.username, tt.groups, tt.permission)
+			assert.Equal(t, tt.expectedAllowed, allowed)
+			assert.Equal(t, tt.expectedDecided, decided)
+		})
+	}
+}
+
+func TestValidateACL(t *testing.T) {
+	assert.NoError(t, ValidateACL([]config.ACLRule{{Path: "/a/**", Allow: []string{"read", "all"}}}))
+	assert.Error(t, ValidateACL([]config.ACLRule{{Path: "a/**", Allow: []string{"read"}}}))
+	assert.Error(t, ValidateACL([]config.ACLRule{{Path: "/a/[", Allow: []string{"read"}}}))
+	assert.Error(t, ValidateACL([]config.ACLRule{{Path: "/a", Deny: []string{"execute"}}}))
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var ErrMalformedAuthHeader = errors.New("malformed authorization header")
+
+// ParseAuthHeader parses the auth-param list of an Authorization header as described in RFC 7235,
+// section 2.1. The scheme must already be stripped. Parameter names are returned in lower case and
+// quoted-string values are unescaped, so commas and quotes inside values are preserved.
+func ParseAuthHeader(header string) (map[string]string, error) {
+	params := make(map[string]string)
+	position := 0
+	for {
+		position = skipListSeparators(header, position)
+		if position >= len(header) {
+			return params, nil
+		}
+		name, next := readToken(header, position)
+		if name == "" {
+			return nil, fmt.Errorf("%w: expected parameter name at offset %d", ErrMalformedAuthHeader, position)
+		}
+		position = skipWhitespace(header, next)
+		if position >= len(header) || header[position] != '=' {
+			return nil, fmt.Errorf("%w: expected '=' after %q", ErrMalformedAuthHeader, name)
+		}
+		position = skipWhitespace(header, position+1)
+		var value string
+		if position < len(header) && header[position] == '"' {
+			quoted, next, err := readQuotedString(header, position)
+			if err != nil {
+				return nil, err
+			}
+			value, position = quoted, next
+		} else {
+			value, position = readToken(header, position)
+			if value == "" {
+				return nil, fmt.Errorf("%w: missing value for %q", ErrMalformedAuthHeader, name)
+			}
+		}
+		name = strings.ToLower(name)
+		if _, exists := params[name]; exists {
+			return nil, fmt.Errorf("%w: duplicate parameter %q", ErrMalformedAuthHeader, name)
+		}
+		params[name] = value
+		position = skipWhitespace(header, position)
+		if position < len(header) && header[position] != ',' {
+			return nil, fmt.Errorf("%w: unexpected character %q at offset %d", ErrMalformedAuthHeader, header[position], position)
+		}
+	}
+}
+
+// decodeExtValue decodes an RFC 8187 ext-value in the UTF-8 charset, as used by username*.
+func decodeExtValue(value string) (string, error) {
+	parts := strings.SplitN(value, "'", 3)
+	if len(parts) != 3 || !strings.EqualFold(parts[0], "UTF-8") {
+		return "", fmt.Errorf("%w: unsupported ext-value %q", ErrMalformedAuthHeader, value)
+	}
+	decoded, err := url.PathUnescape(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrMalformedAuthHeader, err)
+	}
+	return decoded, nil
+}
+
+func readQuotedString(header string, position int) (string, int, error) {
+	var builder strings.Builder
+	for i := position + 1; i < len(header); i++ {
+		switch header[i] {
+		case '"':
+			return builder.String(), i + 1, nil
+		case '\\':
+			i++
+			if i >= len(header) {
+				return "", 0, fmt.Errorf("%w: unterminated quoted-pair", ErrMalformedAuthHeader)
+			}
+		}
+		builder.WriteByte(header[i])
+	}
+	return "", 0, fmt.Errorf("%w: unterminated quoted-string", ErrMalformedAuthHeader)
+}
+
+func readToken(header string, position int) (string, int) {
+	start := position
+	for position < len(header) && isTokenChar(header[position]) {
+		position++
+	}
+	return header[start:position], position
+}
+
+func skipWhitespace(header string, position int) int {
+	for position < len(header) && (header[position] == ' ' || header[position] == '\t') {
+		position++
+	}
+	return position
+}
+
+func skipListSeparators(header string, position int) int {
+	for position < len(header) && (header[position] == ' ' || header[position] == '\t' || header[position] == ',') {
+		position++
+	}
+	return position
+}
+
+// isTokenChar reports whether c is a tchar as defined in RFC 7230, section 3.2.6.
+func isTokenChar(c byte) bool {
+	if c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseAuthHeaderTokenizer(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		expected map[string]string
+		err      error
+	}{
+		{
+			name:     "Comma inside quoted value",
+			header:   `username="doe, john", uri="/a,b/c"`,
+			expected: map[string]string{"username": "doe, john", "uri": "/a,b/c"},
+		},
+		{
+			name:     "Escaped quote",
+			header:   `username="say \"hi\"", realm=WebDAV`,
+			expected: map[string]string{"username": `say "hi"`, "realm": "WebDAV"},
+		},
+		{
+			name:     "Whitespace around equals and empty list elements",
+			header:   ` ,qop = auth ,, nc=00000001 ,`,
+			expected: map[string]string{"qop": "auth", "nc": "00000001"},
+		},
+		{
+			name:     "Parameter names are case insensitive",
+			header:   `UserName="john", Username*=UTF-8''j%C3%B6hn`,
+			expected: map[string]string{"username": "john", "username*": "UTF-8''j%C3%B6hn"},
+		},
+		{
+			name:   "Unterminated quoted string",
+			header: `username="john`,
+			err:    ErrMalformedAuthHeader,
+		},
+		{
+			name:   "Duplicate parameter",
+			header: `nonce=a, nonce=b`,
+			err:    ErrMalformedAuthHeader,
+		},
+		{
+			name:   "Missing separator",
+			header: `nonce="a" nc=1`,
+			err:    ErrMalformedAuthHeader,
+		},
+		{
+			name:   "Missing value",
+			header: `nonce=, nc=1`,
+			err:    ErrMalformedAuthHeader,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := ParseAuthHeader(tt.header)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if tt.err == nil && !reflect.DeepEqual(params, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, params)
+			}
+		})
+	}
+}
+
+func TestDecodeExtValue(t *testing.T) {
+	decoded, err := decodeExtValue("UTF-8''j%C3%B6hn")
+	if err != nil || decoded != "jöhn" {
+		t.Errorf("expected jöhn, got %q (%v)", decoded, err)
+	}
+	if _, err := decodeExtValue("ISO-8859-1''j%F6hn"); !errors.Is(err, ErrMalformedAuthHeader) {
+		t.Errorf("expected unsupported charset to fail, got %v", err)
+	}
+}
@@ -1,22 +1,62 @@
 package auth
 
 import (
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/helper"
 	"github.com/triargos/webdav/pkg/user"
 	"golang.org/x/crypto/bcrypt"
+	"path"
 	"strings"
 )
 
 type Service interface {
 	Authenticate(username, password string) bool
+	AuthenticateToken(username, secret string) (string, helper.TokenScope, bool)
 	HasPermission(path string, username string) bool
+	// Authorize checks a single permission on a path. ACL rules can only narrow down what
+	// HasPermission allows.
+	Authorize(path string, username string, permission Permission) bool
+	// ResolvePath maps a request path onto the content directory when virtual roots are enabled
+	ResolvePath(path string, username string) string
+	// ContainsPath reports whether a path is the parent path or inside of it, comparing paths the
+	// way the file system of the content directory does
+	ContainsPath(parent, child string) bool
+}
+
+// Options configure an authenticator created with NewWithOptions.
+type Options struct {
+	// CredentialCache caches successful password verifications, it is optional
+	CredentialCache *CredentialCache
+	// CaseInsensitivePaths must be set when the content directory is on a case-insensitive file
+	// system, so that access rules can't be bypassed by changing the case of a path
+	CaseInsensitivePaths bool
 }
 
 type BasicAuthenticator struct {
-	userService user.Service
+	userService          user.Service
+	credentialCache      *CredentialCache
+	caseInsensitivePaths bool
 }
 
 func New(userService user.Service) Service {
-	return &BasicAuthenticator{userService: userService}
+	return NewWithOptions(userService, Options{})
+}
+
+// NewWithCredentialCache creates an authenticator that caches successful password verifications.
+// Cached entries of a user are dropped whenever the user is changed through the user service.
+func NewWithCredentialCache(userService user.Service, credentialCache *CredentialCache) Service {
+	return NewWithOptions(userService, Options{CredentialCache: credentialCache})
+}
+
+func NewWithOptions(userService user.Service, options Options) Service {
+	if options.CredentialCache != nil {
+		userService.OnUserChange(options.CredentialCache.Invalidate)
+	}
+	return &BasicAuthenticator{
+		userService:          userService,
+		credentialCache:      options.CredentialCache,
+		caseInsensitivePaths: options.CaseInsensitivePaths,
+	}
 }
 
 func (s *BasicAuthenticator) Authenticate(username, password string) bool {
@@ -24,11 +64,26 @@ func (s *BasicAuthenticator) Authenticate(username, password string) bool {
 		return false
 	}
 	userObject := s.userService.GetUser(username)
+	if !allowsAuthType(userObject, "basic") {
+		return false
+	}
+	if s.credentialCache != nil && s.credentialCache.Contains(username, password, userObject.Password) {
+		return true
+	}
 	verifyPasswordErr := bcrypt.CompareHashAndPassword([]byte(userObject.Password), []byte(password))
-	return verifyPasswordErr == nil
+	if verifyPasswordErr != nil {
+		return false
+	}
+	if s.credentialCache != nil {
+		s.credentialCache.Add(username, password, userObject.Password)
+	}
+	return true
 }
 
-func (s *BasicAuthenticator) HasPermission(path string, username string) bool {
+// HasPermission decides by the deepest root that contains the path: the user's own root and the
+// roots of the user's groups grant access, the roots of other users and of other groups deny it.
+// Paths outside of every root are only accessible to users that are not jailed.
+func (s *BasicAuthenticator) HasPermission(requestPath string, username string) bool {
 	if !s.userService.HasUser(username) {
 		return false
 	}
@@ -36,24 +91,109 @@ func (s *BasicAuthenticator) HasPermission(path string, username string) bool {
 	if userObject.Admin {
 		return true
 	}
-	if userObject.Jail {
-		return isSubPath(userObject.Root, path)
+	allowed, ownerDepth := !userObject.Jail, -1
+	claim := func(root string, grants bool) {
+		if root == "" || !s.ContainsPath(root, requestPath) {
+			return
+		}
+		if depth := len(splitPath(root)); depth > ownerDepth || depth == ownerDepth && !grants {
+			allowed, ownerDepth = grants, depth
+		}
 	}
 	for otherUsername, otherUser := range s.userService.GetUsers() {
-		if otherUsername == username {
-			continue
+		claim(otherUser.Root, otherUsername == username)
+	}
+	groups := s.groupsOf(username)
+	for groupName, group := range s.userService.GetGroups() {
+		claim(group.Root, containsString(groups, groupName))
+	}
+	return allowed
+}
+
+func (s *BasicAuthenticator) Authorize(requestPath string, username string, permission Permission) bool {
+	if !s.HasPermission(requestPath, username) {
+		return false
+	}
+	if s.userService.GetUser(username).Admin {
+		return true
+	}
+	rules := s.userService.GetACL()
+	if s.caseInsensitivePaths {
+		rules, requestPath = foldACL(rules), strings.ToLower(requestPath)
+	}
+	allowed, decided := evaluateACL(rules, requestPath, username, s.groupsOf(username), permission)
+	return allowed || !decided
+}
+
+func (s *BasicAuthenticator) ContainsPath(parent, child string) bool {
+	return isSubPath(parent, child, s.caseInsensitivePaths)
+}
+
+func (s *BasicAuthenticator) ResolvePath(path string, username string) string {
+	virtualRoot, ok := s.userService.VirtualRoot(username)
+	if !ok {
+		return path
+	}
+	return virtualRoot.Resolve(path)
+}
+
+func (s *BasicAuthenticator) groupsOf(username string) []string {
+	var groups []string
+	for groupName, group := range s.userService.GetGroups() {
+		for _, member := range group.Members {
+			if member == username {
+				groups = append(groups, groupName)
+				break
+			}
+		}
+	}
+	return groups
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
 		}
+	}
+	return false
+}
 
-		if otherUser.Root != "" && isSubPath(otherUser.Root, path) {
-			return false
+// allowsAuthType reports whether a user may authenticate with a scheme. Users without explicit
+// auth types may use every scheme the server offers.
+func allowsAuthType(userObject config.User, authType string) bool {
+	if len(userObject.AuthTypes) == 0 {
+		return true
+	}
+	for _, allowed := range userObject.AuthTypes {
+		if strings.EqualFold(allowed, authType) {
+			return true
 		}
 	}
-	return true
+	return false
+}
+
+// isSubPath compares canonical paths segment by segment, so neither "/users/bob/../alice" nor
+// "/users/bobby" is inside "/users/bob".
+func isSubPath(parent, child string, caseInsensitive bool) bool {
+	parent = strings.TrimSuffix(canonicalPath(parent), "/") + "/"
+	child = strings.TrimSuffix(canonicalPath(child), "/") + "/"
+	if caseInsensitive {
+		parent, child = strings.ToLower(parent), strings.ToLower(child)
+	}
+	return strings.HasPrefix(child, parent)
+}
 
+func canonicalPath(p string) string {
+	return path.Clean("/" + p)
 }
 
-func isSubPath(parent, child string) bool {
-	parent = strings.TrimSuffix(parent, "/") + "/"
-	child = strings.TrimSuffix(child, "/") + "/"
-	return strings.HasPrefix(strings.ToLower(child), strings.ToLower(parent))
+// foldACL lower-cases the paths of ACL rules for case-insensitive matching.
+func foldACL(rules []config.ACLRule) []config.ACLRule {
+	folded := make([]config.ACLRule, len(rules))
+	for i, rule := range rules {
+		rule.Path = strings.ToLower(rule.Path)
+		folded[i] = rule
+	}
+	return folded
 }
@@ -3,7 +3,10 @@ package auth_test
 import (
 	"github.com/triargos/webdav/mocks"
 	"github.com/triargos/webdav/pkg/auth"
+	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/triargos/webdav/pkg/config"
@@ -62,6 +65,15 @@ func TestAuthentication(t *testing.T) {
 			password: password2,
 			expected: true,
 		},
+		{
+			name: "User restricted to digest",
+			users: map[string]config.User{
+				"user1": {Password: string(hash1), AuthTypes: []string{"digest"}},
+			},
+			username: "user1",
+			password: password1,
+			expected: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -82,6 +94,7 @@ func TestPermissionCheck(t *testing.T) {
 		path     string
 		username string
 		users    map[string]config.User
+		groups   map[string]config.Group
 		expected bool
 	}{
 		{
@@ -120,14 +133,142 @@ func TestPermissionCheck(t *testing.T) {
 			path:     "/any/path",
 			expected: false,
 		},
+		{
+			name: "Jail compared case-sensitively",
+			users: map[string]config.User{
+				"bob": {Root: "/Users/bob", Jail: true},
+			},
+			username: "bob",
+			path:     "/users/Bob/some/dir",
+			expected: false,
+		},
+		{
+			name: "Escape with dot segments",
+			users: map[string]config.User{
+				"bob": {Root: "/Users/bob", Jail: true},
+			},
+			username: "bob",
+			path:     "/Users/bob/../alice/secret",
+			expected: false,
+		},
+		{
+			name: "Jailed group member",
+			users: map[string]config.User{
+				"user1": {Root: "/Users/user1", Jail: true},
+			},
+			groups: map[string]config.Group{
+				"team": {Members: []string{"user1"}, Root: "/Groups/team"},
+			},
+			username: "user1",
+			path:     "/Groups/team/docs",
+			expected: true,
+		},
+		{
+			name: "Group non-member",
+			users: map[string]config.User{
+				"user1": {Root: "/Users/user1"},
+				"user2": {Root: "/Users/user2"},
+			},
+			groups: map[string]config.Group{
+				"team": {Members: []string{"user2"}, Root: "/Groups/team"},
+			},
+			username: "user1",
+			path:     "/Groups/team/docs",
+			expected: false,
+		},
+		{
+			name: "User root inside group root",
+			users: map[string]config.User{
+				"user1": {Root: "/Groups/team/user1", Jail: true},
+				"user2": {Root: "/Groups/team/user2", Jail: true},
+			},
+			groups: map[string]config.Group{
+				"team": {Members: []string{"user1", "user2"}, Root: "/Groups/team"},
+			},
+			username: "user1",
+			path:     "/Groups/team/user2/notes",
+			expected: false,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			userService := mocks.NewMockUserService(tt.users)
+			userService.Groups = tt.groups
 			authenticationService := auth.New(userService)
 			result := authenticationService.HasPermission(tt.path, tt.username)
 			assert.Equal(t, tt.expected, result)
 		})
 	}
 }
+
+func TestAuthenticationWithCredentialCache(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	userService := mocks.NewMockUserService(map[string]config.User{
+		"user1": {Password: string(hash)},
+	})
+	credentialCache := auth.NewCredentialCache(time.Minute, 10)
+	authenticationService := auth.NewWithCredentialCache(userService, credentialCache)
+
+	assert.False(t, authenticationService.Authenticate("user1", "wrongPassword"))
+	assert.Equal(t, 0, credentialCache.Len(), "failed verifications should not be cached")
+	assert.True(t, authenticationService.Authenticate("user1", "password123"))
+	assert.Equal(t, 1, credentialCache.Len())
+	userService.NotifyUserChange("user1")
+	assert.Equal(t, 0, credentialCache.Len(), "changing a user should invalidate its entries")
+}
+
+func BenchmarkAuthenticate(b *testing.B) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), 10)
+	users := map[string]config.User{"user1": {Password: string(hash)}}
+	benchmarks := []struct {
+		name    string
+		service auth.Service
+	}{
+		{name: "Uncached", service: auth.New(mocks.NewMockUserService(users))},
+		{name: "Cached", service: auth.NewWithCredentialCache(mocks.NewMockUserService(users), auth.NewCredentialCache(time.Minute, 10))},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if !bm.service.Authenticate("user1", "password123") {
+					b.Fatal("authentication failed")
+				}
+			}
+		})
+	}
+}
+
+func TestPermissionCheckCaseInsensitive(t *testing.T) {
+	userService := mocks.NewMockUserService(map[string]config.User{
+		"alice": {Root: "/Users/alice"},
+		"bob":   {Root: "/Users/bob", Jail: true},
+	})
+	userService.ACL = []config.ACLRule{{Path: "/Archive/**", Deny: []string{"write"}}}
+	authenticationService := auth.NewWithOptions(userService, auth.Options{CaseInsensitivePaths: true})
+	assert.True(t, authenticationService.HasPermission("/users/BOB/dir", "bob"))
+	assert.False(t, authenticationService.HasPermission("/USERS/bob/dir", "alice"))
+	assert.False(t, authenticationService.Authorize("/archive/file", "alice", auth.PermissionWrite))
+}
+
+// FuzzHasPermission checks that a jailed user is never granted access outside of their root,
+// whatever the path looks like.
+func FuzzHasPermission(f *testing.F) {
+	for _, seed := range []string{"/Users/bob", "/Users/bob/../alice", "/Users/bobby", "//Users//bob/./x", "/users/bob", "../Users/bob", "/Users/bob/%2e%2e/alice"} {
+		f.Add(seed)
+	}
+	userService := mocks.NewMockUserService(map[string]config.User{
+		"alice": {Root: "/Users/alice"},
+		"bob":   {Root: "/Users/bob", Jail: true},
+	})
+	authenticationService := auth.New(userService)
+	f.Fuzz(func(t *testing.T, requestPath string) {
+		if !authenticationService.HasPermission(requestPath, "bob") {
+			return
+		}
+		cleaned := path.Clean("/" + requestPath)
+		if cleaned != "/Users/bob" && !strings.HasPrefix(cleaned, "/Users/bob/") {
+			t.Fatalf("jailed user may access %q (%q)", requestPath, cleaned)
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/triargos/webdav/pkg/user"
+	"strings"
+)
+
+var ErrUnknownCertificate = errors.New("certificate does not belong to a user")
+
+// CertificateAuthenticator maps client certificates, which the TLS server has verified already, to
+// users. A certificate is identified by the common name of its subject or by an email address in its
+// subject alternative names. The user is the one whose certificate setting is that identity. Users
+// are never matched by their name, as anyone the CA issues a certificate for could pick a name.
+type CertificateAuthenticator struct {
+	userService user.Service
+	identity    string
+}
+
+// NewCertificateAuthenticator creates an authenticator that identifies certificates by cn (the
+// default) or email.
+func NewCertificateAuthenticator(userService user.Service, identity string) (CertificateAuthenticator, error) {
+	switch identity {
+	case "":
+		identity = "cn"
+	case "cn", "email":
+	default:
+		return CertificateAuthenticator{}, fmt.Errorf("unsupported certificate identity %q, must be cn or email", identity)
+	}
+	return CertificateAuthenticator{userService: userService, identity: identity}, nil
+}
+
+// Authenticate returns the user a certificate belongs to.
+func (a CertificateAuthenticator) Authenticate(certificate *x509.Certificate) (string, error) {
+	identities := []string{certificate.Subject.CommonName}
+	if a.identity == "email" {
+		identities = certificate.EmailAddresses
+	}
+	for _, identity := range identities {
+		if identity == "" {
+			continue
+		}
+		for username, candidate := range a.userService.GetUsers() {
+			if candidate.Certificate != "" && strings.EqualFold(candidate.Certificate, identity) {
+				return username, nil
+			}
+		}
+	}
+	return "", ErrUnknownCertificate
+}
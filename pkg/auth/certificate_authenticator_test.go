@@ -0,0 +1,109 @@
+package auth_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/mocks"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/helper"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCertificateAuthenticator(t *testing.T) {
+	userService := mocks.NewMockUserService(map[string]config.User{
+		"alice":   {Admin: true},
+		"scanner": {Certificate: "scanner@example.com", Jail: true, Root: "/scans"},
+		"bob":     {Certificate: "bobs-laptop"},
+	})
+	certificate := func(commonName string, emails ...string) *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: commonName}, EmailAddresses: emails}
+	}
+
+	t.Run("Common names", func(t *testing.T) {
+		authenticator, err := auth.NewCertificateAuthenticator(userService, "")
+		assert.NoError(t, err)
+		username, err := authenticator.Authenticate(certificate("bobs-laptop"))
+		assert.NoError(t, err)
+		assert.Equal(t, "bob", username)
+		username, err = authenticator.Authenticate(certificate("BOBS-LAPTOP"))
+		assert.NoError(t, err)
+		assert.Equal(t, "bob", username)
+		_, err = authenticator.Authenticate(certificate("bob"))
+		assert.ErrorIs(t, err, auth.ErrUnknownCertificate, "users are only matched by their certificate setting")
+		_, err = authenticator.Authenticate(certificate("alice"))
+		assert.ErrorIs(t, err, auth.ErrUnknownCertificate, "users without a certificate setting can't use certificates")
+		_, err = authenticator.Authenticate(certificate("mallory"))
+		assert.ErrorIs(t, err, auth.ErrUnknownCertificate)
+	})
+
+	t.Run("Email addresses", func(t *testing.T) {
+		authenticator, err := auth.NewCertificateAuthenticator(userService, "email")
+		assert.NoError(t, err)
+		username, err := authenticator.Authenticate(certificate("Scanner", "it@example.com", "scanner@example.com"))
+		assert.NoError(t, err)
+		assert.Equal(t, "scanner", username)
+		_, err = authenticator.Authenticate(certificate("alice"))
+		assert.ErrorIs(t, err, auth.ErrUnknownCertificate, "the common name is not used")
+	})
+
+	t.Run("Invalid identity", func(t *testing.T) {
+		_, err := auth.NewCertificateAuthenticator(userService, "serial")
+		assert.Error(t, err)
+	})
+}
+
+func TestCertificateAuthMiddleware(t *testing.T) {
+	password := "password123"
+	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	userService := mocks.NewMockUserService(map[string]config.User{
+		"alice":   {Password: string(hash), Admin: true, Certificate: "alice"},
+		"scanner": {Jail: true, Root: "/scans", Certificate: "scanner"},
+	})
+	authenticationService := auth.New(userService)
+	certificateAuthenticator, err := auth.NewCertificateAuthenticator(userService, "cn")
+	assert.NoError(t, err)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _ := helper.GetUsernameFromContext(r.Context())
+		w.Write([]byte(username))
+	})
+	optional := auth.CertificateAuthMiddleware(certificateAuthenticator, authenticationService, auth.BasicAuthMiddleware(authenticationService))(next)
+	required := auth.CertificateAuthMiddleware(certificateAuthenticator, authenticationService, nil)(next)
+	serve := func(handler http.Handler, path, commonName string, basic bool) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		if commonName != "" {
+			request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: commonName}}}}}
+		}
+		if basic {
+			request.SetBasicAuth("alice", password)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("Certificates of users", func(t *testing.T) {
+		recorder := serve(optional, "/scans/2024", "scanner", false)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "scanner", recorder.Body.String())
+		assert.Equal(t, http.StatusForbidden, serve(required, "/documents", "scanner", false).Code, "permissions apply to the user")
+	})
+
+	t.Run("Passwords are optional", func(t *testing.T) {
+		recorder := serve(optional, "/documents", "", true)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "alice", recorder.Body.String())
+		assert.Equal(t, http.StatusUnauthorized, serve(optional, "/documents", "mallory", false).Code)
+	})
+
+	t.Run("Certificates are required", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, serve(required, "/documents", "", true).Code)
+		assert.Equal(t, http.StatusForbidden, serve(required, "/documents", "mallory", true).Code)
+		assert.Equal(t, http.StatusOK, serve(required, "/documents", "alice", false).Code)
+	})
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCredentialCacheTTL        = time.Minute
+	DefaultCredentialCacheMaxEntries = 1024
+)
+
+// CredentialCache remembers successful password verifications for a short time, so bcrypt does not
+// run on every request. Entries are keyed by an HMAC of the username, the password and the stored
+// hash under a random per-process key, so no plain text password is kept in memory and a changed
+// hash never matches an old entry.
+type CredentialCache struct {
+	mutex      sync.Mutex
+	key        []byte
+	ttl        time.Duration
+	maxEntries int
+	// lru holds the entries, most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+	now     func() time.Time
+}
+
+type credentialCacheEntry struct {
+	key      string
+	username string
+	expires  time.Time
+}
+
+func NewCredentialCache(ttl time.Duration, maxEntries int) *CredentialCache {
+	if ttl <= 0 {
+		ttl = DefaultCredentialCacheTTL
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultCredentialCacheMaxEntries
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &CredentialCache{
+		key:        key,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+		now:        time.Now,
+	}
+}
+
+func (c *CredentialCache) Contains(username, password, storedHash string) bool {
+	key := c.cacheKey(username, password, storedHash)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	if !c.now().Before(element.Value.(*credentialCacheEntry).expires) {
+		c.remove(element)
+		return false
+	}
+	c.lru.MoveToFront(element)
+	return true
+}
+
+func (c *CredentialCache) Add(username, password, storedHash string) {
+	key := c.cacheKey(username, password, storedHash)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	expires := c.now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*credentialCacheEntry).expires = expires
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&credentialCacheEntry{key: key, username: username, expires: expires})
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Invalidate drops every entry of a user.
+func (c *CredentialCache) Invalidate(username string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*credentialCacheEntry).username == username {
+			c.remove(element)
+		}
+		element = next
+	}
+}
+
+func (c *CredentialCache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lru.Init()
+	c.entries = map[string]*list.Element{}
+}
+
+func (c *CredentialCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lru.Len()
+}
+
+func (c *CredentialCache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*credentialCacheEntry).key)
+}
+
+func (c *CredentialCache) cacheKey(username, password, storedHash string) string {
+	mac := hmac.New(sha256.New, c.key)
+	for _, part := range []string{username, password, storedHash} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCredentialCache(t *testing.T) {
+	cache := NewCredentialCache(time.Minute, 2)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.Add("alice", "secret", "hash")
+	assert.True(t, cache.Contains("alice", "secret", "hash"))
+	assert.False(t, cache.Contains("alice", "wrong", "hash"))
+	assert.False(t, cache.Contains("alice", "secret", "changed hash"), "a changed hash should not match")
+	assert.False(t, cache.Contains("bob", "secret", "hash"))
+
+	now = now.Add(time.Minute)
+	assert.False(t, cache.Contains("alice", "secret", "hash"), "expired entries should not match")
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestCredentialCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewCredentialCache(time.Minute, 2)
+	cache.Add("alice", "secret", "hash")
+	cache.Add("bob", "secret", "hash")
+	cache.Contains("alice", "secret", "hash")
+	cache.Add("carol", "secret", "hash")
+	assert.True(t, cache.Contains("alice", "secret", "hash"))
+	assert.False(t, cache.Contains("bob", "secret", "hash"))
+	assert.True(t, cache.Contains("carol", "secret", "hash"))
+}
+
+func TestCredentialCacheInvalidate(t *testing.T) {
+	cache := NewCredentialCache(time.Minute, 10)
+	cache.Add("alice", "secret", "hash")
+	cache.Add("alice", "other", "hash")
+	cache.Add("bob", "secret", "hash")
+	cache.Invalidate("alice")
+	assert.Equal(t, 1, cache.Len())
+	assert.True(t, cache.Contains("bob", "secret", "hash"))
+}
+
+func TestCredentialCacheDoesNotKeepPasswords(t *testing.T) {
+	cache := NewCredentialCache(time.Minute, 10)
+	cache.Add("alice", "secret", "hash")
+	for key := range cache.entries {
+		assert.False(t, strings.Contains(key, "secret"))
+	}
+}
@@ -1,71 +1,243 @@
 package auth
 
 import (
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"github.com/triargos/webdav/pkg/config"
 	"github.com/triargos/webdav/pkg/helper"
 	"github.com/triargos/webdav/pkg/user"
 	"log/slog"
+	"net/url"
+	"strconv"
 	"strings"
-	"time"
 )
 
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrStaleNonce         = errors.New("stale nonce")
+	ErrReplayedNonce      = errors.New("replayed nonce")
+)
+
+// DefaultDigestAlgorithms are offered when no algorithms are configured, in order of preference.
+var DefaultDigestAlgorithms = []string{"SHA-256", "MD5"}
+
+var supportedDigestAlgorithms = []string{"MD5", "MD5-sess", "SHA-256", "SHA-256-sess"}
+
 type DigestAuthenticator struct {
 	userService user.Service
+	nonceStore  NonceStore
+	options     DigestOptions
+}
+
+type DigestOptions struct {
+	// Algorithms are offered to clients in order of preference. Responses computed with any other
+	// algorithm are rejected.
+	Algorithms []string
+	// Userhash advertises support for hashed usernames (RFC 7616, section 3.4.4)
+	Userhash bool
 }
 
 type AuthenticateDigestOptions struct {
 	AuthHeader string
 	Method     string
-	Uri        string
+	// Uri is the request-target of the request, which the digest-uri of the client must match
+	Uri string
 }
 
-func NewDigestAuthenticator(userService user.Service) DigestAuthenticator {
-	return DigestAuthenticator{userService: userService}
+func NewDigestAuthenticator(userService user.Service, nonceStore NonceStore, options DigestOptions) DigestAuthenticator {
+	algorithms := make([]string, 0, len(options.Algorithms))
+	for _, algorithm := range options.Algorithms {
+		if canonical, ok := canonicalDigestAlgorithm(algorithm); ok {
+			algorithms = append(algorithms, canonical)
+		} else {
+			slog.Error("Ignoring unsupported digest algorithm", "algorithm", algorithm)
+		}
+	}
+	if len(algorithms) == 0 {
+		algorithms = DefaultDigestAlgorithms
+	}
+	options.Algorithms = algorithms
+	return DigestAuthenticator{userService: userService, nonceStore: nonceStore, options: options}
 }
 
-func (digestAuthenticator DigestAuthenticator) Authenticate(options AuthenticateDigestOptions) (username string, ok bool) {
+// Authenticate verifies the digest response and the nonce it was computed with. ErrStaleNonce is
+// returned when the response is correct but the nonce has expired or is unknown, in which case the
+// client should be challenged again with stale=true.
+func (digestAuthenticator DigestAuthenticator) Authenticate(options AuthenticateDigestOptions) (username string, err error) {
 	const prefix = "Digest "
-	if !strings.HasPrefix(options.AuthHeader, prefix) {
+	if len(options.AuthHeader) < len(prefix) || !strings.EqualFold(options.AuthHeader[:len(prefix)], prefix) {
 		slog.Error("missing prefix", "prefix", prefix, "auth_header", options.AuthHeader)
-		return "", false
+		return "", ErrInvalidCredentials
 	}
-	params := ParseAuthHeader(strings.TrimPrefix(options.AuthHeader, prefix))
-	if params["realm"] != "WebDAV" {
+	params, parseErr := ParseAuthHeader(options.AuthHeader[len(prefix):])
+	if parseErr != nil {
+		slog.Error("failed to parse digest header", "error", parseErr)
+		return "", ErrInvalidCredentials
+	}
+	if params["realm"] != realm {
 		slog.Error("invalid realm", "realm", params["realm"])
-		return "", false
+		return "", ErrInvalidCredentials
 	}
-	username = params["username"]
-	if !digestAuthenticator.userService.HasUser(username) {
-		slog.Error("user does not exist", "username", username)
-		return username, false
+	algorithm, ok := digestAuthenticator.acceptedAlgorithm(params["algorithm"])
+	if !ok {
+		slog.Error("unsupported digest algorithm", "algorithm", params["algorithm"])
+		return "", ErrInvalidCredentials
+	}
+	hash, _ := helper.DigestHashFunc(algorithm)
+	username, resolveErr := digestAuthenticator.resolveUsername(params, hash)
+	if resolveErr != nil {
+		slog.Error("failed to resolve username", "username", username, "error", resolveErr)
+		return username, ErrInvalidCredentials
+	}
+	if params["qop"] != "auth" {
+		slog.Error("unsupported quality of protection", "qop", params["qop"])
+		return username, ErrInvalidCredentials
+	}
+	if !matchesRequestUri(params["uri"], options.Uri) {
+		slog.Error("digest uri does not match request", "uri", params["uri"], "request_uri", options.Uri)
+		return username, ErrInvalidCredentials
+	}
+	nonceCount, parseNonceCountErr := strconv.ParseUint(params["nc"], 16, 64)
+	if parseNonceCountErr != nil {
+		slog.Error("invalid nonce count", "nc", params["nc"])
+		return username, ErrInvalidCredentials
 	}
 	webdavUser := digestAuthenticator.userService.GetUser(username)
-	ha1 := webdavUser.Password
-	ha2 := helper.Md5Hash(fmt.Sprintf("%s:%s", options.Method, options.Uri))
-	response := helper.Md5Hash(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2))
-	if response != params["response"] {
-		slog.Error("invalid response", "response", response, "expected", params["response"])
-		return username, false
-	}
-	return username, true
+	if !allowsAuthType(webdavUser, "digest") {
+		slog.Error("user may not use digest authentication", "username", username)
+		return username, ErrInvalidCredentials
+	}
+	ha1, ok := storedDigestHash(webdavUser, algorithm)
+	if !ok {
+		slog.Error("no digest credentials stored for algorithm", "username", username, "algorithm", algorithm)
+		return username, ErrInvalidCredentials
+	}
+	if strings.HasSuffix(algorithm, "-sess") {
+		ha1 = hash(fmt.Sprintf("%s:%s:%s", ha1, params["nonce"], params["cnonce"]))
+	}
+	ha2 := hash(fmt.Sprintf("%s:%s", options.Method, params["uri"]))
+	response := hash(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2))
+	if subtle.ConstantTimeCompare([]byte(response), []byte(strings.ToLower(params["response"]))) != 1 {
+		slog.Error("invalid response", "username", username)
+		return username, ErrInvalidCredentials
+	}
+	switch digestAuthenticator.nonceStore.Use(params["nonce"], nonceCount) {
+	case NonceUnknown, NonceStale:
+		return username, ErrStaleNonce
+	case NonceReplayed:
+		slog.Error("replayed nonce", "username", username, "nc", params["nc"])
+		return username, ErrReplayedNonce
+	}
+	return username, nil
+}
+
+// Challenges returns one WWW-Authenticate value per offered algorithm, sharing a freshly issued nonce.
+func (digestAuthenticator DigestAuthenticator) Challenges(stale bool) []string {
+	nonce := digestAuthenticator.GenerateNonce()
+	opaque := digestAuthenticator.GenerateOpaque(nonce)
+	challenges := make([]string, 0, len(digestAuthenticator.options.Algorithms))
+	for _, algorithm := range digestAuthenticator.options.Algorithms {
+		challenge := fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=%s, nonce="%s", opaque="%s", charset=UTF-8`, realm, algorithm, nonce, opaque)
+		if digestAuthenticator.options.Userhash {
+			challenge += ", userhash=true"
+		}
+		if stale {
+			challenge += ", stale=true"
+		}
+		challenges = append(challenges, challenge)
+	}
+	return challenges
 }
 
 func (digestAuthenticator DigestAuthenticator) GenerateNonce() string {
-	data := fmt.Sprintf("%d", time.Now().UnixNano())
-	return helper.Md5Hash(data)
+	return digestAuthenticator.nonceStore.Issue()
 }
 
 func (digestAuthenticator DigestAuthenticator) GenerateOpaque(nonce string) string {
 	return helper.Md5Hash(nonce)
 }
 
-func ParseAuthHeader(header string) map[string]string {
-	params := make(map[string]string)
-	for _, part := range strings.Split(header, ",") {
-		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
-		if len(kv) == 2 {
-			params[strings.Trim(kv[0], `"`)] = strings.Trim(kv[1], `"`)
+// acceptedAlgorithm returns the canonical algorithm name if it is offered. A missing algorithm
+// parameter means MD5 (RFC 7616, section 3.3).
+func (digestAuthenticator DigestAuthenticator) acceptedAlgorithm(algorithm string) (string, bool) {
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	canonical, ok := canonicalDigestAlgorithm(algorithm)
+	if !ok {
+		return "", false
+	}
+	for _, offered := range digestAuthenticator.options.Algorithms {
+		if offered == canonical {
+			return canonical, true
+		}
+	}
+	return "", false
+}
+
+func (digestAuthenticator DigestAuthenticator) resolveUsername(params map[string]string, hash func(string) string) (string, error) {
+	username, hasUsername := params["username"]
+	if extUsername, ok := params["username*"]; ok {
+		if hasUsername || params["userhash"] == "true" {
+			return "", errors.New("username* must not be combined with username or userhash")
+		}
+		decoded, err := decodeExtValue(extUsername)
+		if err != nil {
+			return "", err
+		}
+		username = decoded
+	}
+	if params["userhash"] == "true" {
+		for candidate := range digestAuthenticator.userService.GetUsers() {
+			if hash(fmt.Sprintf("%s:%s", candidate, realm)) == strings.ToLower(username) {
+				return candidate, nil
+			}
+		}
+		return username, errors.New("no user matches the hashed username")
+	}
+	if !digestAuthenticator.userService.HasUser(username) {
+		return username, errors.New("user does not exist")
+	}
+	return username, nil
+}
+
+// storedDigestHash looks up the HA1 of a user for an algorithm. Users created before digest
+// credentials were stored per algorithm keep their MD5 HA1 in the password field.
+func storedDigestHash(webdavUser config.User, algorithm string) (string, bool) {
+	baseAlgorithm := helper.DigestBaseAlgorithm(algorithm)
+	if ha1, ok := webdavUser.Digest[baseAlgorithm]; ok {
+		return ha1, true
+	}
+	if baseAlgorithm == "MD5" && len(webdavUser.Digest) == 0 && webdavUser.Password != "" {
+		return webdavUser.Password, true
+	}
+	return "", false
+}
+
+// matchesRequestUri compares the digest-uri sent by the client with the request-target. The
+// digest-uri may be in absolute form, and clients differ in how they percent-encode paths, so the
+// unescaped paths and the queries are compared.
+func matchesRequestUri(digestUri, requestUri string) bool {
+	if digestUri == "" {
+		return false
+	}
+	if digestUri == requestUri {
+		return true
+	}
+	parsedDigestUri, digestErr := url.Parse(digestUri)
+	parsedRequestUri, requestErr := url.Parse(requestUri)
+	if digestErr != nil || requestErr != nil {
+		return false
+	}
+	return parsedDigestUri.Path == parsedRequestUri.Path && parsedDigestUri.RawQuery == parsedRequestUri.RawQuery
+}
+
+func canonicalDigestAlgorithm(algorithm string) (string, bool) {
+	for _, supported := range supportedDigestAlgorithms {
+		if strings.EqualFold(supported, algorithm) {
+			return supported, true
 		}
 	}
-	return params
+	return "", false
 }
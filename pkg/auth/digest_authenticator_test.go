@@ -1,98 +1,235 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"github.com/triargos/webdav/mocks"
 	"github.com/triargos/webdav/pkg/config"
 	"github.com/triargos/webdav/pkg/helper"
 	"strings"
 	"testing"
+	"time"
 )
 
+func digestResponse(ha1, method, uri string, params map[string]string) string {
+	ha2 := helper.Md5Hash(fmt.Sprintf("%s:%s", method, uri))
+	return helper.Md5Hash(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2))
+}
+
 func TestAuthenticate(t *testing.T) {
 	mockUserService := mocks.NewMockUserService(map[string]config.User{
 		"testuser": {Password: helper.Md5Hash("testuser:testpassword:WebDAV")},
 	})
-	authenticator := NewDigestAuthenticator(mockUserService)
+	authenticator := NewDigestAuthenticator(mockUserService, NewMemoryNonceStore(time.Minute), DigestOptions{})
 
 	tests := []struct {
 		name     string
 		options  AuthenticateDigestOptions
 		expected string
-		ok       bool
+		err      error
 	}{
 		{
 			name: "Valid authentication",
 			options: AuthenticateDigestOptions{
-				AuthHeader: `Digest username="testuser", realm="WebDAV", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", uri="/dir/index.html", qop=auth, nc=00000001, cnonce="0a4f113b", response="%s", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+				AuthHeader: `Digest username="testuser", realm="WebDAV", nonce="{nonce}", uri="/dir/index.html", qop=auth, nc=00000001, cnonce="0a4f113b", response="{response}", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
 				Method:     "GET",
 				Uri:        "/dir/index.html",
 			},
 			expected: "testuser",
-			ok:       true,
 		},
 		{
 			name: "Invalid realm",
 			options: AuthenticateDigestOptions{
-				AuthHeader: `Digest username="testuser", realm="InvalidRealm", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", uri="/dir/index.html", qop=auth, nc=00000001, cnonce="0a4f113b", response="6629fae49393a05397450978507c4ef1", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+				AuthHeader: `Digest username="testuser", realm="InvalidRealm", nonce="{nonce}", uri="/dir/index.html", qop=auth, nc=00000001, cnonce="0a4f113b", response="6629fae49393a05397450978507c4ef1", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
 				Method:     "GET",
 				Uri:        "/dir/index.html",
 			},
 			expected: "",
-			ok:       false,
+			err:      ErrInvalidCredentials,
 		},
 		{
 			name: "User does not exist",
 			options: AuthenticateDigestOptions{
-				AuthHeader: `Digest username="nonexistent", realm="WebDAV", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", uri="/dir/index.html", qop=auth, nc=00000001, cnonce="0a4f113b", response="6629fae49393a05397450978507c4ef1", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+				AuthHeader: `Digest username="nonexistent", realm="WebDAV", nonce="{nonce}", uri="/dir/index.html", qop=auth, nc=00000001, cnonce="0a4f113b", response="6629fae49393a05397450978507c4ef1", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
 				Method:     "GET",
 				Uri:        "/dir/index.html",
 			},
 			expected: "nonexistent",
-			ok:       false,
+			err:      ErrInvalidCredentials,
 		},
 		{
 			name: "Invalid response",
 			options: AuthenticateDigestOptions{
-				AuthHeader: `Digest username="testuser", realm="WebDAV", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", uri="/dir/index.html", qop=auth, nc=00000001, cnonce="0a4f113b", response="invalidresponse", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+				AuthHeader: `Digest username="testuser", realm="WebDAV", nonce="{nonce}", uri="/dir/index.html", qop=auth, nc=00000001, cnonce="0a4f113b", response="invalidresponse", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+				Method:     "GET",
+				Uri:        "/dir/index.html",
+			},
+			expected: "testuser",
+			err:      ErrInvalidCredentials,
+		},
+		{
+			name: "Digest uri does not match the request",
+			options: AuthenticateDigestOptions{
+				AuthHeader: `Digest username="testuser", realm="WebDAV", nonce="{nonce}", uri="/dir/index.html", qop=auth, nc=00000001, cnonce="0a4f113b", response="{response}", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+				Method:     "GET",
+				Uri:        "/dir/other.html",
+			},
+			expected: "testuser",
+			err:      ErrInvalidCredentials,
+		},
+		{
+			name: "Nonce not issued by the server",
+			options: AuthenticateDigestOptions{
+				AuthHeader: `Digest username="testuser", realm="WebDAV", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", uri="/dir/index.html", qop=auth, nc=00000001, cnonce="0a4f113b", response="{response}", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
 				Method:     "GET",
 				Uri:        "/dir/index.html",
 			},
 			expected: "testuser",
-			ok:       false,
+			err:      ErrStaleNonce,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			authHeader := tt.options.AuthHeader
-			if tt.ok {
+			authHeader := strings.ReplaceAll(tt.options.AuthHeader, "{nonce}", authenticator.GenerateNonce())
+			if strings.Contains(authHeader, "{response}") {
 				ha1 := mockUserService.GetUser(tt.expected).Password
-				ha2 := helper.Md5Hash(fmt.Sprintf("%s:%s", tt.options.Method, tt.options.Uri))
-				params := ParseAuthHeader(authHeader)
-				expectedResponse := helper.Md5Hash(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2))
-				authHeader = fmt.Sprintf(tt.options.AuthHeader, expectedResponse)
-				tt.options.AuthHeader = authHeader
+				params, _ := ParseAuthHeader(strings.TrimPrefix(authHeader, "Digest "))
+				response := digestResponse(ha1, tt.options.Method, params["uri"], params)
+				authHeader = strings.ReplaceAll(authHeader, "{response}", response)
 			}
+			tt.options.AuthHeader = authHeader
 
-			username, ok := authenticator.Authenticate(tt.options)
-			if username != tt.expected || ok != tt.ok {
-				t.Errorf("expected %s, %v; got %s, %v", tt.expected, tt.ok, username, ok)
+			username, err := authenticator.Authenticate(tt.options)
+			if username != tt.expected || !errors.Is(err, tt.err) {
+				t.Errorf("expected %s, %v; got %s, %v", tt.expected, tt.err, username, err)
 			}
 		})
 	}
 }
 
+func TestAuthenticateNonceLifecycle(t *testing.T) {
+	mockUserService := mocks.NewMockUserService(map[string]config.User{
+		"testuser": {Password: helper.Md5Hash("testuser:WebDAV:testpassword")},
+	})
+	nonceStore := NewMemoryNonceStore(time.Minute)
+	now := time.Now()
+	nonceStore.now = func() time.Time { return now }
+	authenticator := NewDigestAuthenticator(mockUserService, nonceStore, DigestOptions{})
+	nonce := authenticator.GenerateNonce()
+
+	authenticate := func(nc string) error {
+		params := map[string]string{"nonce": nonce, "nc": nc, "cnonce": "0a4f113b", "qop": "auth"}
+		response := digestResponse(mockUserService.GetUser("testuser").Password, "GET", "/file", params)
+		header := fmt.Sprintf(`Digest username="testuser", realm="WebDAV", nonce="%s", uri="/file", qop=auth, nc=%s, cnonce="0a4f113b", response="%s"`, nonce, nc, response)
+		_, err := authenticator.Authenticate(AuthenticateDigestOptions{AuthHeader: header, Method: "GET", Uri: "/file"})
+		return err
+	}
+
+	if err := authenticate("00000001"); err != nil {
+		t.Fatalf("expected first request to succeed, got %v", err)
+	}
+	if err := authenticate("00000001"); !errors.Is(err, ErrReplayedNonce) {
+		t.Errorf("expected replayed nonce count to be rejected, got %v", err)
+	}
+	if err := authenticate("00000003"); err != nil {
+		t.Errorf("expected higher nonce count to succeed, got %v", err)
+	}
+	if err := authenticate("00000002"); err != nil {
+		t.Errorf("expected out of order nonce count to succeed, got %v", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if err := authenticate("00000004"); !errors.Is(err, ErrStaleNonce) {
+		t.Errorf("expected expired nonce to be stale, got %v", err)
+	}
+}
+
+func TestAuthenticateAlgorithms(t *testing.T) {
+	mockUserService := mocks.NewMockUserService(map[string]config.User{
+		"testuser": {Digest: map[string]string{
+			"MD5":     helper.Md5Hash("testuser:WebDAV:testpassword"),
+			"SHA-256": helper.Sha256Hash("testuser:WebDAV:testpassword"),
+		}},
+		"md5user": {Digest: map[string]string{
+			"MD5": helper.Md5Hash("md5user:WebDAV:testpassword"),
+		}},
+	})
+	authenticator := NewDigestAuthenticator(mockUserService, NewMemoryNonceStore(time.Minute), DigestOptions{
+		Algorithms: []string{"sha-256-sess", "SHA-256", "MD5"},
+	})
+
+	tests := []struct {
+		name      string
+		username  string
+		algorithm string
+		userhash  bool
+		err       error
+	}{
+		{name: "SHA-256", username: "testuser", algorithm: "SHA-256"},
+		{name: "SHA-256-sess", username: "testuser", algorithm: "SHA-256-sess"},
+		{name: "MD5", username: "testuser", algorithm: "MD5"},
+		{name: "Hashed username", username: "testuser", algorithm: "SHA-256", userhash: true},
+		{name: "Algorithm not offered", username: "testuser", algorithm: "MD5-sess", err: ErrInvalidCredentials},
+		{name: "No credentials for algorithm", username: "md5user", algorithm: "SHA-256", err: ErrInvalidCredentials},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, _ := helper.DigestHashFunc(tt.algorithm)
+			nonce := authenticator.GenerateNonce()
+			ha1 := mockUserService.GetUser(tt.username).Digest[helper.DigestBaseAlgorithm(tt.algorithm)]
+			if strings.HasSuffix(strings.ToLower(tt.algorithm), "-sess") {
+				ha1 = hash(fmt.Sprintf("%s:%s:%s", ha1, nonce, "0a4f113b"))
+			}
+			ha2 := hash("PROPFIND:/dir/a,b.txt")
+			response := hash(fmt.Sprintf("%s:%s:00000001:0a4f113b:auth:%s", ha1, nonce, ha2))
+			username := tt.username
+			if tt.userhash {
+				username = hash(tt.username + ":WebDAV")
+			}
+			header := fmt.Sprintf(`Digest username="%s", realm="WebDAV", nonce="%s", uri="/dir/a,b.txt", algorithm=%s, qop=auth, nc=00000001, cnonce="0a4f113b", response="%s", userhash=%v`, username, nonce, tt.algorithm, response, tt.userhash)
+
+			authenticated, err := authenticator.Authenticate(AuthenticateDigestOptions{AuthHeader: header, Method: "PROPFIND", Uri: "/dir/a,b.txt"})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if err == nil && authenticated != tt.username {
+				t.Errorf("expected username %s, got %s", tt.username, authenticated)
+			}
+		})
+	}
+}
+
+func TestChallenges(t *testing.T) {
+	authenticator := NewDigestAuthenticator(nil, NewMemoryNonceStore(time.Minute), DigestOptions{Userhash: true})
+	challenges := authenticator.Challenges(true)
+	if len(challenges) != len(DefaultDigestAlgorithms) {
+		t.Fatalf("expected %d challenges, got %d", len(DefaultDigestAlgorithms), len(challenges))
+	}
+	for i, challenge := range challenges {
+		params, err := ParseAuthHeader(strings.TrimPrefix(challenge, "Digest "))
+		if err != nil {
+			t.Fatalf("failed to parse challenge %q: %v", challenge, err)
+		}
+		if params["algorithm"] != DefaultDigestAlgorithms[i] || params["stale"] != "true" || params["userhash"] != "true" {
+			t.Errorf("unexpected challenge %q", challenge)
+		}
+	}
+}
+
 func TestGenerateNonce(t *testing.T) {
-	authenticator := NewDigestAuthenticator(nil)
+	authenticator := NewDigestAuthenticator(nil, NewMemoryNonceStore(time.Minute), DigestOptions{})
 	nonce := authenticator.GenerateNonce()
 	if nonce == "" {
 		t.Error("expected non-empty nonce")
 	}
+	if nonce == authenticator.GenerateNonce() {
+		t.Error("expected unique nonces")
+	}
 }
 
 func TestGenerateOpaque(t *testing.T) {
-	authenticator := NewDigestAuthenticator(nil)
+	authenticator := NewDigestAuthenticator(nil, NewMemoryNonceStore(time.Minute), DigestOptions{})
 	nonce := authenticator.GenerateNonce()
 	opaque := authenticator.GenerateOpaque(nonce)
 	if opaque == "" {
@@ -113,7 +250,10 @@ func TestParseAuthHeader(t *testing.T) {
 		"response": "6629fae49393a05397450978507c4ef1",
 		"opaque":   "5ccc069c403ebaf9f0171e9517f40e41",
 	}
-	params := ParseAuthHeader(strings.TrimPrefix(header, "Digest "))
+	params, err := ParseAuthHeader(strings.TrimPrefix(header, "Digest "))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 	for k, v := range expected {
 		if params[k] != v {
 			t.Errorf("expected %s=%s, got %s", k, v, params[k])
@@ -0,0 +1,288 @@
+package auth
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LimiterOptions configures the failed-login throttling. Zero values fall back to the defaults.
+type LimiterOptions struct {
+	// Window is the period failed logins are counted in
+	Window time.Duration
+	// BackoffAfter is the number of failures after which clients have to wait before trying again
+	BackoffAfter int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	// MaxFailures is the number of failures after which a client or user is locked out
+	MaxFailures int
+	Lockout     time.Duration
+	// StatePath is the file lockouts are persisted to, so they can be managed from the command line
+	StatePath string
+}
+
+var DefaultLimiterOptions = LimiterOptions{
+	Window:       15 * time.Minute,
+	BackoffAfter: 5,
+	BaseDelay:    time.Second,
+	MaxDelay:     time.Minute,
+	MaxFailures:  20,
+	Lockout:      15 * time.Minute,
+}
+
+// statePollInterval limits how often the state file is checked for changes made by the command line.
+const statePollInterval = 5 * time.Second
+
+type Lockout struct {
+	Key   string    `json:"key"`
+	Until time.Time `json:"until"`
+}
+
+type Limiter interface {
+	// Check returns how long a client has to wait before it may try to log in again
+	Check(remoteAddr, username string) time.Duration
+	Failure(remoteAddr, username string)
+	Success(remoteAddr, username string)
+	Lockouts() []Lockout
+	// Clear lifts the lockout and forgets the failures of a key, or of every key if it is empty
+	Clear(key string) error
+}
+
+type limiterEntry struct {
+	failures     []time.Time
+	blockedUntil time.Time
+	lockedUntil  time.Time
+}
+
+type SlidingWindowLimiter struct {
+	mutex        sync.Mutex
+	options      LimiterOptions
+	entries      map[string]*limiterEntry
+	stateModTime time.Time
+	lastPoll     time.Time
+	now          func() time.Time
+}
+
+func NewSlidingWindowLimiter(options LimiterOptions) *SlidingWindowLimiter {
+	if options.Window <= 0 {
+		options.Window = DefaultLimiterOptions.Window
+	}
+	if options.BackoffAfter <= 0 {
+		options.BackoffAfter = DefaultLimiterOptions.BackoffAfter
+	}
+	if options.BaseDelay <= 0 {
+		options.BaseDelay = DefaultLimiterOptions.BaseDelay
+	}
+	if options.MaxDelay <= 0 {
+		options.MaxDelay = DefaultLimiterOptions.MaxDelay
+	}
+	if options.MaxFailures <= 0 {
+		options.MaxFailures = DefaultLimiterOptions.MaxFailures
+	}
+	if options.Lockout <= 0 {
+		options.Lockout = DefaultLimiterOptions.Lockout
+	}
+	limiter := &SlidingWindowLimiter{options: options, entries: map[string]*limiterEntry{}, now: time.Now}
+	limiter.loadState()
+	return limiter
+}
+
+func (l *SlidingWindowLimiter) Check(remoteAddr, username string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	if now.Sub(l.lastPoll) >= statePollInterval {
+		l.lastPoll = now
+		l.loadState()
+	}
+	var wait time.Duration
+	for _, key := range limiterKeys(remoteAddr, username) {
+		entry, ok := l.entries[key]
+		if !ok {
+			continue
+		}
+		for _, until := range []time.Time{entry.blockedUntil, entry.lockedUntil} {
+			if until.Sub(now) > wait {
+				wait = until.Sub(now)
+			}
+		}
+	}
+	return wait
+}
+
+func (l *SlidingWindowLimiter) Failure(remoteAddr, username string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	lockedOut := false
+	for _, key := range limiterKeys(remoteAddr, username) {
+		entry, ok := l.entries[key]
+		if !ok {
+			entry = &limiterEntry{}
+			l.entries[key] = entry
+		}
+		entry.failures = append(pruneFailures(entry.failures, now.Add(-l.options.Window)), now)
+		failures := len(entry.failures)
+		switch {
+		case failures >= l.options.MaxFailures:
+			entry.lockedUntil = now.Add(l.options.Lockout)
+			entry.blockedUntil = time.Time{}
+			entry.failures = nil
+			lockedOut = true
+			slog.Warn("Locking out after too many failed logins", "key", key, "until", entry.lockedUntil)
+		case failures >= l.options.BackoffAfter:
+			delay := l.options.MaxDelay
+			if exponent := failures - l.options.BackoffAfter; exponent < 32 {
+				delay = min(l.options.BaseDelay<<exponent, l.options.MaxDelay)
+			}
+			entry.blockedUntil = now.Add(delay)
+		}
+	}
+	l.sweep(now)
+	if lockedOut {
+		l.saveState()
+	}
+}
+
+func (l *SlidingWindowLimiter) Success(remoteAddr, username string) {
+	if username == "" {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	entry, ok := l.entries["user:"+username]
+	if ok && entry.lockedUntil.IsZero() {
+		delete(l.entries, "user:"+username)
+	}
+}
+
+func (l *SlidingWindowLimiter) Lockouts() []Lockout {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.activeLockouts(l.now())
+}
+
+func (l *SlidingWindowLimiter) Clear(key string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if key == "" {
+		l.entries = map[string]*limiterEntry{}
+	} else {
+		delete(l.entries, key)
+	}
+	return l.saveState()
+}
+
+// Flush writes the active lockouts to the state file.
+func (l *SlidingWindowLimiter) Flush() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.loadState()
+	return l.saveState()
+}
+
+func (l *SlidingWindowLimiter) activeLockouts(now time.Time) []Lockout {
+	lockouts := []Lockout{}
+	for key, entry := range l.entries {
+		if entry.lockedUntil.After(now) {
+			lockouts = append(lockouts, Lockout{Key: key, Until: entry.lockedUntil})
+		}
+	}
+	sort.Slice(lockouts, func(i, j int) bool { return lockouts[i].Key < lockouts[j].Key })
+	return lockouts
+}
+
+// sweep forgets keys whose failures and lockouts are all in the past, so memory stays bounded by
+// the number of clients failing within one window.
+func (l *SlidingWindowLimiter) sweep(now time.Time) {
+	for key, entry := range l.entries {
+		entry.failures = pruneFailures(entry.failures, now.Add(-l.options.Window))
+		if len(entry.failures) == 0 && !entry.blockedUntil.After(now) && !entry.lockedUntil.After(now) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+func (l *SlidingWindowLimiter) saveState() error {
+	if l.options.StatePath == "" {
+		return nil
+	}
+	marshalled, marshalErr := json.MarshalIndent(l.activeLockouts(l.now()), "", "  ")
+	if marshalErr != nil {
+		return marshalErr
+	}
+	if writeErr := os.WriteFile(l.options.StatePath, marshalled, 0600); writeErr != nil {
+		slog.Error("Failed to write lockouts", "error", writeErr)
+		return writeErr
+	}
+	if fileInfo, statErr := os.Stat(l.options.StatePath); statErr == nil {
+		l.stateModTime = fileInfo.ModTime()
+	}
+	return nil
+}
+
+// loadState replaces the lockouts with the ones in the state file if it changed since it was last
+// read or written, which happens when lockouts are cleared from the command line.
+func (l *SlidingWindowLimiter) loadState() {
+	if l.options.StatePath == "" {
+		return
+	}
+	fileInfo, statErr := os.Stat(l.options.StatePath)
+	if statErr != nil || fileInfo.ModTime().Equal(l.stateModTime) {
+		return
+	}
+	l.stateModTime = fileInfo.ModTime()
+	content, readErr := os.ReadFile(l.options.StatePath)
+	if readErr != nil {
+		slog.Error("Failed to read lockouts", "error", readErr)
+		return
+	}
+	var lockouts []Lockout
+	if unmarshalErr := json.Unmarshal(content, &lockouts); unmarshalErr != nil {
+		slog.Error("Failed to parse lockouts", "error", unmarshalErr)
+		return
+	}
+	locked := make(map[string]bool, len(lockouts))
+	for _, lockout := range lockouts {
+		locked[lockout.Key] = true
+	}
+	for key, entry := range l.entries {
+		if !entry.lockedUntil.IsZero() && !locked[key] {
+			delete(l.entries, key)
+		}
+	}
+	for _, lockout := range lockouts {
+		entry, ok := l.entries[lockout.Key]
+		if !ok {
+			entry = &limiterEntry{}
+			l.entries[lockout.Key] = entry
+		}
+		entry.lockedUntil = lockout.Until
+	}
+}
+
+func limiterKeys(remoteAddr, username string) []string {
+	host, _, splitErr := net.SplitHostPort(remoteAddr)
+	if splitErr != nil {
+		host = remoteAddr
+	}
+	keys := []string{"ip:" + host}
+	if username != "" {
+		keys = append(keys, "user:"+username)
+	}
+	return keys
+}
+
+func pruneFailures(failures []time.Time, cutoff time.Time) []time.Time {
+	kept := failures[:0]
+	for _, failure := range failures {
+		if failure.After(cutoff) {
+			kept = append(kept, failure)
+		}
+	}
+	return kept
+}
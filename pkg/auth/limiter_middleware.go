@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// LimiterMiddleware throttles clients that fail to log in. It wraps one of the auth middlewares and
+// judges each attempt by its response: a 401 to a request that carried credentials is a failure,
+// unless the client is only asked to retry with a fresh nonce.
+func LimiterMiddleware(limiter Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			username := requestUsername(request)
+			if wait := limiter.Check(request.RemoteAddr, username); wait > 0 {
+				slog.Error("Too many failed logins", "remote_addr", request.RemoteAddr, "username", username, "retry_after", wait)
+				writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(writer, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+			recorder := &statusRecorder{ResponseWriter: writer}
+			next.ServeHTTP(recorder, request)
+			if request.Header.Get("Authorization") == "" {
+				return
+			}
+			if recorder.status != http.StatusUnauthorized {
+				limiter.Success(request.RemoteAddr, username)
+				return
+			}
+			for _, challenge := range writer.Header().Values("WWW-Authenticate") {
+				if strings.Contains(challenge, "stale=true") {
+					return
+				}
+			}
+			limiter.Failure(request.RemoteAddr, username)
+		})
+	}
+}
+
+// requestUsername returns the username a request tries to log in with, if the scheme carries one.
+func requestUsername(request *http.Request) string {
+	switch authScheme(request) {
+	case "basic":
+		username, _, _ := request.BasicAuth()
+		return username
+	case "digest":
+		params, parseErr := ParseAuthHeader(request.Header.Get("Authorization")[len("Digest"):])
+		if parseErr == nil {
+			return params["username"]
+		}
+	}
+	return ""
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(content []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(content)
+}
+
+// ReadFrom passes io.Copy on to the writer underneath, so files are still sent with sendfile.
+func (r *statusRecorder) ReadFrom(reader io.Reader) (int64, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return io.Copy(r.ResponseWriter, reader)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(t *testing.T) (*SlidingWindowLimiter, *time.Time) {
+	limiter := NewSlidingWindowLimiter(LimiterOptions{
+		Window:       time.Minute,
+		BackoffAfter: 2,
+		BaseDelay:    time.Second,
+		MaxDelay:     4 * time.Second,
+		MaxFailures:  5,
+		Lockout:      time.Hour,
+		StatePath:    filepath.Join(t.TempDir(), "lockouts.json"),
+	})
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+	return limiter, &now
+}
+
+func TestSlidingWindowLimiterBackoffAndLockout(t *testing.T) {
+	limiter, _ := newTestLimiter(t)
+	expectedWaits := []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, time.Hour}
+	for i, expected := range expectedWaits {
+		limiter.Failure("203.0.113.7:51234", "alice")
+		assert.Equal(t, expected, limiter.Check("203.0.113.7:4711", ""), "after %d failures", i+1)
+	}
+	assert.Equal(t, time.Hour, limiter.Check("198.51.100.1:1234", "alice"), "user should be locked out from other addresses")
+	assert.Equal(t, []string{"ip:203.0.113.7", "user:alice"}, lockoutKeys(limiter.Lockouts()))
+}
+
+func TestSlidingWindowLimiterWindow(t *testing.T) {
+	limiter, now := newTestLimiter(t)
+	limiter.Failure("203.0.113.7:1", "alice")
+	*now = now.Add(2 * time.Minute)
+	limiter.Failure("203.0.113.7:1", "alice")
+	assert.Equal(t, time.Duration(0), limiter.Check("203.0.113.7:1", "alice"), "failures outside of the window should not count")
+	assert.Len(t, limiter.entries["user:alice"].failures, 1)
+}
+
+func TestSlidingWindowLimiterSuccessResetsUser(t *testing.T) {
+	limiter, _ := newTestLimiter(t)
+	limiter.Failure("203.0.113.7:1", "alice")
+	limiter.Failure("203.0.113.7:1", "alice")
+	limiter.Success("198.51.100.1:1", "alice")
+	assert.Equal(t, time.Duration(0), limiter.Check("198.51.100.1:1", "alice"))
+}
+
+func TestSlidingWindowLimiterClearThroughStateFile(t *testing.T) {
+	limiter, _ := newTestLimiter(t)
+	for i := 0; i < 5; i++ {
+		limiter.Failure("203.0.113.7:1", "alice")
+	}
+	admin := NewSlidingWindowLimiter(limiter.options)
+	assert.Equal(t, []string{"ip:203.0.113.7", "user:alice"}, lockoutKeys(admin.Lockouts()))
+	assert.NoError(t, admin.Clear("user:alice"))
+
+	limiter.lastPoll = time.Time{}
+	assert.Equal(t, time.Hour, limiter.Check("203.0.113.7:1", ""))
+	assert.Equal(t, time.Duration(0), limiter.Check("198.51.100.1:1", "alice"))
+}
+
+func TestLimiterMiddleware(t *testing.T) {
+	limiter, _ := newTestLimiter(t)
+	handler := LimiterMiddleware(limiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Stale") != "" {
+			w.Header().Set("WWW-Authenticate", `Digest realm="WebDAV", stale=true`)
+		}
+		if _, password, _ := r.BasicAuth(); password != "secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	request := func(password string, stale bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "203.0.113.7:1234"
+		req.SetBasicAuth("alice", password)
+		if stale {
+			req.Header.Set("X-Stale", "1")
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request("wrong", true).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("wrong", true).Code)
+	assert.Equal(t, http.StatusOK, request("secret", false).Code, "stale nonces should not count as failures")
+	assert.Equal(t, http.StatusUnauthorized, request("wrong", false).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("wrong", false).Code)
+	rr := request("secret", false)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+}
+
+func lockoutKeys(lockouts []Lockout) []string {
+	keys := []string{}
+	for _, lockout := range lockouts {
+		keys = append(keys, lockout.Key)
+	}
+	return keys
+}
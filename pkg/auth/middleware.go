@@ -2,69 +2,265 @@ package auth
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"github.com/triargos/webdav/pkg/helper"
+	"github.com/triargos/webdav/pkg/user"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
+const realm = "WebDAV"
+
+const basicChallenge = `Basic realm="WebDAV", charset="UTF-8"`
+
 func BasicAuthMiddleware(authenticationService Service) func(http.Handler) http.Handler {
+	return authMiddleware(authenticationService, nil, true)
+}
+
+func DigestAuthMiddleware(digestAuthenticator DigestAuthenticator, authenticationService Service) func(handler http.Handler) http.Handler {
+	return authMiddleware(authenticationService, &digestAuthenticator, false)
+}
+
+// NegotiateAuthMiddleware serves basic and digest authentication at the same time. Unauthenticated
+// clients receive both challenges, strongest first, and pick the scheme they support. Whether a user
+// may use a scheme is decided by the credentials stored for them.
+func NegotiateAuthMiddleware(digestAuthenticator DigestAuthenticator, authenticationService Service) func(handler http.Handler) http.Handler {
+	return authMiddleware(authenticationService, &digestAuthenticator, true)
+}
+
+// CertificateAuthMiddleware authenticates clients by the certificates they presented in the TLS
+// handshake. Clients without the certificate of a user are authenticated by the fallback middleware,
+// or refused if there is none because certificates are required.
+func CertificateAuthMiddleware(certificateAuthenticator CertificateAuthenticator, authenticationService Service, fallback func(http.Handler) http.Handler) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
+		var passwords http.Handler
+		if fallback != nil {
+			passwords = fallback(next)
+		}
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-			username, password, ok := request.BasicAuth()
-			if !ok {
-				writer.Header().Set("WWW-Authenticate", `Basic realm="WebDAV"`)
-				slog.Error("Unauthorized access attempt: No credentials provided", "remote_addr", request.RemoteAddr)
-				http.Error(writer, "Unauthorized", http.StatusUnauthorized)
-				return
+			if request.TLS != nil && len(request.TLS.VerifiedChains) > 0 && len(request.TLS.VerifiedChains[0]) > 0 {
+				certificate := request.TLS.VerifiedChains[0][0]
+				username, authenticateErr := certificateAuthenticator.Authenticate(certificate)
+				if authenticateErr == nil {
+					authorize(writer, request, authenticationService, username, nil, next)
+					return
+				}
+				slog.Error("Unauthorized access attempt: Unknown certificate", "remote_addr", request.RemoteAddr, "subject", certificate.Subject.String())
+				ReportFailure(request, "certificate", "unknown_certificate")
+			} else if passwords == nil {
+				slog.Error("Unauthorized access attempt: No certificate provided", "remote_addr", request.RemoteAddr)
+				ReportFailure(request, "certificate", "missing_certificate")
 			}
-			if !authenticationService.Authenticate(username, password) {
-				slog.Error("Unauthorized access attempt: Invalid credentials", "remote_addr", request.RemoteAddr, "username", username)
-				http.Error(writer, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-			if !authenticationService.HasPermission(request.URL.Path, username) {
-				slog.Error("Forbidden access attempt", "remote_addr", request.RemoteAddr, "username", username, "path", request.URL.Path)
+			if passwords == nil {
 				http.Error(writer, "Forbidden", http.StatusForbidden)
 				return
 			}
-			ctx := context.WithValue(request.Context(), helper.UserNameContextKey, username)
-			next.ServeHTTP(writer, request.WithContext(ctx))
+			passwords.ServeHTTP(writer, request)
 		})
 	}
 }
 
-const realm = "WebDAV"
+// FailureObserver is told about the failed authentications of the auth middlewares. The scheme is
+// basic, digest, bearer or certificate.
+type FailureObserver func(scheme, reason string)
 
-func DigestAuthMiddleware(digestAuthenticator DigestAuthenticator, authenticationService Service) func(handler http.Handler) http.Handler {
+type failureObserverContextKey struct{}
+
+// ObserveFailures passes the failed authentications of the auth middlewares it wraps to an observer,
+// e.g. to count them.
+func ObserveFailures(observer FailureObserver) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-			authHeader := request.Header.Get("Authorization")
-			if authHeader == "" {
+			next.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), failureObserverContextKey{}, observer)))
+		})
+	}
+}
+
+// ReportFailure tells the observer of a request about a failed authentication, if there is one.
+func ReportFailure(request *http.Request, scheme, reason string) {
+	if observer, ok := request.Context().Value(failureObserverContextKey{}).(FailureObserver); ok {
+		observer(scheme, reason)
+	}
+}
+
+// authMiddleware authenticates requests with the schemes the server offers. App passwords are
+// accepted in every mode, either as bearer tokens or as the password of basic credentials.
+func authMiddleware(authenticationService Service, digestAuthenticator *DigestAuthenticator, basic bool) func(http.Handler) http.Handler {
+	challenges := func(stale bool) []string {
+		var challenges []string
+		if digestAuthenticator != nil {
+			challenges = append(challenges, digestAuthenticator.Challenges(stale)...)
+		}
+		if basic {
+			challenges = append(challenges, basicChallenge)
+		}
+		return challenges
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			scheme := authScheme(request)
+			switch {
+			case scheme == "bearer":
+				secret := strings.TrimSpace(request.Header.Get("Authorization")[len("Bearer"):])
+				username, scope, ok := authenticationService.AuthenticateToken("", secret)
+				if !ok {
+					slog.Error("Unauthorized access attempt: Invalid token", "remote_addr", request.RemoteAddr)
+					ReportFailure(request, "bearer", "invalid_token")
+					unauthorized(writer, challenges(false)...)
+					return
+				}
+				authorize(writer, request, authenticationService, username, &scope, next)
+			case scheme == "basic" && isBasicToken(request):
+				username, secret, _ := request.BasicAuth()
+				username, scope, ok := authenticationService.AuthenticateToken(username, secret)
+				if !ok && basic && authenticationService.Authenticate(username, secret) {
+					authorize(writer, request, authenticationService, username, nil, next)
+					return
+				}
+				if !ok {
+					slog.Error("Unauthorized access attempt: Invalid token", "remote_addr", request.RemoteAddr, "username", username)
+					ReportFailure(request, "basic", "invalid_token")
+					unauthorized(writer, challenges(false)...)
+					return
+				}
+				authorize(writer, request, authenticationService, username, &scope, next)
+			case scheme == "basic" && basic:
+				username, password, _ := request.BasicAuth()
+				if !authenticationService.Authenticate(username, password) {
+					slog.Error("Unauthorized access attempt: Invalid credentials", "remote_addr", request.RemoteAddr, "username", username, "scheme", "basic")
+					ReportFailure(request, "basic", "invalid_credentials")
+					unauthorized(writer, challenges(false)...)
+					return
+				}
+				authorize(writer, request, authenticationService, username, nil, next)
+			case scheme == "digest" && digestAuthenticator != nil:
+				username, authenticateErr := authenticateDigest(*digestAuthenticator, request)
+				if authenticateErr != nil {
+					unauthorized(writer, challenges(errors.Is(authenticateErr, ErrStaleNonce))...)
+					return
+				}
+				authorize(writer, request, authenticationService, username, nil, next)
+			default:
 				slog.Error("Unauthorized access attempt: No credentials provided", "remote_addr", request.RemoteAddr)
-				nonce := digestAuthenticator.GenerateNonce()
-				writer.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm="%s", qop="auth", nonce="%s", opaque="%s"`, realm, nonce, digestAuthenticator.GenerateOpaque(nonce)))
-				http.Error(writer, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-			username, ok := digestAuthenticator.Authenticate(AuthenticateDigestOptions{
-				AuthHeader: authHeader,
-				Method:     request.Method,
-				Uri:        request.URL.Path,
-			})
-			if !ok {
-				slog.Error("Unauthorized access attempt: Invalid credentials", "remote_addr", request.RemoteAddr, "username", username)
-				http.Error(writer, "Unauthorized", http.StatusUnauthorized)
-				return
+				unauthorized(writer, challenges(false)...)
 			}
-			if !authenticationService.HasPermission(request.URL.Path, username) {
-				slog.Error("Forbidden access attempt", "remote_addr", request.RemoteAddr, "username", username, "path", request.URL.Path)
-				http.Error(writer, "Forbidden", http.StatusForbidden)
-				return
-			}
-			ctx := context.WithValue(request.Context(), helper.UserNameContextKey, username)
-			next.ServeHTTP(writer, request.WithContext(ctx))
 		})
 	}
+}
+
+func authenticateDigest(digestAuthenticator DigestAuthenticator, request *http.Request) (string, error) {
+	username, authenticateErr := digestAuthenticator.Authenticate(AuthenticateDigestOptions{
+		AuthHeader: request.Header.Get("Authorization"),
+		Method:     request.Method,
+		Uri:        requestURI(request),
+	})
+	if errors.Is(authenticateErr, ErrStaleNonce) {
+		slog.Info("Stale nonce, challenging client again", "remote_addr", request.RemoteAddr, "username", username)
+	} else if authenticateErr != nil {
+		slog.Error("Unauthorized access attempt: Invalid credentials", "remote_addr", request.RemoteAddr, "username", username, "scheme", "digest", "error", authenticateErr)
+		ReportFailure(request, "digest", "invalid_credentials")
+	}
+	return username, authenticateErr
+}
+
+// authorize checks the permission of an authenticated user and passes the request on with the
+// username, and the token scope if an app password was used, stored in its context. Token scopes
+// apply to the path the client sees, access rules to the path in the content directory. Requests to
+// the state directory are served by handlers that check the access rules themselves.
+func authorize(writer http.ResponseWriter, request *http.Request, authenticationService Service, username string, scope *helper.TokenScope, next http.Handler) {
+	if !helper.IsStatePath(request.URL.Path) {
+		resolvedPath := authenticationService.ResolvePath(request.URL.Path, username)
+		if !authenticationService.HasPermission(resolvedPath, username) {
+			slog.Error("Forbidden access attempt", "remote_addr", request.RemoteAddr, "username", username, "path", request.URL.Path)
+			http.Error(writer, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if (request.Method == "LOCK" || request.Method == "UNLOCK") && !authenticationService.Authorize(resolvedPath, username, PermissionLock) {
+			slog.Error("Forbidden access attempt: Locking not allowed", "remote_addr", request.RemoteAddr, "username", username, "path", request.URL.Path)
+			http.Error(writer, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	ctx := context.WithValue(request.Context(), helper.UserNameContextKey, username)
+	if scope != nil {
+		if !scopeAllows(*scope, request, authenticationService) {
+			slog.Error("Forbidden access attempt: Outside of token scope", "remote_addr", request.RemoteAddr, "username", username, "method", request.Method, "path", request.URL.Path)
+			http.Error(writer, "Forbidden", http.StatusForbidden)
+			return
+		}
+		ctx = context.WithValue(ctx, helper.TokenScopeContextKey, *scope)
+	}
+	next.ServeHTTP(writer, request.WithContext(ctx))
+}
+
+// scopeAllows checks the method, the path and the destination of a request against a token scope.
+func scopeAllows(scope helper.TokenScope, request *http.Request, authenticationService Service) bool {
+	if scope.ReadOnly && !isReadOnlyMethod(request.Method) {
+		return false
+	}
+	if len(scope.Paths) == 0 {
+		return true
+	}
+	paths := []string{request.URL.Path}
+	if destination := request.Header.Get("Destination"); destination != "" {
+		destinationUrl, parseErr := url.Parse(destination)
+		if parseErr != nil {
+			return false
+		}
+		destinationPath, ok := helper.StripDestinationPrefix(request.Context(), destinationUrl)
+		if !ok {
+			return false
+		}
+		paths = append(paths, destinationPath)
+	}
+	for _, requestPath := range paths {
+		allowed := false
+		for _, scopePath := range scope.Paths {
+			if authenticationService.ContainsPath(scopePath, requestPath) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// requestURI returns the URI the client requested, which the digest response is computed over. It
+// still has the URL prefix the server may have stripped from the path.
+func requestURI(request *http.Request) string {
+	if request.RequestURI != "" {
+		return request.RequestURI
+	}
+	return request.URL.RequestURI()
+}
+
+func isReadOnlyMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return true
+	}
+	return false
+}
+
+func unauthorized(writer http.ResponseWriter, challenges ...string) {
+	for _, challenge := range challenges {
+		writer.Header().Add("WWW-Authenticate", challenge)
+	}
+	http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+}
+
+// authScheme returns the lower-cased scheme of the Authorization header of a request.
+func authScheme(request *http.Request) string {
+	scheme, _, _ := strings.Cut(request.Header.Get("Authorization"), " ")
+	return strings.ToLower(scheme)
+}
 
+func isBasicToken(request *http.Request) bool {
+	_, password, ok := request.BasicAuth()
+	return ok && strings.HasPrefix(password, user.TokenPrefix)
 }
@@ -7,7 +7,9 @@ import (
 	"github.com/triargos/webdav/pkg/helper"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/triargos/webdav/pkg/config"
@@ -24,6 +26,7 @@ func TestMiddleware(t *testing.T) {
 		username       string
 		password       string
 		urlPath        string
+		virtualRoots   bool
 		expectedStatus int
 	}{
 		{
@@ -76,6 +79,17 @@ func TestMiddleware(t *testing.T) {
 			urlPath:        "/home/user2",
 			expectedStatus: http.StatusForbidden,
 		},
+		{
+			name: "Jailed user in virtual root",
+			users: map[string]config.User{
+				"user1": {Password: string(hash), Jail: true, Root: "/home/user1"},
+			},
+			username:       "user1",
+			password:       password,
+			urlPath:        "/",
+			virtualRoots:   true,
+			expectedStatus: http.StatusOK,
+		},
 	}
 
 	for _, tt := range tests {
@@ -87,6 +101,7 @@ func TestMiddleware(t *testing.T) {
 			}
 			rr := httptest.NewRecorder()
 			userService := mocks.NewMockUserService(tt.users)
+			userService.VirtualRoots = tt.virtualRoots
 			authenticationService := auth.New(userService)
 			handler := auth.BasicAuthMiddleware(authenticationService)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(http.StatusOK)
@@ -105,7 +120,7 @@ func TestDigestAuthMiddleware(t *testing.T) {
 
 	mockAuthService := auth.New(mockUserService)
 
-	digestAuthenticator := auth.NewDigestAuthenticator(mockUserService)
+	digestAuthenticator := auth.NewDigestAuthenticator(mockUserService, auth.NewMemoryNonceStore(time.Minute), auth.DigestOptions{})
 	middleware := auth.DigestAuthMiddleware(digestAuthenticator, mockAuthService)
 
 	tests := []struct {
@@ -114,7 +129,7 @@ func TestDigestAuthMiddleware(t *testing.T) {
 		requestPath   string
 		expectedCode  int
 		expectedLog   string
-		expectedNonce string
+		expectedStale bool
 	}{
 		{
 			name:         "No Auth Header",
@@ -132,17 +147,24 @@ func TestDigestAuthMiddleware(t *testing.T) {
 		},
 		{
 			name:         "Valid Credentials, No Permission",
-			authHeader:   `Digest username="testuser", realm="WebDAV", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", uri="/forbidden", qop=auth, nc=00000001, cnonce="0a4f113b", response="%s", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+			authHeader:   `Digest username="testuser", realm="WebDAV", nonce="{nonce}", uri="/forbidden", qop=auth, nc=00000001, cnonce="0a4f113b", response="%s", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
 			requestPath:  "/forbidden",
 			expectedCode: http.StatusForbidden,
 			expectedLog:  "Forbidden access attempt",
 		},
 		{
 			name:         "Valid Credentials, Has Permission",
-			authHeader:   `Digest username="testuser", realm="WebDAV", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", uri="/allowed", qop=auth, nc=00000001, cnonce="0a4f113b", response="%s", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+			authHeader:   `Digest username="testuser", realm="WebDAV", nonce="{nonce}", uri="/users/testuser/mydir", qop=auth, nc=00000001, cnonce="0a4f113b", response="%s", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
 			requestPath:  "/users/testuser/mydir",
 			expectedCode: http.StatusOK,
 		},
+		{
+			name:          "Valid Credentials, Unknown Nonce",
+			authHeader:    `Digest username="testuser", realm="WebDAV", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", uri="/users/testuser/mydir", qop=auth, nc=00000001, cnonce="0a4f113b", response="%s", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+			requestPath:   "/users/testuser/mydir",
+			expectedCode:  http.StatusUnauthorized,
+			expectedStale: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -157,10 +179,11 @@ func TestDigestAuthMiddleware(t *testing.T) {
 			}
 			rr := httptest.NewRecorder()
 
-			if tt.name == "Valid Credentials, No Permission" || tt.name == "Valid Credentials, Has Permission" {
+			tt.authHeader = strings.ReplaceAll(tt.authHeader, "{nonce}", digestAuthenticator.GenerateNonce())
+			if strings.Contains(tt.authHeader, `response="%s"`) {
 				ha1 := mockUserService.GetUser("testuser").Password
 				ha2 := helper.Md5Hash(fmt.Sprintf("GET:%s", tt.requestPath))
-				params := auth.ParseAuthHeader(tt.authHeader)
+				params, _ := auth.ParseAuthHeader(strings.TrimPrefix(tt.authHeader, "Digest "))
 				expectedResponse := helper.Md5Hash(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2))
 				tt.authHeader = fmt.Sprintf(tt.authHeader, expectedResponse)
 				req.Header.Set("Authorization", tt.authHeader)
@@ -175,6 +198,102 @@ func TestDigestAuthMiddleware(t *testing.T) {
 			if status := rr.Code; status != tt.expectedCode {
 				t.Errorf("handler returned wrong status code: got %v want %v", status, tt.expectedCode)
 			}
+			challenge := rr.Header().Get("WWW-Authenticate")
+			if tt.expectedCode == http.StatusUnauthorized && !strings.HasPrefix(challenge, "Digest ") {
+				t.Errorf("expected a digest challenge, got %q", challenge)
+			}
+			if stale := strings.Contains(challenge, "stale=true"); stale != tt.expectedStale {
+				t.Errorf("expected stale=%v in challenge %q", tt.expectedStale, challenge)
+			}
+		})
+	}
+}
+
+func TestNegotiateAuthMiddleware(t *testing.T) {
+	password := "testpassword"
+	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	mockUserService := mocks.NewMockUserService(map[string]config.User{
+		"both": {
+			Password: string(hash),
+			Digest:   map[string]string{"SHA-256": helper.Sha256Hash("both:WebDAV:" + password), "MD5": helper.Md5Hash("both:WebDAV:" + password)},
+		},
+		"digestonly": {
+			Digest:    map[string]string{"MD5": helper.Md5Hash("digestonly:WebDAV:" + password)},
+			AuthTypes: []string{"digest"},
+		},
+		"basiconly": {Password: string(hash), AuthTypes: []string{"basic"}},
+	})
+	digestAuthenticator := auth.NewDigestAuthenticator(mockUserService, auth.NewMemoryNonceStore(time.Minute), auth.DigestOptions{Algorithms: []string{"MD5"}})
+	handler := auth.NegotiateAuthMiddleware(digestAuthenticator, auth.New(mockUserService))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	digestHeader := func(username string) string {
+		nonce := digestAuthenticator.GenerateNonce()
+		ha1 := helper.Md5Hash(fmt.Sprintf("%s:WebDAV:%s", username, password))
+		ha2 := helper.Md5Hash("GET:/file")
+		response := helper.Md5Hash(fmt.Sprintf("%s:%s:00000001:0a4f113b:auth:%s", ha1, nonce, ha2))
+		return fmt.Sprintf(`Digest username="%s", realm="WebDAV", nonce="%s", uri="/file", qop=auth, nc=00000001, cnonce="0a4f113b", response="%s"`, username, nonce, response)
+	}
+
+	tests := []struct {
+		name         string
+		username     string
+		scheme       string
+		expectedCode int
+	}{
+		{name: "No credentials", expectedCode: http.StatusUnauthorized},
+		{name: "Basic", username: "both", scheme: "basic", expectedCode: http.StatusOK},
+		{name: "Digest", username: "both", scheme: "digest", expectedCode: http.StatusOK},
+		{name: "Digest only user with digest", username: "digestonly", scheme: "digest", expectedCode: http.StatusOK},
+		{name: "Digest only user with basic", username: "digestonly", scheme: "basic", expectedCode: http.StatusUnauthorized},
+		{name: "Basic only user with digest", username: "basiconly", scheme: "digest", expectedCode: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/file", nil)
+			switch tt.scheme {
+			case "basic":
+				req.SetBasicAuth(tt.username, password)
+			case "digest":
+				req.Header.Set("Authorization", digestHeader(tt.username))
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, tt.expectedCode, rr.Code)
+			if tt.expectedCode == http.StatusUnauthorized {
+				challenges := rr.Header().Values("WWW-Authenticate")
+				assert.Len(t, challenges, 2)
+				assert.True(t, strings.HasPrefix(challenges[0], "Digest "))
+				assert.True(t, strings.HasPrefix(challenges[1], "Basic "))
+			}
 		})
 	}
 }
+
+func TestObserveFailures(t *testing.T) {
+	password := "password123"
+	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	authService := auth.New(mocks.NewMockUserService(map[string]config.User{"user1": {Password: string(hash), Admin: true}}))
+	var failures []string
+	observer := auth.ObserveFailures(func(scheme, reason string) {
+		failures = append(failures, scheme+" "+reason)
+	})
+	handler := observer(auth.BasicAuthMiddleware(authService)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	serve := func(username, secret string) int {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		if username != "" {
+			request.SetBasicAuth(username, secret)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve("user1", password))
+	assert.Equal(t, http.StatusUnauthorized, serve("", ""))
+	assert.Empty(t, failures, "challenging a client without credentials is no failure")
+	assert.Equal(t, http.StatusUnauthorized, serve("user1", "wrong"))
+	assert.Equal(t, []string{"basic invalid_credentials"}, failures)
+}
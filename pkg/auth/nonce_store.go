@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// DefaultNonceLifetime is used when no nonce lifetime is configured.
+const DefaultNonceLifetime = 5 * time.Minute
+
+// nonceCountWindow is the number of nonce-counts below the highest one seen that are still
+// accepted, so that clients sending parallel requests out of order are not rejected.
+const nonceCountWindow = 64
+
+// maxNonces caps the nonces kept at once. Every unauthenticated request is issued a nonce, so
+// without a cap anonymous clients could grow the store until the nonces expire. Once the store is
+// full, the oldest nonces are dropped and their clients are challenged again.
+const maxNonces = 10000
+
+type NonceStatus int
+
+const (
+	NonceValid NonceStatus = iota
+	NonceUnknown
+	NonceStale
+	NonceReplayed
+)
+
+type NonceStore interface {
+	// Issue generates a new nonce and remembers it for the configured lifetime.
+	Issue() string
+	// Use checks the nonce and records the nonce-count sent by the client.
+	Use(nonce string, nonceCount uint64) NonceStatus
+}
+
+type nonceEntry struct {
+	expires time.Time
+	highest uint64
+	// seen holds one bit per nonce-count below highest, bit 0 being highest itself
+	seen uint64
+}
+
+type MemoryNonceStore struct {
+	mutex    sync.Mutex
+	lifetime time.Duration
+	nonces   map[string]*nonceEntry
+	// issued holds the nonces in the order they were issued, which is the order they expire in
+	issued    []string
+	maxNonces int
+	now       func() time.Time
+}
+
+func NewMemoryNonceStore(lifetime time.Duration) *MemoryNonceStore {
+	if lifetime <= 0 {
+		lifetime = DefaultNonceLifetime
+	}
+	return &MemoryNonceStore{
+		lifetime:  lifetime,
+		nonces:    map[string]*nonceEntry{},
+		maxNonces: maxNonces,
+		now:       time.Now,
+	}
+}
+
+func (s *MemoryNonceStore) Issue() string {
+	buffer := make([]byte, 16)
+	if _, err := rand.Read(buffer); err != nil {
+		panic(err)
+	}
+	nonce := hex.EncodeToString(buffer)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.now()
+	s.sweep(now)
+	for len(s.nonces) >= s.maxNonces && len(s.issued) > 0 {
+		delete(s.nonces, s.issued[0])
+		s.issued = s.issued[1:]
+	}
+	s.nonces[nonce] = &nonceEntry{expires: now.Add(s.lifetime)}
+	s.issued = append(s.issued, nonce)
+	return nonce
+}
+
+func (s *MemoryNonceStore) Use(nonce string, nonceCount uint64) NonceStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.nonces[nonce]
+	if !ok {
+		return NonceUnknown
+	}
+	if !s.now().Before(entry.expires) {
+		delete(s.nonces, nonce)
+		return NonceStale
+	}
+	if nonceCount == 0 {
+		return NonceReplayed
+	}
+	if nonceCount > entry.highest {
+		shift := nonceCount - entry.highest
+		if shift >= nonceCountWindow {
+			entry.seen = 0
+		} else {
+			entry.seen <<= shift
+		}
+		entry.seen |= 1
+		entry.highest = nonceCount
+		return NonceValid
+	}
+	offset := entry.highest - nonceCount
+	if offset >= nonceCountWindow || entry.seen&(1<<offset) != 0 {
+		return NonceReplayed
+	}
+	entry.seen |= 1 << offset
+	return NonceValid
+}
+
+// sweep drops the expired nonces. They are the oldest ones, so only the start of issued is looked at.
+func (s *MemoryNonceStore) sweep(now time.Time) {
+	for len(s.issued) > 0 {
+		entry, ok := s.nonces[s.issued[0]]
+		if ok && now.Before(entry.expires) {
+			return
+		}
+		delete(s.nonces, s.issued[0])
+		s.issued = s.issued[1:]
+	}
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryNonceStore(t *testing.T) {
+	store := NewMemoryNonceStore(time.Minute)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	nonce := store.Issue()
+
+	tests := []struct {
+		name       string
+		nonce      string
+		nonceCount uint64
+		advance    time.Duration
+		expected   NonceStatus
+	}{
+		{name: "Unknown nonce", nonce: "unknown", nonceCount: 1, expected: NonceUnknown},
+		{name: "Zero nonce count", nonce: nonce, nonceCount: 0, expected: NonceReplayed},
+		{name: "First use", nonce: nonce, nonceCount: 1, expected: NonceValid},
+		{name: "Same nonce count", nonce: nonce, nonceCount: 1, expected: NonceReplayed},
+		{name: "Skipped nonce count", nonce: nonce, nonceCount: 5, expected: NonceValid},
+		{name: "Out of order nonce count", nonce: nonce, nonceCount: 3, expected: NonceValid},
+		{name: "Out of order replay", nonce: nonce, nonceCount: 3, expected: NonceReplayed},
+		{name: "Large jump", nonce: nonce, nonceCount: 500, expected: NonceValid},
+		{name: "Outside of the window", nonce: nonce, nonceCount: 6, expected: NonceReplayed},
+		{name: "Expired nonce", nonce: nonce, nonceCount: 501, advance: time.Minute, expected: NonceStale},
+		{name: "Expired nonce is forgotten", nonce: nonce, nonceCount: 502, expected: NonceUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.advance)
+			if status := store.Use(tt.nonce, tt.nonceCount); status != tt.expected {
+				t.Errorf("expected status %d, got %d", tt.expected, status)
+			}
+		})
+	}
+}
+
+func TestMemoryNonceStoreSweepsExpiredNonces(t *testing.T) {
+	store := NewMemoryNonceStore(time.Minute)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	store.Issue()
+	now = now.Add(2 * time.Minute)
+	store.Issue()
+	if len(store.nonces) != 1 {
+		t.Errorf("expected expired nonce to be swept, %d nonces left", len(store.nonces))
+	}
+}
+
+func TestMemoryNonceStoreDropsOldestNonces(t *testing.T) {
+	store := NewMemoryNonceStore(time.Minute)
+	store.maxNonces = 3
+	first := store.Issue()
+	second := store.Issue()
+	for i := 0; i < 10; i++ {
+		store.Issue()
+	}
+	if len(store.nonces) != 3 || len(store.issued) != 3 {
+		t.Errorf("expected 3 nonces to be kept, got %d", len(store.nonces))
+	}
+	if status := store.Use(first, 1); status != NonceUnknown {
+		t.Errorf("expected oldest nonce to be dropped, got status %d", status)
+	}
+	if status := store.Use(second, 1); status != NonceUnknown {
+		t.Errorf("expected oldest nonce to be dropped, got status %d", status)
+	}
+	if status := store.Use(store.issued[2], 1); status != NonceValid {
+		t.Errorf("expected newest nonce to be kept, got status %d", status)
+	}
+}
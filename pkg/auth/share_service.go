@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/user"
+)
+
+// ShareService authorizes access to a share. Users authenticate like they do for the content
+// directory, but the share has its own rules: the users and groups of the share may access all of
+// it, and a read-only share may only be read. The roots, jails and ACL of the content directory
+// don't apply to shares.
+type ShareService struct {
+	Service
+	userService          user.Service
+	share                config.Share
+	caseInsensitivePaths bool
+}
+
+// NewShareService creates the authorizer of a share, which authenticates users with the
+// authenticator of the content directory. caseInsensitivePaths must be set when the directory of the
+// share is on a case-insensitive file system.
+func NewShareService(authenticationService Service, userService user.Service, share config.Share, caseInsensitivePaths bool) Service {
+	return &ShareService{
+		Service:              authenticationService,
+		userService:          userService,
+		share:                share,
+		caseInsensitivePaths: caseInsensitivePaths,
+	}
+}
+
+// HasPermission allows the users of the share and the members of its groups, or every user if the
+// share lists neither.
+func (s *ShareService) HasPermission(_ string, username string) bool {
+	if !s.userService.HasUser(username) {
+		return false
+	}
+	if len(s.share.Users) == 0 && len(s.share.Groups) == 0 {
+		return true
+	}
+	if containsString(s.share.Users, username) {
+		return true
+	}
+	groups := s.userService.GetGroups()
+	for _, groupName := range s.share.Groups {
+		if containsString(groups[groupName].Members, username) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ShareService) Authorize(requestPath string, username string, permission Permission) bool {
+	if !s.HasPermission(requestPath, username) {
+		return false
+	}
+	return !s.share.ReadOnly || permission == PermissionRead || permission == PermissionList
+}
+
+// ResolvePath returns the path unchanged, virtual roots don't apply to shares.
+func (s *ShareService) ResolvePath(path string, _ string) string {
+	return path
+}
+
+func (s *ShareService) ContainsPath(parent, child string) bool {
+	return isSubPath(parent, child, s.caseInsensitivePaths)
+}
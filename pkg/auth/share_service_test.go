@@ -0,0 +1,51 @@
+package auth_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/mocks"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/config"
+	"testing"
+)
+
+func TestShareService(t *testing.T) {
+	userService := mocks.NewMockUserService(map[string]config.User{
+		"alice": {Root: "/Users/alice", Jail: true},
+		"bob":   {Root: "/Users/bob", Jail: true},
+		"carol": {Admin: true},
+	})
+	userService.Groups = map[string]config.Group{
+		"team": {Members: []string{"bob"}},
+	}
+	authService := auth.New(userService)
+
+	t.Run("Users and groups of the share", func(t *testing.T) {
+		share := auth.NewShareService(authService, userService, config.Share{Dir: "/srv/projects", Users: []string{"alice"}, Groups: []string{"team"}}, false)
+		assert.True(t, share.HasPermission("/plans", "alice"), "jails of the content directory don't apply")
+		assert.True(t, share.Authorize("/plans", "bob", auth.PermissionWrite))
+		assert.False(t, share.HasPermission("/plans", "carol"), "admins are not listed")
+		assert.False(t, share.HasPermission("/plans", "mallory"))
+	})
+
+	t.Run("Open share", func(t *testing.T) {
+		share := auth.NewShareService(authService, userService, config.Share{Dir: "/srv/public"}, false)
+		assert.True(t, share.HasPermission("/", "carol"))
+		assert.True(t, share.HasPermission("/", "alice"))
+		assert.Equal(t, "/Users/bob", share.ResolvePath("/Users/bob", "alice"))
+	})
+
+	t.Run("Read-only share", func(t *testing.T) {
+		share := auth.NewShareService(authService, userService, config.Share{Dir: "/srv/archive", ReadOnly: true}, false)
+		assert.True(t, share.Authorize("/2023", "alice", auth.PermissionRead))
+		assert.True(t, share.Authorize("/2023", "alice", auth.PermissionList))
+		for _, permission := range []auth.Permission{auth.PermissionWrite, auth.PermissionMkdir, auth.PermissionDelete, auth.PermissionMove, auth.PermissionLock} {
+			assert.False(t, share.Authorize("/2023", "alice", permission), permission)
+		}
+	})
+
+	t.Run("Case-insensitive share", func(t *testing.T) {
+		share := auth.NewShareService(authService, userService, config.Share{Dir: "/srv/scans"}, true)
+		assert.True(t, share.ContainsPath("/Scans", "/scans/today.pdf"))
+		assert.False(t, authService.ContainsPath("/Scans", "/scans/today.pdf"))
+	})
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/helper"
+	"github.com/triargos/webdav/pkg/user"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// AuthenticateToken verifies an app password. An empty username matches the tokens of every user,
+// which is how bearer tokens are looked up.
+func (s *BasicAuthenticator) AuthenticateToken(username, secret string) (string, helper.TokenScope, bool) {
+	if !strings.HasPrefix(secret, user.TokenPrefix) {
+		return username, helper.TokenScope{}, false
+	}
+	candidates := s.userService.GetUsers()
+	if username != "" {
+		if !s.userService.HasUser(username) {
+			return username, helper.TokenScope{}, false
+		}
+		candidates = map[string]config.User{username: s.userService.GetUser(username)}
+	}
+	hash := user.HashToken(secret)
+	for candidateName, candidate := range candidates {
+		for _, token := range candidate.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hash)) != 1 {
+				continue
+			}
+			if token.Expires != nil && !time.Now().Before(*token.Expires) {
+				slog.Error("expired token", "username", candidateName, "token", token.Name)
+				return candidateName, helper.TokenScope{}, false
+			}
+			s.userService.TouchToken(candidateName, token.Name)
+			return candidateName, helper.TokenScope{ReadOnly: token.ReadOnly, Paths: token.Paths}, true
+		}
+	}
+	return username, helper.TokenScope{}, false
+}
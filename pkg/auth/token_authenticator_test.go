@@ -0,0 +1,101 @@
+package auth_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/mocks"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/user"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthenticateToken(t *testing.T) {
+	expired := time.Now().Add(-time.Hour)
+	users := map[string]config.User{
+		"user1": {Tokens: []config.Token{
+			{Name: "laptop", Hash: user.HashToken("wdv_laptop")},
+			{Name: "old", Hash: user.HashToken("wdv_old"), Expires: &expired},
+			{Name: "backup", Hash: user.HashToken("wdv_backup"), ReadOnly: true, Paths: []string{"/Users/user1"}},
+		}},
+	}
+
+	tests := []struct {
+		name             string
+		username         string
+		secret           string
+		expectedUsername string
+		expected         bool
+	}{
+		{name: "Valid token", username: "user1", secret: "wdv_laptop", expectedUsername: "user1", expected: true},
+		{name: "Bearer token without username", secret: "wdv_backup", expectedUsername: "user1", expected: true},
+		{name: "Expired token", username: "user1", secret: "wdv_old", expectedUsername: "user1", expected: false},
+		{name: "Unknown token", username: "user1", secret: "wdv_unknown", expectedUsername: "user1", expected: false},
+		{name: "Token of another user", username: "user2", secret: "wdv_laptop", expectedUsername: "user2", expected: false},
+		{name: "Not a token", username: "user1", secret: "laptop", expectedUsername: "user1", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userService := mocks.NewMockUserService(users)
+			username, _, ok := auth.New(userService).AuthenticateToken(tt.username, tt.secret)
+			assert.Equal(t, tt.expected, ok)
+			assert.Equal(t, tt.expectedUsername, username)
+			if tt.expected {
+				assert.Equal(t, 1, userService.TouchTokenCalls)
+			}
+		})
+	}
+}
+
+func TestTokenScopeMiddleware(t *testing.T) {
+	userService := mocks.NewMockUserService(map[string]config.User{
+		"user1": {Tokens: []config.Token{
+			{Name: "laptop", Hash: user.HashToken("wdv_laptop")},
+			{Name: "backup", Hash: user.HashToken("wdv_backup"), ReadOnly: true},
+			{Name: "sync", Hash: user.HashToken("wdv_sync"), Paths: []string{"/Users/user1/sync"}},
+		}},
+	})
+	handler := auth.BasicAuthMiddleware(auth.New(userService))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		destination  string
+		bearer       string
+		basic        string
+		expectedCode int
+	}{
+		{name: "Bearer token", method: "PUT", path: "/file", bearer: "wdv_laptop", expectedCode: http.StatusOK},
+		{name: "Token as basic password", method: "PUT", path: "/file", basic: "wdv_laptop", expectedCode: http.StatusOK},
+		{name: "Invalid bearer token", method: "GET", path: "/file", bearer: "wdv_invalid", expectedCode: http.StatusUnauthorized},
+		{name: "Read-only token reading", method: "PROPFIND", path: "/file", bearer: "wdv_backup", expectedCode: http.StatusOK},
+		{name: "Read-only token writing", method: "DELETE", path: "/file", bearer: "wdv_backup", expectedCode: http.StatusForbidden},
+		{name: "Path token inside scope", method: "PUT", path: "/Users/user1/sync/file", bearer: "wdv_sync", expectedCode: http.StatusOK},
+		{name: "Path token outside scope", method: "GET", path: "/Users/user1/private", bearer: "wdv_sync", expectedCode: http.StatusForbidden},
+		{name: "Path token moving outside scope", method: "MOVE", path: "/Users/user1/sync/file", destination: "http://localhost/Users/user1/private/file", bearer: "wdv_sync", expectedCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			if tt.basic != "" {
+				req.SetBasicAuth("user1", tt.basic)
+			}
+			if tt.destination != "" {
+				req.Header.Set("Destination", tt.destination)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, tt.expectedCode, rr.Code)
+		})
+	}
+}
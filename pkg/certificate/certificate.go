@@ -0,0 +1,174 @@
+package certificate
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reloadInterval is how often the certificate files are checked for changes at most.
+const reloadInterval = 5 * time.Second
+
+// Loader provides the certificate of a TLS server.
+type Loader interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// FileLoader keeps a certificate loaded from PEM files. The files are loaded again when they change,
+// so rotated certificates are picked up without a restart. If the new files can't be loaded, e.g.
+// because only one of them was replaced yet, the previous certificate is kept.
+type FileLoader struct {
+	certFile    string
+	keyFile     string
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+	now         func() time.Time
+}
+
+// NewFileLoader loads a certificate and its key from PEM files.
+func NewFileLoader(certFile, keyFile string) (*FileLoader, error) {
+	loader := &FileLoader{certFile: certFile, keyFile: keyFile, now: time.Now}
+	if err := loader.load(); err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+func (l *FileLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	if now.Sub(l.lastCheck) >= reloadInterval {
+		l.lastCheck = now
+		if l.changed() {
+			if err := l.load(); err != nil {
+				slog.Error("Failed to reload certificate, keeping the previous one", "error", err)
+			} else {
+				slog.Info("Reloaded certificate", "cert", l.certFile)
+			}
+		}
+	}
+	return l.certificate, nil
+}
+
+func (l *FileLoader) changed() bool {
+	certInfo, certErr := os.Stat(l.certFile)
+	keyInfo, keyErr := os.Stat(l.keyFile)
+	if certErr != nil || keyErr != nil {
+		return false
+	}
+	return !certInfo.ModTime().Equal(l.certModTime) || !keyInfo.ModTime().Equal(l.keyModTime)
+}
+
+func (l *FileLoader) load() error {
+	certInfo, err := os.Stat(l.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(l.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate key: %w", err)
+	}
+	certificate, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	l.certificate = &certificate
+	l.certModTime = certInfo.ModTime()
+	l.keyModTime = keyInfo.ModTime()
+	return nil
+}
+
+// ParseVersion parses a TLS version such as 1.2. An empty version is TLS 1.2.
+func ParseVersion(version string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(version), "tls") {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %q, must be 1.2 or 1.3", version)
+	}
+}
+
+// ParseCipherSuites parses cipher suites by their names in crypto/tls, e.g.
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Insecure cipher suites are refused. No names leave the
+// choice to crypto/tls.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	suites := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range names {
+		id, ok := suites[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unsupported cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Generate creates a self-signed certificate for hosts, which may be names and IP addresses, and
+// returns it and its key PEM encoded.
+func Generate(hosts []string, validFor time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{Organization: []string{"webdav-go"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validFor),
+		// A leaf certificate, which can't be misused to sign certificates for other hosts once a
+		// client trusts it
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
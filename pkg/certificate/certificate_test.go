@@ -0,0 +1,86 @@
+package certificate
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLoader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate := func(host string, modTime time.Time) {
+		certPEM, keyPEM, err := Generate([]string{host, "192.168.1.2"}, time.Hour)
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(certFile, certPEM, 0644))
+		assert.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+		// Make sure the modification time changes on file systems with a coarse resolution
+		assert.NoError(t, os.Chtimes(certFile, modTime, modTime))
+		assert.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	}
+	servedHost := func(loader *FileLoader) string {
+		certificate, err := loader.GetCertificate(&tls.ClientHelloInfo{})
+		assert.NoError(t, err)
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		assert.NoError(t, err)
+		return leaf.DNSNames[0]
+	}
+	now := time.Now()
+	writeCertificate("nas.local", now)
+	loader, err := NewFileLoader(certFile, keyFile)
+	assert.NoError(t, err)
+	loader.now = func() time.Time { return now }
+
+	t.Run("Generated certificates", func(t *testing.T) {
+		certificate, err := loader.GetCertificate(&tls.ClientHelloInfo{})
+		assert.NoError(t, err)
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"nas.local"}, leaf.DNSNames)
+		assert.Equal(t, "192.168.1.2", leaf.IPAddresses[0].String())
+		assert.NoError(t, leaf.VerifyHostname("nas.local"))
+		assert.False(t, leaf.IsCA)
+		assert.Equal(t, x509.KeyUsageDigitalSignature, leaf.KeyUsage)
+		roots := x509.NewCertPool()
+		roots.AddCert(leaf)
+		_, err = leaf.Verify(x509.VerifyOptions{DNSName: "nas.local", Roots: roots})
+		assert.NoError(t, err, "clients can trust the certificate itself")
+	})
+
+	t.Run("Rotated certificates are reloaded", func(t *testing.T) {
+		writeCertificate("files.local", now.Add(time.Minute))
+		assert.Equal(t, "nas.local", servedHost(loader), "the files are not checked on every handshake")
+		now = now.Add(reloadInterval)
+		assert.Equal(t, "files.local", servedHost(loader))
+	})
+
+	t.Run("Broken certificates are not loaded", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(certFile, []byte("broken"), 0644))
+		assert.NoError(t, os.Chtimes(certFile, now.Add(2*time.Minute), now.Add(2*time.Minute)))
+		now = now.Add(reloadInterval)
+		assert.Equal(t, "files.local", servedHost(loader))
+		_, err := NewFileLoader(certFile, keyFile)
+		assert.Error(t, err)
+	})
+}
+
+func TestParseSettings(t *testing.T) {
+	version, err := ParseVersion("")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), version)
+	version, err = ParseVersion("1.3")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), version)
+	_, err = ParseVersion("1.0")
+	assert.Error(t, err)
+
+	suites, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, suites)
+	_, err = ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"})
+	assert.Error(t, err, "insecure cipher suites are refused")
+}
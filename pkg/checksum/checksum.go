@@ -0,0 +1,221 @@
+package checksum
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"net/http"
+	"strings"
+)
+
+// The algorithms are named like in the OC-Checksum header.
+const (
+	SHA256  = "SHA256"
+	MD5     = "MD5"
+	Adler32 = "ADLER32"
+)
+
+// Algorithms are the supported algorithms, in the order checksums are listed in.
+var Algorithms = []string{SHA256, MD5, Adler32}
+
+// DefaultAlgorithms are the algorithms of the checksums kept for uploaded files by default.
+var DefaultAlgorithms = []string{SHA256, MD5}
+
+var ErrInvalidHeader = errors.New("invalid checksum header")
+
+// Checksums are hex encoded checksums of a file, keyed by algorithm.
+type Checksums map[string]string
+
+// ParseAlgorithm returns the name of a supported algorithm, which may be given in any case and with
+// a dash, such as sha-256.
+func ParseAlgorithm(name string) (string, error) {
+	normalized := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(name), "-", ""))
+	for _, algorithm := range Algorithms {
+		if normalized == algorithm {
+			return algorithm, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported checksum algorithm %q", name)
+}
+
+// Parse parses checksums in the format of String. Unsupported algorithms are skipped.
+func Parse(value string) Checksums {
+	checksums := Checksums{}
+	for _, field := range strings.Fields(value) {
+		name, sum, ok := strings.Cut(field, ":")
+		algorithm, err := ParseAlgorithm(name)
+		if ok && err == nil && isHex(sum) {
+			checksums[algorithm] = strings.ToLower(sum)
+		}
+	}
+	return checksums
+}
+
+// String lists the checksums as space separated <algorithm>:<hex> pairs, e.g. SHA256:2cf2… MD5:5d41…
+func (c Checksums) String() string {
+	var fields []string
+	for _, algorithm := range Algorithms {
+		if sum, ok := c[algorithm]; ok {
+			fields = append(fields, algorithm+":"+sum)
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// Matches reports whether the checksums agree on every algorithm both of them have.
+func (c Checksums) Matches(other Checksums) bool {
+	for algorithm, sum := range other {
+		if own, ok := c[algorithm]; ok && own != sum {
+			return false
+		}
+	}
+	return true
+}
+
+// Hasher computes the checksums of the data written to it.
+type Hasher struct {
+	hashes map[string]hash.Hash
+}
+
+// NewHasher creates a hasher for supported algorithms.
+func NewHasher(algorithms ...string) *Hasher {
+	hashes := map[string]hash.Hash{}
+	for _, algorithm := range algorithms {
+		switch algorithm {
+		case SHA256:
+			hashes[algorithm] = sha256.New()
+		case MD5:
+			hashes[algorithm] = md5.New()
+		case Adler32:
+			hashes[algorithm] = adler32.New()
+		}
+	}
+	return &Hasher{hashes: hashes}
+}
+
+func (h *Hasher) Write(data []byte) (int, error) {
+	for _, digest := range h.hashes {
+		digest.Write(data)
+	}
+	return len(data), nil
+}
+
+// Sum returns the checksums of the data written so far.
+func (h *Hasher) Sum() Checksums {
+	checksums := Checksums{}
+	for algorithm, digest := range h.hashes {
+		checksums[algorithm] = hex.EncodeToString(digest.Sum(nil))
+	}
+	return checksums
+}
+
+// FromHeaders returns the checksums a client sent along with a file in the Digest (RFC 3230),
+// Content-MD5 and OC-Checksum headers. Unsupported algorithms are skipped. Headers that contradict
+// each other are invalid.
+func FromHeaders(header http.Header) (Checksums, error) {
+	checksums := Checksums{}
+	add := func(algorithm, sum string) error {
+		if existing, ok := checksums[algorithm]; ok && existing != sum {
+			return ErrInvalidHeader
+		}
+		checksums[algorithm] = sum
+		return nil
+	}
+	for _, digest := range header.Values("Digest") {
+		for _, instance := range strings.Split(digest, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(instance), "=")
+			if !ok {
+				return nil, ErrInvalidHeader
+			}
+			algorithm, err := ParseAlgorithm(name)
+			if err != nil {
+				continue
+			}
+			sum, err := decodeDigest(algorithm, value)
+			if err != nil {
+				return nil, ErrInvalidHeader
+			}
+			if err := add(algorithm, sum); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if value := header.Get("Content-MD5"); value != "" {
+		sum, err := decodeDigest(MD5, value)
+		if err != nil {
+			return nil, ErrInvalidHeader
+		}
+		if err := add(MD5, sum); err != nil {
+			return nil, err
+		}
+	}
+	if value := header.Get("OC-Checksum"); value != "" {
+		name, sum, ok := strings.Cut(strings.TrimSpace(value), ":")
+		if !ok || !isHex(sum) {
+			return nil, ErrInvalidHeader
+		}
+		if algorithm, err := ParseAlgorithm(name); err == nil {
+			if err := add(algorithm, strings.ToLower(sum)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return checksums, nil
+}
+
+// Digest formats checksums for the Digest header, e.g. SHA-256=LCa0a2j/…=, MD5=XUFAKrxLKna5cZ2REBfFkg==
+func Digest(checksums Checksums) string {
+	var instances []string
+	for _, algorithm := range Algorithms {
+		sum, ok := checksums[algorithm]
+		if !ok {
+			continue
+		}
+		if algorithm == Adler32 {
+			instances = append(instances, algorithm+"="+sum)
+			continue
+		}
+		decoded, err := hex.DecodeString(sum)
+		if err != nil {
+			continue
+		}
+		name := algorithm
+		if algorithm == SHA256 {
+			name = "SHA-256"
+		}
+		instances = append(instances, name+"="+base64.StdEncoding.EncodeToString(decoded))
+	}
+	return strings.Join(instances, ", ")
+}
+
+// decodeDigest decodes a digest value to hex. Adler-32 digests are hex already, the others are base64.
+func decodeDigest(algorithm, value string) (string, error) {
+	if algorithm == Adler32 {
+		if len(value) != 8 || !isHex(value) {
+			return "", ErrInvalidHeader
+		}
+		return strings.ToLower(value), nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	size := sha256.Size
+	if algorithm == MD5 {
+		size = md5.Size
+	}
+	if len(decoded) != size {
+		return "", ErrInvalidHeader
+	}
+	return hex.EncodeToString(decoded), nil
+}
+
+func isHex(value string) bool {
+	_, err := hex.DecodeString(value)
+	return value != "" && err == nil
+}
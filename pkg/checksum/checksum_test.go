@@ -0,0 +1,69 @@
+package checksum_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/pkg/checksum"
+	"net/http"
+	"testing"
+)
+
+const (
+	helloSHA256  = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	helloMD5     = "5d41402abc4b2a76b9719d911017c592"
+	helloAdler32 = "062c0215"
+)
+
+func TestChecksums(t *testing.T) {
+	hasher := checksum.NewHasher(checksum.Algorithms...)
+	hasher.Write([]byte("hel"))
+	hasher.Write([]byte("lo"))
+	sums := hasher.Sum()
+	assert.Equal(t, checksum.Checksums{checksum.SHA256: helloSHA256, checksum.MD5: helloMD5, checksum.Adler32: helloAdler32}, sums)
+	assert.Equal(t, "SHA256:"+helloSHA256+" MD5:"+helloMD5+" ADLER32:"+helloAdler32, sums.String())
+	assert.Equal(t, sums, checksum.Parse(sums.String()+" SHA1:aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"))
+	assert.Equal(t, "SHA-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=, MD5=XUFAKrxLKna5cZ2REBfFkg==, ADLER32="+helloAdler32, checksum.Digest(sums))
+
+	algorithm, err := checksum.ParseAlgorithm("sha-256")
+	assert.NoError(t, err)
+	assert.Equal(t, checksum.SHA256, algorithm)
+	_, err = checksum.ParseAlgorithm("sha1")
+	assert.Error(t, err)
+}
+
+func TestFromHeaders(t *testing.T) {
+	t.Run("Digest, Content-MD5 and OC-Checksum", func(t *testing.T) {
+		header := http.Header{}
+		header.Set("Digest", "sha-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=, SHA=qvTGHdzF6KLavt4PO0gs2a6pQ00=")
+		header.Set("Content-MD5", "XUFAKrxLKna5cZ2REBfFkg==")
+		header.Set("OC-Checksum", "ADLER32:062C0215")
+		expected, err := checksum.FromHeaders(header)
+		assert.NoError(t, err)
+		assert.Equal(t, checksum.Checksums{checksum.SHA256: helloSHA256, checksum.MD5: helloMD5, checksum.Adler32: helloAdler32}, expected)
+	})
+
+	t.Run("Unsupported algorithms are skipped", func(t *testing.T) {
+		header := http.Header{}
+		header.Set("OC-Checksum", "SHA1:aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d")
+		expected, err := checksum.FromHeaders(header)
+		assert.NoError(t, err)
+		assert.Empty(t, expected)
+	})
+
+	t.Run("Invalid headers", func(t *testing.T) {
+		for name, value := range map[string]string{
+			"Digest":      "sha-256=not base64",
+			"Content-MD5": "aGVsbG8=",
+			"OC-Checksum": "MD5",
+		} {
+			header := http.Header{}
+			header.Set(name, value)
+			_, err := checksum.FromHeaders(header)
+			assert.ErrorIs(t, err, checksum.ErrInvalidHeader, name)
+		}
+		header := http.Header{}
+		header.Set("Content-MD5", "XUFAKrxLKna5cZ2REBfFkg==")
+		header.Set("OC-Checksum", "MD5:00000000000000000000000000000000")
+		_, err := checksum.FromHeaders(header)
+		assert.ErrorIs(t, err, checksum.ErrInvalidHeader, "contradicting headers")
+	})
+}
@@ -1,32 +1,214 @@
 package config
 
+import "time"
+
 type Config struct {
 	Network  NetworkConfig   `yaml:"network"`
 	Content  ContentConfig   `yaml:"content"`
 	Users    map[string]User `yaml:"users"`
 	Security SecurityConfig  `yaml:"security"`
+	// ACL narrows down what users may do on paths, see ACLRule
+	ACL    []ACLRule        `yaml:"acl,omitempty"`
+	Groups map[string]Group `yaml:"groups,omitempty"`
+	// Shares are further directories, each served under its own prefix with its own access rules
+	Shares map[string]Share `yaml:"shares,omitempty"`
+	// Metrics serves Prometheus metrics on an address of their own
+	Metrics MetricsConfig `yaml:"metrics,omitempty"`
+}
+
+// MetricsConfig serves Prometheus metrics at /metrics on a separate address, so they don't have to be
+// exposed with the WebDAV server
+type MetricsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Address is the address the metrics are served on, 127.0.0.1:9110 by default
+	Address string `yaml:"address,omitempty"`
+	// Users may read the metrics with their credentials. Without users, the metrics are public.
+	Users []string `yaml:"users,omitempty"`
+}
+
+// Share is a directory served under a URL prefix, /<network prefix>/<name> by default. The users and
+// groups of a share may access all of it, a share without either is open to every user. The roots
+// and ACL of the content directory don't apply to shares.
+type Share struct {
+	Dir    string `yaml:"dir"`
+	Prefix string `yaml:"prefix,omitempty"`
+	// ReadOnly only allows reading and listing the share
+	ReadOnly bool     `yaml:"readonly,omitempty"`
+	Users    []string `yaml:"users,omitempty"`
+	Groups   []string `yaml:"groups,omitempty"`
+}
+
+// ACLRule allows or denies permissions (read, list, write, mkdir, delete, move, lock or all) on the
+// paths matching a glob pattern. A rule without users and groups applies to everyone.
+type ACLRule struct {
+	Path   string   `yaml:"path"`
+	Users  []string `yaml:"users,omitempty"`
+	Groups []string `yaml:"groups,omitempty"`
+	Allow  []string `yaml:"allow,omitempty"`
+	Deny   []string `yaml:"deny,omitempty"`
+}
+
+type Group struct {
+	Members []string `yaml:"members"`
+	// Root is a shared folder only the members of the group may access
+	Root           string   `yaml:"root,omitempty"`
+	SubDirectories []string `yaml:"subdirectories,omitempty"`
+	// Quota limits the size of the shared folder, e.g. 10G
+	Quota string `yaml:"quota,omitempty"`
 }
 
 type SecurityConfig struct {
 	AuthType string `yaml:"authtype"`
+	// NonceLifetime is the number of seconds a digest nonce stays valid
+	NonceLifetime int `yaml:"noncelifetime,omitempty"`
+	// DigestAlgorithms are offered to digest clients in order of preference
+	DigestAlgorithms []string `yaml:"digestalgorithms,omitempty"`
+	DigestUserhash   bool     `yaml:"digestuserhash,omitempty"`
+	// LegacyDigest treats passwords of 32 hex digits as the MD5 digest hashes older versions stored
+	// in place of the password, instead of as plain text passwords
+	LegacyDigest    bool                  `yaml:"legacydigest,omitempty"`
+	BruteForce      BruteForceConfig      `yaml:"bruteforce,omitempty"`
+	CredentialCache CredentialCacheConfig `yaml:"credentialcache,omitempty"`
+	// Symlinks is the symlink policy inside the content directory: deny, inside or follow
+	Symlinks string `yaml:"symlinks,omitempty"`
+	// ClientCerts authenticates clients with certificates, which requires TLS
+	ClientCerts ClientCertsConfig `yaml:"clientcerts,omitempty"`
+}
+
+// ClientCertsConfig authenticates clients with certificates issued by a CA. A certificate belongs to
+// the user whose certificate setting is its identity.
+type ClientCertsConfig struct {
+	// CA is a PEM file with the certificates of the CAs that issue client certificates
+	CA string `yaml:"ca,omitempty"`
+	// Mode is optional (a certificate or a password, default) or required
+	Mode string `yaml:"mode,omitempty"`
+	// Identity is what identifies a certificate: cn (the common name of its subject, default) or
+	// email (an email address in its subject alternative names)
+	Identity string `yaml:"identity,omitempty"`
+}
+
+// CredentialCacheConfig caches successful password verifications, so bcrypt does not run on every request
+type CredentialCacheConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// TTL is the number of seconds a verification is cached
+	TTL        int `yaml:"ttl,omitempty"`
+	MaxEntries int `yaml:"maxentries,omitempty"`
+}
+
+// BruteForceConfig throttles failed logins per remote address and per username. Durations are in seconds.
+type BruteForceConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Window is the period failed logins are counted in
+	Window int `yaml:"window,omitempty"`
+	// BackoffAfter is the number of failures after which clients have to wait exponentially longer
+	BackoffAfter int `yaml:"backoffafter,omitempty"`
+	// MaxFailures is the number of failures after which a client or user is locked out
+	MaxFailures int `yaml:"maxfailures,omitempty"`
+	Lockout     int `yaml:"lockout,omitempty"`
 }
 
 type NetworkConfig struct {
 	Address string `yaml:"address"`
 	Port    string `yaml:"port"`
+	// Prefix is the URL path the content directory is served under, e.g. /dav behind a reverse proxy
+	Prefix string `yaml:"prefix,omitempty"`
+	// ShutdownTimeout is the number of seconds running requests may take to finish on shutdown,
+	// 30 by default
+	ShutdownTimeout int `yaml:"shutdowntimeout,omitempty"`
+	// TLS serves HTTPS instead of HTTP if a certificate is configured
+	TLS TLSConfig `yaml:"tls,omitempty"`
+}
+
+// TLSConfig serves HTTPS with a certificate and key in PEM files, which are reloaded when they change
+type TLSConfig struct {
+	Cert string `yaml:"cert,omitempty"`
+	Key  string `yaml:"key,omitempty"`
+	// MinVersion is the lowest TLS version accepted: 1.2 (default) or 1.3
+	MinVersion string `yaml:"minversion,omitempty"`
+	// Ciphers limits the cipher suites of TLS 1.2, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	Ciphers []string `yaml:"ciphers,omitempty"`
+	// RedirectPort is a port on which HTTP requests are redirected to HTTPS
+	RedirectPort string `yaml:"redirectport,omitempty"`
 }
 
 type ContentConfig struct {
 	Dir            string   `yaml:"dir"`
 	SubDirectories []string `yaml:"subdirectories,omitempty"`
+	// VirtualRoot makes the root of every user the root of the namespace they see
+	VirtualRoot bool `yaml:"virtualroot,omitempty"`
+	// Trash moves deleted files into a recycle bin instead of removing them
+	Trash TrashConfig `yaml:"trash,omitempty"`
+	// Versions keeps earlier versions of overwritten files
+	Versions VersionsConfig `yaml:"versions,omitempty"`
+	// Properties is where the properties clients set are kept: sidecar (default) or none
+	Properties string `yaml:"properties,omitempty"`
+	// Fsync flushes uploads to disk before they replace their target
+	Fsync bool `yaml:"fsync,omitempty"`
+	// ETags is what ETags are computed from: mtime (modification time and size, default) or content
+	ETags string `yaml:"etags,omitempty"`
+	// Checksums are the algorithms of the checksums kept for uploaded files: sha256, md5 and adler32.
+	// Defaults to sha256 and md5.
+	Checksums []string `yaml:"checksums,omitempty"`
+	// Uploads serves resumable uploads with the tus protocol
+	Uploads UploadsConfig `yaml:"uploads,omitempty"`
+}
+
+// UploadsConfig serves resumable uploads, which are kept in the content directory until they are complete
+type UploadsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Expiry is the number of hours an upload is kept after it was last written to, 0 keeps it forever
+	Expiry int `yaml:"expiry,omitempty"`
+	// MaxSize limits the size of an upload, e.g. 10G
+	MaxSize string `yaml:"maxsize,omitempty"`
+}
+
+// TrashConfig keeps deleted files in a recycle bin per user, from which they can be restored
+type TrashConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Retention is the number of days deleted files are kept, 0 keeps them until the trash is emptied
+	Retention int `yaml:"retention,omitempty"`
+}
+
+// VersionsConfig keeps the content of files before they are overwritten. Every limit that is set applies.
+type VersionsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Keep is the number of versions kept per file, 0 keeps all of them
+	Keep int `yaml:"keep,omitempty"`
+	// Thin keeps fewer versions the older they get
+	Thin bool `yaml:"thin,omitempty"`
+	// MaxAge is the number of days versions are kept, 0 keeps them forever
+	MaxAge int `yaml:"maxage,omitempty"`
+	// MaxSize limits the size of the versions created by each user, e.g. 1G
+	MaxSize string `yaml:"maxsize,omitempty"`
 }
 
 type User struct {
-	Password       string   `yaml:"password"`
+	Password string `yaml:"password"`
+	// Digest maps a digest algorithm (MD5, SHA-256) to the HA1 stored for it
+	Digest map[string]string `yaml:"digest,omitempty"`
+	// AuthTypes restricts the schemes (basic, digest) a user may authenticate with
+	AuthTypes      []string `yaml:"authtypes,omitempty"`
 	Root           string   `yaml:"root,omitempty"`
 	SubDirectories []string `yaml:"subdirectories,omitempty"`
 	Jail           bool     `yaml:"jail,omitempty"`
 	Admin          bool     `yaml:"admin"`
+	// Quota limits the size of the root of the user, e.g. 10G
+	Quota string `yaml:"quota,omitempty"`
+	// Tokens are app passwords that can be used instead of the password
+	Tokens []Token `yaml:"tokens,omitempty"`
+	// Certificate is the identity of the client certificate the user may authenticate with
+	Certificate string `yaml:"certificate,omitempty"`
+}
+
+type Token struct {
+	Name string `yaml:"name"`
+	// Hash is the hex encoded SHA-256 hash of the token
+	Hash     string     `yaml:"hash"`
+	Created  time.Time  `yaml:"created"`
+	Expires  *time.Time `yaml:"expires,omitempty"`
+	ReadOnly bool       `yaml:"readonly,omitempty"`
+	// Paths limits the token to these paths and everything below them
+	Paths []string `yaml:"paths,omitempty"`
 }
 
 var configTemplate = Config{
@@ -37,9 +219,26 @@ var configTemplate = Config{
 	Content: ContentConfig{
 		Dir:            "/var/webdav/data",
 		SubDirectories: []string{"documents"},
+		Trash: TrashConfig{
+			Retention: 30,
+		},
+		Versions: VersionsConfig{
+			Keep: 10,
+		},
+		Properties: "sidecar",
+		Uploads: UploadsConfig{
+			Expiry: 24,
+		},
 	},
 	Security: SecurityConfig{
 		AuthType: "basic",
+		BruteForce: BruteForceConfig{
+			Enabled: true,
+		},
+		CredentialCache: CredentialCacheConfig{
+			Enabled: true,
+		},
+		Symlinks: "deny",
 	},
 	Users: map[string]User{},
 }
@@ -47,14 +246,43 @@ var configTemplate = Config{
 func DeepCopyConfig(original Config) Config {
 	newConfig := Config{
 		Network: NetworkConfig{
-			Address: original.Network.Address,
-			Port:    original.Network.Port,
+			Address:         original.Network.Address,
+			Port:            original.Network.Port,
+			Prefix:          original.Network.Prefix,
+			ShutdownTimeout: original.Network.ShutdownTimeout,
+			TLS: TLSConfig{
+				Cert:         original.Network.TLS.Cert,
+				Key:          original.Network.TLS.Key,
+				MinVersion:   original.Network.TLS.MinVersion,
+				Ciphers:      append([]string{}, original.Network.TLS.Ciphers...),
+				RedirectPort: original.Network.TLS.RedirectPort,
+			},
 		},
 		Security: SecurityConfig{
-			AuthType: original.Security.AuthType,
+			AuthType:         original.Security.AuthType,
+			NonceLifetime:    original.Security.NonceLifetime,
+			DigestAlgorithms: append([]string{}, original.Security.DigestAlgorithms...),
+			DigestUserhash:   original.Security.DigestUserhash,
+			BruteForce:       original.Security.BruteForce,
+			CredentialCache:  original.Security.CredentialCache,
+			Symlinks:         original.Security.Symlinks,
+			ClientCerts:      original.Security.ClientCerts,
 		},
 		Content: ContentConfig{
-			Dir: original.Content.Dir,
+			Dir:         original.Content.Dir,
+			VirtualRoot: original.Content.VirtualRoot,
+			Trash:       original.Content.Trash,
+			Versions:    original.Content.Versions,
+			Properties:  original.Content.Properties,
+			Fsync:       original.Content.Fsync,
+			ETags:       original.Content.ETags,
+			Checksums:   append([]string{}, original.Content.Checksums...),
+			Uploads:     original.Content.Uploads,
+		},
+		Metrics: MetricsConfig{
+			Enabled: original.Metrics.Enabled,
+			Address: original.Metrics.Address,
+			Users:   append([]string{}, original.Metrics.Users...),
 		},
 		Users: map[string]User{},
 	}
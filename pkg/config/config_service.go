@@ -19,11 +19,14 @@ type Service interface {
 	Reset() error
 
 	CreateConfigDirectory() error
+	// StatePath returns the path of a state file that is kept next to the configuration file
+	StatePath(name string) string
 
 	GenerateDefault(config EnvironmentConfig) Config
 	AddUser(username string, user User)
 	UpdateUser(username string, user User)
 	RemoveUser(username string)
+	UpdateGroup(name string, group Group)
 
 	readEnvironmentConfig() EnvironmentConfig
 }
@@ -112,6 +115,10 @@ func (s *ConfigService) getConfigurationPath() string {
 	return filepath.Join(defaultConfigPath, "config.yaml")
 }
 
+func (s *ConfigService) StatePath(name string) string {
+	return filepath.Join(filepath.Dir(s.getConfigurationPath()), name)
+}
+
 func (s *ConfigService) AddUser(username string, user User) {
 	currentUsers := s.Get().Users
 	currentUsers[username] = user
@@ -128,6 +135,15 @@ func (s *ConfigService) UpdateUser(username string, user User) {
 	s.AddUser(username, user)
 }
 
+func (s *ConfigService) UpdateGroup(name string, group Group) {
+	currentGroups := s.Get().Groups
+	if currentGroups == nil {
+		currentGroups = map[string]Group{}
+	}
+	currentGroups[name] = group
+	currentConfig.Groups = currentGroups
+}
+
 func (s *ConfigService) readEnvironmentConfig() EnvironmentConfig {
 	webdavPort := s.environmentService.Get("WEBDAV_PORT")
 	webdavDataDir := s.environmentService.Get("WEBDAV_DATA_DIR")
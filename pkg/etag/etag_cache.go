@@ -0,0 +1,100 @@
+package etag
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"golang.org/x/net/webdav"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxEntries is the number of hashes a cache keeps by default.
+const DefaultMaxEntries = 10000
+
+// Cache computes strong ETags from the content of files and keeps them until the files change.
+type Cache interface {
+	ETag(ctx context.Context, name string, fileInfo os.FileInfo) (string, error)
+	// Invalidate drops the ETags of a file or of a collection and everything below it. It must be
+	// called whenever a file is written, as a write may keep its size and modification time.
+	Invalidate(name string)
+}
+
+type entry struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+// HashCache hashes files with SHA-256. A hash is reused as long as the file keeps its size and
+// modification time and has not been invalidated, so changes made outside of the server are
+// noticed as well.
+type HashCache struct {
+	fileSystem webdav.FileSystem
+	maxEntries int
+	mutex      sync.Mutex
+	entries    map[string]entry
+	// generation counts the invalidations, so a hash computed while a file changed is not cached
+	generation uint64
+}
+
+// NewHashCache creates a cache for the files of a file system, which must not check permissions.
+func NewHashCache(fileSystem webdav.FileSystem, maxEntries int) Cache {
+	return &HashCache{fileSystem: fileSystem, maxEntries: maxEntries, entries: map[string]entry{}}
+}
+
+func (c *HashCache) ETag(ctx context.Context, name string, fileInfo os.FileInfo) (string, error) {
+	name = path.Clean("/" + name)
+	c.mutex.Lock()
+	cached, ok := c.entries[name]
+	generation := c.generation
+	c.mutex.Unlock()
+	if ok && cached.modTime.Equal(fileInfo.ModTime()) && cached.size == fileInfo.Size() {
+		return cached.etag, nil
+	}
+	etag, err := c.hash(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.generation == generation {
+		if len(c.entries) >= c.maxEntries {
+			for evicted := range c.entries {
+				delete(c.entries, evicted)
+				break
+			}
+		}
+		c.entries[name] = entry{modTime: fileInfo.ModTime(), size: fileInfo.Size(), etag: etag}
+	}
+	return etag, nil
+}
+
+func (c *HashCache) Invalidate(name string) {
+	name = path.Clean("/" + name)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+	for cachedName := range c.entries {
+		if cachedName == name || strings.HasPrefix(cachedName, name+"/") || name == "/" {
+			delete(c.entries, cachedName)
+		}
+	}
+}
+
+func (c *HashCache) hash(ctx context.Context, name string) (string, error) {
+	file, err := c.fileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`, nil
+}
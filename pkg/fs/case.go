@@ -0,0 +1,27 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IsCaseInsensitive probes whether the file system of a directory ignores the case of file names,
+// by creating a temporary file and looking it up with its name upper-cased.
+func IsCaseInsensitive(dir string) (bool, error) {
+	probe, err := os.CreateTemp(dir, ".case-probe-")
+	if err != nil {
+		return false, err
+	}
+	probePath := probe.Name()
+	probe.Close()
+	defer os.Remove(probePath)
+	_, statErr := os.Stat(filepath.Join(dir, strings.ToUpper(filepath.Base(probePath))))
+	if statErr == nil {
+		return true, nil
+	}
+	if os.IsNotExist(statErr) {
+		return false, nil
+	}
+	return false, statErr
+}
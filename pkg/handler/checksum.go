@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/checksum"
+	"golang.org/x/net/webdav"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// checksumsProperty holds the checksums of a file like ownCloud and Nextcloud report them.
+var checksumsProperty = xml.Name{Space: "http://owncloud.org/ns", Local: "checksums"}
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// checksumStore is implemented by file systems that keep the checksums of uploaded files.
+type checksumStore interface {
+	// ChecksumAlgorithms returns the algorithms of the checksums that are kept.
+	ChecksumAlgorithms() []string
+	Checksums(ctx context.Context, name string) (checksum.Checksums, error)
+	// SetChecksums replaces the checksums of a file, no checksums remove them.
+	SetChecksums(ctx context.Context, name string, checksums checksum.Checksums) error
+}
+
+// checksumBody computes the checksums of the body of a PUT while it is read. Once the body is read
+// completely, they are compared with the checksums the client sent. A mismatch fails the read, so
+// the upload is discarded.
+type checksumBody struct {
+	io.ReadCloser
+	hasher   *checksum.Hasher
+	expected checksum.Checksums
+	mismatch bool
+	// sums are the checksums of the complete body, if it matched
+	sums checksum.Checksums
+}
+
+func (b *checksumBody) Read(p []byte) (int, error) {
+	read, err := b.ReadCloser.Read(p)
+	b.hasher.Write(p[:read])
+	if err == io.EOF && b.sums == nil && !b.mismatch {
+		sums := b.hasher.Sum()
+		if !sums.Matches(b.expected) {
+			b.mismatch = true
+			return read, errChecksumMismatch
+		}
+		b.sums = sums
+	}
+	if b.mismatch {
+		return read, errChecksumMismatch
+	}
+	return read, err
+}
+
+// trackChecksums wraps the body of a PUT, so its checksums are computed: the ones the file system
+// keeps and the ones the client sent to be verified.
+func (h *WebDAVHandler) trackChecksums(r *http.Request) (*checksumBody, error) {
+	expected, err := checksum.FromHeaders(r.Header)
+	if err != nil {
+		return nil, err
+	}
+	var algorithms []string
+	if store, ok := h.FileSystem.(checksumStore); ok {
+		algorithms = append(algorithms, store.ChecksumAlgorithms()...)
+	}
+	for algorithm := range expected {
+		algorithms = append(algorithms, algorithm)
+	}
+	if len(algorithms) == 0 || r.Body == nil {
+		return nil, nil
+	}
+	body := &checksumBody{ReadCloser: r.Body, hasher: checksum.NewHasher(algorithms...), expected: expected}
+	r.Body = body
+	return body, nil
+}
+
+// handlePut stores the checksums of a file after webdav.Handler wrote it. A body that does not
+// match the checksums the client sent is answered with 400 Bad Request.
+func (h *WebDAVHandler) handlePut(w http.ResponseWriter, r *http.Request, body *checksumBody) {
+	if body == nil {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+	recorder := &statusResponseWriter{ResponseWriter: &checksumResponseWriter{ResponseWriter: w, body: body}}
+	h.Handler.ServeHTTP(recorder, r)
+	store, ok := h.FileSystem.(checksumStore)
+	if !ok || body.sums == nil || (recorder.status != http.StatusCreated && recorder.status != http.StatusNoContent) {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, h.Prefix)
+	kept := checksum.Checksums{}
+	for _, algorithm := range store.ChecksumAlgorithms() {
+		kept[algorithm] = body.sums[algorithm]
+	}
+	if err := store.SetChecksums(r.Context(), name, kept); err != nil {
+		slog.Error("Failed to store checksums", "path", name, "error", err)
+	}
+}
+
+// setChecksumHeaders returns the checksums of a file in the Digest and OC-Checksum headers of a
+// GET or HEAD.
+func (h *WebDAVHandler) setChecksumHeaders(w http.ResponseWriter, r *http.Request) {
+	store, ok := h.FileSystem.(checksumStore)
+	if !ok {
+		return
+	}
+	name, ok := strings.CutPrefix(r.URL.Path, h.Prefix)
+	if !ok {
+		return
+	}
+	checksums, err := store.Checksums(r.Context(), name)
+	if err != nil || len(checksums) == 0 {
+		return
+	}
+	w.Header().Set("Digest", checksum.Digest(checksums))
+	for _, algorithm := range checksum.Algorithms {
+		if sum, ok := checksums[algorithm]; ok {
+			w.Header().Set("OC-Checksum", algorithm+":"+sum)
+			break
+		}
+	}
+}
+
+// checksumResponseWriter replaces the error status of an upload that did not match its checksums
+// with 400.
+type checksumResponseWriter struct {
+	http.ResponseWriter
+	body     *checksumBody
+	replaced bool
+}
+
+func (w *checksumResponseWriter) WriteHeader(statusCode int) {
+	if statusCode >= http.StatusBadRequest && w.body.mismatch {
+		w.replaced = true
+		http.Error(w.ResponseWriter, "Checksum mismatch", http.StatusBadRequest)
+		return
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *checksumResponseWriter) Write(data []byte) (int, error) {
+	if w.replaced {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *checksumResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ChecksumAlgorithms returns the algorithms of the checksums kept for uploaded files. They are kept
+// in the property store, so none are kept without one.
+func (filesystem *WebdavFs) ChecksumAlgorithms() []string {
+	if filesystem.properties == nil {
+		return nil
+	}
+	return filesystem.checksums
+}
+
+func (filesystem *WebdavFs) Checksums(ctx context.Context, name string) (checksum.Checksums, error) {
+	if filesystem.properties == nil {
+		return nil, nil
+	}
+	if !filesystem.authorize(ctx, name, auth.PermissionRead) {
+		return nil, os.ErrPermission
+	}
+	properties, err := filesystem.properties.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	property, ok := properties[checksumsProperty]
+	if !ok {
+		return nil, nil
+	}
+	var value struct {
+		Checksum string `xml:"checksum"`
+	}
+	if err := xml.Unmarshal([]byte("<checksums>"+string(property.InnerXML)+"</checksums>"), &value); err != nil {
+		return nil, err
+	}
+	return checksum.Parse(value.Checksum), nil
+}
+
+func (filesystem *WebdavFs) SetChecksums(ctx context.Context, name string, checksums checksum.Checksums) error {
+	if filesystem.properties == nil {
+		return nil
+	}
+	if !filesystem.authorize(ctx, name, auth.PermissionWrite) {
+		return os.ErrPermission
+	}
+	return filesystem.setChecksums(ctx, name, checksums)
+}
+
+func (filesystem *WebdavFs) setChecksums(ctx context.Context, name string, checksums checksum.Checksums) error {
+	patch := webdav.Proppatch{Props: []webdav.Property{{XMLName: checksumsProperty}}}
+	if len(checksums) == 0 {
+		properties, err := filesystem.properties.Get(ctx, name)
+		if _, ok := properties[checksumsProperty]; err != nil || !ok {
+			return err
+		}
+		patch.Remove = true
+	} else {
+		var value strings.Builder
+		xml.EscapeText(&value, []byte(checksums.String()))
+		patch.Props[0].InnerXML = []byte(`<checksum xmlns="` + checksumsProperty.Space + `">` + value.String() + `</checksum>`)
+	}
+	propstats, err := filesystem.properties.Patch(ctx, name, []webdav.Proppatch{patch})
+	if err != nil {
+		return err
+	}
+	for _, propstat := range propstats {
+		if propstat.Status != http.StatusOK {
+			return fmt.Errorf("failed to patch checksums: status %d", propstat.Status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package handler_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/checksum"
+	"github.com/triargos/webdav/pkg/handler"
+	"github.com/triargos/webdav/pkg/property"
+	"golang.org/x/net/webdav"
+	"net/http"
+	"testing"
+)
+
+const (
+	helloSHA256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	helloMD5    = "5d41402abc4b2a76b9719d911017c592"
+)
+
+func TestChecksums(t *testing.T) {
+	ctx := context.Background()
+	memFs := newTestFs(t, []string{"/alice"}, nil)
+	webdavFs := handler.NewWebdavFsWithOptions(memFs, auth.New(jailedUsers("alice")), handler.FsOptions{
+		Properties: property.NewFileStore(memFs),
+		Checksums:  checksum.DefaultAlgorithms,
+	})
+	webdavHandler := handler.NewWebdavHandler(webdavFs, webdav.NewMemLS(), nil)
+
+	t.Run("Matching uploads keep their checksums", func(t *testing.T) {
+		recorder := serve(webdavHandler, "alice", http.MethodPut, "/alice/hello.txt", "hello", map[string]string{"OC-Checksum": "MD5:" + helloMD5})
+		assert.Equal(t, http.StatusCreated, recorder.Code)
+
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			recorder = serve(webdavHandler, "alice", method, "/alice/hello.txt", "", nil)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, "SHA256:"+helloSHA256, recorder.Header().Get("OC-Checksum"))
+			assert.Equal(t, "SHA-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=, MD5=XUFAKrxLKna5cZ2REBfFkg==", recorder.Header().Get("Digest"))
+		}
+
+		recorder = serve(webdavHandler, "alice", "PROPFIND", "/alice/hello.txt", "", map[string]string{"Depth": "0"})
+		assert.Contains(t, recorder.Body.String(), "SHA256:"+helloSHA256+" MD5:"+helloMD5)
+	})
+
+	t.Run("Mismatching uploads are refused", func(t *testing.T) {
+		recorder := serve(webdavHandler, "alice", http.MethodPut, "/alice/hello.txt", "hellp", map[string]string{"Content-MD5": "XUFAKrxLKna5cZ2REBfFkg=="})
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Equal(t, "hello", readFile(memFs, "/alice/hello.txt"), "the file is kept")
+		assert.Equal(t, "SHA256:"+helloSHA256, serve(webdavHandler, "alice", http.MethodHead, "/alice/hello.txt", "", nil).Header().Get("OC-Checksum"))
+
+		recorder = serve(webdavHandler, "alice", http.MethodPut, "/alice/other.txt", "hello", map[string]string{"Digest": "sha-256=not base64"})
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		_, err := memFs.Stat(ctx, "/alice/other.txt")
+		assert.Error(t, err)
+	})
+
+	t.Run("Clients can't patch checksums", func(t *testing.T) {
+		body := `<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:" xmlns:oc="http://owncloud.org/ns"><D:set><D:prop><oc:checksums><oc:checksum>MD5:00000000000000000000000000000000</oc:checksum></oc:checksums></D:prop></D:set></D:propertyupdate>`
+		recorder := serve(webdavHandler, "alice", "PROPPATCH", "/alice/hello.txt", body, nil)
+		assert.Equal(t, http.StatusMultiStatus, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "403 Forbidden")
+		assert.Equal(t, "SHA256:"+helloSHA256, serve(webdavHandler, "alice", http.MethodHead, "/alice/hello.txt", "", nil).Header().Get("OC-Checksum"))
+	})
+
+	t.Run("Copies keep their checksums", func(t *testing.T) {
+		recorder := serve(webdavHandler, "alice", "COPY", "/alice/hello.txt", "", map[string]string{"Destination": "/alice/copy.txt"})
+		assert.Equal(t, http.StatusCreated, recorder.Code)
+		assert.Equal(t, "SHA256:"+helloSHA256, serve(webdavHandler, "alice", http.MethodHead, "/alice/copy.txt", "", nil).Header().Get("OC-Checksum"))
+	})
+
+	t.Run("Writes drop outdated checksums", func(t *testing.T) {
+		recorder := serve(webdavHandler, "alice", http.MethodPut, "/alice/copy.txt", "X", map[string]string{"Content-Range": "bytes 0-0/5"})
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+		assert.Empty(t, serve(webdavHandler, "alice", http.MethodHead, "/alice/copy.txt", "", nil).Header().Get("OC-Checksum"))
+	})
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// handlePreconditions evaluates the conditional headers of a request on the resource it targets.
+// If they fail, it answers the request with 304 Not Modified or 412 Precondition Failed and
+// returns true. webdav.Handler only evaluates them for GET, so they are checked up front for the
+// other methods.
+func (h *WebDAVHandler) handlePreconditions(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("If-Match") == "" && r.Header.Get("If-None-Match") == "" &&
+		r.Header.Get("If-Modified-Since") == "" && r.Header.Get("If-Unmodified-Since") == "" {
+		return false
+	}
+	name, ok := strings.CutPrefix(r.URL.Path, h.Prefix)
+	if !ok {
+		return false
+	}
+	fileInfo, err := h.FileSystem.Stat(r.Context(), name)
+	if err != nil && !os.IsNotExist(err) {
+		// Let the handler answer requests for resources the user may not see
+		return false
+	}
+	status := h.checkPreconditions(r, name, fileInfo)
+	if status == 0 {
+		return false
+	}
+	if status == http.StatusNotModified {
+		if etag, err := findETag(r.Context(), h.FileSystem, h.LockSystem, name, fileInfo); err == nil {
+			w.Header().Set("ETag", etag)
+		}
+	}
+	w.WriteHeader(status)
+	return true
+}
+
+// checkPreconditions evaluates the If-Match, If-None-Match, If-Modified-Since and
+// If-Unmodified-Since headers of a request in the order of RFC 9110 against the current state of a
+// resource, which is nil if it does not exist. It returns 0 if the request may go ahead, and the
+// status to answer with otherwise.
+func (h *WebDAVHandler) checkPreconditions(r *http.Request, name string, fileInfo os.FileInfo) int {
+	etag := ""
+	if fileInfo != nil {
+		etag, _ = findETag(r.Context(), h.FileSystem, h.LockSystem, name, fileInfo)
+	}
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if etag == "" || !etagListMatches(ifMatch, etag, true) {
+			return http.StatusPreconditionFailed
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil && fileInfo != nil {
+		if modifiedSince(fileInfo, since) {
+			return http.StatusPreconditionFailed
+		}
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etag != "" && etagListMatches(ifNoneMatch, etag, false) {
+			if read {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && read && fileInfo != nil {
+		if !modifiedSince(fileInfo, since) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+func modifiedSince(fileInfo os.FileInfo, since time.Time) bool {
+	return fileInfo.ModTime().Truncate(time.Second).After(since)
+}
+
+// etagListMatches reports whether a list of entity tags, or *, matches an entity tag. The strong
+// comparison of If-Match never matches weak tags, the weak comparison of If-None-Match compares
+// their opaque values.
+func etagListMatches(list, etag string, strong bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		switch {
+		case candidate == "*":
+			return true
+		case strong:
+			if candidate == etag && !strings.HasPrefix(etag, "W/") {
+				return true
+			}
+		case strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/"):
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package handler_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/etag"
+	"github.com/triargos/webdav/pkg/handler"
+	"golang.org/x/net/webdav"
+	"net/http"
+	"testing"
+)
+
+func TestConditionalRequests(t *testing.T) {
+	memFs := newTestFs(t, []string{"/alice"}, nil)
+	webdavFs := handler.NewWebdavFsWithOptions(memFs, auth.New(jailedUsers("alice")), handler.FsOptions{
+		ETags: etag.NewHashCache(memFs, etag.DefaultMaxEntries),
+	})
+	webdavHandler := handler.NewWebdavHandler(webdavFs, webdav.NewMemLS(), nil)
+
+	first := serve(webdavHandler, "alice", http.MethodPut, "/alice/notes.txt", "aaaa", nil).Header().Get("ETag")
+	second := serve(webdavHandler, "alice", http.MethodPut, "/alice/notes.txt", "bbbb", nil).Header().Get("ETag")
+
+	t.Run("ETags follow the content", func(t *testing.T) {
+		assert.NotEqual(t, first, second, "writes of the same size get different ETags")
+		assert.Equal(t, first, serve(webdavHandler, "alice", http.MethodPut, "/alice/notes.txt", "aaaa", nil).Header().Get("ETag"))
+		assert.Equal(t, first, serve(webdavHandler, "alice", http.MethodGet, "/alice/notes.txt", "", nil).Header().Get("ETag"))
+		recorder := serve(webdavHandler, "alice", "PROPFIND", "/alice/notes.txt", "", map[string]string{"Depth": "0"})
+		assert.Contains(t, recorder.Body.String(), "<D:getetag>"+first+"</D:getetag>")
+	})
+
+	t.Run("Reads", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotModified, serve(webdavHandler, "alice", http.MethodGet, "/alice/notes.txt", "", map[string]string{"If-None-Match": first}).Code)
+		assert.Equal(t, http.StatusNotModified, serve(webdavHandler, "alice", http.MethodHead, "/alice/notes.txt", "", map[string]string{"If-None-Match": first}).Code)
+		assert.Equal(t, http.StatusOK, serve(webdavHandler, "alice", http.MethodGet, "/alice/notes.txt", "", map[string]string{"If-None-Match": second}).Code)
+		assert.Equal(t, http.StatusPreconditionFailed, serve(webdavHandler, "alice", http.MethodGet, "/alice/notes.txt", "", map[string]string{"If-Match": second}).Code)
+	})
+
+	t.Run("Writes", func(t *testing.T) {
+		assert.Equal(t, http.StatusPreconditionFailed, serve(webdavHandler, "alice", http.MethodPut, "/alice/notes.txt", "cccc", map[string]string{"If-Match": second}).Code)
+		assert.Equal(t, http.StatusPreconditionFailed, serve(webdavHandler, "alice", http.MethodPut, "/alice/notes.txt", "cccc", map[string]string{"If-None-Match": "*"}).Code)
+		assert.Equal(t, http.StatusCreated, serve(webdavHandler, "alice", http.MethodPut, "/alice/new.txt", "cccc", map[string]string{"If-None-Match": "*"}).Code)
+		assert.Equal(t, http.StatusPreconditionFailed, serve(webdavHandler, "alice", http.MethodDelete, "/alice/notes.txt", "", map[string]string{"If-Match": second}).Code)
+		moved := serve(webdavHandler, "alice", "MOVE", "/alice/notes.txt", "", map[string]string{"If-Match": second, "Destination": "http://example.com/alice/moved.txt"})
+		assert.Equal(t, http.StatusPreconditionFailed, moved.Code)
+		assert.Equal(t, http.StatusNoContent, serve(webdavHandler, "alice", http.MethodDelete, "/alice/notes.txt", "", map[string]string{"If-Match": first}).Code)
+	})
+}
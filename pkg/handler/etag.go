@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"context"
+	"encoding/xml"
+	"golang.org/x/net/webdav"
+	"os"
+)
+
+// withETag gives the information of a file a content based ETag, if the file system has an ETag
+// cache. webdav.Handler uses it for the ETag header and the getetag property alike.
+func (filesystem *WebdavFs) withETag(name string, fileInfo os.FileInfo) os.FileInfo {
+	if filesystem.etags == nil || fileInfo.IsDir() {
+		return fileInfo
+	}
+	return &etagFileInfo{FileInfo: fileInfo, filesystem: filesystem, name: name}
+}
+
+// withETagFile gives the information of an opened file a content based ETag. If the file is opened
+// for writing, the ETag is invalidated once it is closed.
+func (filesystem *WebdavFs) withETagFile(name string, file webdav.File, write bool) webdav.File {
+	if filesystem.etags == nil {
+		return file
+	}
+	if write {
+		filesystem.etags.Invalidate(name)
+	}
+	return &etagFile{File: file, filesystem: filesystem, name: name, write: write}
+}
+
+// invalidateETags drops the cached ETags of a file or collection that changed.
+func (filesystem *WebdavFs) invalidateETags(names ...string) {
+	if filesystem.etags == nil {
+		return
+	}
+	for _, name := range names {
+		filesystem.etags.Invalidate(name)
+	}
+}
+
+type etagFileInfo struct {
+	os.FileInfo
+	filesystem *WebdavFs
+	name       string
+}
+
+func (f *etagFileInfo) ETag(ctx context.Context) (string, error) {
+	return f.filesystem.etags.ETag(ctx, f.name, f.FileInfo)
+}
+
+type etagFile struct {
+	webdav.File
+	filesystem *WebdavFs
+	name       string
+	write      bool
+}
+
+func (f *etagFile) Stat() (os.FileInfo, error) {
+	fileInfo, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return f.filesystem.withETag(f.name, fileInfo), nil
+}
+
+func (f *etagFile) Close() error {
+	err := f.File.Close()
+	if f.write {
+		f.filesystem.etags.Invalidate(f.name)
+	}
+	return err
+}
+
+func (f *etagFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps(f.File)
+}
+
+func (f *etagFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return patchDeadProps(f.File, patches)
+}
@@ -2,60 +2,328 @@ package handler
 
 import (
 	"context"
+	"encoding/xml"
 	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/etag"
 	"github.com/triargos/webdav/pkg/helper"
+	"github.com/triargos/webdav/pkg/property"
+	"github.com/triargos/webdav/pkg/quota"
+	"github.com/triargos/webdav/pkg/trash"
+	"github.com/triargos/webdav/pkg/version"
 	"golang.org/x/net/webdav"
+	"log/slog"
 	"os"
+	"path"
 )
 
 type WebdavFs struct {
 	webdav.FileSystem
 	authService auth.Service
+	quota       quota.Service
+	trash       trash.Service
+	versions    version.Service
+	properties  property.Store
+	etags       etag.Cache
+	fsync       bool
+	checksums   []string
+}
+
+// FsOptions configure the optional features of a WebdavFs.
+type FsOptions struct {
+	// Quota enforces the quotas of users and groups
+	Quota quota.Service
+	// Trash keeps deleted files in the recycle bin of the user who deleted them
+	Trash trash.Service
+	// Versions keeps the content of files before they are overwritten
+	Versions version.Service
+	// Properties keeps the dead properties of files and collections
+	Properties property.Store
+	// ETags computes strong ETags from the content of files instead of their modification time
+	ETags etag.Cache
+	// Fsync flushes uploads to disk before they replace their target
+	Fsync bool
+	// Checksums are the algorithms of the checksums kept for uploaded files, see checksum.Algorithms
+	Checksums []string
 }
 
 func NewWebdavFs(fs webdav.FileSystem, authService auth.Service) *WebdavFs {
+	return NewWebdavFsWithOptions(fs, authService, FsOptions{})
+}
+
+func NewWebdavFsWithOptions(fs webdav.FileSystem, authService auth.Service, options FsOptions) *WebdavFs {
 	return &WebdavFs{
 		FileSystem:  fs,
 		authService: authService,
+		quota:       options.Quota,
+		trash:       options.Trash,
+		versions:    options.Versions,
+		properties:  options.Properties,
+		etags:       options.ETags,
+		fsync:       options.Fsync,
+		checksums:   options.Checksums,
 	}
 }
 
+// writeFlags are the open flags that make OpenFile a write instead of a read.
+const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_TRUNC | os.O_APPEND
+
 func (filesystem *WebdavFs) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
-	username, ok := helper.GetUsernameFromContext(ctx)
-	if !ok || !filesystem.authService.HasPermission(name, username) {
+	if flag&writeFlags != 0 {
+		if !filesystem.authorize(ctx, name, auth.PermissionWrite) {
+			return nil, os.ErrPermission
+		}
+		var file webdav.File
+		var err error
+		if filesystem.quota != nil {
+			file, err = filesystem.openQuotaFile(ctx, name, flag, perm)
+		} else {
+			file, err = filesystem.openWrite(ctx, name, flag, perm)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return filesystem.withETagFile(name, file, true), nil
+	}
+	if !filesystem.authorize(ctx, name) {
+		return nil, os.ErrPermission
+	}
+	file, err := filesystem.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	file = filesystem.withProperties(ctx, name, file)
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// Opening a collection only exposes its own properties, listing its members is checked separately
+	if fileInfo.IsDir() {
+		var dir webdav.File = &aclDir{File: file, listAllowed: filesystem.authorize(ctx, name, auth.PermissionList), hideState: path.Clean("/"+name) == "/"}
+		if filesystem.quota != nil {
+			dir = &quotaDir{File: dir, ctx: ctx, filesystem: filesystem, name: name}
+		}
+		return dir, nil
+	}
+	if !filesystem.authorize(ctx, name, auth.PermissionRead) {
+		file.Close()
 		return nil, os.ErrPermission
 	}
-	return filesystem.FileSystem.OpenFile(ctx, name, flag, perm)
+	return filesystem.withETagFile(name, file, false), nil
+}
+
+// openWrite opens a file for writing. A file that is about to be replaced is staged, see openStaged.
+func (filesystem *WebdavFs) openWrite(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	fileInfo, statErr := filesystem.FileSystem.Stat(ctx, name)
+	if flag&os.O_TRUNC != 0 {
+		if statErr == nil && !fileInfo.IsDir() {
+			return filesystem.openStaged(ctx, name, fileInfo.Mode().Perm(), true)
+		}
+		if os.IsNotExist(statErr) && flag&os.O_CREATE != 0 {
+			return filesystem.openStaged(ctx, name, perm, false)
+		}
+	}
+	// PROPPATCH opens resources for writing, which directories of the os can't be. Their properties
+	// are in the property store, so they can be patched on a directory opened for reading.
+	if filesystem.properties != nil && flag&(os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 && statErr == nil && fileInfo.IsDir() {
+		flag = os.O_RDONLY
+	}
+	file, err := filesystem.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return filesystem.withProperties(ctx, name, file), nil
+}
+
+// withProperties exposes the dead properties of a file in the property store.
+func (filesystem *WebdavFs) withProperties(ctx context.Context, name string, file webdav.File) webdav.File {
+	if filesystem.properties == nil {
+		return file
+	}
+	return &propertyFile{File: file, ctx: ctx, properties: filesystem.properties, name: name}
 }
 
 func (filesystem *WebdavFs) Stat(ctx context.Context, name string) (os.FileInfo, error) {
-	username, ok := helper.GetUsernameFromContext(ctx)
-	if !ok || !filesystem.authService.HasPermission(name, username) {
+	if !filesystem.authorize(ctx, name) {
 		return nil, os.ErrPermission
 	}
-	return filesystem.FileSystem.Stat(ctx, name)
+	fileInfo, err := filesystem.FileSystem.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return filesystem.withETag(name, fileInfo), nil
 }
 
 func (filesystem *WebdavFs) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
-	username, ok := helper.GetUsernameFromContext(ctx)
-	if !ok || !filesystem.authService.HasPermission(name, username) {
+	if !filesystem.authorize(ctx, name, auth.PermissionMkdir) {
 		return os.ErrPermission
 	}
 	return filesystem.FileSystem.Mkdir(ctx, name, perm)
 }
 
 func (filesystem *WebdavFs) RemoveAll(ctx context.Context, name string) error {
-	username, ok := helper.GetUsernameFromContext(ctx)
-	if !ok || !filesystem.authService.HasPermission(name, username) {
+	if !filesystem.authorize(ctx, name, auth.PermissionDelete) {
 		return os.ErrPermission
 	}
-	return filesystem.FileSystem.RemoveAll(ctx, name)
+	// Data moved into the trash keeps counting toward the quota until it is removed from there
+	if filesystem.quota == nil || filesystem.trash != nil {
+		return filesystem.remove(ctx, name)
+	}
+	size, _ := filesystem.quota.Size(ctx, name)
+	if err := filesystem.remove(ctx, name); err != nil {
+		return err
+	}
+	return filesystem.quota.Reserve(ctx, name, -size)
+}
+
+// remove moves a file or collection into the trash if there is one, and removes it otherwise. Its
+// dead properties go along with it into the trash, or are removed.
+func (filesystem *WebdavFs) remove(ctx context.Context, name string) error {
+	var err error
+	if filesystem.trash == nil {
+		err = filesystem.FileSystem.RemoveAll(ctx, name)
+	} else {
+		username, _ := helper.GetUsernameFromContext(ctx)
+		_, err = filesystem.trash.Move(ctx, username, name)
+	}
+	if err == nil {
+		filesystem.invalidateETags(name)
+	}
+	if err == nil && filesystem.trash == nil && filesystem.properties != nil {
+		if err := filesystem.properties.Delete(ctx, name); err != nil {
+			slog.Error("Failed to remove properties", "path", name, "error", err)
+		}
+	}
+	return err
 }
 
 func (filesystem *WebdavFs) Rename(ctx context.Context, oldName, newName string) error {
-	username, ok := helper.GetUsernameFromContext(ctx)
-	if !ok || !filesystem.authService.HasPermission(oldName, username) || !filesystem.authService.HasPermission(newName, username) {
+	if !filesystem.authorize(ctx, oldName, auth.PermissionMove) || !filesystem.authorize(ctx, newName, auth.PermissionMove) {
 		return os.ErrPermission
 	}
-	return filesystem.FileSystem.Rename(ctx, oldName, newName)
+	if filesystem.quota == nil {
+		return filesystem.rename(ctx, oldName, newName)
+	}
+	size, err := filesystem.quota.Size(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if err := filesystem.quota.ReserveMove(ctx, oldName, newName, size); err != nil {
+		return quotaError(ctx, err)
+	}
+	if err := filesystem.rename(ctx, oldName, newName); err != nil {
+		filesystem.quota.ReserveMove(ctx, newName, oldName, size)
+		return err
+	}
+	return nil
+}
+
+// rename moves a file or collection along with its dead properties.
+func (filesystem *WebdavFs) rename(ctx context.Context, oldName, newName string) error {
+	if err := filesystem.FileSystem.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	filesystem.invalidateETags(oldName, newName)
+	if filesystem.properties != nil {
+		if err := filesystem.properties.Move(ctx, oldName, newName); err != nil {
+			slog.Error("Failed to move properties", "from", oldName, "to", newName, "error", err)
+		}
+	}
+	return nil
+}
+
+// CopyProps copies the dead properties of a copied collection, which webdav.Handler does not do.
+func (filesystem *WebdavFs) CopyProps(ctx context.Context, src, dst string, recursive bool) error {
+	if filesystem.properties == nil {
+		return nil
+	}
+	if !filesystem.authorize(ctx, src, auth.PermissionRead) || !filesystem.authorize(ctx, dst, auth.PermissionWrite) {
+		return os.ErrPermission
+	}
+	return filesystem.properties.Copy(ctx, src, dst, recursive)
+}
+
+// canonicalizer is implemented by file systems that resolve symlinks, such as SafeDir.
+type canonicalizer interface {
+	Canonicalize(name string) (string, error)
+}
+
+// authorize checks the permissions of the user in the context on a path. Without permissions, only
+// the access rules of the user are checked. If the path leads through a symlink, the permissions are
+// checked on its target as well. The state directory and the temp files of uploads are never accessible.
+func (filesystem *WebdavFs) authorize(ctx context.Context, name string, permissions ...auth.Permission) bool {
+	username, ok := helper.GetUsernameFromContext(ctx)
+	if !ok {
+		return false
+	}
+	names := []string{name}
+	if c, ok := filesystem.FileSystem.(canonicalizer); ok {
+		if canonical, err := c.Canonicalize(name); err == nil && canonical != path.Clean("/"+name) {
+			names = append(names, canonical)
+		}
+	}
+	for _, checkedName := range names {
+		if helper.IsStatePath(checkedName) || helper.IsUploadPath(checkedName) {
+			return false
+		}
+		if !filesystem.authService.HasPermission(checkedName, username) {
+			return false
+		}
+		for _, permission := range permissions {
+			if !filesystem.authService.Authorize(checkedName, username, permission) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// aclDir is a collection opened for reading. Listing its members requires the list permission. The
+// listing hides the temp files of uploads, and the listing of the root the state directory.
+type aclDir struct {
+	webdav.File
+	listAllowed bool
+	hideState   bool
+}
+
+func (d *aclDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.listAllowed {
+		return nil, os.ErrPermission
+	}
+	fileInfos, err := d.File.Readdir(count)
+	visible := fileInfos[:0]
+	for _, fileInfo := range fileInfos {
+		if !helper.IsUploadPath(fileInfo.Name()) && !(d.hideState && helper.IsStatePath(fileInfo.Name())) {
+			visible = append(visible, fileInfo)
+		}
+	}
+	return visible, err
+}
+
+func (d *aclDir) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps(d.File)
+}
+
+func (d *aclDir) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return patchDeadProps(d.File, patches)
+}
+
+// propertyFile holds its dead properties in the property store. The checksums are computed by the
+// server, so clients can't patch them. Copies get them from WebdavFs.CopyProps.
+type propertyFile struct {
+	webdav.File
+	ctx        context.Context
+	properties property.Store
+	name       string
+}
+
+func (f *propertyFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return f.properties.Get(f.ctx, f.name)
+}
+
+func (f *propertyFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if propstats, refused := refuseProtected(patches, map[xml.Name]bool{checksumsProperty: true}); refused {
+		return propstats, nil
+	}
+	return f.properties.Patch(f.ctx, f.name, patches)
 }
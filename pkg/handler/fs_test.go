@@ -0,0 +1,76 @@
+package handler_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/mocks"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/handler"
+	"github.com/triargos/webdav/pkg/helper"
+	"golang.org/x/net/webdav"
+	"os"
+	"testing"
+)
+
+func TestWebdavFsPermissions(t *testing.T) {
+	ctx := context.Background()
+	memFs := webdav.NewMemFS()
+	assert.NoError(t, memFs.Mkdir(ctx, "/drop", 0755))
+	assert.NoError(t, memFs.Mkdir(ctx, "/shared", 0755))
+	for _, name := range []string{"/drop/existing.txt", "/shared/readme.txt"} {
+		file, err := memFs.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE, 0644)
+		assert.NoError(t, err)
+		file.Close()
+	}
+	userService := mocks.NewMockUserService(map[string]config.User{"alice": {}})
+	userService.ACL = []config.ACLRule{
+		{Path: "/drop/**", Deny: []string{"read", "list", "delete"}, Allow: []string{"write"}},
+		{Path: "/shared/**", Allow: []string{"read", "list"}, Deny: []string{"write", "delete", "move", "mkdir"}},
+	}
+	webdavFs := handler.NewWebdavFs(memFs, auth.New(userService))
+	userCtx := context.WithValue(ctx, helper.UserNameContextKey, "alice")
+
+	t.Run("Read-only share", func(t *testing.T) {
+		file, err := webdavFs.OpenFile(userCtx, "/shared/readme.txt", os.O_RDONLY, 0)
+		assert.NoError(t, err)
+		file.Close()
+		_, err = webdavFs.OpenFile(userCtx, "/shared/readme.txt", os.O_RDWR|os.O_TRUNC, 0)
+		assert.ErrorIs(t, err, os.ErrPermission)
+		assert.ErrorIs(t, webdavFs.Mkdir(userCtx, "/shared/new", 0755), os.ErrPermission)
+		assert.ErrorIs(t, webdavFs.Rename(userCtx, "/shared/readme.txt", "/drop/readme.txt"), os.ErrPermission)
+	})
+
+	t.Run("Write-only drop folder", func(t *testing.T) {
+		file, err := webdavFs.OpenFile(userCtx, "/drop/upload.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		assert.NoError(t, err)
+		file.Close()
+		_, err = webdavFs.OpenFile(userCtx, "/drop/existing.txt", os.O_RDONLY, 0)
+		assert.ErrorIs(t, err, os.ErrPermission)
+		dir, err := webdavFs.OpenFile(userCtx, "/drop", os.O_RDONLY, 0)
+		assert.NoError(t, err, "the collection itself can be opened for its properties")
+		_, err = dir.Readdir(0)
+		assert.ErrorIs(t, err, os.ErrPermission)
+		dir.Close()
+		assert.ErrorIs(t, webdavFs.RemoveAll(userCtx, "/drop/existing.txt"), os.ErrPermission)
+	})
+
+	t.Run("State directory is hidden in the root", func(t *testing.T) {
+		assert.NoError(t, helper.MkdirAll(ctx, memFs, helper.StatePath("trash")))
+		dir, err := webdavFs.OpenFile(userCtx, "/", os.O_RDONLY, 0)
+		assert.NoError(t, err)
+		defer dir.Close()
+		members, err := dir.Readdir(0)
+		assert.NoError(t, err)
+		names := []string{}
+		for _, member := range members {
+			names = append(names, member.Name())
+		}
+		assert.ElementsMatch(t, []string{"drop", "shared"}, names)
+	})
+
+	t.Run("No user in context", func(t *testing.T) {
+		_, err := webdavFs.OpenFile(ctx, "/shared/readme.txt", os.O_RDONLY, 0)
+		assert.ErrorIs(t, err, os.ErrPermission)
+	})
+}
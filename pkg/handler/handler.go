@@ -4,9 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/triargos/webdav/pkg/helper"
 	"golang.org/x/net/webdav"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 )
 
 type WebDAVHandler struct {
@@ -24,15 +29,138 @@ func NewWebdavHandler(fs webdav.FileSystem, ls webdav.LockSystem, logger func(*h
 }
 
 func (h *WebDAVHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodHead {
+	if prefixed, prefix := helper.RestorePrefix(r); prefix != "" {
+		// The server stripped a URL prefix, webdav.Handler needs it to write hrefs and to resolve
+		// destinations.
+		handler := *h.Handler
+		handler.Prefix = prefix + h.Prefix
+		(&WebDAVHandler{Handler: &handler}).ServeHTTP(w, prefixed)
+		return
+	}
+	if r.Method != "LOCK" {
+		// Locks webdav.Handler creates outside of LOCK requests only guard the request
+		handler := *h.Handler
+		handler.LockSystem = &temporaryLockSystem{LockSystem: h.LockSystem}
+		h = &WebDAVHandler{Handler: &handler}
+	}
+	ctx, quotaExceeded := withQuotaTracking(r.Context())
+	if r.Method == http.MethodPut && r.ContentLength > 0 {
+		ctx = withExpectedSize(ctx, r.ContentLength)
+	}
+	r = r.WithContext(ctx)
+	var checksums *checksumBody
+	if r.Method == http.MethodPut && r.Header.Get("Content-Range") == "" {
+		var err error
+		if checksums, err = h.trackChecksums(r); err != nil {
+			http.Error(w, "Invalid checksum header", http.StatusBadRequest)
+			return
+		}
+	}
+	if r.Method == http.MethodPut {
+		r = trackUpload(r)
+	}
+	w = &quotaResponseWriter{ResponseWriter: w, exceeded: quotaExceeded}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, "MOVE", "COPY":
+		if r.Header.Get("Content-Range") == "" && h.handlePreconditions(w, r) {
+			return
+		}
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		h.setChecksumHeaders(w, r)
+	}
+	switch {
+	case r.Method == http.MethodHead:
 		h.handleHead(w, r)
+	case r.Method == http.MethodPut && r.Header.Get("Content-Range") != "":
+		h.handlePartialPut(w, r)
+	case r.Method == http.MethodPut:
+		h.handlePut(w, r, checksums)
+	case r.Method == http.MethodPatch:
+		h.handlePatch(w, r)
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Accept-Patch", partialUpdateType)
+		h.Handler.ServeHTTP(w, r)
+	case r.Method == "COPY":
+		h.handleCopy(w, r)
+	default:
+		h.Handler.ServeHTTP(w, r)
+	}
+}
+
+// temporaryLocker is implemented by lock systems that keep the locks guarding a single request apart
+// from the ones taken with LOCK.
+type temporaryLocker interface {
+	CreateTemporary(now time.Time, details webdav.LockDetails) (string, error)
+}
+
+// createTemporaryLock creates a lock that is released when the request is done.
+func createTemporaryLock(ls webdav.LockSystem, now time.Time, details webdav.LockDetails) (string, error) {
+	if locker, ok := ls.(temporaryLocker); ok {
+		return locker.CreateTemporary(now, details)
+	}
+	return ls.Create(now, details)
+}
+
+// temporaryLockSystem creates temporary locks only, webdav.Handler takes them for modifying requests
+// that don't claim a lock.
+type temporaryLockSystem struct {
+	webdav.LockSystem
+}
+
+func (ls *temporaryLockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	return createTemporaryLock(ls.LockSystem, now, details)
+}
+
+// propertyCopier is implemented by file systems that keep the dead properties of collections, which
+// webdav.Handler does not copy.
+type propertyCopier interface {
+	CopyProps(ctx context.Context, src, dst string, recursive bool) error
+}
+
+func (h *WebDAVHandler) handleCopy(w http.ResponseWriter, r *http.Request) {
+	copier, ok := h.FileSystem.(propertyCopier)
+	if !ok {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+	recorder := &statusResponseWriter{ResponseWriter: w}
+	h.Handler.ServeHTTP(recorder, r)
+	if recorder.status != http.StatusCreated && recorder.status != http.StatusNoContent {
+		return
+	}
+	destination, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil {
 		return
 	}
-	h.Handler.ServeHTTP(w, r)
+	src := strings.TrimPrefix(r.URL.Path, h.Prefix)
+	dst := strings.TrimPrefix(destination.Path, h.Prefix)
+	if err := copier.CopyProps(r.Context(), src, dst, r.Header.Get("Depth") != "0"); err != nil {
+		slog.Error("Failed to copy properties", "from", src, "to", dst, "error", err)
+	}
+}
+
+// statusResponseWriter records the status of a response.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(statusCode int) {
+	w.status = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
 func (h *WebDAVHandler) handleHead(w http.ResponseWriter, r *http.Request) {
-	reqPath := r.URL.Path
+	reqPath, ok := strings.CutPrefix(r.URL.Path, h.Prefix)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
 	ctx := r.Context()
 	f, err := h.FileSystem.OpenFile(ctx, reqPath, os.O_RDONLY, 0)
 	if err != nil {
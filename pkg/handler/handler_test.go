@@ -0,0 +1,33 @@
+package handler_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/handler"
+	"github.com/triargos/webdav/pkg/lock"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestTemporaryLocks(t *testing.T) {
+	memFs := newTestFs(t, []string{"/alice"}, nil)
+	statePath := filepath.Join(t.TempDir(), "locks.json")
+	webdavHandler := handler.NewWebdavHandler(handler.NewWebdavFs(memFs, auth.New(jailedUsers("alice"))), lock.NewFileLockSystem(statePath), nil)
+
+	t.Run("Modifying requests don't persist their locks", func(t *testing.T) {
+		assert.Equal(t, http.StatusCreated, serve(webdavHandler, "alice", http.MethodPut, "/alice/notes.txt", "notes", nil).Code)
+		assert.Empty(t, lock.NewFileLockSystem(statePath).Locks())
+	})
+
+	t.Run("Locks without owner and timeout are persisted", func(t *testing.T) {
+		lockBody := `<?xml version="1.0" encoding="utf-8"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`
+		recorder := serve(webdavHandler, "alice", "LOCK", "/alice/notes.txt", lockBody, map[string]string{"Depth": "0", "Timeout": "Infinite"})
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		locks := lock.NewFileLockSystem(statePath).Locks()
+		if assert.Len(t, locks, 1) {
+			assert.Equal(t, "/alice/notes.txt", locks[0].Root)
+			assert.Equal(t, "<"+locks[0].Token+">", recorder.Header().Get("Lock-Token"))
+		}
+	})
+}
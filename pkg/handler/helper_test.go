@@ -0,0 +1,77 @@
+package handler_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/mocks"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/helper"
+	"golang.org/x/net/webdav"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// newTestFs creates an in-memory file system with collections and with files holding their content.
+// Missing parents are created.
+func newTestFs(t testing.TB, dirs []string, files map[string]string) webdav.FileSystem {
+	memFs := webdav.NewMemFS()
+	for _, dir := range dirs {
+		assert.NoError(t, helper.MkdirAll(context.Background(), memFs, dir))
+	}
+	for name, content := range files {
+		writeFile(t, memFs, name, content)
+	}
+	return memFs
+}
+
+// jailedUsers creates users that are jailed to a root named like them, e.g. /alice.
+func jailedUsers(usernames ...string) *mocks.MockUserService {
+	users := map[string]config.User{}
+	for _, username := range usernames {
+		users[username] = config.User{Root: "/" + username, Jail: true}
+	}
+	return mocks.NewMockUserService(users)
+}
+
+func writeFile(t testing.TB, fileSystem webdav.FileSystem, name, content string) {
+	ctx := context.Background()
+	assert.NoError(t, helper.MkdirAll(ctx, fileSystem, path.Dir(name)))
+	assert.NoError(t, helper.WriteFile(ctx, fileSystem, name, []byte(content)))
+}
+
+// readFile returns the content of a file, or an empty string if it can't be read.
+func readFile(fileSystem webdav.FileSystem, name string) string {
+	file, err := fileSystem.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	data, _ := io.ReadAll(file)
+	return string(data)
+}
+
+// serve sends a request to a handler as a user, like it is passed on by the auth middleware. Requests
+// without a username are sent unauthenticated.
+func serve(h http.Handler, username, method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+	return serveReader(h, username, method, target, strings.NewReader(body), headers)
+}
+
+// serveReader sends a request like serve does, with a body read from a reader, e.g. one that hides
+// its length or fails.
+func serveReader(h http.Handler, username, method, target string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, body)
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	if username != "" {
+		request = request.WithContext(context.WithValue(request.Context(), helper.UserNameContextKey, username))
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	return recorder
+}
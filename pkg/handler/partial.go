@@ -0,0 +1,297 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/webdav"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// partialUpdateType is the content type of SabreDAV partial updates.
+const partialUpdateType = "application/x-sabredav-partialupdate"
+
+var errInvalidRange = errors.New("invalid range")
+
+// versionSaver is implemented by file systems that keep versions, which have to be saved before a
+// file is changed in place.
+type versionSaver interface {
+	SaveVersion(ctx context.Context, name string) error
+}
+
+// byteRange is the part of a file a partial update writes.
+type byteRange struct {
+	start  int64
+	length int64
+	// fromEnd counts the start back from the end of the file, so a start of 0 appends
+	fromEnd bool
+	// open ranges extend as far as the body
+	open bool
+}
+
+// handlePartialPut writes the body of a PUT with a Content-Range header into an existing file,
+// instead of replacing the file.
+func (h *WebDAVHandler) handlePartialPut(w http.ResponseWriter, r *http.Request) {
+	written, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, "Invalid Content-Range", http.StatusBadRequest)
+		return
+	}
+	h.writeRange(w, r, written, true)
+}
+
+// handlePatch writes the body of a SabreDAV partial update into an existing file. The range is
+// given by the X-Update-Range header: bytes=<start>-<end>, bytes=<start>-, bytes=-<length> for the
+// last bytes of the file, or append.
+func (h *WebDAVHandler) handlePatch(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != partialUpdateType {
+		http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	written, err := parseUpdateRange(r.Header.Get("X-Update-Range"), r.ContentLength)
+	if err != nil {
+		http.Error(w, "Invalid X-Update-Range", http.StatusBadRequest)
+		return
+	}
+	h.writeRange(w, r, written, false)
+}
+
+// writeRange writes the body of a request into a range of a file through the file system, after
+// checking locks and ETag preconditions like webdav.Handler does for a PUT. The file is written in
+// place and not atomically: a request that fails halfway leaves the bytes written until then. The
+// content before the first write is saved as a version, if versions are kept.
+func (h *WebDAVHandler) writeRange(w http.ResponseWriter, r *http.Request, written byteRange, create bool) {
+	if r.ContentLength >= 0 && !written.open && r.ContentLength != written.length {
+		http.Error(w, "Content-Length does not match the range", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	name, ok := strings.CutPrefix(r.URL.Path, h.Prefix)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	release, err := confirmLock(h.LockSystem, r, name)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, webdav.ErrLocked):
+			status = webdav.StatusLocked
+		case errors.Is(err, webdav.ErrConfirmationFailed):
+			status = http.StatusPreconditionFailed
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	defer release()
+	fileInfo, statErr := h.FileSystem.Stat(ctx, name)
+	if statErr != nil && (!os.IsNotExist(statErr) || !create) {
+		writeFileError(w, r, statErr)
+		return
+	}
+	if fileInfo != nil && fileInfo.IsDir() {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if status := h.checkPreconditions(r, name, fileInfo); status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+	var size int64
+	if fileInfo != nil {
+		size = fileInfo.Size()
+	}
+	start := written.start
+	if written.fromEnd {
+		start = size - written.start
+	}
+	if start < 0 || start > size {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, "Requested Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if saver, ok := h.FileSystem.(versionSaver); ok && fileInfo != nil {
+		if err := saver.SaveVersion(ctx, name); err != nil {
+			writeFileError(w, r, err)
+			return
+		}
+	}
+	flag := os.O_RDWR
+	if fileInfo == nil {
+		flag |= os.O_CREATE
+	}
+	file, err := h.FileSystem.OpenFile(ctx, name, flag, 0644)
+	if err != nil {
+		writeFileError(w, r, err)
+		return
+	}
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		file.Close()
+		writeFileError(w, r, err)
+		return
+	}
+	body := io.Reader(r.Body)
+	if !written.open {
+		body = io.LimitReader(r.Body, written.length)
+	}
+	copied, copyErr := io.Copy(file, body)
+	closeErr := file.Close()
+	if err := errors.Join(copyErr, closeErr); err != nil {
+		writeFileError(w, r, err)
+		return
+	}
+	if !written.open && copied != written.length {
+		http.Error(w, "Body does not match the range", http.StatusBadRequest)
+		return
+	}
+	if store, ok := h.FileSystem.(checksumStore); ok {
+		if err := store.SetChecksums(ctx, name, nil); err != nil {
+			slog.Error("Failed to remove checksums", "path", name, "error", err)
+		}
+	}
+	if fileInfo, err := h.FileSystem.Stat(ctx, name); err == nil {
+		if etag, err := findETag(ctx, h.FileSystem, h.LockSystem, name, fileInfo); err == nil {
+			w.Header().Set("ETag", etag)
+		}
+	}
+	if statErr != nil {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// confirmLock checks that a request may modify a resource. Without an If header, the resource must
+// not be locked, otherwise one of the lock tokens in the header must hold a lock on it. It returns a
+// function releasing the lock, or webdav.ErrLocked or webdav.ErrConfirmationFailed.
+func confirmLock(lockSystem webdav.LockSystem, r *http.Request, name string) (func(), error) {
+	now := time.Now()
+	header := r.Header.Get("If")
+	if header == "" {
+		token, err := createTemporaryLock(lockSystem, now, webdav.LockDetails{Root: name, Duration: -1, ZeroDepth: true})
+		if err != nil {
+			return nil, err
+		}
+		return func() { lockSystem.Unlock(now, token) }, nil
+	}
+	var conditions []webdav.Condition
+	for _, token := range ifHeaderTokens(header) {
+		conditions = append(conditions, webdav.Condition{Token: token})
+	}
+	release, err := lockSystem.Confirm(now, name, "", conditions...)
+	if err != nil {
+		return nil, webdav.ErrConfirmationFailed
+	}
+	return release, nil
+}
+
+// ifHeaderTokens returns the state tokens in the conditions of an If header. Resource tags, which
+// are outside of the conditions, are skipped.
+func ifHeaderTokens(header string) []string {
+	var tokens []string
+	depth := 0
+	for i := 0; i < len(header); i++ {
+		switch header[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case '<':
+			end := strings.IndexByte(header[i:], '>')
+			if end < 0 {
+				return tokens
+			}
+			if depth > 0 {
+				tokens = append(tokens, header[i+1:i+end])
+			}
+			i += end
+		}
+	}
+	return tokens
+}
+
+// writeFileError answers with the status matching a file system error.
+func writeFileError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case os.IsNotExist(err):
+		http.NotFound(w, r)
+	case os.IsPermission(err):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// parseContentRange parses a Content-Range header of the form bytes <start>-<end>/<size or *>.
+func parseContentRange(header string) (byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return byteRange{}, errInvalidRange
+	}
+	bounds, total, ok := strings.Cut(strings.TrimSpace(spec), "/")
+	if !ok {
+		return byteRange{}, errInvalidRange
+	}
+	start, end, err := parseBounds(bounds)
+	if err != nil || end < 0 {
+		return byteRange{}, errInvalidRange
+	}
+	if total != "*" {
+		if size, err := strconv.ParseInt(total, 10, 64); err != nil || size <= end {
+			return byteRange{}, errInvalidRange
+		}
+	}
+	return byteRange{start: start, length: end - start + 1}, nil
+}
+
+// parseUpdateRange parses an X-Update-Range header. Open ranges take the length of the body.
+func parseUpdateRange(header string, contentLength int64) (byteRange, error) {
+	if header == "append" {
+		return byteRange{fromEnd: true, length: contentLength, open: contentLength < 0}, nil
+	}
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return byteRange{}, errInvalidRange
+	}
+	if suffix, ok := strings.CutPrefix(spec, "-"); ok {
+		length, err := strconv.ParseInt(suffix, 10, 64)
+		if err != nil || length <= 0 {
+			return byteRange{}, errInvalidRange
+		}
+		return byteRange{start: length, fromEnd: true, length: length}, nil
+	}
+	start, end, err := parseBounds(spec)
+	if err != nil {
+		return byteRange{}, errInvalidRange
+	}
+	if end < 0 {
+		return byteRange{start: start, length: contentLength, open: contentLength < 0}, nil
+	}
+	return byteRange{start: start, length: end - start + 1}, nil
+}
+
+// parseBounds parses <start>-<end>, where the end may be missing. A missing end is returned as -1.
+func parseBounds(bounds string) (int64, int64, error) {
+	startValue, endValue, ok := strings.Cut(bounds, "-")
+	if !ok {
+		return 0, 0, errInvalidRange
+	}
+	start, err := strconv.ParseInt(startValue, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, errInvalidRange
+	}
+	if endValue == "" {
+		return start, -1, nil
+	}
+	end, err := strconv.ParseInt(endValue, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, errInvalidRange
+	}
+	return start, end, nil
+}
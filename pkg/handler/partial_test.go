@@ -0,0 +1,118 @@
+package handler_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/mocks"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/handler"
+	"github.com/triargos/webdav/pkg/version"
+	"golang.org/x/net/webdav"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPartialUpdates(t *testing.T) {
+	memFs := newTestFs(t, []string{"/alice"}, nil)
+	lockSystem := webdav.NewMemLS()
+	webdavHandler := handler.NewWebdavHandler(handler.NewWebdavFs(memFs, auth.New(jailedUsers("alice"))), lockSystem, nil)
+	patch := func(updateRange, body string, headers map[string]string) *httptest.ResponseRecorder {
+		if headers == nil {
+			headers = map[string]string{}
+		}
+		headers["Content-Type"] = "application/x-sabredav-partialupdate"
+		headers["X-Update-Range"] = updateRange
+		return serve(webdavHandler, "alice", http.MethodPatch, "/alice/log.txt", body, headers)
+	}
+	content := func() string {
+		return readFile(memFs, "/alice/log.txt")
+	}
+
+	t.Run("Patching a missing file", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, patch("append", "line", nil).Code)
+	})
+
+	etag := serve(webdavHandler, "alice", http.MethodPut, "/alice/log.txt", "first\n", nil).Header().Get("ETag")
+
+	t.Run("Append", func(t *testing.T) {
+		recorder := patch("append", "second\n", map[string]string{"If-Match": etag})
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+		assert.Equal(t, "first\nsecond\n", content())
+		etag = recorder.Header().Get("ETag")
+	})
+
+	t.Run("Byte ranges", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, patch("bytes=0-4", "FIRST", nil).Code)
+		assert.Equal(t, http.StatusNoContent, patch("bytes=-7", "SECOND\n", nil).Code)
+		assert.Equal(t, "FIRST\nSECOND\n", content())
+		recorder := serve(webdavHandler, "alice", http.MethodPut, "/alice/log.txt", "THIRD\n", map[string]string{"Content-Range": "bytes 13-18/*"})
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+		assert.Equal(t, "FIRST\nSECOND\nTHIRD\n", content())
+	})
+
+	t.Run("Ranges beyond the end are refused", func(t *testing.T) {
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, patch("bytes=100-101", "xx", nil).Code)
+		assert.Equal(t, http.StatusBadRequest, patch("bytes=0-9", "short", nil).Code)
+	})
+
+	t.Run("Stale ETags are refused", func(t *testing.T) {
+		assert.Equal(t, http.StatusPreconditionFailed, patch("append", "stale\n", map[string]string{"If-Match": etag}).Code)
+		assert.Equal(t, "FIRST\nSECOND\nTHIRD\n", content())
+	})
+
+	t.Run("Locked files require the lock token", func(t *testing.T) {
+		token, err := lockSystem.Create(time.Now(), webdav.LockDetails{Root: "/alice/log.txt", Duration: time.Hour, ZeroDepth: true})
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusLocked, patch("append", "x", nil).Code)
+		assert.Equal(t, http.StatusNoContent, patch("append", "x", map[string]string{"If": "(<" + token + ">)"}).Code)
+	})
+}
+
+func TestPartialUpdateVersions(t *testing.T) {
+	memFs := newTestFs(t, nil, map[string]string{"/alice/log.txt": "first\n"})
+	versionService := version.NewVersionService(memFs, version.Retention{})
+	webdavFs := handler.NewWebdavFsWithOptions(memFs, auth.New(jailedUsers("alice")), handler.FsOptions{Versions: versionService})
+	webdavHandler := handler.NewWebdavHandler(webdavFs, webdav.NewMemLS(), nil)
+
+	recorder := serve(webdavHandler, "alice", http.MethodPatch, "/alice/log.txt", "second\n", map[string]string{
+		"Content-Type":   "application/x-sabredav-partialupdate",
+		"X-Update-Range": "append",
+	})
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, "first\nsecond\n", readFile(memFs, "/alice/log.txt"))
+	versions, err := versionService.List(context.Background(), "/alice/log.txt")
+	assert.NoError(t, err)
+	if assert.Len(t, versions, 1) {
+		assert.Equal(t, "alice", versions[0].Username)
+		file, err := versionService.Open(context.Background(), "/alice/log.txt", versions[0].ID)
+		assert.NoError(t, err)
+		defer file.Close()
+		content, _ := io.ReadAll(file)
+		assert.Equal(t, "first\n", string(content), "the content before the update is kept")
+	}
+}
+
+func TestPartialUpdateVersionsVirtualRoot(t *testing.T) {
+	memFs := newTestFs(t, nil, map[string]string{"/Users/alice/log.txt": "first\n"})
+	userService := mocks.NewMockUserService(map[string]config.User{
+		"alice": {Root: "/Users/alice", Jail: true},
+	})
+	userService.VirtualRoots = true
+	versionService := version.NewVersionService(memFs, version.Retention{})
+	webdavFs := handler.NewWebdavFsWithOptions(memFs, auth.New(userService), handler.FsOptions{Versions: versionService})
+	virtualRootHandler := handler.NewVirtualRootHandler(webdavFs, webdav.NewMemLS(), userService, nil)
+
+	recorder := serve(virtualRootHandler, "alice", http.MethodPatch, "/log.txt", "second\n", map[string]string{
+		"Content-Type":   "application/x-sabredav-partialupdate",
+		"X-Update-Range": "append",
+	})
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, "first\nsecond\n", readFile(memFs, "/Users/alice/log.txt"))
+	versions, err := versionService.List(context.Background(), "/Users/alice/log.txt")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1, "the version is saved under the path in the content directory")
+}
@@ -0,0 +1,52 @@
+package handler_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/mocks"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/handler"
+	"github.com/triargos/webdav/pkg/helper"
+	"golang.org/x/net/webdav"
+	"net/http"
+	"testing"
+)
+
+func TestPrefix(t *testing.T) {
+	ctx := context.Background()
+	memFs := newTestFs(t, nil, map[string]string{"/docs/notes.txt": "notes"})
+	userService := mocks.NewMockUserService(map[string]config.User{"alice": {Admin: true}})
+	webdavHandler := handler.NewWebdavHandler(handler.NewWebdavFs(memFs, auth.New(userService)), webdav.NewMemLS(), nil)
+	prefixed := helper.StripPrefix("/dav", webdavHandler)
+
+	t.Run("Hrefs carry the prefix", func(t *testing.T) {
+		recorder := serve(prefixed, "alice", "PROPFIND", "/dav/docs", "", map[string]string{"Depth": "1"})
+		assert.Equal(t, http.StatusMultiStatus, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "<D:href>/dav/docs/notes.txt</D:href>")
+	})
+
+	t.Run("Files are served below the prefix only", func(t *testing.T) {
+		recorder := serve(prefixed, "alice", http.MethodGet, "/dav/docs/notes.txt", "", nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "notes", recorder.Body.String())
+		assert.Equal(t, http.StatusOK, serve(prefixed, "alice", http.MethodHead, "/dav/docs/notes.txt", "", nil).Code)
+		assert.Equal(t, http.StatusNotFound, serve(prefixed, "alice", http.MethodGet, "/docs/notes.txt", "", nil).Code)
+		assert.Equal(t, http.StatusNotFound, serve(prefixed, "alice", http.MethodGet, "/davdocs/notes.txt", "", nil).Code)
+	})
+
+	t.Run("Destinations are resolved below the prefix", func(t *testing.T) {
+		recorder := serve(prefixed, "alice", "COPY", "/dav/docs/notes.txt", "", map[string]string{"Destination": "http://example.com/dav/docs/copy.txt"})
+		assert.Equal(t, http.StatusCreated, recorder.Code)
+		_, err := memFs.Stat(ctx, "/docs/copy.txt")
+		assert.NoError(t, err)
+		recorder = serve(prefixed, "alice", "MOVE", "/dav/docs/copy.txt", "", map[string]string{"Destination": "http://example.com/elsewhere/copy.txt"})
+		assert.True(t, recorder.Code >= http.StatusBadRequest, "destinations outside of the prefix are refused")
+	})
+
+	t.Run("Root of the prefix", func(t *testing.T) {
+		recorder := serve(prefixed, "alice", "PROPFIND", "/dav", "", map[string]string{"Depth": "0"})
+		assert.Equal(t, http.StatusMultiStatus, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "<D:href>/dav/</D:href>")
+	})
+}
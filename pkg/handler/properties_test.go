@@ -0,0 +1,71 @@
+package handler_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/handler"
+	"github.com/triargos/webdav/pkg/property"
+	"golang.org/x/net/webdav"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeadProperties(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "alice", "docs"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "alice", "docs", "notes.txt"), []byte("notes"), 0644))
+	fileSystem := webdav.Dir(dir)
+	webdavFs := handler.NewWebdavFsWithOptions(fileSystem, auth.New(jailedUsers("alice")), handler.FsOptions{
+		Properties: property.NewFileStore(fileSystem),
+	})
+	webdavHandler := handler.NewWebdavHandler(webdavFs, webdav.NewMemLS(), nil)
+	proppatch := func(target, value string) int {
+		body := `<?xml version="1.0" encoding="utf-8"?><D:propertyupdate xmlns:D="DAV:" xmlns:T="urn:tags"><D:set><D:prop><T:color>` + value + `</T:color></D:prop></D:set></D:propertyupdate>`
+		recorder := serve(webdavHandler, "alice", "PROPPATCH", target, body, nil)
+		assert.Equal(t, http.StatusMultiStatus, recorder.Code)
+		if strings.Contains(recorder.Body.String(), "200 OK") {
+			return http.StatusOK
+		}
+		return http.StatusForbidden
+	}
+	color := func(target string) string {
+		body := `<?xml version="1.0" encoding="utf-8"?><D:propfind xmlns:D="DAV:"><D:prop><T:color xmlns:T="urn:tags"/></D:prop></D:propfind>`
+		recorder := serve(webdavHandler, "alice", "PROPFIND", target, body, map[string]string{"Depth": "0"})
+		if recorder.Code != http.StatusMultiStatus || !strings.Contains(recorder.Body.String(), "200 OK") {
+			return ""
+		}
+		value := recorder.Body.String()
+		value = value[strings.Index(value, "urn:tags\">")+len("urn:tags\">"):]
+		return value[:strings.Index(value, "<")]
+	}
+
+	t.Run("Patch files and collections", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, proppatch("/alice/docs/notes.txt", "red"))
+		assert.Equal(t, http.StatusOK, proppatch("/alice/docs", "blue"))
+		assert.Equal(t, "red", color("/alice/docs/notes.txt"))
+		assert.Equal(t, "blue", color("/alice/docs"))
+	})
+
+	t.Run("Properties move with their resources", func(t *testing.T) {
+		recorder := serve(webdavHandler, "alice", "MOVE", "/alice/docs", "", map[string]string{"Destination": "http://example.com/alice/moved"})
+		assert.Equal(t, http.StatusCreated, recorder.Code)
+		assert.Equal(t, "blue", color("/alice/moved"))
+		assert.Equal(t, "red", color("/alice/moved/notes.txt"))
+	})
+
+	t.Run("Properties are copied with their resources", func(t *testing.T) {
+		recorder := serve(webdavHandler, "alice", "COPY", "/alice/moved", "", map[string]string{"Destination": "http://example.com/alice/copied"})
+		assert.Equal(t, http.StatusCreated, recorder.Code)
+		assert.Equal(t, "blue", color("/alice/copied"))
+		assert.Equal(t, "red", color("/alice/copied/notes.txt"))
+	})
+
+	t.Run("Properties are deleted with their resources", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, serve(webdavHandler, "alice", http.MethodDelete, "/alice/copied", "", nil).Code)
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, "alice", "copied"), 0755))
+		assert.Equal(t, "", color("/alice/copied"))
+	})
+}
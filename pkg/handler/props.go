@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"encoding/xml"
+	"golang.org/x/net/webdav"
+	"net/http"
+)
+
+// Wrappers of webdav.File hide whether the wrapped file holds dead properties, so they forward
+// DeadProps and Patch with these helpers.
+
+func deadProps(file webdav.File) (map[xml.Name]webdav.Property, error) {
+	holder, ok := file.(webdav.DeadPropsHolder)
+	if !ok {
+		return nil, nil
+	}
+	return holder.DeadProps()
+}
+
+// patchDeadProps patches the dead properties of a file. Files without dead properties refuse every
+// patch, like webdav.Handler does for them.
+func patchDeadProps(file webdav.File, patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if holder, ok := file.(webdav.DeadPropsHolder); ok {
+		return holder.Patch(patches)
+	}
+	return []webdav.Propstat{patchStatus(patches, http.StatusForbidden)}, nil
+}
+
+// patchStatus answers every property of a patch with the same status.
+func patchStatus(patches []webdav.Proppatch, status int) webdav.Propstat {
+	propstat := webdav.Propstat{Status: status}
+	for _, patch := range patches {
+		for _, property := range patch.Props {
+			propstat.Props = append(propstat.Props, webdav.Property{XMLName: property.XMLName})
+		}
+	}
+	return propstat
+}
+
+// protectProps refuses patches of protected properties. As PROPPATCH is atomic, the other
+// properties of the request fail with 424 Failed Dependency.
+func protectProps(file webdav.File, patches []webdav.Proppatch, protected map[xml.Name]bool) ([]webdav.Propstat, error) {
+	if propstats, refused := refuseProtected(patches, protected); refused {
+		return propstats, nil
+	}
+	return patchDeadProps(file, patches)
+}
+
+// refuseProtected answers a patch of protected properties, if it touches any.
+func refuseProtected(patches []webdav.Proppatch, protected map[xml.Name]bool) ([]webdav.Propstat, bool) {
+	var refused, dependent []webdav.Proppatch
+	for _, patch := range patches {
+		for _, property := range patch.Props {
+			single := webdav.Proppatch{Remove: patch.Remove, Props: []webdav.Property{property}}
+			if protected[property.XMLName] {
+				refused = append(refused, single)
+			} else {
+				dependent = append(dependent, single)
+			}
+		}
+	}
+	if len(refused) == 0 {
+		return nil, false
+	}
+	propstats := []webdav.Propstat{patchStatus(refused, http.StatusForbidden)}
+	if len(dependent) > 0 {
+		propstats = append(propstats, patchStatus(dependent, http.StatusFailedDependency))
+	}
+	return propstats, true
+}
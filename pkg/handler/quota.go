@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"github.com/triargos/webdav/pkg/quota"
+	"golang.org/x/net/webdav"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+var (
+	quotaAvailableBytes = xml.Name{Space: "DAV:", Local: "quota-available-bytes"}
+	quotaUsedBytes      = xml.Name{Space: "DAV:", Local: "quota-used-bytes"}
+)
+
+type quotaExceededKey struct{}
+
+type expectedSizeKey struct{}
+
+// withQuotaTracking returns a context in which the file system records that a request failed because
+// of a quota. webdav.Handler maps file system errors to fixed status codes, so the handler uses the
+// record to answer with 507 Insufficient Storage instead.
+func withQuotaTracking(ctx context.Context) (context.Context, *atomic.Bool) {
+	exceeded := &atomic.Bool{}
+	return context.WithValue(ctx, quotaExceededKey{}, exceeded), exceeded
+}
+
+// quotaError records a quota error in the context of the request.
+func quotaError(ctx context.Context, err error) error {
+	if errors.Is(err, quota.ErrQuotaExceeded) {
+		if exceeded, ok := ctx.Value(quotaExceededKey{}).(*atomic.Bool); ok {
+			exceeded.Store(true)
+		}
+	}
+	return err
+}
+
+// withExpectedSize announces the size of an upload, so a file that does not fit into the quota is
+// refused before it is truncated.
+func withExpectedSize(ctx context.Context, size int64) context.Context {
+	return context.WithValue(ctx, expectedSizeKey{}, size)
+}
+
+func expectedSize(ctx context.Context) int64 {
+	size, _ := ctx.Value(expectedSizeKey{}).(int64)
+	return size
+}
+
+// quotaResponseWriter replaces the error status of a request that exceeded a quota with 507.
+type quotaResponseWriter struct {
+	http.ResponseWriter
+	exceeded *atomic.Bool
+	replaced bool
+}
+
+func (w *quotaResponseWriter) WriteHeader(statusCode int) {
+	if statusCode >= http.StatusBadRequest && w.exceeded.Load() {
+		w.replaced = true
+		w.ResponseWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.ResponseWriter.WriteHeader(http.StatusInsufficientStorage)
+		w.ResponseWriter.Write([]byte(http.StatusText(http.StatusInsufficientStorage)))
+		return
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *quotaResponseWriter) Write(data []byte) (int, error) {
+	if w.replaced {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *quotaResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// openQuotaFile opens a file for writing and accounts its growth against the quotas of its path.
+func (filesystem *WebdavFs) openQuotaFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	var size int64
+	fileInfo, statErr := filesystem.FileSystem.Stat(ctx, name)
+	if statErr == nil {
+		if fileInfo.IsDir() {
+			return filesystem.openWrite(ctx, name, flag, perm)
+		}
+		size = fileInfo.Size()
+	}
+	accounted := size
+	if flag&os.O_TRUNC != 0 {
+		// Reserve the announced size up front, so a file that can't fit is not truncated
+		if expected := expectedSize(ctx); expected > 0 {
+			if err := filesystem.quota.Reserve(ctx, name, expected-size); err != nil {
+				return nil, quotaError(ctx, err)
+			}
+			accounted = expected
+		}
+	}
+	file, err := filesystem.openWrite(ctx, name, flag, perm)
+	if err != nil {
+		filesystem.quota.Reserve(ctx, name, size-accounted)
+		return nil, err
+	}
+	quotaFile := &quotaFile{File: file, ctx: ctx, filesystem: filesystem, name: name, size: size, accounted: accounted}
+	if flag&os.O_TRUNC != 0 {
+		quotaFile.size = 0
+	}
+	if flag&os.O_APPEND != 0 {
+		quotaFile.offset = quotaFile.size
+	}
+	return quotaFile, nil
+}
+
+// quotaFile reserves space for writes that grow the file beyond what has been accounted for, and
+// settles the account with the actual size when it is closed.
+type quotaFile struct {
+	webdav.File
+	ctx        context.Context
+	filesystem *WebdavFs
+	name       string
+	offset     int64
+	size       int64
+	accounted  int64
+}
+
+func (f *quotaFile) Write(data []byte) (int, error) {
+	if end := f.offset + int64(len(data)); end > f.accounted {
+		if err := f.filesystem.quota.Reserve(f.ctx, f.name, end-f.accounted); err != nil {
+			return 0, quotaError(f.ctx, err)
+		}
+		f.accounted = end
+	}
+	written, err := f.File.Write(data)
+	f.offset += int64(written)
+	f.size = max(f.size, f.offset)
+	return written, err
+}
+
+func (f *quotaFile) Seek(offset int64, whence int) (int64, error) {
+	position, err := f.File.Seek(offset, whence)
+	if err == nil {
+		f.offset = position
+	}
+	return position, err
+}
+
+func (f *quotaFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps(f.File)
+}
+
+func (f *quotaFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return patchDeadProps(f.File, patches)
+}
+
+func (f *quotaFile) Close() error {
+	closeErr := f.File.Close()
+	size := f.size
+	if fileInfo, err := f.filesystem.FileSystem.Stat(context.Background(), f.name); err == nil {
+		size = fileInfo.Size()
+	}
+	if size < f.accounted {
+		f.filesystem.quota.Reserve(f.ctx, f.name, size-f.accounted)
+	}
+	return closeErr
+}
+
+// quotaDir reports the quota that applies to a collection with the RFC 4331 properties.
+type quotaDir struct {
+	webdav.File
+	ctx        context.Context
+	filesystem *WebdavFs
+	name       string
+}
+
+func (d *quotaDir) DeadProps() (map[xml.Name]webdav.Property, error) {
+	properties, err := deadProps(d.File)
+	if err != nil {
+		return nil, err
+	}
+	usage, ok := d.filesystem.quota.Usage(d.ctx, d.name)
+	if !ok {
+		return properties, nil
+	}
+	withQuota := make(map[xml.Name]webdav.Property, len(properties)+2)
+	for name, property := range properties {
+		withQuota[name] = property
+	}
+	withQuota[quotaAvailableBytes] = webdav.Property{XMLName: quotaAvailableBytes, InnerXML: []byte(strconv.FormatInt(usage.Available, 10))}
+	withQuota[quotaUsedBytes] = webdav.Property{XMLName: quotaUsedBytes, InnerXML: []byte(strconv.FormatInt(usage.Used, 10))}
+	return withQuota, nil
+}
+
+func (d *quotaDir) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return protectProps(d.File, patches, map[xml.Name]bool{quotaAvailableBytes: true, quotaUsedBytes: true})
+}
@@ -0,0 +1,78 @@
+package handler_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/mocks"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/handler"
+	"github.com/triargos/webdav/pkg/quota"
+	"golang.org/x/net/webdav"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	ctx := context.Background()
+	memFs := newTestFs(t, []string{"/alice", "/public"}, map[string]string{"/public/large.bin": strings.Repeat("x", 70)})
+	userService := mocks.NewMockUserService(map[string]config.User{
+		"alice": {Root: "/alice", Quota: "100"},
+	})
+	authService := auth.New(userService)
+	webdavFs := handler.NewWebdavFsWithOptions(memFs, authService, handler.FsOptions{
+		Quota: quota.NewQuotaService(memFs, userService, nil, authService.ContainsPath, quota.DefaultUsageTTL),
+	})
+	webdavHandler := handler.NewWebdavHandler(webdavFs, webdav.NewMemLS(), nil)
+	size := func(name string) int64 {
+		fileInfo, err := memFs.Stat(ctx, name)
+		if err != nil {
+			return -1
+		}
+		return fileInfo.Size()
+	}
+
+	assert.Equal(t, http.StatusCreated, serve(webdavHandler, "alice", http.MethodPut, "/alice/a.txt", strings.Repeat("a", 60), nil).Code)
+
+	t.Run("Announced upload over quota", func(t *testing.T) {
+		recorder := serve(webdavHandler, "alice", http.MethodPut, "/alice/b.txt", strings.Repeat("b", 60), nil)
+		assert.Equal(t, http.StatusInsufficientStorage, recorder.Code)
+		assert.Equal(t, "Insufficient Storage", recorder.Body.String())
+		assert.Equal(t, int64(-1), size("/alice/b.txt"))
+	})
+
+	t.Run("Overwrite only counts the difference", func(t *testing.T) {
+		assert.Equal(t, http.StatusCreated, serve(webdavHandler, "alice", http.MethodPut, "/alice/a.txt", strings.Repeat("a", 90), nil).Code)
+		assert.Equal(t, int64(90), size("/alice/a.txt"))
+	})
+
+	t.Run("Streamed upload over quota", func(t *testing.T) {
+		// A MultiReader hides the length of the body, so the upload is not announced
+		body := io.MultiReader(strings.NewReader(strings.Repeat("c", 20)))
+		recorder := serveReader(webdavHandler, "alice", http.MethodPut, "/alice/c.txt", body, nil)
+		assert.Equal(t, http.StatusInsufficientStorage, recorder.Code)
+	})
+
+	t.Run("Copy into quota", func(t *testing.T) {
+		recorder := serve(webdavHandler, "alice", "COPY", "/public/large.bin", "", map[string]string{"Destination": "http://example.com/alice/large.bin"})
+		assert.Equal(t, http.StatusInsufficientStorage, recorder.Code)
+	})
+
+	t.Run("Delete frees space", func(t *testing.T) {
+		serve(webdavHandler, "alice", http.MethodDelete, "/alice/c.txt", "", nil)
+		assert.Equal(t, http.StatusNoContent, serve(webdavHandler, "alice", http.MethodDelete, "/alice/a.txt", "", nil).Code)
+		recorder := serve(webdavHandler, "alice", "MOVE", "/public/large.bin", "", map[string]string{"Destination": "http://example.com/alice/large.bin", "Overwrite": "T"})
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+	})
+
+	t.Run("Quota properties", func(t *testing.T) {
+		propfind := `<?xml version="1.0" encoding="utf-8"?><D:propfind xmlns:D="DAV:"><D:prop><D:quota-available-bytes/><D:quota-used-bytes/></D:prop></D:propfind>`
+		recorder := serve(webdavHandler, "alice", "PROPFIND", "/alice", propfind, map[string]string{"Depth": "0"})
+		assert.Equal(t, http.StatusMultiStatus, recorder.Code)
+		body := recorder.Body.String()
+		assert.Contains(t, body, "<D:quota-available-bytes>30</D:quota-available-bytes>")
+		assert.Contains(t, body, "<D:quota-used-bytes>70</D:quota-used-bytes>")
+	})
+}
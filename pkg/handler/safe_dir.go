@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/net/webdav"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SymlinkPolicy decides how SafeDir treats symlinks inside the content directory.
+type SymlinkPolicy string
+
+const (
+	// SymlinksDeny refuses every path that passes through a symlink and hides symlinks from listings
+	SymlinksDeny SymlinkPolicy = "deny"
+	// SymlinksInside follows symlinks whose target is inside the content directory. Access rules are
+	// checked on the target as well.
+	SymlinksInside SymlinkPolicy = "inside"
+	// SymlinksFollow follows every symlink, access rules are only checked on the requested path
+	SymlinksFollow SymlinkPolicy = "follow"
+)
+
+func ParseSymlinkPolicy(value string) (SymlinkPolicy, error) {
+	switch SymlinkPolicy(value) {
+	case "":
+		return SymlinksDeny, nil
+	case SymlinksDeny, SymlinksInside, SymlinksFollow:
+		return SymlinkPolicy(value), nil
+	}
+	return "", fmt.Errorf("invalid symlink policy %q, must be one of deny, inside or follow", value)
+}
+
+// SafeDir is a webdav.Dir that enforces a symlink policy. Paths are resolved component by component,
+// so neither ".." nor a symlink can lead a request out of the content directory unless the policy
+// is SymlinksFollow.
+type SafeDir struct {
+	root   string
+	policy SymlinkPolicy
+}
+
+func NewSafeDir(dir string, policy SymlinkPolicy) (*SafeDir, error) {
+	absolute, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve content directory: %w", err)
+	}
+	root, err := filepath.EvalSymlinks(absolute)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve content directory: %w", err)
+	}
+	return &SafeDir{root: root, policy: policy}, nil
+}
+
+// Canonicalize returns the path a name refers to after resolving symlinks, relative to the content
+// directory. Names passing through a symlink that the policy forbids are rejected with
+// os.ErrPermission.
+func (d *SafeDir) Canonicalize(name string) (string, error) {
+	return d.canonicalize(name, true)
+}
+
+// canonicalize resolves a name. Unless followLast is set, a symlink in the last component is not
+// resolved, so the symlink itself can be removed or moved.
+func (d *SafeDir) canonicalize(name string, followLast bool) (string, error) {
+	if strings.ContainsRune(name, 0) || filepath.Separator != '/' && strings.ContainsRune(name, filepath.Separator) {
+		return "", os.ErrNotExist
+	}
+	name = path.Clean("/" + name)
+	if d.policy == SymlinksFollow || name == "/" {
+		return name, nil
+	}
+	segments := strings.Split(name[1:], "/")
+	current := d.root
+	for i, segment := range segments {
+		next := filepath.Join(current, segment)
+		if i == len(segments)-1 && !followLast {
+			current = next
+			break
+		}
+		fileInfo, err := os.Lstat(next)
+		if os.IsNotExist(err) {
+			// Missing components can't be symlinks
+			current = filepath.Join(append([]string{current}, segments[i:]...)...)
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if fileInfo.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		if d.policy == SymlinksDeny {
+			return "", os.ErrPermission
+		}
+		target, err := filepath.EvalSymlinks(next)
+		if err != nil {
+			return "", err
+		}
+		if !d.contains(target) {
+			return "", os.ErrPermission
+		}
+		current = target
+	}
+	relative, err := filepath.Rel(d.root, current)
+	if err != nil {
+		return "", os.ErrPermission
+	}
+	return path.Clean("/" + filepath.ToSlash(relative)), nil
+}
+
+func (d *SafeDir) contains(target string) bool {
+	relative, err := filepath.Rel(d.root, target)
+	return err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
+func (d *SafeDir) dir() webdav.Dir {
+	return webdav.Dir(d.root)
+}
+
+func (d *SafeDir) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	canonical, err := d.canonicalize(name, true)
+	if err != nil {
+		return nil, err
+	}
+	file, err := d.dir().OpenFile(ctx, canonical, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &safeDirFile{File: file, dir: d, name: canonical}, nil
+}
+
+func (d *SafeDir) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	canonical, err := d.canonicalize(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return d.dir().Stat(ctx, canonical)
+}
+
+func (d *SafeDir) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	canonical, err := d.canonicalize(name, true)
+	if err != nil {
+		return err
+	}
+	return d.dir().Mkdir(ctx, canonical, perm)
+}
+
+func (d *SafeDir) RemoveAll(ctx context.Context, name string) error {
+	canonical, err := d.canonicalize(name, false)
+	if err != nil {
+		return err
+	}
+	if canonical == "/" {
+		return os.ErrInvalid
+	}
+	return d.dir().RemoveAll(ctx, canonical)
+}
+
+func (d *SafeDir) Rename(ctx context.Context, oldName, newName string) error {
+	oldCanonical, err := d.canonicalize(oldName, false)
+	if err != nil {
+		return err
+	}
+	newCanonical, err := d.canonicalize(newName, false)
+	if err != nil {
+		return err
+	}
+	return d.dir().Rename(ctx, oldCanonical, newCanonical)
+}
+
+// safeDirFile lists the members of a directory according to the symlink policy: symlinks are hidden
+// when they may not be followed, and otherwise listed with the information of their target.
+type safeDirFile struct {
+	webdav.File
+	dir  *SafeDir
+	name string
+}
+
+func (f *safeDirFile) Sync() error {
+	return syncFile(f.File)
+}
+
+func (f *safeDirFile) Readdir(count int) ([]os.FileInfo, error) {
+	fileInfos, err := f.File.Readdir(count)
+	visible := fileInfos[:0]
+	for _, fileInfo := range fileInfos {
+		if fileInfo.Mode()&os.ModeSymlink == 0 {
+			visible = append(visible, fileInfo)
+			continue
+		}
+		target, targetErr := f.dir.Stat(context.Background(), path.Join(f.name, fileInfo.Name()))
+		if targetErr != nil {
+			continue
+		}
+		visible = append(visible, &renamedFileInfo{FileInfo: target, name: fileInfo.Name()})
+	}
+	return visible, err
+}
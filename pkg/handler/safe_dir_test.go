@@ -0,0 +1,152 @@
+package handler_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/mocks"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/handler"
+	"github.com/triargos/webdav/pkg/helper"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newSymlinkTree creates a content directory with a user directory containing symlinks to a file
+// outside of the content directory, to a file of another user and to a file of the user, and
+// returns the content directory.
+func newSymlinkTree(t testing.TB) string {
+	base := t.TempDir()
+	content := filepath.Join(base, "content")
+	for _, dir := range []string{"outside", "content/alice", "content/bob"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(base, dir), 0755))
+	}
+	files := map[string]string{
+		"outside/secret.txt":      "outside",
+		"content/alice/notes.txt": "alice",
+		"content/bob/private.txt": "bob",
+	}
+	for name, content := range files {
+		assert.NoError(t, os.WriteFile(filepath.Join(base, name), []byte(content), 0644))
+	}
+	links := map[string]string{
+		"content/alice/escape":   "../../outside",
+		"content/alice/neighbor": "../bob",
+		"content/alice/own":      "notes.txt",
+	}
+	for name, target := range links {
+		assert.NoError(t, os.Symlink(target, filepath.Join(base, name)))
+	}
+	return content
+}
+
+func TestSafeDirSymlinkPolicies(t *testing.T) {
+	content := newSymlinkTree(t)
+	userService := mocks.NewMockUserService(map[string]config.User{
+		"alice": {Root: "/alice", Jail: true},
+		"bob":   {Root: "/bob", Jail: true},
+	})
+	authService := auth.New(userService)
+	ctx := context.WithValue(context.Background(), helper.UserNameContextKey, "alice")
+	open := func(fs *handler.WebdavFs, name string) (string, error) {
+		file, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		return string(data), err
+	}
+
+	tests := []struct {
+		policy   handler.SymlinkPolicy
+		readable map[string]bool
+		listed   []string
+	}{
+		{
+			policy:   handler.SymlinksDeny,
+			readable: map[string]bool{"/alice/notes.txt": true, "/alice/own": false, "/alice/escape/secret.txt": false, "/alice/neighbor/private.txt": false},
+			listed:   []string{"notes.txt"},
+		},
+		{
+			policy:   handler.SymlinksInside,
+			readable: map[string]bool{"/alice/notes.txt": true, "/alice/own": true, "/alice/escape/secret.txt": false, "/alice/neighbor/private.txt": false},
+			listed:   []string{"neighbor", "notes.txt", "own"},
+		},
+		{
+			policy:   handler.SymlinksFollow,
+			readable: map[string]bool{"/alice/notes.txt": true, "/alice/own": true, "/alice/escape/secret.txt": true, "/alice/neighbor/private.txt": true},
+			listed:   []string{"escape", "neighbor", "notes.txt", "own"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			safeDir, err := handler.NewSafeDir(content, tt.policy)
+			assert.NoError(t, err)
+			fs := handler.NewWebdavFs(safeDir, authService)
+			for name, readable := range tt.readable {
+				_, err := open(fs, name)
+				assert.Equal(t, readable, err == nil, "%s: %v", name, err)
+			}
+			dir, err := safeDir.OpenFile(ctx, "/alice", os.O_RDONLY, 0)
+			assert.NoError(t, err)
+			defer dir.Close()
+			fileInfos, err := dir.Readdir(0)
+			assert.NoError(t, err)
+			var names []string
+			for _, fileInfo := range fileInfos {
+				names = append(names, fileInfo.Name())
+			}
+			assert.ElementsMatch(t, tt.listed, names)
+		})
+	}
+
+	t.Run("Removing a symlink keeps its target", func(t *testing.T) {
+		safeDir, err := handler.NewSafeDir(content, handler.SymlinksInside)
+		assert.NoError(t, err)
+		assert.NoError(t, safeDir.RemoveAll(ctx, "/alice/neighbor"))
+		_, err = os.Stat(filepath.Join(content, "bob", "private.txt"))
+		assert.NoError(t, err)
+	})
+}
+
+// FuzzSafeDir checks that no name leads out of the content directory or through a forbidden symlink.
+func FuzzSafeDir(f *testing.F) {
+	for _, seed := range []string{"/alice/notes.txt", "/alice/escape/secret.txt", "/../outside/secret.txt", "alice/../../outside/secret.txt", "/alice/own", "/alice/neighbor/private.txt", "/alice/escape/../../outside/secret.txt", "\x00", "/alice//./escape"} {
+		f.Add(seed, uint8(0))
+	}
+	content := newSymlinkTree(f)
+	policies := []handler.SymlinkPolicy{handler.SymlinksDeny, handler.SymlinksInside}
+	safeDirs := make([]*handler.SafeDir, len(policies))
+	for i, policy := range policies {
+		safeDir, err := handler.NewSafeDir(content, policy)
+		if err != nil {
+			f.Fatal(err)
+		}
+		safeDirs[i] = safeDir
+	}
+	f.Fuzz(func(t *testing.T, name string, policyIndex uint8) {
+		safeDir := safeDirs[int(policyIndex)%len(safeDirs)]
+		file, err := safeDir.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+		if err != nil {
+			return
+		}
+		defer file.Close()
+		fileInfo, err := file.Stat()
+		if err != nil || fileInfo.IsDir() {
+			return
+		}
+		data, _ := io.ReadAll(file)
+		if strings.Contains(string(data), "outside") {
+			t.Fatalf("%q leads out of the content directory", name)
+		}
+		requested := filepath.Join(content, filepath.FromSlash(path.Clean("/"+name)))
+		if resolved, _ := filepath.EvalSymlinks(requested); safeDir == safeDirs[0] && resolved != requested {
+			t.Fatalf("%q was read through a symlink", name)
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/helper"
+	"github.com/triargos/webdav/pkg/trash"
+	"github.com/triargos/webdav/pkg/user"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// TrashHandler serves the trash of the authenticated user:
+//
+//	GET    /.webdav/trash       lists the entries as JSON
+//	POST   /.webdav/trash/<id>  restores an entry to its original path
+//	DELETE /.webdav/trash/<id>  deletes an entry for good
+//	DELETE /.webdav/trash       empties the trash
+//
+// Restoring requires the write permission on the original path. Entries count toward the quotas of
+// their original path, so deleting them frees up space and restoring them takes none.
+type TrashHandler struct {
+	trash       trash.Service
+	fileSystem  *WebdavFs
+	userService user.Service
+}
+
+// NewTrashHandler creates a handler that restores entries into a file system, which checks the
+// permissions and quotas of the users.
+func NewTrashHandler(trashService trash.Service, fs *WebdavFs, userService user.Service) *TrashHandler {
+	return &TrashHandler{
+		trash:       trashService,
+		fileSystem:  fs,
+		userService: userService,
+	}
+}
+
+// trashEntry is an entry as shown to clients, with the path they see.
+type trashEntry struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	Deleted time.Time `json:"deleted"`
+	Dir     bool      `json:"dir"`
+}
+
+func (h *TrashHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, ok := helper.GetUsernameFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, helper.StatePath("trash")), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		h.list(w, r, username)
+	case r.Method == http.MethodPost && id != "":
+		h.restore(w, r, username, id)
+	case r.Method == http.MethodDelete && id != "":
+		h.writeResult(w, r, h.delete(r.Context(), username, id), http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		h.writeResult(w, r, h.empty(r.Context(), username), http.StatusNoContent)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *TrashHandler) list(w http.ResponseWriter, r *http.Request, username string) {
+	entries, err := h.trash.List(r.Context(), username)
+	if err != nil {
+		h.writeResult(w, r, err, http.StatusOK)
+		return
+	}
+	virtualRoot, virtual := h.userService.VirtualRoot(username)
+	visible := make([]trashEntry, 0, len(entries))
+	for _, entry := range entries {
+		entryPath := entry.Path
+		if virtual {
+			if unresolved, ok := virtualRoot.Unresolve(entryPath); ok {
+				entryPath = unresolved
+			}
+		}
+		visible = append(visible, trashEntry{ID: entry.ID, Path: entryPath, Deleted: entry.Deleted, Dir: entry.Dir})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(visible)
+}
+
+func (h *TrashHandler) restore(w http.ResponseWriter, r *http.Request, username, id string) {
+	ctx := r.Context()
+	entry, err := h.trash.Get(ctx, username, id)
+	if err != nil {
+		h.writeResult(w, r, err, http.StatusCreated)
+		return
+	}
+	if !h.fileSystem.authorize(ctx, entry.Path, auth.PermissionWrite) {
+		slog.Error("Forbidden access attempt: Restoring from trash not allowed", "remote_addr", r.RemoteAddr, "username", username, "path", entry.Path)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	_, err = h.trash.Restore(ctx, username, id)
+	h.writeResult(w, r, err, http.StatusCreated)
+}
+
+// delete removes an entry for good and gives its size back to the quotas of its original path.
+func (h *TrashHandler) delete(ctx context.Context, username, id string) error {
+	if h.fileSystem.quota == nil {
+		return h.trash.Delete(ctx, username, id)
+	}
+	entry, err := h.trash.Get(ctx, username, id)
+	if err != nil {
+		return err
+	}
+	dataPath, err := h.trash.DataPath(username, id)
+	if err != nil {
+		return err
+	}
+	size, _ := h.fileSystem.quota.Size(ctx, dataPath)
+	if err := h.trash.Delete(ctx, username, id); err != nil {
+		return err
+	}
+	return h.fileSystem.quota.Reserve(ctx, entry.Path, -size)
+}
+
+// empty deletes every entry of the trash of a user.
+func (h *TrashHandler) empty(ctx context.Context, username string) error {
+	entries, err := h.trash.List(ctx, username)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := h.delete(ctx, username, entry.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeResult writes the success status of a trash operation, or the status matching its error.
+func (h *TrashHandler) writeResult(w http.ResponseWriter, r *http.Request, err error, successStatus int) {
+	switch {
+	case err == nil:
+		w.WriteHeader(successStatus)
+	case errors.Is(err, trash.ErrNotFound), os.IsNotExist(err):
+		http.NotFound(w, r)
+	case errors.Is(err, trash.ErrConflict):
+		http.Error(w, "Conflict", http.StatusConflict)
+	default:
+		slog.Error("Trash operation failed", "method", r.Method, "path", r.URL.Path, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,127 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/mocks"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/handler"
+	"github.com/triargos/webdav/pkg/quota"
+	"github.com/triargos/webdav/pkg/trash"
+	"golang.org/x/net/webdav"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTrash(t *testing.T) {
+	ctx := context.Background()
+	memFs := newTestFs(t, []string{"/alice", "/bob"}, map[string]string{"/alice/docs/notes.txt": ""})
+	userService := jailedUsers("alice", "bob")
+	authService := auth.New(userService)
+	trashService := trash.NewTrashService(memFs, nil, 0)
+	webdavFs := handler.NewWebdavFsWithOptions(memFs, authService, handler.FsOptions{Trash: trashService})
+	webdavHandler := handler.NewWebdavHandler(webdavFs, webdav.NewMemLS(), nil)
+	trashHandler := handler.NewTrashHandler(trashService, webdavFs, userService)
+	list := func(username string) []map[string]any {
+		recorder := serve(trashHandler, username, http.MethodGet, "/.webdav/trash", "", nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var entries []map[string]any
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &entries))
+		return entries
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve(webdavHandler, "alice", http.MethodDelete, "/alice/docs", "", nil).Code)
+	entries := list("alice")
+	assert.Len(t, entries, 1)
+	id := entries[0]["id"].(string)
+
+	t.Run("Deleted files are moved into the trash", func(t *testing.T) {
+		_, err := memFs.Stat(ctx, "/alice/docs")
+		assert.True(t, os.IsNotExist(err))
+		assert.Equal(t, "/alice/docs", entries[0]["path"])
+		assert.Equal(t, true, entries[0]["dir"])
+		assert.Empty(t, list("bob"))
+	})
+
+	t.Run("State directory is hidden", func(t *testing.T) {
+		recorder := serve(webdavHandler, "alice", "PROPFIND", "/", "", map[string]string{"Depth": "1"})
+		assert.NotContains(t, recorder.Body.String(), ".webdav")
+		assert.NotEqual(t, http.StatusMultiStatus, serve(webdavHandler, "alice", "PROPFIND", "/.webdav/trash/alice", "", map[string]string{"Depth": "1"}).Code)
+		assert.NotEqual(t, http.StatusNoContent, serve(webdavHandler, "alice", http.MethodDelete, "/.webdav", "", nil).Code)
+	})
+
+	t.Run("Entries of other users can't be restored", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, serve(trashHandler, "bob", http.MethodPost, "/.webdav/trash/"+id, "", nil).Code)
+		assert.Equal(t, http.StatusNotFound, serve(trashHandler, "alice", http.MethodPost, "/.webdav/trash/..", "", nil).Code)
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		assert.Equal(t, http.StatusCreated, serve(trashHandler, "alice", http.MethodPost, "/.webdav/trash/"+id, "", nil).Code)
+		_, err := memFs.Stat(ctx, "/alice/docs/notes.txt")
+		assert.NoError(t, err)
+		assert.Empty(t, list("alice"))
+	})
+
+	t.Run("Restore does not overwrite", func(t *testing.T) {
+		serve(webdavHandler, "alice", http.MethodDelete, "/alice/docs/notes.txt", "", nil)
+		assert.NoError(t, memFs.Mkdir(ctx, "/alice/docs/notes.txt", 0755))
+		id := list("alice")[0]["id"].(string)
+		assert.Equal(t, http.StatusConflict, serve(trashHandler, "alice", http.MethodPost, "/.webdav/trash/"+id, "", nil).Code)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, serve(trashHandler, "alice", http.MethodDelete, "/.webdav/trash", "", nil).Code)
+		assert.Empty(t, list("alice"))
+	})
+}
+
+func TestTrashQuota(t *testing.T) {
+	memFs := newTestFs(t, []string{"/alice"}, nil)
+	userService := mocks.NewMockUserService(map[string]config.User{
+		"alice": {Root: "/alice", Jail: true, Quota: "100"},
+	})
+	authService := auth.New(userService)
+	trashService := trash.NewTrashService(memFs, nil, 0)
+	webdavFs := handler.NewWebdavFsWithOptions(memFs, authService, handler.FsOptions{
+		Quota: quota.NewQuotaService(memFs, userService, trashService, authService.ContainsPath, quota.DefaultUsageTTL),
+		Trash: trashService,
+	})
+	webdavHandler := handler.NewWebdavHandler(webdavFs, webdav.NewMemLS(), nil)
+	trashHandler := handler.NewTrashHandler(trashService, webdavFs, userService)
+	upload := func() int {
+		return serve(webdavHandler, "alice", http.MethodPut, "/alice/data.bin", strings.Repeat("d", 40), nil).Code
+	}
+
+	t.Run("Deleted data counts toward the quota", func(t *testing.T) {
+		assert.Equal(t, http.StatusCreated, upload())
+		assert.Equal(t, http.StatusNoContent, serve(webdavHandler, "alice", http.MethodDelete, "/alice/data.bin", "", nil).Code)
+		assert.Equal(t, http.StatusCreated, upload())
+		assert.Equal(t, http.StatusNoContent, serve(webdavHandler, "alice", http.MethodDelete, "/alice/data.bin", "", nil).Code)
+		assert.Equal(t, http.StatusInsufficientStorage, upload(), "the trash holds 80 of 100 bytes")
+	})
+
+	t.Run("Deleting an entry frees up space", func(t *testing.T) {
+		entries, err := trashService.List(context.Background(), "alice")
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2)
+		assert.Equal(t, http.StatusNoContent, serve(trashHandler, "alice", http.MethodDelete, "/.webdav/trash/"+entries[0].ID, "", nil).Code)
+		assert.Equal(t, http.StatusCreated, upload())
+		assert.Equal(t, http.StatusInsufficientStorage, serve(webdavHandler, "alice", http.MethodPut, "/alice/more.bin", strings.Repeat("m", 40), nil).Code)
+	})
+
+	t.Run("Usage is scanned with the trash", func(t *testing.T) {
+		rescanned := quota.NewQuotaService(memFs, userService, trashService, authService.ContainsPath, quota.DefaultUsageTTL)
+		usage, ok := rescanned.Usage(context.Background(), "/alice")
+		assert.True(t, ok)
+		assert.Equal(t, int64(80), usage.Used)
+	})
+
+	t.Run("Emptying the trash frees up space", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, serve(trashHandler, "alice", http.MethodDelete, "/.webdav/trash", "", nil).Code)
+		assert.Equal(t, http.StatusCreated, serve(webdavHandler, "alice", http.MethodPut, "/alice/more.bin", strings.Repeat("m", 40), nil).Code)
+	})
+}
@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/helper"
+	"golang.org/x/net/webdav"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sync/atomic"
+)
+
+var errUploadIncomplete = errors.New("upload incomplete")
+
+type uploadFailedKey struct{}
+
+// withUploadTracking returns a context in which an upload can be marked as failed. webdav.Handler
+// closes a file after a failed upload just like after a successful one, so a staged file checks the
+// mark to decide whether it replaces its target.
+func withUploadTracking(ctx context.Context) (context.Context, *atomic.Bool) {
+	failed := &atomic.Bool{}
+	return context.WithValue(ctx, uploadFailedKey{}, failed), failed
+}
+
+func uploadFailed(ctx context.Context) bool {
+	failed, ok := ctx.Value(uploadFailedKey{}).(*atomic.Bool)
+	return ok && failed.Load()
+}
+
+// trackedBody marks an upload as failed when its body can't be read to the end, e.g. because the
+// client disconnected.
+type trackedBody struct {
+	io.ReadCloser
+	failed *atomic.Bool
+}
+
+func (b *trackedBody) Read(data []byte) (int, error) {
+	read, err := b.ReadCloser.Read(data)
+	if err != nil && err != io.EOF {
+		b.failed.Store(true)
+	}
+	return read, err
+}
+
+// trackUpload wraps the body of a PUT request, so an interrupted upload is discarded.
+func trackUpload(r *http.Request) *http.Request {
+	ctx, failed := withUploadTracking(r.Context())
+	r = r.WithContext(ctx)
+	if r.Body != nil {
+		r.Body = &trackedBody{ReadCloser: r.Body, failed: failed}
+	}
+	return r
+}
+
+// syncer is implemented by files that can be flushed to disk, such as os.File.
+type syncer interface {
+	Sync() error
+}
+
+func syncFile(file webdav.File) error {
+	if s, ok := file.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// openStaged opens a file that is about to be replaced. The content is written to a temp file next
+// to it, which replaces it in one rename when the file is closed, so an interrupted upload never
+// leaves a truncated file behind. The file is saved as a version right before it is replaced.
+func (filesystem *WebdavFs) openStaged(ctx context.Context, name string, perm os.FileMode, exists bool) (webdav.File, error) {
+	target := path.Clean("/" + name)
+	// Replace the target of a symlink rather than the symlink itself
+	if c, ok := filesystem.FileSystem.(canonicalizer); ok {
+		canonical, err := c.Canonicalize(name)
+		if err != nil {
+			return nil, err
+		}
+		target = canonical
+	}
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	tempName := path.Join(path.Dir(target), helper.UploadPrefix+hex.EncodeToString(random))
+	file, err := filesystem.FileSystem.OpenFile(ctx, tempName, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return nil, err
+	}
+	staged := &stagedFile{File: file, ctx: ctx, filesystem: filesystem, name: name, target: target, tempName: tempName, exists: exists}
+	return filesystem.withProperties(ctx, name, staged), nil
+}
+
+// stagedFile is the temp file of an upload, which replaces its target when it is closed after all
+// writes succeeded.
+type stagedFile struct {
+	webdav.File
+	ctx        context.Context
+	filesystem *WebdavFs
+	name       string
+	target     string
+	tempName   string
+	exists     bool
+	err        error
+}
+
+func (f *stagedFile) Write(data []byte) (int, error) {
+	written, err := f.File.Write(data)
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+	return written, err
+}
+
+func (f *stagedFile) Close() error {
+	// Replacing the target must not be cut short when the client goes away after the upload
+	ctx := context.WithoutCancel(f.ctx)
+	err := f.err
+	if err == nil && uploadFailed(f.ctx) {
+		err = errUploadIncomplete
+	}
+	if err == nil && f.filesystem.fsync {
+		err = syncFile(f.File)
+	}
+	err = errors.Join(err, f.File.Close())
+	if err == nil && f.exists && f.filesystem.versions != nil {
+		err = f.filesystem.saveVersion(ctx, f.target, f.name)
+	}
+	if err == nil {
+		err = f.filesystem.FileSystem.Rename(ctx, f.tempName, f.target)
+	}
+	if err != nil {
+		if removeErr := f.filesystem.FileSystem.RemoveAll(ctx, f.tempName); removeErr != nil && !os.IsNotExist(removeErr) {
+			slog.Error("Failed to remove temp file of upload", "path", f.tempName, "error", removeErr)
+		}
+		return err
+	}
+	if f.filesystem.fsync {
+		f.syncDir(ctx)
+	}
+	if f.exists && f.filesystem.properties != nil {
+		// The checksums of the replaced content no longer apply, new ones are set after a PUT
+		if err := f.filesystem.setChecksums(ctx, f.name, nil); err != nil {
+			slog.Error("Failed to remove checksums", "path", f.name, "error", err)
+		}
+	}
+	return nil
+}
+
+// SaveVersion saves the content of a file as a version before it is changed in place, as partial
+// updates do.
+func (filesystem *WebdavFs) SaveVersion(ctx context.Context, name string) error {
+	if filesystem.versions == nil {
+		return nil
+	}
+	if !filesystem.authorize(ctx, name, auth.PermissionWrite) {
+		return os.ErrPermission
+	}
+	return filesystem.saveVersion(ctx, name, name)
+}
+
+// saveVersion saves the content that is about to be replaced as a version. The target is where the
+// content is, which differs from the name of the file if it is a symlink.
+func (filesystem *WebdavFs) saveVersion(ctx context.Context, target, name string) error {
+	fileInfo, err := filesystem.FileSystem.Stat(ctx, target)
+	if err != nil || fileInfo.IsDir() || fileInfo.Size() == 0 {
+		return nil
+	}
+	username, _ := helper.GetUsernameFromContext(ctx)
+	_, err = filesystem.versions.Save(ctx, username, name)
+	return err
+}
+
+// syncDir flushes the directory of the target, so the rename survives a crash as well.
+func (f *stagedFile) syncDir(ctx context.Context) {
+	dir, err := f.filesystem.FileSystem.OpenFile(ctx, path.Dir(f.target), os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+	if err := syncFile(dir); err != nil {
+		slog.Warn("Failed to sync directory", "path", path.Dir(f.target), "error", err)
+	}
+}
+
+// RemoveUploads removes the temp files of uploads that were interrupted by a crash or restart. It
+// returns the number of removed files.
+func RemoveUploads(ctx context.Context, fileSystem webdav.FileSystem, name string) (int, error) {
+	dir, err := fileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	members, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	removed := 0
+	for _, member := range members {
+		memberName := path.Join(name, member.Name())
+		switch {
+		case helper.IsUploadPath(memberName) && !member.IsDir():
+			if err := fileSystem.RemoveAll(ctx, memberName); err != nil {
+				return removed, err
+			}
+			removed++
+		case member.IsDir() && !helper.IsStatePath(memberName):
+			count, err := RemoveUploads(ctx, fileSystem, memberName)
+			removed += count
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,67 @@
+package handler_test
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/handler"
+	"github.com/triargos/webdav/pkg/helper"
+	"golang.org/x/net/webdav"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// brokenReader fails after its content, like the body of a client that disconnected.
+type brokenReader struct {
+	io.Reader
+}
+
+func (r *brokenReader) Read(data []byte) (int, error) {
+	read, err := r.Reader.Read(data)
+	if err == io.EOF {
+		return read, errors.New("connection reset")
+	}
+	return read, err
+}
+
+func TestAtomicUploads(t *testing.T) {
+	ctx := context.Background()
+	memFs := newTestFs(t, []string{"/alice"}, nil)
+	webdavHandler := handler.NewWebdavHandler(handler.NewWebdavFs(memFs, auth.New(jailedUsers("alice"))), webdav.NewMemLS(), nil)
+	put := func(target string, body io.Reader) int {
+		return serveReader(webdavHandler, "alice", http.MethodPut, target, body, nil).Code
+	}
+	members := func() []string {
+		names, err := helper.ReadDirNames(ctx, memFs, "/alice")
+		assert.NoError(t, err)
+		return names
+	}
+
+	t.Run("Completed upload replaces the file", func(t *testing.T) {
+		assert.Equal(t, http.StatusCreated, put("/alice/notes.txt", strings.NewReader("first")))
+		assert.Equal(t, http.StatusCreated, put("/alice/notes.txt", strings.NewReader("second")))
+		assert.Equal(t, "second", readFile(memFs, "/alice/notes.txt"))
+		assert.Equal(t, []string{"notes.txt"}, members())
+	})
+
+	t.Run("Interrupted upload keeps the file", func(t *testing.T) {
+		assert.NotEqual(t, http.StatusCreated, put("/alice/notes.txt", &brokenReader{strings.NewReader("trunc")}))
+		assert.Equal(t, "second", readFile(memFs, "/alice/notes.txt"))
+		assert.NotEqual(t, http.StatusCreated, put("/alice/new.txt", &brokenReader{strings.NewReader("trunc")}))
+		assert.Equal(t, []string{"notes.txt"}, members())
+	})
+
+	t.Run("Leftover temp files are removed", func(t *testing.T) {
+		file, err := memFs.OpenFile(ctx, "/alice/"+helper.UploadPrefix+"0123456789abcdef", os.O_RDWR|os.O_CREATE, 0644)
+		assert.NoError(t, err)
+		file.Close()
+		removed, err := handler.RemoveUploads(ctx, memFs, "/")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, removed)
+		assert.Equal(t, []string{"notes.txt"}, members())
+	})
+}
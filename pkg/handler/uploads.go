@@ -0,0 +1,287 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/helper"
+	"github.com/triargos/webdav/pkg/quota"
+	"github.com/triargos/webdav/pkg/upload"
+	"golang.org/x/net/webdav"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+)
+
+// UploadsHandler serves resumable uploads with the tus protocol 1.0 under /.webdav/uploads:
+//
+//	POST   /.webdav/uploads       creates an upload, the Upload-Metadata must contain its path
+//	HEAD   /.webdav/uploads/<id>  returns the offset to resume the upload from
+//	PATCH  /.webdav/uploads/<id>  appends data to the upload
+//	DELETE /.webdav/uploads/<id>  cancels the upload
+//
+// Uploads are written through the file system once they are complete, so the file only appears
+// then. Completing an upload of a locked file requires the lock token in the If header of the last
+// PATCH. Creating an upload requires the write permission on its path and enough quota for it, which
+// the upload holds until it is completed, deleted or expires.
+type UploadsHandler struct {
+	uploads    upload.Service
+	fileSystem *WebdavFs
+	lockSystem webdav.LockSystem
+	maxSize    int64
+	// mutex serializes creating uploads, so concurrent uploads can't reserve the same space
+	mutex sync.Mutex
+}
+
+// NewUploadsHandler creates a handler for uploads of at most maxSize bytes, 0 allows any size. The
+// lock system is the one of the WebDAV handler, so uploads can't replace locked files.
+func NewUploadsHandler(uploads upload.Service, fs *WebdavFs, lockSystem webdav.LockSystem, maxSize int64) *UploadsHandler {
+	return &UploadsHandler{
+		uploads:    uploads,
+		fileSystem: fs,
+		lockSystem: lockSystem,
+		maxSize:    maxSize,
+	}
+}
+
+func (h *UploadsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, ok := helper.GetUsernameFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		if h.maxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.maxSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, helper.StatePath("uploads")), "/")
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		h.create(w, r, username)
+	case r.Method == http.MethodHead && id != "":
+		h.head(w, r, username, id)
+	case r.Method == http.MethodPatch && id != "":
+		h.patch(w, r, username, id)
+	case r.Method == http.MethodDelete && id != "":
+		h.writeResult(w, r, h.uploads.Delete(r.Context(), username, id), http.StatusNoContent)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *UploadsHandler) create(w http.ResponseWriter, r *http.Request, username string) {
+	ctx := r.Context()
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if h.maxSize > 0 && length > h.maxSize {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil || metadata["path"] == "" {
+		http.Error(w, "Upload-Metadata must contain the path of the upload", http.StatusBadRequest)
+		return
+	}
+	name := h.fileSystem.authService.ResolvePath(path.Clean("/"+metadata["path"]), username)
+	if !h.fileSystem.authorize(ctx, name, auth.PermissionWrite) {
+		slog.Error("Forbidden access attempt: Upload not allowed", "remote_addr", r.RemoteAddr, "username", username, "path", name)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if parentInfo, err := h.fileSystem.FileSystem.Stat(ctx, path.Dir(name)); err != nil || !parentInfo.IsDir() {
+		http.Error(w, "Conflict", http.StatusConflict)
+		return
+	}
+	var existingSize int64
+	if fileInfo, err := h.fileSystem.FileSystem.Stat(ctx, name); err == nil {
+		if fileInfo.IsDir() {
+			http.Error(w, "Conflict", http.StatusConflict)
+			return
+		}
+		existingSize = fileInfo.Size()
+	}
+	reserved := max(length-existingSize, 0)
+	h.mutex.Lock()
+	err = h.checkQuota(ctx, username, name, reserved)
+	var created upload.Upload
+	if err == nil {
+		created, err = h.uploads.Create(ctx, username, name, length, reserved, metadata)
+	}
+	h.mutex.Unlock()
+	if err != nil {
+		h.writeResult(w, r, err, http.StatusCreated)
+		return
+	}
+	if length == 0 {
+		if err := h.complete(r, username, created); err != nil {
+			h.writeResult(w, r, err, http.StatusCreated)
+			return
+		}
+	}
+	w.Header().Set("Location", helper.GetPrefixFromContext(r.Context())+helper.StatePath("uploads", created.ID))
+	setUploadExpires(w, created)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// checkQuota checks that the space an upload reserves fits into the quota of its path, along with
+// the space reserved by the other uploads of the user below the quota root.
+func (h *UploadsHandler) checkQuota(ctx context.Context, username, name string, reserved int64) error {
+	if h.fileSystem.quota == nil {
+		return nil
+	}
+	usage, ok := h.fileSystem.quota.Usage(ctx, name)
+	if !ok {
+		return nil
+	}
+	staged, err := h.uploads.List(ctx, username)
+	if err != nil {
+		return err
+	}
+	for _, pending := range staged {
+		if h.fileSystem.authService.ContainsPath(usage.Root, pending.Path) {
+			reserved += pending.Reserved
+		}
+	}
+	if reserved > usage.Available {
+		return quota.ErrQuotaExceeded
+	}
+	return nil
+}
+
+func (h *UploadsHandler) head(w http.ResponseWriter, r *http.Request, username, id string) {
+	current, err := h.uploads.Get(r.Context(), username, id)
+	if err != nil {
+		h.writeResult(w, r, err, http.StatusOK)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(current.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(current.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	setUploadExpires(w, current)
+	w.WriteHeader(http.StatusOK)
+}
+
+// patch appends the body to an upload. When the upload is complete, it is written to its path. If
+// that fails, the client can try again with an empty PATCH at the final offset.
+func (h *UploadsHandler) patch(w http.ResponseWriter, r *http.Request, username, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	written, err := h.uploads.Write(r.Context(), username, id, offset, r.Body)
+	if err == nil && written.Offset == written.Length {
+		err = h.complete(r, username, written)
+	}
+	if err != nil {
+		h.writeResult(w, r, err, http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(written.Offset, 10))
+	setUploadExpires(w, written)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// complete writes a complete upload to its path through the file system, which checks the
+// permissions and quota of the user once more, and removes the upload. The path must not be locked
+// unless the request holds the lock.
+func (h *UploadsHandler) complete(r *http.Request, username string, completed upload.Upload) error {
+	ctx := r.Context()
+	release, err := confirmLock(h.lockSystem, r, completed.Path)
+	if err != nil {
+		return err
+	}
+	defer release()
+	source, err := h.uploads.Open(ctx, username, completed.ID)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	ctx, failed := withUploadTracking(withExpectedSize(ctx, completed.Length))
+	target, err := h.fileSystem.OpenFile(ctx, completed.Path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, copyErr := io.Copy(target, source)
+	failed.Store(copyErr != nil)
+	if err := errors.Join(copyErr, target.Close()); err != nil {
+		return err
+	}
+	return h.uploads.Delete(ctx, username, completed.ID)
+}
+
+// writeResult writes the success status of an upload operation, or the status matching its error.
+func (h *UploadsHandler) writeResult(w http.ResponseWriter, r *http.Request, err error, successStatus int) {
+	switch {
+	case err == nil:
+		w.WriteHeader(successStatus)
+	case errors.Is(err, upload.ErrNotFound):
+		http.NotFound(w, r)
+	case errors.Is(err, upload.ErrOffsetMismatch):
+		http.Error(w, "Conflict", http.StatusConflict)
+	case errors.Is(err, upload.ErrBusy), errors.Is(err, webdav.ErrLocked), errors.Is(err, webdav.ErrConfirmationFailed):
+		http.Error(w, "Locked", http.StatusLocked)
+	case errors.Is(err, upload.ErrTooLarge):
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+	case os.IsPermission(err):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	case errors.Is(err, quota.ErrQuotaExceeded):
+		http.Error(w, "Insufficient Storage", http.StatusInsufficientStorage)
+	default:
+		slog.Error("Upload operation failed", "method", r.Method, "path", r.URL.Path, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func setUploadExpires(w http.ResponseWriter, current upload.Upload) {
+	if !current.Expires.IsZero() {
+		w.Header().Set("Upload-Expires", current.Expires.Format(http.TimeFormat))
+	}
+}
+
+// parseUploadMetadata parses the comma separated key and base64 encoded value pairs of the
+// Upload-Metadata header.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,128 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/mocks"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/handler"
+	"github.com/triargos/webdav/pkg/quota"
+	"github.com/triargos/webdav/pkg/upload"
+	"golang.org/x/net/webdav"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumableUploads(t *testing.T) {
+	ctx := context.Background()
+	memFs := newTestFs(t, []string{"/alice", "/bob"}, nil)
+	webdavFs := handler.NewWebdavFs(memFs, auth.New(jailedUsers("alice", "bob")))
+	lockSystem := webdav.NewMemLS()
+	uploadsHandler := handler.NewUploadsHandler(upload.NewUploadService(memFs, time.Hour), webdavFs, lockSystem, 0)
+	tus := map[string]string{"Tus-Resumable": "1.0.0"}
+	create := func(username, name string, length int) *httptest.ResponseRecorder {
+		return serve(uploadsHandler, username, http.MethodPost, "/.webdav/uploads", "", map[string]string{
+			"Tus-Resumable":   "1.0.0",
+			"Upload-Length":   strconv.Itoa(length),
+			"Upload-Metadata": "path " + base64.StdEncoding.EncodeToString([]byte(name)),
+		})
+	}
+	patch := func(location string, offset int, body io.Reader) *httptest.ResponseRecorder {
+		return serveReader(uploadsHandler, "alice", http.MethodPatch, location, body, map[string]string{
+			"Tus-Resumable": "1.0.0",
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		})
+	}
+
+	t.Run("Resume an interrupted upload", func(t *testing.T) {
+		recorder := create("alice", "/alice/video.mp4", 10)
+		assert.Equal(t, http.StatusCreated, recorder.Code)
+		location := recorder.Header().Get("Location")
+		assert.NotEqual(t, http.StatusNoContent, patch(location, 0, &brokenReader{strings.NewReader("01234")}).Code)
+		_, err := memFs.Stat(ctx, "/alice/video.mp4")
+		assert.True(t, os.IsNotExist(err), "the file appears once the upload is complete")
+
+		recorder = serve(uploadsHandler, "alice", http.MethodHead, location, "", tus)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "5", recorder.Header().Get("Upload-Offset"))
+		assert.Equal(t, http.StatusConflict, patch(location, 0, strings.NewReader("0123456789")).Code)
+		recorder = patch(location, 5, strings.NewReader("56789"))
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+		assert.Equal(t, "10", recorder.Header().Get("Upload-Offset"))
+
+		assert.Equal(t, "0123456789", readFile(memFs, "/alice/video.mp4"))
+		assert.Equal(t, http.StatusNotFound, serve(uploadsHandler, "alice", http.MethodHead, location, "", tus).Code)
+	})
+
+	t.Run("Locked files are not replaced", func(t *testing.T) {
+		writeFile(t, memFs, "/alice/locked.txt", "original")
+		token, err := lockSystem.Create(time.Now(), webdav.LockDetails{Root: "/alice/locked.txt", Duration: time.Hour, ZeroDepth: true})
+		assert.NoError(t, err)
+		location := create("alice", "/alice/locked.txt", 3).Header().Get("Location")
+		assert.Equal(t, http.StatusLocked, patch(location, 0, strings.NewReader("new")).Code)
+		assert.Equal(t, "original", readFile(memFs, "/alice/locked.txt"))
+
+		recorder := serve(uploadsHandler, "alice", http.MethodPatch, location, "", map[string]string{
+			"Tus-Resumable": "1.0.0",
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": "3",
+			"If":            "(<" + token + ">)",
+		})
+		assert.Equal(t, http.StatusNoContent, recorder.Code, "the lock holder completes the upload")
+		assert.Equal(t, "new", readFile(memFs, "/alice/locked.txt"))
+	})
+
+	t.Run("Uploads require the write permission", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, create("bob", "/alice/other.txt", 3).Code)
+		assert.Equal(t, http.StatusForbidden, create("alice", "/.webdav/trash/alice/x", 3).Code)
+	})
+
+	t.Run("Uploads are private", func(t *testing.T) {
+		location := create("alice", "/alice/private.txt", 3).Header().Get("Location")
+		assert.Equal(t, http.StatusNotFound, serve(uploadsHandler, "bob", http.MethodHead, location, "", tus).Code)
+		assert.Equal(t, http.StatusNoContent, serve(uploadsHandler, "alice", http.MethodDelete, location, "", tus).Code)
+	})
+
+	t.Run("Unsupported protocol version", func(t *testing.T) {
+		recorder := serve(uploadsHandler, "alice", http.MethodHead, "/.webdav/uploads/x", "", map[string]string{"Tus-Resumable": "0.2.2"})
+		assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+		assert.Equal(t, "1.0.0", recorder.Header().Get("Tus-Version"))
+	})
+}
+
+func TestResumableUploadsQuota(t *testing.T) {
+	memFs := newTestFs(t, []string{"/alice"}, map[string]string{"/alice/old.bin": strings.Repeat("o", 20)})
+	userService := mocks.NewMockUserService(map[string]config.User{
+		"alice": {Root: "/alice", Jail: true, Quota: "100"},
+	})
+	authService := auth.New(userService)
+	webdavFs := handler.NewWebdavFsWithOptions(memFs, authService, handler.FsOptions{
+		Quota: quota.NewQuotaService(memFs, userService, nil, authService.ContainsPath, quota.DefaultUsageTTL),
+	})
+	uploadsHandler := handler.NewUploadsHandler(upload.NewUploadService(memFs, time.Hour), webdavFs, webdav.NewMemLS(), 0)
+	create := func(name string, length int) *httptest.ResponseRecorder {
+		return serve(uploadsHandler, "alice", http.MethodPost, "/.webdav/uploads", "", map[string]string{
+			"Tus-Resumable":   "1.0.0",
+			"Upload-Length":   strconv.Itoa(length),
+			"Upload-Metadata": "path " + base64.StdEncoding.EncodeToString([]byte(name)),
+		})
+	}
+	tus := map[string]string{"Tus-Resumable": "1.0.0"}
+
+	first := create("/alice/first.bin", 50)
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Equal(t, http.StatusInsufficientStorage, create("/alice/second.bin", 50).Code, "started uploads hold their space")
+	assert.Equal(t, http.StatusCreated, create("/alice/old.bin", 50).Code, "replacing a file only holds the difference")
+
+	assert.Equal(t, http.StatusNoContent, serve(uploadsHandler, "alice", http.MethodDelete, first.Header().Get("Location"), "", tus).Code)
+	assert.Equal(t, http.StatusCreated, create("/alice/second.bin", 50).Code, "deleted uploads release their space")
+}
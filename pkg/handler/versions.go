@@ -0,0 +1,277 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/helper"
+	"github.com/triargos/webdav/pkg/quota"
+	"github.com/triargos/webdav/pkg/version"
+	"golang.org/x/net/webdav"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// VersionsHandler serves the versions of files as a read-only WebDAV tree under /.webdav/versions.
+// Every file with versions is a collection there, holding its versions named by their ID:
+//
+//	PROPFIND /.webdav/versions/<path>       lists the versions of a file
+//	GET      /.webdav/versions/<path>/<id>  downloads a version
+//	POST     /.webdav/versions/<path>/<id>  restores a version
+//	DELETE   /.webdav/versions/<path>/<id>  deletes a version
+//
+// Paths are the paths the client sees. Listing and downloading versions requires the read
+// permission on the file, restoring requires the write permission and deleting the delete permission.
+// A locked file is only restored with the lock token in the If header.
+type VersionsHandler struct {
+	versions   version.Service
+	fileSystem *WebdavFs
+	lockSystem webdav.LockSystem
+	logger     func(*http.Request, error)
+}
+
+// NewVersionsHandler creates a handler that restores versions through a file system, so restoring is
+// subject to its permissions and quotas. The lock system is the one of the WebDAV handler, so
+// restoring can't replace locked files.
+func NewVersionsHandler(versions version.Service, fs *WebdavFs, lockSystem webdav.LockSystem, logger func(*http.Request, error)) *VersionsHandler {
+	return &VersionsHandler{
+		versions:   versions,
+		fileSystem: fs,
+		lockSystem: lockSystem,
+		logger:     logger,
+	}
+}
+
+func (h *VersionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, ok := helper.GetUsernameFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	resolve := func(name string) string {
+		return h.fileSystem.authService.ResolvePath(name, username)
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		prefixed, prefix := helper.RestorePrefix(r)
+		webdavHandler := &webdav.Handler{
+			Prefix:     prefix + helper.StatePath("versions"),
+			FileSystem: &versionFs{versions: h.versions, fileSystem: h.fileSystem, resolve: resolve},
+			LockSystem: h.lockSystem,
+			Logger:     h.logger,
+		}
+		webdavHandler.ServeHTTP(w, prefixed)
+	case http.MethodPost, http.MethodDelete:
+		fileName, id := path.Split(path.Clean("/" + strings.TrimPrefix(r.URL.Path, helper.StatePath("versions"))))
+		name := resolve(path.Clean(fileName))
+		if r.Method == http.MethodPost {
+			h.restore(w, r, name, id)
+		} else {
+			h.delete(w, r, name, id)
+		}
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// restore writes a version over its file through the file system, which saves the replaced content
+// as a version in turn.
+func (h *VersionsHandler) restore(w http.ResponseWriter, r *http.Request, name, id string) {
+	ctx := r.Context()
+	if !h.fileSystem.authorize(ctx, name, auth.PermissionRead) {
+		http.NotFound(w, r)
+		return
+	}
+	selected, err := h.versions.Get(ctx, name, id)
+	if err != nil {
+		h.writeResult(w, r, err, http.StatusOK)
+		return
+	}
+	source, err := h.versions.Open(ctx, name, id)
+	if err != nil {
+		h.writeResult(w, r, err, http.StatusOK)
+		return
+	}
+	defer source.Close()
+	release, err := confirmLock(h.lockSystem, r, name)
+	if err != nil {
+		h.writeResult(w, r, err, http.StatusOK)
+		return
+	}
+	defer release()
+	ctx, failed := withUploadTracking(withExpectedSize(ctx, selected.Size))
+	target, err := h.fileSystem.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		h.writeResult(w, r, err, http.StatusOK)
+		return
+	}
+	_, copyErr := io.Copy(target, source)
+	// Keep the current content if the version can't be read completely
+	failed.Store(copyErr != nil)
+	closeErr := target.Close()
+	h.writeResult(w, r, errors.Join(copyErr, closeErr), http.StatusNoContent)
+}
+
+func (h *VersionsHandler) delete(w http.ResponseWriter, r *http.Request, name, id string) {
+	if !h.fileSystem.authorize(r.Context(), name, auth.PermissionRead) {
+		http.NotFound(w, r)
+		return
+	}
+	if !h.fileSystem.authorize(r.Context(), name, auth.PermissionDelete) {
+		h.writeResult(w, r, os.ErrPermission, http.StatusOK)
+		return
+	}
+	h.writeResult(w, r, h.versions.Delete(r.Context(), name, id), http.StatusNoContent)
+}
+
+// writeResult writes the success status of a version operation, or the status matching its error.
+func (h *VersionsHandler) writeResult(w http.ResponseWriter, r *http.Request, err error, successStatus int) {
+	switch {
+	case err == nil:
+		w.WriteHeader(successStatus)
+	case errors.Is(err, version.ErrNotFound), os.IsNotExist(err):
+		http.NotFound(w, r)
+	case os.IsPermission(err):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	case errors.Is(err, webdav.ErrLocked), errors.Is(err, webdav.ErrConfirmationFailed):
+		http.Error(w, "Locked", http.StatusLocked)
+	case errors.Is(err, quota.ErrQuotaExceeded):
+		http.Error(w, "Insufficient Storage", http.StatusInsufficientStorage)
+	default:
+		slog.Error("Version operation failed", "method", r.Method, "path", r.URL.Path, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// versionFs is the read-only tree of versions. A path is either a file with versions, which is a
+// collection, or a version in such a collection.
+type versionFs struct {
+	versions   version.Service
+	fileSystem *WebdavFs
+	resolve    func(name string) string
+}
+
+func (f *versionFs) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&writeFlags != 0 {
+		return nil, os.ErrPermission
+	}
+	name = path.Clean("/" + name)
+	fileName, id := path.Split(name)
+	if resolved := f.resolve(path.Clean(fileName)); f.fileSystem.authorize(ctx, resolved, auth.PermissionRead) {
+		if selected, err := f.versions.Get(ctx, resolved, id); err == nil {
+			file, err := f.versions.Open(ctx, resolved, id)
+			if err != nil {
+				return nil, err
+			}
+			return &versionFile{File: file, fileInfo: newVersionInfo(selected)}, nil
+		}
+	}
+	resolved := f.resolve(name)
+	if !f.fileSystem.authorize(ctx, resolved, auth.PermissionRead) {
+		return nil, os.ErrNotExist
+	}
+	versions, err := f.versions.List(ctx, resolved)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, os.ErrNotExist
+	}
+	fileInfos := make([]os.FileInfo, 0, len(versions))
+	for _, listed := range versions {
+		fileInfos = append(fileInfos, newVersionInfo(listed))
+	}
+	dirInfo := &staticFileInfo{name: path.Base(name), modTime: versions[0].Created, dir: true}
+	return &versionDir{fileInfo: dirInfo, entries: fileInfos}, nil
+}
+
+func (f *versionFs) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	file, err := f.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.Stat()
+}
+
+func (f *versionFs) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (f *versionFs) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (f *versionFs) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+// versionFile is a version, with the size and modification time of the content it was saved from.
+type versionFile struct {
+	webdav.File
+	fileInfo os.FileInfo
+}
+
+func (f *versionFile) Stat() (os.FileInfo, error) {
+	return f.fileInfo, nil
+}
+
+// versionDir lists the versions of a file.
+type versionDir struct {
+	fileInfo os.FileInfo
+	entries  []os.FileInfo
+	offset   int
+}
+
+func (d *versionDir) Readdir(count int) ([]os.FileInfo, error) {
+	return readEntries(d.entries, &d.offset, count)
+}
+
+func (d *versionDir) Stat() (os.FileInfo, error) {
+	return d.fileInfo, nil
+}
+
+func (d *versionDir) Read([]byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *versionDir) Seek(int64, int) (int64, error) {
+	return 0, nil
+}
+
+func (d *versionDir) Write([]byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (d *versionDir) Close() error {
+	return nil
+}
+
+func newVersionInfo(selected version.Version) os.FileInfo {
+	return &staticFileInfo{name: selected.ID, size: selected.Size, modTime: selected.Modified}
+}
+
+type staticFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *staticFileInfo) Name() string       { return fi.name }
+func (fi *staticFileInfo) Size() int64        { return fi.size }
+func (fi *staticFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *staticFileInfo) IsDir() bool        { return fi.dir }
+func (fi *staticFileInfo) Sys() any           { return nil }
+
+func (fi *staticFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
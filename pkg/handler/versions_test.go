@@ -0,0 +1,77 @@
+package handler_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/handler"
+	"github.com/triargos/webdav/pkg/version"
+	"golang.org/x/net/webdav"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestVersions(t *testing.T) {
+	ctx := context.Background()
+	memFs := newTestFs(t, []string{"/alice", "/bob"}, nil)
+	versionService := version.NewVersionService(memFs, version.Retention{})
+	webdavFs := handler.NewWebdavFsWithOptions(memFs, auth.New(jailedUsers("alice", "bob")), handler.FsOptions{Versions: versionService})
+	lockSystem := webdav.NewMemLS()
+	webdavHandler := handler.NewWebdavHandler(webdavFs, lockSystem, nil)
+	versionsHandler := handler.NewVersionsHandler(versionService, webdavFs, lockSystem, nil)
+	depth := map[string]string{"Depth": "1"}
+
+	for _, body := range []string{"first", "second", "third"} {
+		assert.Equal(t, http.StatusCreated, serve(webdavHandler, "alice", http.MethodPut, "/alice/notes.txt", body, nil).Code)
+	}
+	versions, err := versionService.List(ctx, "/alice/notes.txt")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	first := versions[1]
+
+	t.Run("Versions collection", func(t *testing.T) {
+		recorder := serve(versionsHandler, "alice", "PROPFIND", "/.webdav/versions/alice/notes.txt", "", depth)
+		assert.Equal(t, http.StatusMultiStatus, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "/.webdav/versions/alice/notes.txt/"+first.ID)
+		recorder = serve(versionsHandler, "alice", http.MethodGet, "/.webdav/versions/alice/notes.txt/"+first.ID, "", nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "first", recorder.Body.String())
+	})
+
+	t.Run("Versions of inaccessible files are hidden", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, serve(versionsHandler, "bob", "PROPFIND", "/.webdav/versions/alice/notes.txt", "", depth).Code)
+		assert.Equal(t, http.StatusNotFound, serve(versionsHandler, "bob", http.MethodPost, "/.webdav/versions/alice/notes.txt/"+first.ID, "", nil).Code)
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		recorder := serve(versionsHandler, "alice", http.MethodPost, "/.webdav/versions/alice/notes.txt/"+first.ID, "", nil)
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+		assert.Equal(t, "first", readFile(memFs, "/alice/notes.txt"))
+		versions, _ := versionService.List(ctx, "/alice/notes.txt")
+		assert.Len(t, versions, 3)
+	})
+
+	t.Run("Locked files are not restored", func(t *testing.T) {
+		token, err := lockSystem.Create(time.Now(), webdav.LockDetails{Root: "/alice/notes.txt", Duration: time.Hour, ZeroDepth: true})
+		assert.NoError(t, err)
+		defer lockSystem.Unlock(time.Now(), token)
+		versions, _ := versionService.List(ctx, "/alice/notes.txt")
+		recorder := serve(versionsHandler, "alice", http.MethodPost, "/.webdav/versions/alice/notes.txt/"+versions[0].ID, "", nil)
+		assert.Equal(t, http.StatusLocked, recorder.Code)
+		assert.Equal(t, "first", readFile(memFs, "/alice/notes.txt"))
+		recorder = serve(versionsHandler, "alice", http.MethodPost, "/.webdav/versions/alice/notes.txt/"+versions[0].ID, "", map[string]string{"If": "(<" + token + ">)"})
+		assert.Equal(t, http.StatusNoContent, recorder.Code, "the lock holder restores the version")
+		assert.Equal(t, "third", readFile(memFs, "/alice/notes.txt"))
+	})
+
+	t.Run("Versions collection is read-only", func(t *testing.T) {
+		recorder := serve(versionsHandler, "alice", http.MethodPut, "/.webdav/versions/alice/notes.txt/"+first.ID, "changed", nil)
+		assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, serve(versionsHandler, "alice", http.MethodDelete, "/.webdav/versions/alice/notes.txt/"+first.ID, "", nil).Code)
+		assert.Equal(t, http.StatusNotFound, serve(versionsHandler, "alice", http.MethodGet, "/.webdav/versions/alice/notes.txt/"+first.ID, "", nil).Code)
+	})
+}
@@ -0,0 +1,282 @@
+package handler
+
+import (
+	"context"
+	"encoding/xml"
+	"github.com/triargos/webdav/pkg/checksum"
+	"github.com/triargos/webdav/pkg/helper"
+	"github.com/triargos/webdav/pkg/user"
+	"golang.org/x/net/webdav"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// VirtualRootHandler serves every user the namespace of their virtual root. The file system and the
+// lock system are wrapped per request, so paths are mapped onto the content directory before the
+// access rules of the wrapped file system are checked.
+type VirtualRootHandler struct {
+	fileSystem  webdav.FileSystem
+	lockSystem  webdav.LockSystem
+	userService user.Service
+	logger      func(*http.Request, error)
+}
+
+func NewVirtualRootHandler(fs webdav.FileSystem, ls webdav.LockSystem, userService user.Service, logger func(*http.Request, error)) *VirtualRootHandler {
+	return &VirtualRootHandler{
+		fileSystem:  fs,
+		lockSystem:  ls,
+		userService: userService,
+		logger:      logger,
+	}
+}
+
+func (h *VirtualRootHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, _ := helper.GetUsernameFromContext(r.Context())
+	virtualRoot, ok := h.userService.VirtualRoot(username)
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	fs := &virtualRootFs{FileSystem: h.fileSystem, virtualRoot: virtualRoot}
+	ls := &virtualRootLockSystem{LockSystem: h.lockSystem, virtualRoot: virtualRoot}
+	NewWebdavHandler(fs, ls, h.logger).ServeHTTP(w, r)
+}
+
+// virtualRootFs maps the paths of a namespace onto the wrapped file system. The root and the mount
+// points of shared folders can neither be removed nor moved.
+type virtualRootFs struct {
+	webdav.FileSystem
+	virtualRoot user.VirtualRoot
+}
+
+func (f *virtualRootFs) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	file, err := f.FileSystem.OpenFile(ctx, f.virtualRoot.Resolve(name), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if mountName, ok := f.virtualRoot.MountPoint(name); ok {
+		return &mountedFile{File: file, name: mountName}, nil
+	}
+	if isRoot(name) && len(f.virtualRoot.Mounts) > 0 {
+		return &virtualRootDir{File: file, ctx: ctx, fs: f}, nil
+	}
+	return file, nil
+}
+
+func (f *virtualRootFs) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fileInfo, err := f.FileSystem.Stat(ctx, f.virtualRoot.Resolve(name))
+	if err != nil {
+		return nil, err
+	}
+	if mountName, ok := f.virtualRoot.MountPoint(name); ok {
+		return &renamedFileInfo{FileInfo: fileInfo, name: mountName}, nil
+	}
+	return fileInfo, nil
+}
+
+func (f *virtualRootFs) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return f.FileSystem.Mkdir(ctx, f.virtualRoot.Resolve(name), perm)
+}
+
+func (f *virtualRootFs) RemoveAll(ctx context.Context, name string) error {
+	if f.isFixed(name) {
+		return os.ErrPermission
+	}
+	return f.FileSystem.RemoveAll(ctx, f.virtualRoot.Resolve(name))
+}
+
+func (f *virtualRootFs) Rename(ctx context.Context, oldName, newName string) error {
+	if f.isFixed(oldName) || f.isFixed(newName) {
+		return os.ErrPermission
+	}
+	return f.FileSystem.Rename(ctx, f.virtualRoot.Resolve(oldName), f.virtualRoot.Resolve(newName))
+}
+
+func (f *virtualRootFs) CopyProps(ctx context.Context, src, dst string, recursive bool) error {
+	copier, ok := f.FileSystem.(propertyCopier)
+	if !ok {
+		return nil
+	}
+	return copier.CopyProps(ctx, f.virtualRoot.Resolve(src), f.virtualRoot.Resolve(dst), recursive)
+}
+
+func (f *virtualRootFs) ChecksumAlgorithms() []string {
+	store, ok := f.FileSystem.(checksumStore)
+	if !ok {
+		return nil
+	}
+	return store.ChecksumAlgorithms()
+}
+
+func (f *virtualRootFs) Checksums(ctx context.Context, name string) (checksum.Checksums, error) {
+	store, ok := f.FileSystem.(checksumStore)
+	if !ok {
+		return nil, nil
+	}
+	return store.Checksums(ctx, f.virtualRoot.Resolve(name))
+}
+
+func (f *virtualRootFs) SetChecksums(ctx context.Context, name string, checksums checksum.Checksums) error {
+	store, ok := f.FileSystem.(checksumStore)
+	if !ok {
+		return nil
+	}
+	return store.SetChecksums(ctx, f.virtualRoot.Resolve(name), checksums)
+}
+
+func (f *virtualRootFs) SaveVersion(ctx context.Context, name string) error {
+	saver, ok := f.FileSystem.(versionSaver)
+	if !ok {
+		return nil
+	}
+	return saver.SaveVersion(ctx, f.virtualRoot.Resolve(name))
+}
+
+func (f *virtualRootFs) isFixed(name string) bool {
+	_, mountPoint := f.virtualRoot.MountPoint(name)
+	return mountPoint || isRoot(name)
+}
+
+func isRoot(name string) bool {
+	return name == "" || name == "/"
+}
+
+// virtualRootDir is the root of a namespace. Its members are the members of the user's root and the
+// mounted shared folders, which hide members of the same name.
+type virtualRootDir struct {
+	webdav.File
+	ctx     context.Context
+	fs      *virtualRootFs
+	entries []os.FileInfo
+	offset  int
+}
+
+func (d *virtualRootDir) Readdir(count int) ([]os.FileInfo, error) {
+	if d.entries == nil {
+		entries, err := d.readEntries()
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+	}
+	return readEntries(d.entries, &d.offset, count)
+}
+
+// readEntries implements Readdir on a listing that has been read before, advancing the offset.
+func readEntries(entries []os.FileInfo, offset *int, count int) ([]os.FileInfo, error) {
+	remaining := entries[*offset:]
+	if count <= 0 {
+		*offset = len(entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(remaining) {
+		count = len(remaining)
+	}
+	*offset += count
+	return remaining[:count], nil
+}
+
+func (d *virtualRootDir) readEntries() ([]os.FileInfo, error) {
+	members, err := d.File.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]os.FileInfo, 0, len(members)+len(d.fs.virtualRoot.Mounts))
+	for _, member := range members {
+		if _, shadowed := d.fs.virtualRoot.Mounts[member.Name()]; !shadowed {
+			entries = append(entries, member)
+		}
+	}
+	for mountName, mountRoot := range d.fs.virtualRoot.Mounts {
+		fileInfo, err := d.fs.FileSystem.Stat(d.ctx, mountRoot)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, &renamedFileInfo{FileInfo: fileInfo, name: mountName})
+	}
+	return entries, nil
+}
+
+func (d *virtualRootDir) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps(d.File)
+}
+
+func (d *virtualRootDir) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return patchDeadProps(d.File, patches)
+}
+
+// mountedFile is the root of a shared folder, named after its mount point.
+type mountedFile struct {
+	webdav.File
+	name string
+}
+
+func (f *mountedFile) Stat() (os.FileInfo, error) {
+	fileInfo, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &renamedFileInfo{FileInfo: fileInfo, name: f.name}, nil
+}
+
+func (f *mountedFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps(f.File)
+}
+
+func (f *mountedFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return patchDeadProps(f.File, patches)
+}
+
+type renamedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi *renamedFileInfo) Name() string {
+	return fi.name
+}
+
+// virtualRootLockSystem keeps the locks of all namespaces in one lock system by locking the paths
+// in the content directory.
+type virtualRootLockSystem struct {
+	webdav.LockSystem
+	virtualRoot user.VirtualRoot
+}
+
+func (ls *virtualRootLockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	if name0 != "" {
+		name0 = ls.virtualRoot.Resolve(name0)
+	}
+	if name1 != "" {
+		name1 = ls.virtualRoot.Resolve(name1)
+	}
+	return ls.LockSystem.Confirm(now, name0, name1, conditions...)
+}
+
+func (ls *virtualRootLockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	details.Root = ls.virtualRoot.Resolve(details.Root)
+	return ls.LockSystem.Create(now, details)
+}
+
+func (ls *virtualRootLockSystem) CreateTemporary(now time.Time, details webdav.LockDetails) (string, error) {
+	details.Root = ls.virtualRoot.Resolve(details.Root)
+	return createTemporaryLock(ls.LockSystem, now, details)
+}
+
+func (ls *virtualRootLockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	details, err := ls.LockSystem.Refresh(now, token, duration)
+	if err != nil {
+		return details, err
+	}
+	root, ok := ls.virtualRoot.Unresolve(details.Root)
+	if !ok {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	details.Root = root
+	return details, nil
+}
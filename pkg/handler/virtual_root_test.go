@@ -0,0 +1,61 @@
+package handler_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/mocks"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/handler"
+	"golang.org/x/net/webdav"
+	"net/http"
+	"testing"
+)
+
+func TestVirtualRootHandler(t *testing.T) {
+	ctx := context.Background()
+	memFs := newTestFs(t, nil, map[string]string{"/Users/alice/notes.txt": "", "/Users/bob/secret.txt": "", "/Groups/team/plan.txt": ""})
+	userService := mocks.NewMockUserService(map[string]config.User{
+		"alice": {Root: "/Users/alice", Jail: true},
+		"bob":   {Root: "/Users/bob", Jail: true},
+	})
+	userService.Groups = map[string]config.Group{
+		"team": {Members: []string{"alice"}, Root: "/Groups/team"},
+	}
+	userService.VirtualRoots = true
+	authService := auth.New(userService)
+	virtualRootHandler := handler.NewVirtualRootHandler(handler.NewWebdavFs(memFs, authService), webdav.NewMemLS(), userService, nil)
+
+	t.Run("Root lists home and shared folders", func(t *testing.T) {
+		recorder := serve(virtualRootHandler, "alice", "PROPFIND", "/", "", map[string]string{"Depth": "1"})
+		assert.Equal(t, http.StatusMultiStatus, recorder.Code)
+		body := recorder.Body.String()
+		assert.Contains(t, body, "<D:href>/notes.txt</D:href>")
+		assert.Contains(t, body, "<D:href>/team/</D:href>")
+		assert.NotContains(t, body, "secret.txt")
+		assert.NotContains(t, body, "Users")
+	})
+
+	t.Run("Shared folder is readable", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, serve(virtualRootHandler, "alice", http.MethodGet, "/team/plan.txt", "", nil).Code)
+		assert.Equal(t, http.StatusNotFound, serve(virtualRootHandler, "bob", http.MethodGet, "/team/plan.txt", "", nil).Code)
+	})
+
+	t.Run("Writes go to the home of the user", func(t *testing.T) {
+		assert.Equal(t, http.StatusCreated, serve(virtualRootHandler, "bob", "MKCOL", "/archive", "", nil).Code)
+		_, err := memFs.Stat(ctx, "/Users/bob/archive")
+		assert.NoError(t, err)
+	})
+
+	t.Run("Mount points are fixed", func(t *testing.T) {
+		recorder := serve(virtualRootHandler, "alice", "MOVE", "/team", "", map[string]string{"Destination": "http://example.com/renamed"})
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+		assert.Equal(t, http.StatusMethodNotAllowed, serve(virtualRootHandler, "alice", http.MethodDelete, "/team", "", nil).Code)
+	})
+
+	t.Run("Locks are kept per namespace", func(t *testing.T) {
+		lockBody := `<?xml version="1.0" encoding="utf-8"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`
+		assert.Equal(t, http.StatusCreated, serve(virtualRootHandler, "alice", "LOCK", "/shared.txt", lockBody, nil).Code)
+		assert.Equal(t, http.StatusCreated, serve(virtualRootHandler, "bob", http.MethodPut, "/shared.txt", "", nil).Code)
+	})
+}
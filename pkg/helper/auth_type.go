@@ -1,5 +1,28 @@
 package helper
 
+// ValidateAuthType checks the server wide auth type. "any" serves basic and digest at the same time.
 func ValidateAuthType(authType string) bool {
-	return authType == "basic" || authType == "digest"
+	return authType == "basic" || authType == "digest" || authType == "any"
+}
+
+// AuthTypes returns the schemes a server wide auth type consists of.
+func AuthTypes(authType string) []string {
+	if authType == "any" {
+		return []string{"basic", "digest"}
+	}
+	return []string{authType}
+}
+
+// AllowsDigest reports whether digest credentials are needed for a user, given the server wide auth
+// type and the auth types configured for the user.
+func AllowsDigest(authType string, userAuthTypes []string) bool {
+	if len(userAuthTypes) == 0 {
+		userAuthTypes = AuthTypes(authType)
+	}
+	for _, userAuthType := range userAuthTypes {
+		if userAuthType == "digest" {
+			return authType == "digest" || authType == "any"
+		}
+	}
+	return false
 }
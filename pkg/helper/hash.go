@@ -2,10 +2,36 @@ package helper
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
+	"strings"
 )
 
+// DigestAlgorithms lists the base digest algorithms credentials are stored for, strongest first.
+var DigestAlgorithms = []string{"SHA-256", "MD5"}
+
 func Md5Hash(data string) string {
 	hash := md5.Sum([]byte(data))
 	return hex.EncodeToString(hash[:])
 }
+
+func Sha256Hash(data string) string {
+	hash := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(hash[:])
+}
+
+// DigestHashFunc returns the hash function of a digest algorithm, ignoring a "-sess" suffix.
+func DigestHashFunc(algorithm string) (func(string) string, bool) {
+	switch DigestBaseAlgorithm(algorithm) {
+	case "MD5":
+		return Md5Hash, true
+	case "SHA-256":
+		return Sha256Hash, true
+	}
+	return nil, false
+}
+
+// DigestBaseAlgorithm returns the canonical name of a digest algorithm without its "-sess" suffix.
+func DigestBaseAlgorithm(algorithm string) string {
+	return strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS")
+}
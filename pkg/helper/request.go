@@ -1,12 +1,91 @@
 package helper
 
-import "context"
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
 
 var (
-	UserNameContextKey = "user"
+	UserNameContextKey   = "user"
+	TokenScopeContextKey = "token_scope"
+	PrefixContextKey     = "prefix"
 )
 
+// TokenScope limits what a request authenticated with an app password may do.
+type TokenScope struct {
+	ReadOnly bool
+	// Paths the token is limited to. An empty list allows every path the user may access.
+	Paths []string
+}
+
 func GetUsernameFromContext(ctx context.Context) (string, bool) {
 	username, ok := ctx.Value(UserNameContextKey).(string)
 	return username, ok
 }
+
+func GetTokenScopeFromContext(ctx context.Context) (TokenScope, bool) {
+	scope, ok := ctx.Value(TokenScopeContextKey).(TokenScope)
+	return scope, ok
+}
+
+// GetPrefixFromContext returns the URL prefix StripPrefix removed from the path of a request, or an
+// empty string if the request was not served under a prefix.
+func GetPrefixFromContext(ctx context.Context) string {
+	prefix, _ := ctx.Value(PrefixContextKey).(string)
+	return prefix
+}
+
+// StripPrefix serves the requests below a URL prefix such as /dav with the prefix removed from their
+// path, so they are authorized and routed like requests to the root. Other requests are not found.
+// The prefix is kept in the context for handlers that build URLs, see RestorePrefix.
+func StripPrefix(prefix string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := cutPrefix(r.URL.Path, prefix)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		stripped := r.WithContext(context.WithValue(r.Context(), PrefixContextKey, prefix))
+		strippedUrl := *r.URL
+		strippedUrl.Path = rest
+		strippedUrl.RawPath = ""
+		stripped.URL = &strippedUrl
+		next.ServeHTTP(w, stripped)
+	})
+}
+
+// RestorePrefix returns a request with the prefix StripPrefix removed put back in front of its path,
+// along with the prefix. It is for handlers such as webdav.Handler that strip the prefix themselves
+// and write it into the URLs of their responses.
+func RestorePrefix(r *http.Request) (*http.Request, string) {
+	prefix := GetPrefixFromContext(r.Context())
+	if prefix == "" {
+		return r, ""
+	}
+	restored := r.WithContext(context.WithValue(r.Context(), PrefixContextKey, ""))
+	restoredUrl := *r.URL
+	restoredUrl.Path = prefix + r.URL.Path
+	restoredUrl.RawPath = ""
+	restored.URL = &restoredUrl
+	return restored, prefix
+}
+
+// StripDestinationPrefix returns the path of a Destination header with the prefix StripPrefix
+// removed from the request, if the destination is below the prefix.
+func StripDestinationPrefix(ctx context.Context, destination *url.URL) (string, bool) {
+	return cutPrefix(destination.Path, GetPrefixFromContext(ctx))
+}
+
+// cutPrefix removes a URL prefix from a path. /dav is a prefix of /dav and /dav/file, but not of /davfile.
+func cutPrefix(name, prefix string) (string, bool) {
+	rest, ok := strings.CutPrefix(name, prefix)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return "", false
+	}
+	if rest == "" {
+		rest = "/"
+	}
+	return rest, true
+}
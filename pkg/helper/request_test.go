@@ -2,6 +2,9 @@ package helper
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -42,3 +45,52 @@ func TestGetUsernameFromContext(t *testing.T) {
 		})
 	}
 }
+
+func TestStripPrefix(t *testing.T) {
+	var served *http.Request
+	handler := StripPrefix("/dav", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = r
+	}))
+	tests := []struct {
+		target   string
+		expected string
+		found    bool
+	}{
+		{target: "/dav", expected: "/", found: true},
+		{target: "/dav/", expected: "/", found: true},
+		{target: "/dav/docs/a%20b.txt", expected: "/docs/a b.txt", found: true},
+		{target: "/davdocs", found: false},
+		{target: "/docs", found: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			served = nil
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if !tt.found {
+				assert.Equal(t, http.StatusNotFound, recorder.Code)
+				assert.Nil(t, served)
+				return
+			}
+			assert.Equal(t, tt.expected, served.URL.Path)
+			assert.Equal(t, "/dav", GetPrefixFromContext(served.Context()))
+
+			restored, prefix := RestorePrefix(served)
+			assert.Equal(t, "/dav", prefix)
+			assert.Equal(t, "/dav"+tt.expected, restored.URL.Path)
+			_, prefix = RestorePrefix(restored)
+			assert.Empty(t, prefix, "the prefix is restored once")
+		})
+	}
+
+	t.Run("Destination", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), PrefixContextKey, "/dav")
+		destination, _ := url.Parse("http://example.com/dav/docs/copy.txt")
+		name, ok := StripDestinationPrefix(ctx, destination)
+		assert.True(t, ok)
+		assert.Equal(t, "/docs/copy.txt", name)
+		destination, _ = url.Parse("http://example.com/docs/copy.txt")
+		_, ok = StripDestinationPrefix(ctx, destination)
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,53 @@
+package helper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+// ParseSize parses a size such as "512M" or "10 GB". Units are binary, so 1K is 1024 bytes. A
+// size without a unit is a number of bytes.
+func ParseSize(value string) (int64, error) {
+	trimmed := strings.ToUpper(strings.TrimSpace(value))
+	trimmed = strings.Replace(trimmed, "IB", "B", 1)
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(trimmed, unit.suffix) {
+			trimmed, multiplier = strings.TrimSpace(strings.TrimSuffix(trimmed, unit.suffix)), unit.multiplier
+			break
+		}
+	}
+	number, err := strconv.ParseFloat(trimmed, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	size := number * float64(multiplier)
+	if size >= 1<<63 {
+		return 0, fmt.Errorf("size %q is too large", value)
+	}
+	return int64(size), nil
+}
+
+// FormatSize formats a number of bytes with the largest binary unit that keeps it above one.
+func FormatSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value, unit := float64(size), 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
@@ -0,0 +1,40 @@
+package helper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int64
+		valid    bool
+	}{
+		{value: "1024", expected: 1024, valid: true},
+		{value: "512M", expected: 512 << 20, valid: true},
+		{value: "10 GB", expected: 10 << 30, valid: true},
+		{value: "1.5GiB", expected: 3 << 29, valid: true},
+		{value: "2k", expected: 2048, valid: true},
+		{value: "-1G", valid: false},
+		{value: "lots", valid: false},
+		{value: "", valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			size, err := ParseSize(tt.value)
+			if !tt.valid {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, size)
+		})
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "512 B", FormatSize(512))
+	assert.Equal(t, "1.5 GB", FormatSize(3<<29))
+}
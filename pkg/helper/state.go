@@ -0,0 +1,90 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/webdav"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// StateDir is the directory in the content directory where the server keeps its own data, such as
+// the trash. It is hidden from WebDAV clients.
+const StateDir = "/.webdav"
+
+// StatePath joins path elements onto the state directory.
+func StatePath(elements ...string) string {
+	return path.Join(append([]string{StateDir}, elements...)...)
+}
+
+// IsStatePath reports whether a path is the state directory or inside of it. The comparison ignores
+// case, so the state directory can't be reached on case-insensitive file systems either.
+func IsStatePath(name string) bool {
+	cleaned := strings.ToLower(path.Clean("/" + name))
+	return cleaned == StateDir || strings.HasPrefix(cleaned, StateDir+"/")
+}
+
+// UploadPrefix starts the names of the temp files uploads are written to before they replace their
+// target. Like the state directory, they are hidden from WebDAV clients.
+const UploadPrefix = ".webdav-upload-"
+
+// IsUploadPath reports whether a path is the temp file of an upload.
+func IsUploadPath(name string) bool {
+	return strings.HasPrefix(strings.ToLower(path.Base(name)), UploadPrefix)
+}
+
+// MkdirAll creates a collection and all missing parents.
+func MkdirAll(ctx context.Context, fileSystem webdav.FileSystem, name string) error {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return nil
+	}
+	if fileInfo, err := fileSystem.Stat(ctx, name); err == nil {
+		if !fileInfo.IsDir() {
+			return fmt.Errorf("%s is not a collection", name)
+		}
+		return nil
+	}
+	if err := MkdirAll(ctx, fileSystem, path.Dir(name)); err != nil {
+		return err
+	}
+	if err := fileSystem.Mkdir(ctx, name, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// WriteFile creates or truncates a file and writes its content.
+func WriteFile(ctx context.Context, fileSystem webdav.FileSystem, name string, content []byte) error {
+	file, err := fileSystem.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, writeErr := file.Write(content)
+	closeErr := file.Close()
+	return errors.Join(writeErr, closeErr)
+}
+
+// ReadDirNames returns the names of the members of a collection, or none if it does not exist.
+func ReadDirNames(ctx context.Context, fileSystem webdav.FileSystem, name string) ([]string, error) {
+	dir, err := fileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	fileInfos, err := dir.Readdir(0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	names := make([]string, 0, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		names = append(names, fileInfo.Name())
+	}
+	return names, nil
+}
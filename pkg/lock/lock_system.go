@@ -0,0 +1,343 @@
+package lock
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/webdav"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lock is a lock as it is persisted and listed.
+type Lock struct {
+	Token string `json:"token"`
+	Root  string `json:"root"`
+	// OwnerXML is the owner the client sent with the LOCK request
+	OwnerXML  string `json:"owner,omitempty"`
+	ZeroDepth bool   `json:"zerodepth,omitempty"`
+	// Duration is the timeout of the lock, negative if it never expires
+	Duration time.Duration `json:"duration"`
+	Expires  time.Time     `json:"expires,omitempty"`
+}
+
+type lockEntry struct {
+	Lock
+	held bool
+	// temporary locks guard a single request and are neither persisted nor listed
+	temporary bool
+}
+
+// FileLockSystem is a webdav.LockSystem that persists its locks to a state file, so they survive
+// restarts. The file is read again when it changes, which happens when locks are broken from the
+// command line.
+type FileLockSystem struct {
+	mutex        sync.Mutex
+	statePath    string
+	locks        map[string]*lockEntry
+	stateModTime time.Time
+}
+
+// NewFileLockSystem creates a lock system with the locks in a state file. Without a state file, locks
+// are only kept in memory.
+func NewFileLockSystem(statePath string) *FileLockSystem {
+	ls := &FileLockSystem{statePath: statePath, locks: map[string]*lockEntry{}}
+	ls.loadState()
+	return ls
+}
+
+func (ls *FileLockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ls.loadState()
+	ls.collectExpired(now)
+	var lock0, lock1 *lockEntry
+	if name0 != "" {
+		if lock0 = ls.lookup(cleanName(name0), conditions...); lock0 == nil {
+			return nil, webdav.ErrConfirmationFailed
+		}
+	}
+	if name1 != "" {
+		if lock1 = ls.lookup(cleanName(name1), conditions...); lock1 == nil {
+			return nil, webdav.ErrConfirmationFailed
+		}
+	}
+	// Don't hold the same lock twice
+	if lock1 == lock0 {
+		lock1 = nil
+	}
+	for _, held := range []*lockEntry{lock0, lock1} {
+		if held != nil {
+			held.held = true
+		}
+	}
+	return func() {
+		ls.mutex.Lock()
+		defer ls.mutex.Unlock()
+		for _, held := range []*lockEntry{lock0, lock1} {
+			if held != nil {
+				held.held = false
+			}
+		}
+	}, nil
+}
+
+// lookup returns the lock of a resource that matches one of the conditions and is not held. The lock
+// may be on a parent of the resource if it has infinite depth.
+func (ls *FileLockSystem) lookup(name string, conditions ...webdav.Condition) *lockEntry {
+	for _, condition := range conditions {
+		entry := ls.locks[condition.Token]
+		if entry == nil || entry.held {
+			continue
+		}
+		if name == entry.Root || !entry.ZeroDepth && isAncestor(entry.Root, name) {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (ls *FileLockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	return ls.create(now, details, false)
+}
+
+// CreateTemporary creates a lock that guards a single request that doesn't claim a lock, such as the
+// locks webdav.Handler takes for modifying requests. It is released when the request is done and
+// doesn't have to survive a restart.
+func (ls *FileLockSystem) CreateTemporary(now time.Time, details webdav.LockDetails) (string, error) {
+	return ls.create(now, details, true)
+}
+
+func (ls *FileLockSystem) create(now time.Time, details webdav.LockDetails, temporary bool) (string, error) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ls.loadState()
+	ls.collectExpired(now)
+	root := cleanName(details.Root)
+	for _, entry := range ls.locks {
+		if entry.Root == root ||
+			!entry.ZeroDepth && isAncestor(entry.Root, root) ||
+			!details.ZeroDepth && isAncestor(root, entry.Root) {
+			return "", webdav.ErrLocked
+		}
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	entry := &lockEntry{Lock: Lock{
+		Token:     token,
+		Root:      root,
+		OwnerXML:  details.OwnerXML,
+		ZeroDepth: details.ZeroDepth,
+		Duration:  details.Duration,
+	}, temporary: temporary}
+	if details.Duration >= 0 {
+		entry.Expires = now.Add(details.Duration)
+	}
+	ls.locks[token] = entry
+	if !temporary {
+		if err := ls.saveState(); err != nil {
+			delete(ls.locks, token)
+			return "", err
+		}
+	}
+	return token, nil
+}
+
+func (ls *FileLockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ls.loadState()
+	ls.collectExpired(now)
+	entry := ls.locks[token]
+	if entry == nil {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	if entry.held {
+		return webdav.LockDetails{}, webdav.ErrLocked
+	}
+	entry.Duration = duration
+	entry.Expires = time.Time{}
+	if duration >= 0 {
+		entry.Expires = now.Add(duration)
+	}
+	if !entry.temporary {
+		if err := ls.saveState(); err != nil {
+			return webdav.LockDetails{}, err
+		}
+	}
+	return webdav.LockDetails{Root: entry.Root, Duration: entry.Duration, OwnerXML: entry.OwnerXML, ZeroDepth: entry.ZeroDepth}, nil
+}
+
+func (ls *FileLockSystem) Unlock(now time.Time, token string) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ls.loadState()
+	ls.collectExpired(now)
+	entry := ls.locks[token]
+	if entry == nil {
+		return webdav.ErrNoSuchLock
+	}
+	if entry.held {
+		return webdav.ErrLocked
+	}
+	delete(ls.locks, token)
+	if !entry.temporary {
+		return ls.saveState()
+	}
+	return nil
+}
+
+// Locks returns the active locks, ordered by their root.
+func (ls *FileLockSystem) Locks() []Lock {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ls.loadState()
+	ls.collectExpired(time.Now())
+	return ls.persistentLocks()
+}
+
+// Break removes a lock regardless of who holds it.
+func (ls *FileLockSystem) Break(token string) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ls.loadState()
+	if _, ok := ls.locks[token]; !ok {
+		return webdav.ErrNoSuchLock
+	}
+	delete(ls.locks, token)
+	return ls.saveState()
+}
+
+// Flush removes expired locks and writes the persistent locks to the state file.
+func (ls *FileLockSystem) Flush() error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ls.loadState()
+	ls.collectExpired(time.Now())
+	return ls.saveState()
+}
+
+// collectExpired removes the locks that have expired and are not held.
+func (ls *FileLockSystem) collectExpired(now time.Time) {
+	expired := false
+	for token, entry := range ls.locks {
+		if !entry.held && !entry.Expires.IsZero() && !now.Before(entry.Expires) {
+			delete(ls.locks, token)
+			expired = expired || !entry.temporary
+		}
+	}
+	if expired {
+		ls.saveState()
+	}
+}
+
+func (ls *FileLockSystem) persistentLocks() []Lock {
+	locks := []Lock{}
+	for _, entry := range ls.locks {
+		if !entry.temporary {
+			locks = append(locks, entry.Lock)
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Root < locks[j].Root
+	})
+	return locks
+}
+
+// saveState writes the persistent locks to the state file. The file is replaced atomically, so a
+// crash can't leave a truncated file behind.
+func (ls *FileLockSystem) saveState() error {
+	if ls.statePath == "" {
+		return nil
+	}
+	marshalled, marshalErr := json.MarshalIndent(ls.persistentLocks(), "", "  ")
+	if marshalErr != nil {
+		return marshalErr
+	}
+	tempFile, createErr := os.CreateTemp(filepath.Dir(ls.statePath), ".locks-*")
+	if createErr != nil {
+		slog.Error("Failed to write locks", "error", createErr)
+		return createErr
+	}
+	_, writeErr := tempFile.Write(marshalled)
+	writeErr = errors.Join(writeErr, tempFile.Close())
+	if writeErr == nil {
+		writeErr = os.Rename(tempFile.Name(), ls.statePath)
+	}
+	if writeErr != nil {
+		os.Remove(tempFile.Name())
+		slog.Error("Failed to write locks", "error", writeErr)
+		return fmt.Errorf("failed to write locks: %w", writeErr)
+	}
+	if fileInfo, statErr := os.Stat(ls.statePath); statErr == nil {
+		ls.stateModTime = fileInfo.ModTime()
+	}
+	return nil
+}
+
+// loadState replaces the persistent locks with the ones in the state file if it changed since it was
+// last read or written.
+func (ls *FileLockSystem) loadState() {
+	if ls.statePath == "" {
+		return
+	}
+	fileInfo, statErr := os.Stat(ls.statePath)
+	if statErr != nil || fileInfo.ModTime().Equal(ls.stateModTime) {
+		return
+	}
+	ls.stateModTime = fileInfo.ModTime()
+	content, readErr := os.ReadFile(ls.statePath)
+	if readErr != nil {
+		slog.Error("Failed to read locks", "error", readErr)
+		return
+	}
+	var locks []Lock
+	if unmarshalErr := json.Unmarshal(content, &locks); unmarshalErr != nil {
+		slog.Error("Failed to parse locks", "error", unmarshalErr)
+		return
+	}
+	entries := make(map[string]*lockEntry, len(locks))
+	for _, lock := range locks {
+		// Keep the entries of locks held by running requests
+		entry := ls.locks[lock.Token]
+		if entry == nil {
+			entry = &lockEntry{}
+		}
+		entry.Lock = lock
+		entries[lock.Token] = entry
+	}
+	for token, entry := range ls.locks {
+		if entry.temporary {
+			entries[token] = entry
+		}
+	}
+	ls.locks = entries
+}
+
+func isAncestor(parent, child string) bool {
+	return parent == "/" && child != "/" || strings.HasPrefix(child, parent+"/")
+}
+
+func cleanName(name string) string {
+	return path.Clean("/" + name)
+}
+
+// newToken returns a random lock token in the opaquelocktoken URI scheme of RFC 4918.
+func newToken() (string, error) {
+	buffer := make([]byte, 16)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	buffer[6] = buffer[6]&0x0f | 0x40
+	buffer[8] = buffer[8]&0x3f | 0x80
+	return fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x", buffer[0:4], buffer[4:6], buffer[6:8], buffer[8:10], buffer[10:]), nil
+}
@@ -0,0 +1,71 @@
+package lock
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLockSystem(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "locks.json")
+	now := time.Now()
+	lockSystem := NewFileLockSystem(statePath)
+	token, err := lockSystem.Create(now, webdav.LockDetails{Root: "/alice/docs", Duration: time.Hour, OwnerXML: "<D:href>alice</D:href>"})
+	assert.NoError(t, err)
+
+	t.Run("Conflicting locks", func(t *testing.T) {
+		_, err := lockSystem.Create(now, webdav.LockDetails{Root: "/alice/docs/notes.txt", Duration: time.Hour, ZeroDepth: true})
+		assert.ErrorIs(t, err, webdav.ErrLocked)
+		_, err = lockSystem.Create(now, webdav.LockDetails{Root: "/alice", Duration: time.Hour})
+		assert.ErrorIs(t, err, webdav.ErrLocked)
+		_, err = lockSystem.Create(now, webdav.LockDetails{Root: "/alice/documents", Duration: time.Hour})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Temporary locks are not persisted", func(t *testing.T) {
+		temporary, err := lockSystem.CreateTemporary(now, webdav.LockDetails{Root: "/bob/notes.txt", Duration: -1, ZeroDepth: true})
+		assert.NoError(t, err)
+		assert.Len(t, NewFileLockSystem(statePath).Locks(), 2)
+		assert.NoError(t, lockSystem.Unlock(now, temporary))
+	})
+
+	t.Run("Locks without owner and timeout are persisted", func(t *testing.T) {
+		infinite, err := lockSystem.Create(now, webdav.LockDetails{Root: "/bob/notes.txt", Duration: -1, ZeroDepth: true})
+		assert.NoError(t, err)
+		assert.Len(t, NewFileLockSystem(statePath).Locks(), 3)
+		assert.NoError(t, lockSystem.Unlock(now, infinite))
+	})
+
+	t.Run("Locks survive restarts", func(t *testing.T) {
+		restarted := NewFileLockSystem(statePath)
+		release, err := restarted.Confirm(now, "/alice/docs/notes.txt", "", webdav.Condition{Token: token})
+		assert.NoError(t, err)
+		release()
+	})
+
+	t.Run("Broken locks are picked up", func(t *testing.T) {
+		assert.NoError(t, NewFileLockSystem(statePath).Break(token))
+		// Make sure the modification time changes on file systems with a coarse resolution
+		assert.NoError(t, os.Chtimes(statePath, now.Add(time.Minute), now.Add(time.Minute)))
+		_, err := lockSystem.Confirm(now, "/alice/docs", "", webdav.Condition{Token: token})
+		assert.ErrorIs(t, err, webdav.ErrConfirmationFailed)
+	})
+
+	t.Run("Expired locks are removed", func(t *testing.T) {
+		assert.Len(t, lockSystem.Locks(), 1)
+		_, err := lockSystem.Create(now.Add(2*time.Hour), webdav.LockDetails{Root: "/alice", Duration: time.Hour})
+		assert.NoError(t, err)
+		locks := NewFileLockSystem(statePath).Locks()
+		assert.Len(t, locks, 1)
+		assert.Equal(t, "/alice", locks[0].Root)
+	})
+
+	t.Run("Flush writes the locks", func(t *testing.T) {
+		assert.NoError(t, os.Remove(statePath))
+		assert.NoError(t, lockSystem.Flush())
+		assert.Len(t, NewFileLockSystem(statePath).Locks(), 1)
+	})
+}
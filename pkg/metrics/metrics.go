@@ -0,0 +1,208 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/triargos/webdav/pkg/helper"
+	"github.com/triargos/webdav/pkg/lock"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// methods are the methods requests are labeled with, others are labeled as OTHER so clients can't
+// create arbitrary series.
+var methods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPut: true, http.MethodPost: true, http.MethodPatch: true,
+	http.MethodDelete: true, http.MethodOptions: true, "PROPFIND": true, "PROPPATCH": true, "MKCOL": true,
+	"COPY": true, "MOVE": true, "LOCK": true, "UNLOCK": true,
+}
+
+// LockLister is implemented by lock systems that can list their active locks.
+type LockLister interface {
+	Locks() []lock.Lock
+}
+
+// Metrics collects the metrics of the server and serves them in the Prometheus text format.
+type Metrics struct {
+	registry     *prometheus.Registry
+	requests     *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	uploaded     *prometheus.CounterVec
+	downloaded   *prometheus.CounterVec
+	authFailures *prometheus.CounterVec
+}
+
+// New creates the metrics of the server, including the stats of the process and the Go runtime.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webdav_requests_total",
+			Help: "Requests served, by method and status.",
+		}, []string{"method", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "webdav_request_duration_seconds",
+			Help:    "Time taken to serve requests, by method and status.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"method", "status"}),
+		uploaded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webdav_uploaded_bytes_total",
+			Help: "Bytes uploaded with PUT, PATCH and POST, by user.",
+		}, []string{"user"}),
+		downloaded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webdav_downloaded_bytes_total",
+			Help: "Bytes downloaded with GET, by user.",
+		}, []string{"user"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webdav_auth_failures_total",
+			Help: "Failed authentications, by scheme and reason.",
+		}, []string{"scheme", "reason"}),
+	}
+	m.registry.MustRegister(
+		m.requests, m.duration, m.uploaded, m.downloaded, m.authFailures,
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewGoCollector(),
+	)
+	return m
+}
+
+// Handler serves the metrics.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// AuthFailure counts a failed authentication, it is an auth.FailureObserver.
+func (m *Metrics) AuthFailure(scheme, reason string) {
+	m.authFailures.WithLabelValues(scheme, reason).Inc()
+}
+
+// RegisterLocks reports the number of active locks of a lock system, labeled with the share it
+// belongs to. The content directory has no share name.
+func (m *Metrics) RegisterLocks(share string, lockLister LockLister) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "webdav_active_locks",
+		Help:        "Locks currently held by clients.",
+		ConstLabels: prometheus.Labels{"share": share},
+	}, func() float64 {
+		return float64(len(lockLister.Locks()))
+	}))
+}
+
+// Middleware counts requests and measures how long they take. It wraps everything else, so requests
+// refused before they reach the handlers are counted as well.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		method := r.Method
+		if !methods[method] {
+			method = "OTHER"
+		}
+		status := strconv.Itoa(recorder.status)
+		m.requests.WithLabelValues(method, status).Inc()
+		m.duration.WithLabelValues(method, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// TransferMiddleware counts the bytes users upload and download. It has to be wrapped by an auth
+// middleware, which stores the user in the context of the request.
+func (m *Metrics) TransferMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := helper.GetUsernameFromContext(r.Context())
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut, http.MethodPatch, http.MethodPost:
+			if r.Body != nil {
+				body := &countingBody{ReadCloser: r.Body}
+				r.Body = body
+				defer func() { m.uploaded.WithLabelValues(username).Add(float64(body.read)) }()
+			}
+			next.ServeHTTP(w, r)
+		case http.MethodGet:
+			recorder, ok := findRecorder(w)
+			if !ok {
+				recorder = &responseRecorder{ResponseWriter: w}
+				w = recorder
+			}
+			before := recorder.written
+			next.ServeHTTP(w, r)
+			m.downloaded.WithLabelValues(username).Add(float64(recorder.written - before))
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// responseRecorder records the status and the size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(content []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	written, err := r.ResponseWriter.Write(content)
+	r.written += int64(written)
+	return written, err
+}
+
+// ReadFrom passes io.Copy on to the writer underneath, so files are still sent with sendfile.
+func (r *responseRecorder) ReadFrom(reader io.Reader) (int64, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	written, err := io.Copy(r.ResponseWriter, reader)
+	r.written += written
+	return written, err
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// findRecorder returns the recorder of Middleware if it wraps a response writer, so responses aren't
+// recorded twice.
+func findRecorder(w http.ResponseWriter) (*responseRecorder, bool) {
+	for {
+		switch writer := w.(type) {
+		case *responseRecorder:
+			return writer, true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = writer.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	read, err := b.ReadCloser.Read(p)
+	b.read += int64(read)
+	return read, err
+}
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/pkg/helper"
+	"github.com/triargos/webdav/pkg/lock"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type lockList []lock.Lock
+
+func (l lockList) Locks() []lock.Lock {
+	return l
+}
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	m.RegisterLocks("", lockList{{Token: "a"}, {Token: "b"}})
+	handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), helper.UserNameContextKey, "alice"))
+		m.TransferMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet:
+				w.Write([]byte("downloaded"))
+			case http.MethodPut:
+				io.Copy(io.Discard, r.Body)
+				w.WriteHeader(http.StatusCreated)
+			default:
+				w.WriteHeader(http.StatusMultiStatus)
+			}
+		})).ServeHTTP(w, r)
+	}))
+	serve := func(method, body string) {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/file.txt", strings.NewReader(body)))
+	}
+	serve(http.MethodGet, "")
+	serve(http.MethodPut, "uploaded content")
+	serve("PROPFIND", "")
+	serve("BREW", "")
+	m.AuthFailure("basic", "invalid_credentials")
+
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	scraped := recorder.Body.String()
+	for _, expected := range []string{
+		`webdav_requests_total{method="GET",status="200"} 1`,
+		`webdav_requests_total{method="PUT",status="201"} 1`,
+		`webdav_requests_total{method="PROPFIND",status="207"} 1`,
+		`webdav_requests_total{method="OTHER",status="207"} 1`,
+		`webdav_request_duration_seconds_count{method="PUT",status="201"} 1`,
+		`webdav_uploaded_bytes_total{user="alice"} 16`,
+		`webdav_downloaded_bytes_total{user="alice"} 10`,
+		`webdav_auth_failures_total{reason="invalid_credentials",scheme="basic"} 1`,
+		`webdav_active_locks{share=""} 2`,
+		"go_goroutines",
+	} {
+		assert.Contains(t, scraped, expected)
+	}
+}
+
+// readerFromRecorder notes if a response was copied with ReadFrom, like a connection using sendfile.
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (r *readerFromRecorder) ReadFrom(reader io.Reader) (int64, error) {
+	r.readFrom = true
+	return io.Copy(r.ResponseRecorder, reader)
+}
+
+func TestDownloadRecorder(t *testing.T) {
+	m := New()
+	var writer http.ResponseWriter
+	handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), helper.UserNameContextKey, "alice"))
+		m.TransferMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writer = w
+			io.Copy(w, io.LimitReader(strings.NewReader("downloaded"), 10))
+		})).ServeHTTP(w, r)
+	}))
+	recorder := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/file.txt", nil))
+
+	assert.True(t, recorder.readFrom, "the copy is passed on to the connection")
+	assert.Equal(t, "downloaded", recorder.Body.String())
+	_, wrapped := writer.(*responseRecorder).ResponseWriter.(*responseRecorder)
+	assert.False(t, wrapped, "the response is recorded once")
+	scraped := httptest.NewRecorder()
+	m.Handler().ServeHTTP(scraped, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, scraped.Body.String(), `webdav_downloaded_bytes_total{user="alice"} 10`)
+}
@@ -0,0 +1,231 @@
+package property
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/triargos/webdav/pkg/helper"
+	"golang.org/x/net/webdav"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Store keeps the dead properties of resources, the properties clients set with PROPPATCH.
+type Store interface {
+	Get(ctx context.Context, name string) (map[xml.Name]webdav.Property, error)
+	// Patch sets and removes properties of a resource. The patches are applied all or nothing.
+	Patch(ctx context.Context, name string, patches []webdav.Proppatch) ([]webdav.Propstat, error)
+	// Copy replaces the properties of a resource with the ones of another. If recursive, the
+	// properties of the resources below it are copied as well.
+	Copy(ctx context.Context, oldName, newName string, recursive bool) error
+	// Move moves the properties of a resource and the resources below it.
+	Move(ctx context.Context, oldName, newName string) error
+	// Delete removes the properties of a resource and the resources below it.
+	Delete(ctx context.Context, name string) error
+}
+
+const propsFile = "props"
+
+// FileStore keeps dead properties in sidecar files in the state directory of a file system. The
+// files are laid out like the resources they belong to, so the properties of a collection can be
+// moved and removed along with it in one operation. Member names are prefixed, so they can't
+// collide with the property files.
+type FileStore struct {
+	fileSystem webdav.FileSystem
+	mutex      sync.Mutex
+}
+
+// NewFileStore creates a property store on a file system, which must not check permissions.
+func NewFileStore(fileSystem webdav.FileSystem) Store {
+	return &FileStore{fileSystem: fileSystem}
+}
+
+// storedProperty is the encoding of a property in a property file.
+type storedProperty struct {
+	Space    string `json:"space"`
+	Local    string `json:"local"`
+	Lang     string `json:"lang,omitempty"`
+	InnerXML string `json:"innerxml"`
+}
+
+func (s *FileStore) Get(ctx context.Context, name string) (map[xml.Name]webdav.Property, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.read(ctx, name)
+}
+
+func (s *FileStore) Patch(ctx context.Context, name string, patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	properties, err := s.read(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	propstat := webdav.Propstat{Status: http.StatusOK}
+	for _, patch := range patches {
+		for _, property := range patch.Props {
+			propstat.Props = append(propstat.Props, webdav.Property{XMLName: property.XMLName})
+			if patch.Remove {
+				delete(properties, property.XMLName)
+			} else {
+				properties[property.XMLName] = property
+			}
+		}
+	}
+	if err := s.write(ctx, name, properties); err != nil {
+		return nil, err
+	}
+	return []webdav.Propstat{propstat}, nil
+}
+
+func (s *FileStore) Copy(ctx context.Context, oldName, newName string, recursive bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	oldDir, newDir := propsDir(oldName), propsDir(newName)
+	if !recursive {
+		properties, err := s.read(ctx, oldName)
+		if err != nil {
+			return err
+		}
+		return s.write(ctx, newName, properties)
+	}
+	if err := s.fileSystem.RemoveAll(ctx, newDir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := s.fileSystem.Stat(ctx, oldDir); os.IsNotExist(err) {
+		return nil
+	}
+	if err := helper.MkdirAll(ctx, s.fileSystem, path.Dir(newDir)); err != nil {
+		return err
+	}
+	return s.copyTree(ctx, oldDir, newDir)
+}
+
+func (s *FileStore) Move(ctx context.Context, oldName, newName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	oldDir, newDir := propsDir(oldName), propsDir(newName)
+	if err := s.fileSystem.RemoveAll(ctx, newDir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := s.fileSystem.Stat(ctx, oldDir); os.IsNotExist(err) {
+		return nil
+	}
+	if err := helper.MkdirAll(ctx, s.fileSystem, path.Dir(newDir)); err != nil {
+		return err
+	}
+	return s.fileSystem.Rename(ctx, oldDir, newDir)
+}
+
+func (s *FileStore) Delete(ctx context.Context, name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.fileSystem.RemoveAll(ctx, propsDir(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) read(ctx context.Context, name string) (map[xml.Name]webdav.Property, error) {
+	properties := map[xml.Name]webdav.Property{}
+	file, err := s.fileSystem.OpenFile(ctx, path.Join(propsDir(name), propsFile), os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return properties, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	var stored []storedProperty
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return nil, fmt.Errorf("invalid properties of %s: %w", name, err)
+	}
+	for _, property := range stored {
+		xmlName := xml.Name{Space: property.Space, Local: property.Local}
+		properties[xmlName] = webdav.Property{XMLName: xmlName, Lang: property.Lang, InnerXML: []byte(property.InnerXML)}
+	}
+	return properties, nil
+}
+
+// write replaces the properties of a resource, removing the property file if there are none.
+func (s *FileStore) write(ctx context.Context, name string, properties map[xml.Name]webdav.Property) error {
+	fileName := path.Join(propsDir(name), propsFile)
+	if len(properties) == 0 {
+		if err := s.fileSystem.RemoveAll(ctx, fileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	stored := make([]storedProperty, 0, len(properties))
+	for _, property := range properties {
+		stored = append(stored, storedProperty{
+			Space:    property.XMLName.Space,
+			Local:    property.XMLName.Local,
+			Lang:     property.Lang,
+			InnerXML: string(property.InnerXML),
+		})
+	}
+	marshalled, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	if err := helper.MkdirAll(ctx, s.fileSystem, propsDir(name)); err != nil {
+		return err
+	}
+	return helper.WriteFile(ctx, s.fileSystem, fileName, marshalled)
+}
+
+func (s *FileStore) copyTree(ctx context.Context, oldName, newName string) error {
+	source, err := s.fileSystem.OpenFile(ctx, oldName, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	fileInfo, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	if !fileInfo.IsDir() {
+		target, err := s.fileSystem.OpenFile(ctx, newName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		_, copyErr := io.Copy(target, source)
+		closeErr := target.Close()
+		return errors.Join(copyErr, closeErr)
+	}
+	if err := s.fileSystem.Mkdir(ctx, newName, 0755); err != nil {
+		return err
+	}
+	members, err := source.Readdir(0)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if err := s.copyTree(ctx, path.Join(oldName, member.Name()), path.Join(newName, member.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// propsDir returns the collection holding the properties of a resource.
+func propsDir(name string) string {
+	elements := []string{helper.StatePath("props")}
+	for _, element := range strings.Split(path.Clean("/"+name), "/") {
+		if element != "" {
+			elements = append(elements, "_"+element)
+		}
+	}
+	return path.Join(elements...)
+}
@@ -0,0 +1,51 @@
+package property
+
+import (
+	"context"
+	"encoding/xml"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileStore(webdav.NewMemFS())
+	color := xml.Name{Space: "urn:tags", Local: "color"}
+	set := func(name, value string) {
+		_, err := store.Patch(ctx, name, []webdav.Proppatch{{Props: []webdav.Property{{XMLName: color, InnerXML: []byte(value)}}}})
+		assert.NoError(t, err)
+	}
+	get := func(name string) string {
+		properties, err := store.Get(ctx, name)
+		assert.NoError(t, err)
+		return string(properties[color].InnerXML)
+	}
+	set("/docs", "blue")
+	set("/docs/props", "red")
+
+	t.Run("Member names don't collide with property files", func(t *testing.T) {
+		assert.Equal(t, "blue", get("/docs"))
+		assert.Equal(t, "red", get("/docs/props"))
+	})
+
+	t.Run("Shallow copy", func(t *testing.T) {
+		assert.NoError(t, store.Copy(ctx, "/docs", "/shallow", false))
+		assert.Equal(t, "blue", get("/shallow"))
+		assert.Equal(t, "", get("/shallow/props"))
+	})
+
+	t.Run("Move replaces the destination", func(t *testing.T) {
+		set("/archive/props", "green")
+		assert.NoError(t, store.Move(ctx, "/docs", "/archive"))
+		assert.Equal(t, "red", get("/archive/props"))
+		assert.Equal(t, "", get("/docs"))
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		_, err := store.Patch(ctx, "/archive", []webdav.Proppatch{{Remove: true, Props: []webdav.Property{{XMLName: color}}}})
+		assert.NoError(t, err)
+		assert.Equal(t, "", get("/archive"))
+		assert.Equal(t, "red", get("/archive/props"))
+	})
+}
@@ -0,0 +1,301 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/triargos/webdav/pkg/helper"
+	"github.com/triargos/webdav/pkg/user"
+	"golang.org/x/net/webdav"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned when a write does not fit into the quota of a root.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// DefaultUsageTTL is how long the usage of a root is trusted before it is scanned again, which
+// picks up changes made outside of the server.
+const DefaultUsageTTL = 10 * time.Minute
+
+// Usage is the usage of the tightest quota that applies to a path.
+type Usage struct {
+	Root      string
+	Used      int64
+	Available int64
+}
+
+type Service interface {
+	// Usage returns the usage of the quota with the least space left that applies to a path. The
+	// second result is false if no quota applies.
+	Usage(ctx context.Context, name string) (Usage, bool)
+	// Reserve accounts a change in size below a path. Growth fails with ErrQuotaExceeded if it does
+	// not fit into every quota that applies to the path.
+	Reserve(ctx context.Context, name string, delta int64) error
+	// ReserveMove accounts moving a tree of a size from one path to another. Only quotas that apply
+	// to the destination but not to the source have to fit the tree.
+	ReserveMove(ctx context.Context, oldName, newName string, size int64) error
+	// Size returns the size of the files below a path.
+	Size(ctx context.Context, name string) (int64, error)
+}
+
+// Retainer keeps deleted data that still counts toward the quotas of the path it was deleted from,
+// like a trash does.
+type Retainer interface {
+	// Retained returns the paths deleted data is kept at, mapped to the paths it was deleted from.
+	Retained(ctx context.Context) (map[string]string, error)
+}
+
+type limit struct {
+	root  string
+	bytes int64
+}
+
+type usageEntry struct {
+	used    int64
+	scanned time.Time
+}
+
+// QuotaService accounts the usage of the user and group roots with a quota. Usage is scanned once
+// and then kept up to date by the writes going through the server.
+type QuotaService struct {
+	mutex        sync.Mutex
+	fileSystem   webdav.FileSystem
+	userService  user.Service
+	retainer     Retainer
+	containsPath func(parent, child string) bool
+	ttl          time.Duration
+	usage        map[string]*usageEntry
+	now          func() time.Time
+}
+
+// NewQuotaService creates a quota service that scans usage on the given file system, which must not
+// check permissions. containsPath compares paths like the file system does. The data kept by the
+// retainer, which is optional, counts toward the quotas of the paths it was deleted from.
+func NewQuotaService(fileSystem webdav.FileSystem, userService user.Service, retainer Retainer, containsPath func(parent, child string) bool, ttl time.Duration) Service {
+	if ttl <= 0 {
+		ttl = DefaultUsageTTL
+	}
+	return &QuotaService{
+		fileSystem:   fileSystem,
+		userService:  userService,
+		retainer:     retainer,
+		containsPath: containsPath,
+		ttl:          ttl,
+		usage:        map[string]*usageEntry{},
+		now:          time.Now,
+	}
+}
+
+// Validate checks the quotas of all users and groups.
+func Validate(userService user.Service) error {
+	for username, userObject := range userService.GetUsers() {
+		if _, err := parseQuota(userObject.Quota); err != nil {
+			return fmt.Errorf("invalid quota of user %s: %w", username, err)
+		}
+	}
+	for groupName, group := range userService.GetGroups() {
+		if _, err := parseQuota(group.Quota); err != nil {
+			return fmt.Errorf("invalid quota of group %s: %w", groupName, err)
+		}
+	}
+	return nil
+}
+
+func parseQuota(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return helper.ParseSize(value)
+}
+
+// limits returns the quotas of the roots containing a path. If a root has several quotas, the
+// smallest one applies.
+func (s *QuotaService) limits(name string) []limit {
+	smallest := map[string]int64{}
+	add := func(root, value string) {
+		bytes, err := parseQuota(value)
+		if root == "" || err != nil || bytes == 0 || !s.containsPath(root, name) {
+			return
+		}
+		root = path.Clean("/" + root)
+		if current, ok := smallest[root]; !ok || bytes < current {
+			smallest[root] = bytes
+		}
+	}
+	for _, userObject := range s.userService.GetUsers() {
+		add(userObject.Root, userObject.Quota)
+	}
+	for _, group := range s.userService.GetGroups() {
+		add(group.Root, group.Quota)
+	}
+	limits := make([]limit, 0, len(smallest))
+	for root, bytes := range smallest {
+		limits = append(limits, limit{root: root, bytes: bytes})
+	}
+	return limits
+}
+
+func (s *QuotaService) Usage(ctx context.Context, name string) (Usage, bool) {
+	limits := s.limits(name)
+	if len(limits) == 0 {
+		return Usage{}, false
+	}
+	s.scan(ctx, limits)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var tightest Usage
+	for i, limit := range limits {
+		used := s.usage[limit.root].used
+		available := max(limit.bytes-used, 0)
+		if i == 0 || available < tightest.Available {
+			tightest = Usage{Root: limit.root, Used: used, Available: available}
+		}
+	}
+	return tightest, true
+}
+
+func (s *QuotaService) Reserve(ctx context.Context, name string, delta int64) error {
+	limits := s.limits(name)
+	if len(limits) == 0 || delta == 0 {
+		return nil
+	}
+	s.scan(ctx, limits)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if delta > 0 {
+		for _, limit := range limits {
+			if s.usage[limit.root].used+delta > limit.bytes {
+				return ErrQuotaExceeded
+			}
+		}
+	}
+	for _, limit := range limits {
+		s.usage[limit.root].used += delta
+	}
+	return nil
+}
+
+func (s *QuotaService) ReserveMove(ctx context.Context, oldName, newName string, size int64) error {
+	oldLimits, newLimits := s.limits(oldName), s.limits(newName)
+	s.scan(ctx, append(oldLimits, newLimits...))
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	shared := map[string]bool{}
+	for _, limit := range oldLimits {
+		shared[limit.root] = true
+	}
+	var gained []limit
+	for _, limit := range newLimits {
+		if shared[limit.root] {
+			delete(shared, limit.root)
+			continue
+		}
+		if s.usage[limit.root].used+size > limit.bytes {
+			return ErrQuotaExceeded
+		}
+		gained = append(gained, limit)
+	}
+	for _, limit := range gained {
+		s.usage[limit.root].used += size
+	}
+	for root := range shared {
+		s.usage[root].used -= size
+	}
+	return nil
+}
+
+// scan computes the usage of roots that were never scanned or whose usage has expired.
+func (s *QuotaService) scan(ctx context.Context, limits []limit) {
+	for _, limit := range limits {
+		s.mutex.Lock()
+		entry, ok := s.usage[limit.root]
+		fresh := ok && s.now().Sub(entry.scanned) < s.ttl
+		s.mutex.Unlock()
+		if fresh {
+			continue
+		}
+		used, err := s.Size(ctx, limit.root)
+		if os.IsNotExist(err) {
+			used, err = 0, nil
+		}
+		if err == nil {
+			var retained int64
+			retained, err = s.retainedSize(ctx, limit.root)
+			used += retained
+		}
+		if err != nil {
+			slog.Warn("Failed to scan usage of quota root", "root", limit.root, "error", err)
+			// Keep the previous usage, a failed scan must not free up space
+			if ok {
+				used = entry.used
+			}
+		}
+		s.mutex.Lock()
+		s.usage[limit.root] = &usageEntry{used: used, scanned: s.now()}
+		s.mutex.Unlock()
+	}
+}
+
+// retainedSize returns the size of the data kept by the retainer that was deleted below a root.
+func (s *QuotaService) retainedSize(ctx context.Context, root string) (int64, error) {
+	if s.retainer == nil {
+		return 0, nil
+	}
+	retained, err := s.retainer.Retained(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for dataPath, deletedFrom := range retained {
+		if !s.containsPath(root, deletedFrom) {
+			continue
+		}
+		dataSize, err := s.Size(ctx, dataPath)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		size += dataSize
+	}
+	return size, nil
+}
+
+func (s *QuotaService) Size(ctx context.Context, name string) (int64, error) {
+	fileInfo, err := s.fileSystem.Stat(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	if !fileInfo.IsDir() {
+		return fileInfo.Size(), nil
+	}
+	dir, err := s.fileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	members, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	var size int64
+	for _, member := range members {
+		// Uploads in progress have been reserved for already
+		if helper.IsUploadPath(member.Name()) {
+			continue
+		}
+		if !member.IsDir() {
+			size += member.Size()
+			continue
+		}
+		memberSize, err := s.Size(ctx, path.Join(name, member.Name()))
+		if err != nil {
+			return 0, err
+		}
+		size += memberSize
+	}
+	return size, nil
+}
@@ -0,0 +1,67 @@
+package quota
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/mocks"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/helper"
+	"golang.org/x/net/webdav"
+	"strings"
+	"testing"
+	"time"
+)
+
+func containsPath(parent, child string) bool {
+	return child == parent || strings.HasPrefix(child, strings.TrimSuffix(parent, "/")+"/")
+}
+
+func TestQuotaService(t *testing.T) {
+	ctx := context.Background()
+	memFs := webdav.NewMemFS()
+	for _, dir := range []string{"/team", "/team/alice", "/other"} {
+		assert.NoError(t, memFs.Mkdir(ctx, dir, 0755))
+	}
+	assert.NoError(t, helper.WriteFile(ctx, memFs, "/team/plan.txt", make([]byte, 300)))
+	assert.NoError(t, helper.WriteFile(ctx, memFs, "/team/alice/notes.txt", make([]byte, 100)))
+	userService := mocks.NewMockUserService(map[string]config.User{
+		"alice": {Root: "/team/alice", Quota: "500"},
+	})
+	userService.Groups = map[string]config.Group{
+		"team": {Members: []string{"alice"}, Root: "/team", Quota: "1K"},
+	}
+	service := NewQuotaService(memFs, userService, nil, containsPath, time.Minute).(*QuotaService)
+	now := time.Now()
+	service.now = func() time.Time { return now }
+
+	t.Run("Tightest quota", func(t *testing.T) {
+		usage, ok := service.Usage(ctx, "/team/alice/docs")
+		assert.True(t, ok)
+		assert.Equal(t, Usage{Root: "/team/alice", Used: 100, Available: 400}, usage)
+		usage, _ = service.Usage(ctx, "/team")
+		assert.Equal(t, Usage{Root: "/team", Used: 400, Available: 624}, usage)
+		_, ok = service.Usage(ctx, "/other")
+		assert.False(t, ok)
+	})
+
+	t.Run("Nested quotas are charged together", func(t *testing.T) {
+		assert.ErrorIs(t, service.Reserve(ctx, "/team/alice/big.bin", 401), ErrQuotaExceeded)
+		assert.NoError(t, service.Reserve(ctx, "/team/alice/big.bin", 400))
+		usage, _ := service.Usage(ctx, "/team")
+		assert.Equal(t, int64(800), usage.Used)
+		assert.ErrorIs(t, service.Reserve(ctx, "/team/plan.txt", 300), ErrQuotaExceeded)
+	})
+
+	t.Run("Moves only charge new quotas", func(t *testing.T) {
+		assert.ErrorIs(t, service.ReserveMove(ctx, "/team/plan.txt", "/team/alice/plan.txt", 300), ErrQuotaExceeded)
+		assert.NoError(t, service.ReserveMove(ctx, "/team/alice/big.bin", "/team/big.bin", 400))
+		assert.Equal(t, int64(100), service.usage["/team/alice"].used)
+		assert.Equal(t, int64(800), service.usage["/team"].used)
+	})
+
+	t.Run("Usage is scanned again after the TTL", func(t *testing.T) {
+		now = now.Add(2 * time.Minute)
+		usage, _ := service.Usage(ctx, "/team")
+		assert.Equal(t, int64(400), usage.Used)
+	})
+}
@@ -1,20 +1,38 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/triargos/webdav/pkg/auth"
 	"github.com/triargos/webdav/pkg/config"
 	"github.com/triargos/webdav/pkg/fs"
 	"github.com/triargos/webdav/pkg/handler"
+	"github.com/triargos/webdav/pkg/helper"
+	"github.com/triargos/webdav/pkg/metrics"
+	"github.com/triargos/webdav/pkg/trash"
+	"github.com/triargos/webdav/pkg/user"
+	"github.com/triargos/webdav/pkg/version"
 	"golang.org/x/net/webdav"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
+// defaultMetricsAddress is the address metrics are served on if none is configured.
+const defaultMetricsAddress = "127.0.0.1:9110"
+
+// defaultShutdownTimeout is how long running requests may take to finish when the server shuts down.
+const defaultShutdownTimeout = 30 * time.Second
+
 func webdavLogger(req *http.Request, err error) {
 	if err != nil {
 		slog.Error("REQ", "method", req.Method, "path", req.URL.Path, "error", err)
@@ -28,31 +46,297 @@ type StartWebdavServerContainer struct {
 	ConfigService       config.Service
 	AuthService         auth.Service
 	DigestAuthenticator auth.DigestAuthenticator
-	WebdavFileSystem    *handler.WebdavFs
-	FsService           fs.Service
+	// Limiter throttles failed logins, it is optional
+	Limiter          auth.Limiter
+	WebdavFileSystem *handler.WebdavFs
+	FsService        fs.Service
+	UserService      user.Service
+	// Trash serves the recycle bins of the users, it is optional
+	Trash trash.Service
+	// Versions serves the versions of files, it is optional
+	Versions version.Service
+	// Uploads serves resumable uploads, it is optional
+	Uploads *handler.UploadsHandler
+	// LockSystem keeps the WebDAV locks, locks are kept in memory if it is not set
+	LockSystem webdav.LockSystem
+	// TLSConfig serves HTTPS instead of HTTP, it is optional
+	TLSConfig *tls.Config
+	// CertificateAuthenticator authenticates clients with certificates, it is optional
+	CertificateAuthenticator *auth.CertificateAuthenticator
+	// Shares are served next to the content directory under their own prefixes
+	Shares []Share
+	// Metrics are served on an address of their own, they are optional
+	Metrics *metrics.Metrics
 }
 
 func StartWebdavServer(container StartWebdavServerContainer) error {
 	configurationValue := container.ConfigService.Get()
 	address := fmt.Sprintf("%s:%s", configurationValue.Network.Address, configurationValue.Network.Port)
-	webdavSrv := handler.NewWebdavHandler(container.WebdavFileSystem, webdav.NewMemLS(), webdavLogger)
-	authType := container.ConfigService.Get().Security.AuthType
-	middleware := auth.BasicAuthMiddleware(container.AuthService)
-	if authType == "digest" {
-		middleware = auth.DigestAuthMiddleware(container.DigestAuthenticator, container.AuthService)
+	lockSystem := container.LockSystem
+	if lockSystem == nil {
+		lockSystem = webdav.NewMemLS()
+	}
+	var webdavSrv http.Handler = handler.NewWebdavHandler(container.WebdavFileSystem, lockSystem, webdavLogger)
+	if configurationValue.Content.VirtualRoot {
+		webdavSrv = handler.NewVirtualRootHandler(container.WebdavFileSystem, lockSystem, container.UserService, webdavLogger)
+	}
+	middleware := newAuthMiddleware(container, container.AuthService)
+	transfers := func(next http.Handler) http.Handler {
+		if container.Metrics == nil {
+			return next
+		}
+		return container.Metrics.TransferMiddleware(next)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", webdavSrv)
+	if container.Trash != nil {
+		trashHandler := handler.NewTrashHandler(container.Trash, container.WebdavFileSystem, container.UserService)
+		mux.Handle(helper.StatePath("trash"), trashHandler)
+		mux.Handle(helper.StatePath("trash")+"/", trashHandler)
+	}
+	if container.Versions != nil {
+		mux.Handle(helper.StatePath("versions")+"/", handler.NewVersionsHandler(container.Versions, container.WebdavFileSystem, lockSystem, webdavLogger))
+	}
+	if container.Uploads != nil {
+		mux.Handle(helper.StatePath("uploads"), container.Uploads)
+		mux.Handle(helper.StatePath("uploads")+"/", container.Uploads)
+	}
+	root := http.NewServeMux()
+	mount(root, configurationValue.Network.Prefix, middleware(transfers(mux)))
+	for _, share := range container.Shares {
+		var shareHandler http.Handler = handler.NewWebdavHandler(share.FileSystem, share.LockSystem, webdavLogger)
+		if share.ReadOnly {
+			shareHandler = readOnlyMiddleware(shareHandler)
+		}
+		slog.Info("Serving share", "name", share.Name, "prefix", share.Prefix, "readonly", share.ReadOnly)
+		mount(root, share.Prefix, newAuthMiddleware(container, share.AuthService)(transfers(shareHandler)))
+	}
+	var handler http.Handler = root
+	if container.Limiter != nil {
+		handler = auth.LimiterMiddleware(container.Limiter)(handler)
+	}
+	if container.Metrics != nil {
+		handler = auth.ObserveFailures(container.Metrics.AuthFailure)(handler)
+	}
+	draining := &atomic.Bool{}
+	handler = drainMiddleware(draining)(handler)
+	if container.Metrics != nil {
+		handler = container.Metrics.Middleware(handler)
+	}
+	server := &http.Server{Addr: address, Handler: handler, TLSConfig: container.TLSConfig}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", address, err)
 	}
-	http.Handle("/", middleware(webdavSrv))
+	servers := []*http.Server{server}
+	// Every server reports here when it stops: the server itself, the redirect to HTTPS and the
+	// metrics. Each has a slot, so none of them blocks once the first error was received.
+	serveErr := make(chan error, 3)
 	go func() {
-		slog.Info("Starting server", "address", address)
-		if err := http.ListenAndServe(address, nil); err != nil {
-			slog.Error("Failed to start server", "error", err)
+		if server.TLSConfig == nil {
+			slog.Info("Starting server", "address", address)
+			serveErr <- server.Serve(listener)
+			return
 		}
+		slog.Info("Starting server with TLS", "address", address)
+		serveErr <- server.ServeTLS(listener, "", "")
 	}()
+	if redirectPort := configurationValue.Network.TLS.RedirectPort; server.TLSConfig != nil && redirectPort != "" {
+		redirectAddress := fmt.Sprintf("%s:%s", configurationValue.Network.Address, redirectPort)
+		redirectListener, err := net.Listen("tcp", redirectAddress)
+		if err != nil {
+			server.Close()
+			return fmt.Errorf("failed to listen on %s: %w", redirectAddress, err)
+		}
+		redirectServer := &http.Server{Addr: redirectAddress, Handler: redirectToHTTPS(configurationValue.Network.Port)}
+		servers = append(servers, redirectServer)
+		go func() {
+			slog.Info("Redirecting HTTP to HTTPS", "address", redirectAddress)
+			serveErr <- redirectServer.Serve(redirectListener)
+		}()
+	}
+	if container.Metrics != nil {
+		registerLocks(container.Metrics, lockSystem, container.Shares)
+		metricsAddress := configurationValue.Metrics.Address
+		if metricsAddress == "" {
+			metricsAddress = defaultMetricsAddress
+		}
+		metricsListener, err := net.Listen("tcp", metricsAddress)
+		if err != nil {
+			for _, running := range servers {
+				running.Close()
+			}
+			return fmt.Errorf("failed to listen on %s: %w", metricsAddress, err)
+		}
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", newMetricsHandler(container, configurationValue.Metrics.Users))
+		metricsServer := &http.Server{Addr: metricsAddress, Handler: metricsMux}
+		if container.TLSConfig != nil {
+			// Prometheus authenticates with credentials, not with a client certificate
+			metricsServer.TLSConfig = container.TLSConfig.Clone()
+			metricsServer.TLSConfig.ClientAuth = tls.NoClientCert
+		}
+		servers = append(servers, metricsServer)
+		go func() {
+			slog.Info("Serving metrics", "address", metricsAddress)
+			if metricsServer.TLSConfig != nil {
+				serveErr <- metricsServer.ServeTLS(metricsListener, "", "")
+				return
+			}
+			serveErr <- metricsServer.Serve(metricsListener)
+		}()
+	}
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	slog.Info("Shutting down server...")
-	time.Sleep(1 * time.Second)
+	defer signal.Stop(quit)
+	select {
+	case err := <-serveErr:
+		for _, running := range servers {
+			running.Close()
+		}
+		return fmt.Errorf("server failed: %w", err)
+	case <-quit:
+	}
+	shutdownTimeout := time.Duration(configurationValue.Network.ShutdownTimeout) * time.Second
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+	slog.Info("Shutting down server, waiting for requests to finish...", "timeout", shutdownTimeout)
+	// Running requests finish, but their connections are closed afterwards instead of serving more
+	draining.Store(true)
+	for _, running := range servers {
+		running.SetKeepAlivesEnabled(false)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, running := range servers {
+		if err := running.Shutdown(ctx); err != nil {
+			slog.Warn("Requests did not finish in time, closing their connections", "error", err)
+			running.Close()
+		}
+	}
+	services := []any{lockSystem, container.Limiter, container.UserService}
+	for _, share := range container.Shares {
+		services = append(services, share.LockSystem)
+	}
+	flushErr := flush(services...)
 	slog.Info("Server stopped")
-	return nil
+	return flushErr
+}
+
+// registerLocks reports the active locks of the content directory and of the shares.
+func registerLocks(m *metrics.Metrics, lockSystem webdav.LockSystem, shares []Share) {
+	if lockLister, ok := lockSystem.(metrics.LockLister); ok {
+		m.RegisterLocks("", lockLister)
+	}
+	for _, share := range shares {
+		if lockLister, ok := share.LockSystem.(metrics.LockLister); ok {
+			m.RegisterLocks(share.Name, lockLister)
+		}
+	}
+}
+
+// newMetricsHandler serves the metrics to the users allowed to read them. Failed logins are throttled
+// and counted like the ones of the WebDAV server.
+func newMetricsHandler(container StartWebdavServerContainer, users []string) http.Handler {
+	handler := metricsAuthMiddleware(container.AuthService, users)(container.Metrics.Handler())
+	if container.Limiter != nil {
+		handler = auth.LimiterMiddleware(container.Limiter)(handler)
+	}
+	return auth.ObserveFailures(container.Metrics.AuthFailure)(handler)
+}
+
+// metricsAuthMiddleware lets the users allowed to read the metrics in with basic authentication. The
+// metrics are public if no users are allowed.
+func metricsAuthMiddleware(authService auth.Service, users []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(users) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			username, password, ok := r.BasicAuth()
+			if !ok || !slices.Contains(users, username) || !authService.Authenticate(username, password) {
+				if ok {
+					auth.ReportFailure(r, "basic", "invalid_credentials")
+				}
+				slog.Error("Unauthorized access attempt: Metrics", "remote_addr", r.RemoteAddr, "username", username)
+				w.Header().Set("WWW-Authenticate", `Basic realm="Metrics", charset="UTF-8"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// newAuthMiddleware authenticates requests with the configured schemes and authorizes them with an
+// authorizer, which is the one of the content directory or of a share.
+func newAuthMiddleware(container StartWebdavServerContainer, authService auth.Service) func(http.Handler) http.Handler {
+	configurationValue := container.ConfigService.Get()
+	middleware := auth.BasicAuthMiddleware(authService)
+	switch configurationValue.Security.AuthType {
+	case "digest":
+		middleware = auth.DigestAuthMiddleware(container.DigestAuthenticator, authService)
+	case "any":
+		middleware = auth.NegotiateAuthMiddleware(container.DigestAuthenticator, authService)
+	}
+	if container.CertificateAuthenticator != nil {
+		fallback := middleware
+		if configurationValue.Security.ClientCerts.Mode == "required" {
+			fallback = nil
+		}
+		middleware = auth.CertificateAuthMiddleware(*container.CertificateAuthenticator, authService, fallback)
+	}
+	return middleware
+}
+
+// flusher is implemented by services that keep state, which is written before the server exits.
+type flusher interface {
+	Flush() error
+}
+
+func flush(services ...any) error {
+	var errs []error
+	for _, service := range services {
+		if f, ok := service.(flusher); ok {
+			errs = append(errs, f.Flush())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// redirectToHTTPS redirects requests to the same URL with HTTPS on a port.
+func redirectToHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			// IPv6 addresses keep their brackets without a port as well
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// drainMiddleware refuses new locks and uploads while the server is shutting down, so the requests
+// that are still running can finish without new ones piling up.
+func drainMiddleware(draining *atomic.Bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if draining.Load() {
+				switch r.Method {
+				case "LOCK", http.MethodPut, http.MethodPatch, http.MethodPost:
+					w.Header().Set("Connection", "close")
+					w.Header().Set("Retry-After", "5")
+					http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
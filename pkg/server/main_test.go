@@ -0,0 +1,68 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/mocks"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/metrics"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	userService := mocks.NewMockUserService(map[string]config.User{"prometheus": {Password: string(hash)}})
+	container := StartWebdavServerContainer{
+		AuthService: auth.New(userService),
+		Limiter:     auth.NewSlidingWindowLimiter(auth.LimiterOptions{BackoffAfter: 10, MaxFailures: 2, Lockout: time.Hour}),
+		Metrics:     metrics.New(),
+	}
+	handler := newMetricsHandler(container, []string{"prometheus"})
+	scrape := func(password string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		request.SetBasicAuth("prometheus", password)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusOK, scrape("secret").Code)
+
+	t.Run("Failed logins are throttled and counted", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, scrape("wrong").Code)
+		assert.Equal(t, http.StatusUnauthorized, scrape("wrong").Code)
+		assert.Equal(t, http.StatusTooManyRequests, scrape("secret").Code)
+		container.Limiter.Clear("")
+		recorder := scrape("secret")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), `webdav_auth_failures_total{reason="invalid_credentials",scheme="basic"} 2`)
+	})
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     string
+		port     string
+		expected string
+	}{
+		{name: "Default port", host: "nas.local:8080", port: "443", expected: "https://nas.local/docs/a.txt?x=1"},
+		{name: "Other port", host: "nas.local", port: "8443", expected: "https://nas.local:8443/docs/a.txt?x=1"},
+		{name: "IPv6 on the default port", host: "[fd00::1]:8080", port: "443", expected: "https://[fd00::1]/docs/a.txt?x=1"},
+		{name: "IPv6 on another port", host: "[fd00::1]", port: "8443", expected: "https://[fd00::1]:8443/docs/a.txt?x=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/docs/a.txt?x=1", nil)
+			request.Host = tt.host
+			recorder := httptest.NewRecorder()
+			redirectToHTTPS(tt.port).ServeHTTP(recorder, request)
+			assert.Equal(t, http.StatusPermanentRedirect, recorder.Code)
+			assert.Equal(t, tt.expected, recorder.Header().Get("Location"))
+		})
+	}
+}
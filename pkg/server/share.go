@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"github.com/triargos/webdav/pkg/auth"
+	"github.com/triargos/webdav/pkg/config"
+	"github.com/triargos/webdav/pkg/handler"
+	"github.com/triargos/webdav/pkg/helper"
+	"golang.org/x/net/webdav"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Share is a directory served under its own URL prefix, see config.Share.
+type Share struct {
+	Name   string
+	Prefix string
+	// ReadOnly refuses every request that could change the share
+	ReadOnly    bool
+	FileSystem  *handler.WebdavFs
+	AuthService auth.Service
+	LockSystem  webdav.LockSystem
+}
+
+// ValidatePrefix checks a URL prefix: it is empty or a clean absolute path such as /dav, without a
+// trailing slash.
+func ValidatePrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if !strings.HasPrefix(prefix, "/") || prefix == "/" || path.Clean(prefix) != prefix {
+		return fmt.Errorf("invalid prefix %q, must be an absolute path like /dav without a trailing slash", prefix)
+	}
+	if strings.ContainsAny(prefix, "{}") || strings.IndexFunc(prefix, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("invalid prefix %q, must not contain braces or spaces", prefix)
+	}
+	return nil
+}
+
+// SharePrefixes returns the URL prefixes of the shares by their names. A share without a prefix is
+// served under the network prefix followed by its name. Prefixes must be unique and differ from the
+// network prefix, which serves the content directory. Below the network prefix, they must not hide
+// the state directory or one of the contentNames, the members of the root of the content directory.
+func SharePrefixes(networkPrefix string, shares map[string]config.Share, contentNames []string) (map[string]string, error) {
+	if err := ValidatePrefix(networkPrefix); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(shares))
+	for name := range shares {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	prefixes := map[string]string{}
+	owners := map[string]string{networkPrefix: ""}
+	for _, name := range names {
+		if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\") || strings.IndexFunc(name, unicode.IsSpace) >= 0 {
+			return nil, fmt.Errorf("invalid share name %q, must not start with a dot or contain slashes or spaces", name)
+		}
+		if shares[name].Dir == "" {
+			return nil, fmt.Errorf("share %s has no directory", name)
+		}
+		prefix := shares[name].Prefix
+		if prefix == "" {
+			prefix = networkPrefix + "/" + name
+		}
+		if err := ValidatePrefix(prefix); err != nil {
+			return nil, fmt.Errorf("share %s: %w", name, err)
+		}
+		if member, ok := contentMember(networkPrefix, prefix); ok {
+			if helper.IsStatePath(member) {
+				return nil, fmt.Errorf("share %s: prefix %s hides the state directory", name, prefix)
+			}
+			for _, contentName := range contentNames {
+				if strings.EqualFold(contentName, member) {
+					return nil, fmt.Errorf("share %s: prefix %s hides %s in the content directory", name, prefix, contentName)
+				}
+			}
+		}
+		if owner, ok := owners[prefix]; ok {
+			if owner == "" {
+				return nil, fmt.Errorf("share %s: prefix %s serves the content directory", name, prefix)
+			}
+			return nil, fmt.Errorf("share %s: prefix %s is used by share %s", name, prefix, owner)
+		}
+		owners[prefix] = name
+		prefixes[name] = prefix
+	}
+	return prefixes, nil
+}
+
+// contentMember returns the member of the root of the content directory whose URL a prefix is
+// below, if the prefix is below the network prefix.
+func contentMember(networkPrefix, prefix string) (string, bool) {
+	relative, ok := strings.CutPrefix(prefix, networkPrefix+"/")
+	if !ok {
+		return "", false
+	}
+	member, _, _ := strings.Cut(relative, "/")
+	return member, true
+}
+
+// mount serves a handler under a URL prefix, with the prefix stripped from the requests.
+func mount(mux *http.ServeMux, prefix string, next http.Handler) {
+	if prefix == "" {
+		mux.Handle("/", next)
+		return
+	}
+	stripped := helper.StripPrefix(prefix, next)
+	mux.Handle(prefix, stripped)
+	mux.Handle(prefix+"/", stripped)
+}
+
+// readOnlyMiddleware refuses every request that could change a read-only share, including property
+// changes and locks.
+func readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+			next.ServeHTTP(w, r)
+		default:
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		}
+	})
+}
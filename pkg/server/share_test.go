@@ -0,0 +1,60 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/pkg/config"
+	"testing"
+)
+
+func TestSharePrefixes(t *testing.T) {
+	t.Run("Default prefixes", func(t *testing.T) {
+		prefixes, err := SharePrefixes("/dav", map[string]config.Share{
+			"projects": {Dir: "/srv/projects"},
+			"archive":  {Dir: "/srv/archive", Prefix: "/archive"},
+		}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"projects": "/dav/projects", "archive": "/archive"}, prefixes)
+
+		prefixes, err = SharePrefixes("", map[string]config.Share{"projects": {Dir: "/srv/projects"}}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "/projects", prefixes["projects"])
+	})
+
+	t.Run("Invalid prefixes", func(t *testing.T) {
+		for _, prefix := range []string{"dav", "/dav/", "/", "/dav/../x", "/{name}", "/my dav", "/dav\tx"} {
+			_, err := SharePrefixes(prefix, nil, nil)
+			assert.Error(t, err, prefix)
+			_, err = SharePrefixes("", map[string]config.Share{"projects": {Dir: "/srv/projects", Prefix: prefix}}, nil)
+			assert.Error(t, err, prefix)
+		}
+	})
+
+	t.Run("Conflicts", func(t *testing.T) {
+		_, err := SharePrefixes("/dav", map[string]config.Share{"projects": {Dir: "/srv/projects", Prefix: "/dav"}}, nil)
+		assert.Error(t, err, "the network prefix serves the content directory")
+		_, err = SharePrefixes("", map[string]config.Share{
+			"projects": {Dir: "/srv/projects"},
+			"other":    {Dir: "/srv/other", Prefix: "/projects"},
+		}, nil)
+		assert.Error(t, err)
+		for _, name := range []string{"a/b", "my projects", ".webdav", ".hidden", ".."} {
+			_, err = SharePrefixes("", map[string]config.Share{name: {Dir: "/srv/projects"}}, nil)
+			assert.Error(t, err, name)
+		}
+		_, err = SharePrefixes("", map[string]config.Share{"projects": {}}, nil)
+		assert.Error(t, err, "shares need a directory")
+	})
+
+	t.Run("Prefixes hiding the content directory", func(t *testing.T) {
+		contentNames := []string{"projects", "Photos"}
+		_, err := SharePrefixes("", map[string]config.Share{"projects": {Dir: "/srv/projects"}}, contentNames)
+		assert.Error(t, err, "the default prefix hides a top-level directory")
+		_, err = SharePrefixes("", map[string]config.Share{"archive": {Dir: "/srv/archive", Prefix: "/photos/archive"}}, contentNames)
+		assert.Error(t, err, "names are compared ignoring case")
+		_, err = SharePrefixes("", map[string]config.Share{"state": {Dir: "/srv/state", Prefix: "/.webdav/state"}}, contentNames)
+		assert.Error(t, err, "the state directory can't be hidden")
+		prefixes, err := SharePrefixes("/dav", map[string]config.Share{"projects": {Dir: "/srv/projects", Prefix: "/projects"}}, contentNames)
+		assert.NoError(t, err, "prefixes outside of the network prefix hide nothing")
+		assert.Equal(t, "/projects", prefixes["projects"])
+	})
+}
@@ -0,0 +1,342 @@
+package trash
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/triargos/webdav/pkg/helper"
+	"github.com/triargos/webdav/pkg/property"
+	"golang.org/x/net/webdav"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("trash entry not found")
+	// ErrConflict is returned when restoring an entry whose original path has been taken
+	ErrConflict = errors.New("original path is taken")
+)
+
+// purgeInterval is how often expired entries are purged at most.
+const purgeInterval = time.Hour
+
+const (
+	entryFile = "entry.json"
+	dataFile  = "data"
+)
+
+// Entry is a deleted file or collection.
+type Entry struct {
+	ID string `json:"id"`
+	// Path is the path the entry was deleted from, in the content directory
+	Path    string    `json:"path"`
+	Deleted time.Time `json:"deleted"`
+	Dir     bool      `json:"dir"`
+}
+
+type Service interface {
+	// Move moves a file or collection into the trash of a user.
+	Move(ctx context.Context, username, name string) (Entry, error)
+	// List returns the entries of the trash of a user, most recently deleted first.
+	List(ctx context.Context, username string) ([]Entry, error)
+	Get(ctx context.Context, username, id string) (Entry, error)
+	// DataPath returns the path the deleted data of an entry is kept at.
+	DataPath(username, id string) (string, error)
+	// Retained returns the data of the entries in every trash, mapped to the paths it was deleted
+	// from.
+	Retained(ctx context.Context) (map[string]string, error)
+	// Restore moves an entry back to its original path.
+	Restore(ctx context.Context, username, id string) (Entry, error)
+	// Delete removes an entry for good.
+	Delete(ctx context.Context, username, id string) error
+	// Empty removes the entries deleted before a time, or all entries if it is zero. Without a
+	// username, the trash of every user is emptied.
+	Empty(ctx context.Context, username string, before time.Time) (int, error)
+}
+
+// TrashService keeps the trash of every user in the state directory of a file system, one
+// collection per entry holding the deleted data and its metadata. The dead properties of the data
+// are moved along with it.
+type TrashService struct {
+	fileSystem webdav.FileSystem
+	properties property.Store
+	retention  time.Duration
+	mutex      sync.Mutex
+	lastPurge  time.Time
+	now        func() time.Time
+}
+
+// NewTrashService creates a trash on a file system, which must not check permissions. Entries older
+// than the retention are purged, a retention of zero keeps them until the trash is emptied. The
+// property store is optional.
+func NewTrashService(fileSystem webdav.FileSystem, properties property.Store, retention time.Duration) Service {
+	return &TrashService{fileSystem: fileSystem, properties: properties, retention: retention, now: time.Now}
+}
+
+func (s *TrashService) Move(ctx context.Context, username, name string) (Entry, error) {
+	userDir, err := trashDir(username)
+	if err != nil {
+		return Entry{}, err
+	}
+	fileInfo, err := s.fileSystem.Stat(ctx, name)
+	if err != nil {
+		return Entry{}, err
+	}
+	s.purgeIfDue(ctx)
+	entry := Entry{ID: newID(s.now()), Path: path.Clean("/" + name), Deleted: s.now().UTC(), Dir: fileInfo.IsDir()}
+	entryDir := path.Join(userDir, entry.ID)
+	if err := helper.MkdirAll(ctx, s.fileSystem, entryDir); err != nil {
+		return Entry{}, fmt.Errorf("failed to create trash entry: %w", err)
+	}
+	if err := s.writeEntry(ctx, entryDir, entry); err != nil {
+		s.fileSystem.RemoveAll(ctx, entryDir)
+		return Entry{}, err
+	}
+	if err := s.fileSystem.Rename(ctx, name, path.Join(entryDir, dataFile)); err != nil {
+		s.fileSystem.RemoveAll(ctx, entryDir)
+		return Entry{}, fmt.Errorf("failed to move into trash: %w", err)
+	}
+	s.moveProperties(ctx, entry.Path, path.Join(entryDir, dataFile))
+	return entry, nil
+}
+
+func (s *TrashService) List(ctx context.Context, username string) ([]Entry, error) {
+	userDir, err := trashDir(username)
+	if err != nil {
+		return nil, err
+	}
+	s.purgeIfDue(ctx)
+	ids, err := helper.ReadDirNames(ctx, s.fileSystem, userDir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(ids))
+	for _, id := range ids {
+		entry, err := s.readEntry(ctx, path.Join(userDir, id))
+		if err != nil {
+			slog.Warn("Skipping unreadable trash entry", "username", username, "id", id, "error", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Deleted.After(entries[j].Deleted)
+	})
+	return entries, nil
+}
+
+func (s *TrashService) Get(ctx context.Context, username, id string) (Entry, error) {
+	entryDir, err := entryDir(username, id)
+	if err != nil {
+		return Entry{}, err
+	}
+	return s.readEntry(ctx, entryDir)
+}
+
+func (s *TrashService) DataPath(username, id string) (string, error) {
+	entryDir, err := entryDir(username, id)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(entryDir, dataFile), nil
+}
+
+// Retained makes the trash a quota.Retainer, so entries count toward the quotas of their original
+// paths.
+func (s *TrashService) Retained(ctx context.Context) (map[string]string, error) {
+	usernames, err := helper.ReadDirNames(ctx, s.fileSystem, helper.StatePath("trash"))
+	if err != nil {
+		return nil, err
+	}
+	retained := map[string]string{}
+	for _, username := range usernames {
+		userDir := helper.StatePath("trash", username)
+		ids, err := helper.ReadDirNames(ctx, s.fileSystem, userDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			entry, err := s.readEntry(ctx, path.Join(userDir, id))
+			if err != nil {
+				continue
+			}
+			retained[path.Join(userDir, id, dataFile)] = entry.Path
+		}
+	}
+	return retained, nil
+}
+
+func (s *TrashService) Restore(ctx context.Context, username, id string) (Entry, error) {
+	entryDir, err := entryDir(username, id)
+	if err != nil {
+		return Entry{}, err
+	}
+	entry, err := s.readEntry(ctx, entryDir)
+	if err != nil {
+		return Entry{}, err
+	}
+	if _, err := s.fileSystem.Stat(ctx, entry.Path); err == nil {
+		return Entry{}, ErrConflict
+	}
+	if err := helper.MkdirAll(ctx, s.fileSystem, path.Dir(entry.Path)); err != nil {
+		return Entry{}, fmt.Errorf("failed to recreate parent collection: %w", err)
+	}
+	if err := s.fileSystem.Rename(ctx, path.Join(entryDir, dataFile), entry.Path); err != nil {
+		return Entry{}, fmt.Errorf("failed to restore from trash: %w", err)
+	}
+	s.moveProperties(ctx, path.Join(entryDir, dataFile), entry.Path)
+	s.deleteProperties(ctx, entryDir)
+	return entry, s.fileSystem.RemoveAll(ctx, entryDir)
+}
+
+func (s *TrashService) Delete(ctx context.Context, username, id string) error {
+	entryDir, err := entryDir(username, id)
+	if err != nil {
+		return err
+	}
+	if _, err := s.fileSystem.Stat(ctx, entryDir); err != nil {
+		return ErrNotFound
+	}
+	s.deleteProperties(ctx, entryDir)
+	return s.fileSystem.RemoveAll(ctx, entryDir)
+}
+
+func (s *TrashService) Empty(ctx context.Context, username string, before time.Time) (int, error) {
+	usernames := []string{username}
+	if username == "" {
+		var err error
+		if usernames, err = helper.ReadDirNames(ctx, s.fileSystem, helper.StatePath("trash")); err != nil {
+			return 0, err
+		}
+	}
+	removed := 0
+	for _, username := range usernames {
+		entries, err := s.List(ctx, username)
+		if err != nil {
+			return removed, err
+		}
+		for _, entry := range entries {
+			if !before.IsZero() && !entry.Deleted.Before(before) {
+				continue
+			}
+			if err := s.Delete(ctx, username, entry.ID); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// purgeIfDue removes expired entries, at most once per purge interval.
+func (s *TrashService) purgeIfDue(ctx context.Context) {
+	if s.retention <= 0 {
+		return
+	}
+	s.mutex.Lock()
+	now := s.now()
+	due := now.Sub(s.lastPurge) >= purgeInterval
+	if due {
+		s.lastPurge = now
+	}
+	s.mutex.Unlock()
+	if !due {
+		return
+	}
+	removed, err := s.Empty(ctx, "", now.Add(-s.retention))
+	if err != nil {
+		slog.Error("Failed to purge trash", "error", err)
+	} else if removed > 0 {
+		slog.Info("Purged expired trash entries", "count", removed)
+	}
+}
+
+// moveProperties moves the dead properties of an entry, which is kept either way if they can't be.
+func (s *TrashService) moveProperties(ctx context.Context, oldName, newName string) {
+	if s.properties == nil {
+		return
+	}
+	if err := s.properties.Move(ctx, oldName, newName); err != nil {
+		slog.Error("Failed to move properties", "from", oldName, "to", newName, "error", err)
+	}
+}
+
+// deleteProperties removes the dead properties kept for an entry.
+func (s *TrashService) deleteProperties(ctx context.Context, entryDir string) {
+	if s.properties == nil {
+		return
+	}
+	if err := s.properties.Delete(ctx, entryDir); err != nil {
+		slog.Error("Failed to remove properties", "path", entryDir, "error", err)
+	}
+}
+
+func (s *TrashService) writeEntry(ctx context.Context, entryDir string, entry Entry) error {
+	marshalled, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := helper.WriteFile(ctx, s.fileSystem, path.Join(entryDir, entryFile), marshalled); err != nil {
+		return fmt.Errorf("failed to write trash entry: %w", err)
+	}
+	return nil
+}
+
+func (s *TrashService) readEntry(ctx context.Context, entryDir string) (Entry, error) {
+	file, err := s.fileSystem.OpenFile(ctx, path.Join(entryDir, entryFile), os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return Entry{}, ErrNotFound
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return Entry{}, err
+	}
+	var entry Entry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return Entry{}, fmt.Errorf("invalid trash entry: %w", err)
+	}
+	return entry, nil
+}
+
+func trashDir(username string) (string, error) {
+	if !isPathElement(username) {
+		return "", fmt.Errorf("invalid username %q", username)
+	}
+	return helper.StatePath("trash", username), nil
+}
+
+func entryDir(username, id string) (string, error) {
+	userDir, err := trashDir(username)
+	if err != nil {
+		return "", err
+	}
+	if !isPathElement(id) {
+		return "", ErrNotFound
+	}
+	return path.Join(userDir, id), nil
+}
+
+func isPathElement(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+func newID(now time.Time) string {
+	buffer := make([]byte, 4)
+	if _, err := rand.Read(buffer); err != nil {
+		panic(err)
+	}
+	return now.UTC().Format("20060102T150405") + "-" + hex.EncodeToString(buffer)
+}
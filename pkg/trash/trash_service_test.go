@@ -0,0 +1,92 @@
+package trash
+
+import (
+	"context"
+	"encoding/xml"
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/pkg/helper"
+	"github.com/triargos/webdav/pkg/property"
+	"golang.org/x/net/webdav"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTrashRetention(t *testing.T) {
+	ctx := context.Background()
+	memFs := webdav.NewMemFS()
+	for _, name := range []string{"/old.txt", "/new.txt"} {
+		file, err := memFs.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE, 0644)
+		assert.NoError(t, err)
+		file.Close()
+	}
+	service := NewTrashService(memFs, nil, 24*time.Hour).(*TrashService)
+	now := time.Now()
+	service.now = func() time.Time { return now }
+
+	_, err := service.Move(ctx, "alice", "/old.txt")
+	assert.NoError(t, err)
+	now = now.Add(20 * time.Hour)
+	_, err = service.Move(ctx, "alice", "/new.txt")
+	assert.NoError(t, err)
+
+	t.Run("Purge is throttled", func(t *testing.T) {
+		now = now.Add(10 * time.Hour)
+		service.lastPurge = now.Add(-time.Minute)
+		entries, err := service.List(ctx, "alice")
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2)
+	})
+
+	t.Run("Expired entries are purged", func(t *testing.T) {
+		now = now.Add(purgeInterval)
+		entries, err := service.List(ctx, "alice")
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+		assert.Equal(t, "/new.txt", entries[0].Path)
+	})
+
+	t.Run("Invalid usernames are rejected", func(t *testing.T) {
+		_, err := service.Move(ctx, "../alice", "/new.txt")
+		assert.Error(t, err)
+	})
+}
+
+func TestTrashProperties(t *testing.T) {
+	ctx := context.Background()
+	memFs := webdav.NewMemFS()
+	properties := property.NewFileStore(memFs)
+	service := NewTrashService(memFs, properties, 0)
+	tag := xml.Name{Space: "urn:example", Local: "tag"}
+	for _, name := range []string{"/restored.txt", "/deleted.txt"} {
+		file, err := memFs.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE, 0644)
+		assert.NoError(t, err)
+		file.Close()
+		_, err = properties.Patch(ctx, name, []webdav.Proppatch{{Props: []webdav.Property{{XMLName: tag, InnerXML: []byte("red")}}}})
+		assert.NoError(t, err)
+	}
+
+	t.Run("Properties come back with a restored entry", func(t *testing.T) {
+		entry, err := service.Move(ctx, "alice", "/restored.txt")
+		assert.NoError(t, err)
+		_, err = service.Restore(ctx, "alice", entry.ID)
+		assert.NoError(t, err)
+		restored, err := properties.Get(ctx, "/restored.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, "red", string(restored[tag].InnerXML))
+	})
+
+	t.Run("Properties are deleted with an entry", func(t *testing.T) {
+		entry, err := service.Move(ctx, "alice", "/deleted.txt")
+		assert.NoError(t, err)
+		dataPath, err := service.DataPath("alice", entry.ID)
+		assert.NoError(t, err)
+		assert.NoError(t, service.Delete(ctx, "alice", entry.ID))
+		deleted, err := properties.Get(ctx, dataPath)
+		assert.NoError(t, err)
+		assert.Empty(t, deleted)
+		members, err := helper.ReadDirNames(ctx, memFs, helper.StatePath("props", "_.webdav", "_trash", "_alice"))
+		assert.NoError(t, err)
+		assert.Empty(t, members, "no properties are left behind by restored and deleted entries")
+	})
+}
@@ -0,0 +1,349 @@
+package upload
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/triargos/webdav/pkg/helper"
+	"golang.org/x/net/webdav"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("upload not found")
+	// ErrOffsetMismatch is returned when data is written at an offset other than the end of the
+	// data received so far
+	ErrOffsetMismatch = errors.New("upload offset mismatch")
+	// ErrBusy is returned when data is written to an upload that is being written to already
+	ErrBusy = errors.New("upload is busy")
+	// ErrTooLarge is returned when more data is written than the length of the upload
+	ErrTooLarge = errors.New("upload exceeds its length")
+)
+
+// purgeInterval is how often expired uploads are purged at most.
+const purgeInterval = time.Hour
+
+const (
+	uploadFile = "upload.json"
+	dataFile   = "data"
+)
+
+// Upload is a file that is uploaded in several requests.
+type Upload struct {
+	ID string `json:"id"`
+	// Path is the path the file is created at once the upload is complete, in the content directory
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+	// Reserved is the quota held for the upload until it is completed, deleted or expires
+	Reserved int64 `json:"reserved,omitempty"`
+	// Offset is the number of bytes received so far
+	Offset   int64             `json:"-"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Created  time.Time         `json:"created"`
+	Expires  time.Time         `json:"expires,omitempty"`
+}
+
+type Service interface {
+	// Create starts an upload of a user, holding reserved bytes of quota for it.
+	Create(ctx context.Context, username, name string, length, reserved int64, metadata map[string]string) (Upload, error)
+	Get(ctx context.Context, username, id string) (Upload, error)
+	// List returns the uploads of a user that have not expired.
+	List(ctx context.Context, username string) ([]Upload, error)
+	// Write appends data to an upload at an offset, which must be the number of bytes received so
+	// far. The data received before an error is kept, so the upload can be resumed from there.
+	Write(ctx context.Context, username, id string, offset int64, reader io.Reader) (Upload, error)
+	// Open opens the data received for an upload.
+	Open(ctx context.Context, username, id string) (webdav.File, error)
+	Delete(ctx context.Context, username, id string) error
+}
+
+// UploadService keeps the uploads of every user in the state directory of a file system, one
+// collection per upload holding the received data and its metadata.
+type UploadService struct {
+	fileSystem webdav.FileSystem
+	expiry     time.Duration
+	mutex      sync.Mutex
+	busy       map[string]bool
+	lastPurge  time.Time
+	now        func() time.Time
+}
+
+// NewUploadService creates an upload store on a file system, which must not check permissions.
+// Uploads that have not been written to for the expiry are purged, an expiry of zero keeps them
+// until they are completed or deleted.
+func NewUploadService(fileSystem webdav.FileSystem, expiry time.Duration) Service {
+	return &UploadService{fileSystem: fileSystem, expiry: expiry, busy: map[string]bool{}, now: time.Now}
+}
+
+func (s *UploadService) Create(ctx context.Context, username, name string, length, reserved int64, metadata map[string]string) (Upload, error) {
+	userDir, err := userDir(username)
+	if err != nil {
+		return Upload{}, err
+	}
+	s.purgeIfDue(ctx)
+	now := s.now().UTC()
+	upload := Upload{ID: newID(now), Path: path.Clean("/" + name), Length: length, Reserved: reserved, Metadata: metadata, Created: now}
+	if s.expiry > 0 {
+		upload.Expires = now.Add(s.expiry)
+	}
+	uploadDir := path.Join(userDir, upload.ID)
+	if err := helper.MkdirAll(ctx, s.fileSystem, uploadDir); err != nil {
+		return Upload{}, fmt.Errorf("failed to create upload: %w", err)
+	}
+	file, err := s.fileSystem.OpenFile(ctx, path.Join(uploadDir, dataFile), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err == nil {
+		err = file.Close()
+	}
+	if err == nil {
+		err = s.writeUpload(ctx, uploadDir, upload)
+	}
+	if err != nil {
+		s.fileSystem.RemoveAll(ctx, uploadDir)
+		return Upload{}, fmt.Errorf("failed to create upload: %w", err)
+	}
+	return upload, nil
+}
+
+func (s *UploadService) Get(ctx context.Context, username, id string) (Upload, error) {
+	uploadDir, err := uploadDir(username, id)
+	if err != nil {
+		return Upload{}, err
+	}
+	s.purgeIfDue(ctx)
+	return s.readUpload(ctx, uploadDir)
+}
+
+func (s *UploadService) List(ctx context.Context, username string) ([]Upload, error) {
+	userDir, err := userDir(username)
+	if err != nil {
+		return nil, err
+	}
+	s.purgeIfDue(ctx)
+	ids, err := helper.ReadDirNames(ctx, s.fileSystem, userDir)
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	uploads := make([]Upload, 0, len(ids))
+	for _, id := range ids {
+		upload, err := s.readUpload(ctx, path.Join(userDir, id))
+		if err != nil {
+			slog.Warn("Skipping unreadable upload", "username", username, "id", id, "error", err)
+			continue
+		}
+		if !upload.Expires.IsZero() && !now.Before(upload.Expires) {
+			continue
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, nil
+}
+
+func (s *UploadService) Write(ctx context.Context, username, id string, offset int64, reader io.Reader) (Upload, error) {
+	uploadDir, err := uploadDir(username, id)
+	if err != nil {
+		return Upload{}, err
+	}
+	if !s.acquire(uploadDir) {
+		return Upload{}, ErrBusy
+	}
+	defer s.release(uploadDir)
+	upload, err := s.readUpload(ctx, uploadDir)
+	if err != nil {
+		return Upload{}, err
+	}
+	if offset != upload.Offset {
+		return upload, ErrOffsetMismatch
+	}
+	file, err := s.fileSystem.OpenFile(ctx, path.Join(uploadDir, dataFile), os.O_RDWR, 0)
+	if err != nil {
+		return upload, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return upload, err
+	}
+	written, copyErr := io.Copy(file, io.LimitReader(reader, upload.Length-offset))
+	closeErr := file.Close()
+	upload.Offset += written
+	if copyErr == nil && upload.Offset == upload.Length {
+		// Anything after the announced length is refused
+		if read, _ := reader.Read(make([]byte, 1)); read > 0 {
+			copyErr = ErrTooLarge
+		}
+	}
+	if s.expiry > 0 {
+		upload.Expires = s.now().UTC().Add(s.expiry)
+	}
+	return upload, errors.Join(copyErr, closeErr, s.writeUpload(ctx, uploadDir, upload))
+}
+
+func (s *UploadService) Open(ctx context.Context, username, id string) (webdav.File, error) {
+	uploadDir, err := uploadDir(username, id)
+	if err != nil {
+		return nil, err
+	}
+	file, err := s.fileSystem.OpenFile(ctx, path.Join(uploadDir, dataFile), os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+func (s *UploadService) Delete(ctx context.Context, username, id string) error {
+	uploadDir, err := uploadDir(username, id)
+	if err != nil {
+		return err
+	}
+	if _, err := s.fileSystem.Stat(ctx, uploadDir); err != nil {
+		return ErrNotFound
+	}
+	return s.fileSystem.RemoveAll(ctx, uploadDir)
+}
+
+// acquire marks an upload as being written to, unless it is already.
+func (s *UploadService) acquire(uploadDir string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.busy[uploadDir] {
+		return false
+	}
+	s.busy[uploadDir] = true
+	return true
+}
+
+func (s *UploadService) release(uploadDir string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.busy, uploadDir)
+}
+
+// purgeIfDue removes expired uploads, at most once per purge interval.
+func (s *UploadService) purgeIfDue(ctx context.Context) {
+	if s.expiry <= 0 {
+		return
+	}
+	s.mutex.Lock()
+	now := s.now()
+	due := now.Sub(s.lastPurge) >= purgeInterval
+	if due {
+		s.lastPurge = now
+	}
+	s.mutex.Unlock()
+	if !due {
+		return
+	}
+	removed, err := s.purge(ctx, now)
+	if err != nil {
+		slog.Error("Failed to purge uploads", "error", err)
+	} else if removed > 0 {
+		slog.Info("Purged expired uploads", "count", removed)
+	}
+}
+
+func (s *UploadService) purge(ctx context.Context, now time.Time) (int, error) {
+	usernames, err := helper.ReadDirNames(ctx, s.fileSystem, helper.StatePath("uploads"))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, username := range usernames {
+		ids, err := helper.ReadDirNames(ctx, s.fileSystem, helper.StatePath("uploads", username))
+		if err != nil {
+			return removed, err
+		}
+		for _, id := range ids {
+			uploadDir := helper.StatePath("uploads", username, id)
+			upload, err := s.readUpload(ctx, uploadDir)
+			if err == nil && (upload.Expires.IsZero() || now.Before(upload.Expires)) {
+				continue
+			}
+			if !s.acquire(uploadDir) {
+				continue
+			}
+			err = s.fileSystem.RemoveAll(ctx, uploadDir)
+			s.release(uploadDir)
+			if err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (s *UploadService) writeUpload(ctx context.Context, uploadDir string, upload Upload) error {
+	marshalled, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	if err := helper.WriteFile(ctx, s.fileSystem, path.Join(uploadDir, uploadFile), marshalled); err != nil {
+		return fmt.Errorf("failed to write upload: %w", err)
+	}
+	return nil
+}
+
+// readUpload reads the metadata of an upload. The offset is the size of the data received so far.
+func (s *UploadService) readUpload(ctx context.Context, uploadDir string) (Upload, error) {
+	file, err := s.fileSystem.OpenFile(ctx, path.Join(uploadDir, uploadFile), os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return Upload{}, ErrNotFound
+	}
+	if err != nil {
+		return Upload{}, err
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return Upload{}, err
+	}
+	var upload Upload
+	if err := json.Unmarshal(content, &upload); err != nil {
+		return Upload{}, fmt.Errorf("invalid upload: %w", err)
+	}
+	fileInfo, err := s.fileSystem.Stat(ctx, path.Join(uploadDir, dataFile))
+	if err != nil {
+		return Upload{}, err
+	}
+	upload.Offset = fileInfo.Size()
+	return upload, nil
+}
+
+func userDir(username string) (string, error) {
+	if !isPathElement(username) {
+		return "", fmt.Errorf("invalid username %q", username)
+	}
+	return helper.StatePath("uploads", username), nil
+}
+
+func uploadDir(username, id string) (string, error) {
+	userDir, err := userDir(username)
+	if err != nil {
+		return "", err
+	}
+	if !isPathElement(id) {
+		return "", ErrNotFound
+	}
+	return path.Join(userDir, id), nil
+}
+
+func isPathElement(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+func newID(now time.Time) string {
+	buffer := make([]byte, 8)
+	if _, err := rand.Read(buffer); err != nil {
+		panic(err)
+	}
+	return now.UTC().Format("20060102T150405") + "-" + hex.EncodeToString(buffer)
+}
@@ -0,0 +1,47 @@
+package upload
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadExpiry(t *testing.T) {
+	ctx := context.Background()
+	service := NewUploadService(webdav.NewMemFS(), 24*time.Hour).(*UploadService)
+	now := time.Now()
+	service.now = func() time.Time { return now }
+
+	abandoned, err := service.Create(ctx, "alice", "/abandoned.bin", 10, 10, nil)
+	assert.NoError(t, err)
+	active, err := service.Create(ctx, "alice", "/active.bin", 10, 0, nil)
+	assert.NoError(t, err)
+	now = now.Add(20 * time.Hour)
+
+	t.Run("Writing extends the expiry", func(t *testing.T) {
+		written, err := service.Write(ctx, "alice", active.ID, 0, strings.NewReader("01234"))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), written.Offset)
+		assert.Equal(t, now.Add(24*time.Hour).UTC(), written.Expires)
+	})
+
+	t.Run("Data beyond the length is refused", func(t *testing.T) {
+		written, err := service.Write(ctx, "alice", active.ID, 5, strings.NewReader("56789abc"))
+		assert.ErrorIs(t, err, ErrTooLarge)
+		assert.Equal(t, int64(10), written.Offset)
+	})
+
+	t.Run("Expired uploads are purged", func(t *testing.T) {
+		now = now.Add(10 * time.Hour)
+		uploads, err := service.List(ctx, "alice")
+		assert.NoError(t, err)
+		assert.Len(t, uploads, 1)
+		_, err = service.Get(ctx, "alice", abandoned.ID)
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = service.Get(ctx, "alice", active.ID)
+		assert.NoError(t, err)
+	})
+}
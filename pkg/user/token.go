@@ -0,0 +1,168 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/triargos/webdav/pkg/config"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenPrefix marks app passwords, so they can be told apart from regular passwords.
+const TokenPrefix = "wdv_"
+
+const tokenUsageFile = "token_usage.json"
+
+// tokenUsageFlushInterval limits how often last-used timestamps are written to disk.
+const tokenUsageFlushInterval = time.Minute
+
+type tokenUsage struct {
+	mutex     sync.Mutex
+	loaded    bool
+	lastFlush time.Time
+	lastUsed  map[string]map[string]time.Time
+	// unflushed is set when tokens were used since the timestamps were last written
+	unflushed bool
+}
+
+func HashToken(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func generateTokenSecret() (string, error) {
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return TokenPrefix + base64.RawURLEncoding.EncodeToString(buffer), nil
+}
+
+// AddToken creates an app password for a user and returns the secret. Only the hash of the secret
+// is stored, so it cannot be shown again.
+func (s *ServiceImpl) AddToken(username string, token config.Token) (string, error) {
+	if !s.HasUser(username) {
+		return "", errors.New("user does not exist")
+	}
+	if strings.TrimSpace(token.Name) == "" {
+		return "", errors.New("token name must not be empty")
+	}
+	user := s.GetUser(username)
+	for _, existing := range user.Tokens {
+		if existing.Name == token.Name {
+			return "", fmt.Errorf("token %q already exists", token.Name)
+		}
+	}
+	secret, generateErr := generateTokenSecret()
+	if generateErr != nil {
+		return "", generateErr
+	}
+	token.Hash = HashToken(secret)
+	token.Created = time.Now().UTC()
+	user.Tokens = append(user.Tokens, token)
+	s.configService.UpdateUser(username, user)
+	s.notifyUserChange(username)
+	writeConfigErr := s.configService.Write()
+	if writeConfigErr != nil {
+		return "", fmt.Errorf("failed to write config file: %s", writeConfigErr)
+	}
+	return secret, nil
+}
+
+func (s *ServiceImpl) RemoveToken(username, name string) error {
+	if !s.HasUser(username) {
+		return errors.New("user does not exist")
+	}
+	user := s.GetUser(username)
+	tokens := make([]config.Token, 0, len(user.Tokens))
+	for _, token := range user.Tokens {
+		if token.Name != name {
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) == len(user.Tokens) {
+		return fmt.Errorf("token %q does not exist", name)
+	}
+	user.Tokens = tokens
+	s.configService.UpdateUser(username, user)
+	s.notifyUserChange(username)
+	writeConfigErr := s.configService.Write()
+	if writeConfigErr != nil {
+		return fmt.Errorf("failed to write config file: %s", writeConfigErr)
+	}
+	return nil
+}
+
+// TouchToken records that a token was used. The timestamps are kept in a state file instead of the
+// configuration, so a running server never overwrites configuration changes made in the meantime.
+func (s *ServiceImpl) TouchToken(username, name string) {
+	s.tokenUsage.mutex.Lock()
+	defer s.tokenUsage.mutex.Unlock()
+	s.loadTokenUsage()
+	if s.tokenUsage.lastUsed[username] == nil {
+		s.tokenUsage.lastUsed[username] = map[string]time.Time{}
+	}
+	now := time.Now().UTC()
+	s.tokenUsage.lastUsed[username][name] = now
+	s.tokenUsage.unflushed = true
+	if now.Sub(s.tokenUsage.lastFlush) < tokenUsageFlushInterval {
+		return
+	}
+	if writeErr := s.writeTokenUsage(); writeErr != nil {
+		slog.Error("failed to write token usage", "error", writeErr)
+	}
+}
+
+// Flush writes the last-used timestamps that were not written yet, so they survive a shutdown.
+func (s *ServiceImpl) Flush() error {
+	s.tokenUsage.mutex.Lock()
+	defer s.tokenUsage.mutex.Unlock()
+	if !s.tokenUsage.unflushed {
+		return nil
+	}
+	return s.writeTokenUsage()
+}
+
+func (s *ServiceImpl) writeTokenUsage() error {
+	s.tokenUsage.lastFlush = time.Now().UTC()
+	marshalled, marshalErr := json.Marshal(s.tokenUsage.lastUsed)
+	if marshalErr != nil {
+		return fmt.Errorf("failed to marshal token usage: %w", marshalErr)
+	}
+	writeErr := s.fsService.WriteFileContent(s.configService.StatePath(tokenUsageFile), marshalled, 0600)
+	if writeErr != nil {
+		return fmt.Errorf("failed to write token usage: %w", writeErr)
+	}
+	s.tokenUsage.unflushed = false
+	return nil
+}
+
+func (s *ServiceImpl) GetTokenLastUsed(username, name string) (time.Time, bool) {
+	s.tokenUsage.mutex.Lock()
+	defer s.tokenUsage.mutex.Unlock()
+	s.loadTokenUsage()
+	lastUsed, ok := s.tokenUsage.lastUsed[username][name]
+	return lastUsed, ok
+}
+
+func (s *ServiceImpl) loadTokenUsage() {
+	if s.tokenUsage.loaded {
+		return
+	}
+	s.tokenUsage.loaded = true
+	s.tokenUsage.lastUsed = map[string]map[string]time.Time{}
+	content, readErr := s.fsService.ReadFileContent(s.configService.StatePath(tokenUsageFile))
+	if readErr != nil {
+		return
+	}
+	if unmarshalErr := json.Unmarshal(content, &s.tokenUsage.lastUsed); unmarshalErr != nil {
+		slog.Error("failed to read token usage", "error", unmarshalErr)
+	}
+}
@@ -1,6 +1,7 @@
 package user
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/triargos/webdav/pkg/config"
@@ -12,21 +13,36 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type Service interface {
 	AddUser(username string, user config.User) error
 	GetUser(username string) config.User
 	GetUsers() map[string]config.User
+	GetGroups() map[string]config.Group
+	GetACL() []config.ACLRule
 	HasUser(username string) bool
 	RemoveUser(username string) error
 	InitializeDirectories() error
 	HashPasswords() error
+	// OnUserChange registers a listener that is called with the username whenever a user is added,
+	// changed or removed
+	OnUserChange(listener func(username string))
+	// VirtualRoot returns the namespace of a user, or false if virtual roots are disabled
+	VirtualRoot(username string) (VirtualRoot, bool)
+
+	AddToken(username string, token config.Token) (string, error)
+	RemoveToken(username, name string) error
+	TouchToken(username, name string)
+	GetTokenLastUsed(username, name string) (time.Time, bool)
 }
 
 type ServiceImpl struct {
 	configService config.Service
 	fsService     fs.Service
+	tokenUsage    tokenUsage
+	listeners     []func(username string)
 }
 
 func NewOsUserService(configService config.Service, fsService fs.Service) Service {
@@ -34,13 +50,28 @@ func NewOsUserService(configService config.Service, fsService fs.Service) Servic
 }
 
 func (s *ServiceImpl) createUserDirectories(user config.User, contentRoot string) error {
-	userRoot := filepath.Join(contentRoot, user.Root)
-	createDirectoryErr := s.fsService.CreateDirectories(userRoot, os.ModePerm)
+	createDirectoryErr := s.createDirectories(filepath.Join(contentRoot, user.Root), user.SubDirectories)
 	if createDirectoryErr != nil {
 		return fmt.Errorf("failed to create users root directory: %v", createDirectoryErr)
 	}
-	for _, subdirectory := range user.SubDirectories {
-		subDirectoryPath := filepath.Join(userRoot, subdirectory)
+	return nil
+}
+
+func (s *ServiceImpl) createGroupDirectories(group config.Group, contentRoot string) error {
+	createDirectoryErr := s.createDirectories(filepath.Join(contentRoot, group.Root), group.SubDirectories)
+	if createDirectoryErr != nil {
+		return fmt.Errorf("failed to create groups root directory: %v", createDirectoryErr)
+	}
+	return nil
+}
+
+func (s *ServiceImpl) createDirectories(root string, subdirectories []string) error {
+	createDirectoryErr := s.fsService.CreateDirectories(root, os.ModePerm)
+	if createDirectoryErr != nil {
+		return createDirectoryErr
+	}
+	for _, subdirectory := range subdirectories {
+		subDirectoryPath := filepath.Join(root, subdirectory)
 		createSubDirectoryErr := s.fsService.CreateDirectories(subDirectoryPath, os.ModePerm)
 		if createSubDirectoryErr != nil {
 			slog.Error("failed to create subdirectory", "subdirectory", subdirectory, "error", createSubDirectoryErr)
@@ -54,28 +85,43 @@ func generateBasicHash(password string) string {
 	return hash
 }
 
-func generateDigestHash(username, password string) string {
-	hash := helper.Md5Hash(fmt.Sprintf("%s:%s:%s", username, "WebDAV", password))
-	return hash
+func generateDigestHashes(username, password string) map[string]string {
+	hashes := make(map[string]string, len(helper.DigestAlgorithms))
+	for _, algorithm := range helper.DigestAlgorithms {
+		hash, _ := helper.DigestHashFunc(algorithm)
+		hashes[algorithm] = hash(fmt.Sprintf("%s:%s:%s", username, "WebDAV", password))
+	}
+	return hashes
 }
-func (s *ServiceImpl) GenerateHash(username, password string) string {
-	authType := s.configService.Get().Security.AuthType
-	switch authType {
-	case "basic":
-		{
-			return generateBasicHash(password)
-		}
-	case "digest":
-		{
-			return generateDigestHash(username, password)
+
+// HashCredentials replaces the plain text password of a user with the credentials for every scheme
+// the user may authenticate with: a bcrypt hash for basic, and one HA1 per digest algorithm for digest.
+func (s *ServiceImpl) HashCredentials(username string, user config.User) config.User {
+	authTypes := user.AuthTypes
+	if len(authTypes) == 0 {
+		authTypes = helper.AuthTypes(s.configService.Get().Security.AuthType)
+	}
+	password := user.Password
+	user.Password = ""
+	for _, authType := range authTypes {
+		switch authType {
+		case "basic":
+			{
+				user.Password = generateBasicHash(password)
+			}
+		case "digest":
+			{
+				user.Digest = generateDigestHashes(username, password)
+			}
 		}
 	}
-	return ""
+	return user
 }
 
 func (s *ServiceImpl) AddUser(username string, user config.User) error {
-	user.Password = s.GenerateHash(username, user.Password)
+	user = s.HashCredentials(username, user)
 	s.configService.AddUser(username, user)
+	s.notifyUserChange(username)
 	writeConfigErr := s.configService.Write()
 	if writeConfigErr != nil {
 		return fmt.Errorf("failed to write config file: %s", writeConfigErr)
@@ -110,6 +156,8 @@ func (s *ServiceImpl) RemoveUser(username string) error {
 		return fmt.Errorf("error removing user directory: %s", removeUserDirectoryErr)
 	}
 	s.configService.RemoveUser(username)
+	s.removeGroupMember(username)
+	s.notifyUserChange(username)
 	writeConfigErr := s.configService.Write()
 	if writeConfigErr != nil {
 		return fmt.Errorf("failed to write config file: %s", writeConfigErr)
@@ -126,24 +174,80 @@ func (s *ServiceImpl) InitializeDirectories() error {
 			slog.Error("failed to initialize directories", "error", createDirectoriesErr)
 		}
 	}
+	for groupName, group := range s.configService.Get().Groups {
+		if group.Root == "" {
+			continue
+		}
+		createDirectoriesErr := s.createGroupDirectories(group, contentRoot)
+		if createDirectoriesErr != nil {
+			slog.Error("failed to initialize group directories", "group", groupName, "error", createDirectoriesErr)
+		}
+	}
 	return nil
 }
 
 func (s *ServiceImpl) HashPasswords() error {
-	if s.configService.Get().Security.AuthType != "basic" {
-		slog.Info("Skipping hash step because auth type is digest")
-		return nil
-	}
+	authType := s.configService.Get().Security.AuthType
 	for username, user := range s.configService.Get().Users {
-		if !isHashed(user.Password) {
-			slog.Info("Password for user is not hashed, hashing now", "username", username)
-			user.Password = GenHash([]byte(user.Password))
-			s.configService.UpdateUser(username, user)
+		if user.Password == "" || isHashed(user.Password) {
+			if !hasDigestCredentials(user) && helper.AllowsDigest(authType, user.AuthTypes) {
+				slog.Warn("User has no digest credentials, set a plain text password to generate them", "username", username)
+			}
+			continue
+		}
+		if authType != "basic" && isLegacyDigestHash(user) {
+			if s.configService.Get().Security.LegacyDigest {
+				slog.Info("Moving digest hash of user to the digest section", "username", username)
+				user.Digest = map[string]string{"MD5": user.Password}
+				user.Password = ""
+				s.configService.UpdateUser(username, user)
+				s.notifyUserChange(username)
+				continue
+			}
+			slog.Warn("Password of user looks like a digest hash of an older version, hashing it as a plain text password. Enable security.legacydigest if it is one", "username", username)
 		}
+		slog.Info("Password for user is not hashed, hashing now", "username", username)
+		s.configService.UpdateUser(username, s.HashCredentials(username, user))
+		s.notifyUserChange(username)
 	}
 	return s.configService.Write()
 }
 
+func (s *ServiceImpl) GetGroups() map[string]config.Group {
+	return s.configService.Get().Groups
+}
+
+// removeGroupMember drops a removed user from every group, so that a new user with the same name
+// does not inherit the memberships.
+func (s *ServiceImpl) removeGroupMember(username string) {
+	for groupName, group := range s.configService.Get().Groups {
+		members := make([]string, 0, len(group.Members))
+		for _, member := range group.Members {
+			if member != username {
+				members = append(members, member)
+			}
+		}
+		if len(members) != len(group.Members) {
+			group.Members = members
+			s.configService.UpdateGroup(groupName, group)
+		}
+	}
+}
+
+func (s *ServiceImpl) GetACL() []config.ACLRule {
+	return s.configService.Get().ACL
+}
+
+func (s *ServiceImpl) OnUserChange(listener func(username string)) {
+	s.listeners = append(s.listeners, listener)
+}
+
+func (s *ServiceImpl) notifyUserChange(username string) {
+	for _, listener := range s.listeners {
+		listener(username)
+	}
+}
+
 func (s *ServiceImpl) GetUsers() map[string]config.User {
 	return s.configService.Get().Users
 }
@@ -153,6 +257,21 @@ func isHashed(password string) bool {
 	return strings.HasPrefix(password, "$2a$") || strings.HasPrefix(password, "$2b$") || strings.HasPrefix(password, "$2y$")
 }
 
+func hasDigestCredentials(user config.User) bool {
+	return len(user.Digest) > 0 || isLegacyDigestHash(user)
+}
+
+// isLegacyDigestHash reports whether the password of a user may be an MD5 HA1, which is how digest
+// credentials were stored before they were kept per algorithm. A plain text password can look the
+// same, so it is only taken for one with security.legacydigest.
+func isLegacyDigestHash(user config.User) bool {
+	if len(user.Digest) > 0 || len(user.Password) != 32 {
+		return false
+	}
+	_, decodeErr := hex.DecodeString(user.Password)
+	return decodeErr == nil
+}
+
 func GenHash(password []byte) string {
 	pw, err := bcrypt.GenerateFromPassword(password, 10)
 	if err != nil {
@@ -0,0 +1,98 @@
+package user
+
+import (
+	"github.com/triargos/webdav/pkg/config"
+	"path"
+	"strings"
+)
+
+// VirtualRoot maps the namespace a user sees onto the content directory. The root of the namespace
+// is the root of the user, and the shared folders of the user's groups are mounted as its children.
+type VirtualRoot struct {
+	Root string
+	// Mounts maps the name of a child of the root to the shared folder it is mounted from
+	Mounts map[string]string
+}
+
+// VirtualRoot returns the namespace of a user, or false if virtual roots are disabled.
+func (s *ServiceImpl) VirtualRoot(username string) (VirtualRoot, bool) {
+	if !s.configService.Get().Content.VirtualRoot || !s.HasUser(username) {
+		return VirtualRoot{}, false
+	}
+	return NewVirtualRoot(username, s.GetUser(username).Root, s.GetGroups()), true
+}
+
+// NewVirtualRoot creates the namespace of a user from their root and the shared folders of the
+// groups they are a member of.
+func NewVirtualRoot(username, root string, groups map[string]config.Group) VirtualRoot {
+	mounts := map[string]string{}
+	for groupName, group := range groups {
+		if group.Root == "" || strings.Contains(groupName, "/") {
+			continue
+		}
+		for _, member := range group.Members {
+			if member == username {
+				mounts[groupName] = cleanPath(group.Root)
+				break
+			}
+		}
+	}
+	return VirtualRoot{Root: cleanPath(root), Mounts: mounts}
+}
+
+// Resolve maps a path of the namespace onto the content directory.
+func (v VirtualRoot) Resolve(name string) string {
+	name = cleanPath(name)
+	first, rest, _ := strings.Cut(strings.TrimPrefix(name, "/"), "/")
+	if mountRoot, ok := v.Mounts[first]; ok {
+		return path.Join(mountRoot, rest)
+	}
+	return path.Join(v.Root, name)
+}
+
+// Unresolve maps a path of the content directory back into the namespace. It returns false if the
+// path is not visible in the namespace.
+func (v VirtualRoot) Unresolve(name string) (string, bool) {
+	name = cleanPath(name)
+	for mountName, mountRoot := range v.Mounts {
+		if rest, ok := cutPathPrefix(name, mountRoot); ok {
+			return path.Join("/", mountName, rest), true
+		}
+	}
+	rest, ok := cutPathPrefix(name, v.Root)
+	if !ok {
+		return "", false
+	}
+	if first, _, _ := strings.Cut(rest, "/"); first != "" {
+		if _, shadowed := v.Mounts[first]; shadowed {
+			return "", false
+		}
+	}
+	return path.Join("/", rest), true
+}
+
+// MountPoint reports whether a path of the namespace is the root of a mounted shared folder.
+func (v VirtualRoot) MountPoint(name string) (string, bool) {
+	name = cleanPath(name)
+	if name == "/" || strings.Count(name, "/") != 1 {
+		return "", false
+	}
+	mountName := name[1:]
+	_, ok := v.Mounts[mountName]
+	return mountName, ok
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func cutPathPrefix(name, prefix string) (string, bool) {
+	if prefix == "/" {
+		return strings.TrimPrefix(name, "/"), true
+	}
+	if name == prefix {
+		return "", true
+	}
+	rest, ok := strings.CutPrefix(name, prefix+"/")
+	return rest, ok
+}
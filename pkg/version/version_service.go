@@ -0,0 +1,397 @@
+package version
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/triargos/webdav/pkg/helper"
+	"golang.org/x/net/webdav"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("version not found")
+
+const metadataSuffix = ".json"
+
+// Version is an earlier content of a file, saved when it was overwritten.
+type Version struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	// Created is when the content was replaced
+	Created time.Time `json:"created"`
+	// Modified is the modification time of the content
+	Modified time.Time `json:"modified"`
+	Size     int64     `json:"size"`
+	// Username is the user who replaced the content
+	Username string `json:"username"`
+}
+
+// Retention decides which versions are kept. Every limit that is set applies.
+type Retention struct {
+	// Keep is the number of versions kept per file, 0 keeps all of them
+	Keep int
+	// Thin keeps fewer versions the older they get: every version of the last hour, one per hour
+	// of the last day, one per day of the last month and one per week before that
+	Thin bool
+	// MaxAge is how long versions are kept, 0 keeps them forever
+	MaxAge time.Duration
+	// MaxSize limits the size of the versions created by a user, the oldest are removed first
+	MaxSize int64
+	// Quota returns the quota of a user, or 0 if they have none. Their versions are limited to it
+	// as well, so versions can't take more space than the user may store.
+	Quota func(username string) int64
+}
+
+// maxSize returns the limit of the versions created by a user, or 0 if there is none.
+func (r Retention) maxSize(username string) int64 {
+	maxSize := r.MaxSize
+	if r.Quota != nil {
+		if quota := r.Quota(username); quota > 0 && (maxSize <= 0 || quota < maxSize) {
+			maxSize = quota
+		}
+	}
+	return maxSize
+}
+
+type Service interface {
+	// Save saves the content of a file as a version, created by a user.
+	Save(ctx context.Context, username, name string) (Version, error)
+	// List returns the versions of a file, newest first.
+	List(ctx context.Context, name string) ([]Version, error)
+	Get(ctx context.Context, name, id string) (Version, error)
+	// Open opens the content of a version for reading.
+	Open(ctx context.Context, name, id string) (webdav.File, error)
+	// Restore replaces the content of a file with a version. The replaced content is saved as a
+	// version first, so restoring can be undone.
+	Restore(ctx context.Context, username, name, id string) (Version, error)
+	Delete(ctx context.Context, name, id string) error
+}
+
+// VersionService keeps the versions in the state directory of a file system, in one collection per
+// user and file. The collections are named after a hash of the path of the file, so versions stay
+// with the path when the file is moved or deleted.
+type VersionService struct {
+	fileSystem webdav.FileSystem
+	retention  Retention
+	now        func() time.Time
+}
+
+// NewVersionService creates a version store on a file system, which must not check permissions.
+func NewVersionService(fileSystem webdav.FileSystem, retention Retention) Service {
+	return &VersionService{fileSystem: fileSystem, retention: retention, now: time.Now}
+}
+
+func (s *VersionService) Save(ctx context.Context, username, name string) (Version, error) {
+	version, err := s.save(ctx, username, name)
+	if err != nil {
+		return Version{}, err
+	}
+	s.prune(ctx, version.Path)
+	s.enforceMaxSize(ctx, username)
+	return version, nil
+}
+
+func (s *VersionService) save(ctx context.Context, username, name string) (Version, error) {
+	if !isPathElement(username) {
+		return Version{}, fmt.Errorf("invalid username %q", username)
+	}
+	name = path.Clean("/" + name)
+	source, err := s.fileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return Version{}, err
+	}
+	defer source.Close()
+	fileInfo, err := source.Stat()
+	if err != nil {
+		return Version{}, err
+	}
+	if fileInfo.IsDir() {
+		return Version{}, fmt.Errorf("%s is a collection", name)
+	}
+	now := s.now()
+	version := Version{
+		ID:       newID(now),
+		Path:     name,
+		Created:  now.UTC(),
+		Modified: fileInfo.ModTime().UTC(),
+		Size:     fileInfo.Size(),
+		Username: username,
+	}
+	dir := versionDir(username, name)
+	if err := helper.MkdirAll(ctx, s.fileSystem, dir); err != nil {
+		return Version{}, fmt.Errorf("failed to create version collection: %w", err)
+	}
+	if err := s.copyFile(ctx, path.Join(dir, version.ID), source); err != nil {
+		s.fileSystem.RemoveAll(ctx, path.Join(dir, version.ID))
+		return Version{}, fmt.Errorf("failed to save version: %w", err)
+	}
+	marshalled, err := json.Marshal(version)
+	if err != nil {
+		return Version{}, err
+	}
+	if err := helper.WriteFile(ctx, s.fileSystem, path.Join(dir, version.ID+metadataSuffix), marshalled); err != nil {
+		s.fileSystem.RemoveAll(ctx, path.Join(dir, version.ID))
+		return Version{}, fmt.Errorf("failed to save version: %w", err)
+	}
+	return version, nil
+}
+
+func (s *VersionService) List(ctx context.Context, name string) ([]Version, error) {
+	name = path.Clean("/" + name)
+	usernames, err := helper.ReadDirNames(ctx, s.fileSystem, helper.StatePath("versions"))
+	if err != nil {
+		return nil, err
+	}
+	var versions []Version
+	for _, username := range usernames {
+		dir := versionDir(username, name)
+		names, err := helper.ReadDirNames(ctx, s.fileSystem, dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, fileName := range names {
+			if !strings.HasSuffix(fileName, metadataSuffix) {
+				continue
+			}
+			version, err := s.readVersion(ctx, path.Join(dir, fileName))
+			if err != nil {
+				slog.Warn("Skipping unreadable version", "path", name, "file", fileName, "error", err)
+				continue
+			}
+			// Paths with the same hash are too unlikely to handle, but must not show up as versions
+			if version.Path == name {
+				versions = append(versions, version)
+			}
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Created.After(versions[j].Created)
+	})
+	return versions, nil
+}
+
+func (s *VersionService) Get(ctx context.Context, name, id string) (Version, error) {
+	if !isPathElement(id) {
+		return Version{}, ErrNotFound
+	}
+	versions, err := s.List(ctx, name)
+	if err != nil {
+		return Version{}, err
+	}
+	for _, version := range versions {
+		if version.ID == id {
+			return version, nil
+		}
+	}
+	return Version{}, ErrNotFound
+}
+
+func (s *VersionService) Open(ctx context.Context, name, id string) (webdav.File, error) {
+	version, err := s.Get(ctx, name, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.fileSystem.OpenFile(ctx, path.Join(versionDir(version.Username, version.Path), version.ID), os.O_RDONLY, 0)
+}
+
+func (s *VersionService) Restore(ctx context.Context, username, name, id string) (Version, error) {
+	source, err := s.Open(ctx, name, id)
+	if err != nil {
+		return Version{}, err
+	}
+	defer source.Close()
+	version, _ := s.Get(ctx, name, id)
+	if fileInfo, err := s.fileSystem.Stat(ctx, version.Path); err == nil && !fileInfo.IsDir() && fileInfo.Size() > 0 {
+		if _, err := s.save(ctx, username, version.Path); err != nil {
+			return Version{}, err
+		}
+	}
+	if err := s.copyFile(ctx, version.Path, source); err != nil {
+		return Version{}, fmt.Errorf("failed to restore version: %w", err)
+	}
+	s.prune(ctx, version.Path)
+	s.enforceMaxSize(ctx, username)
+	return version, nil
+}
+
+func (s *VersionService) Delete(ctx context.Context, name, id string) error {
+	version, err := s.Get(ctx, name, id)
+	if err != nil {
+		return err
+	}
+	return s.delete(ctx, versionDir(version.Username, version.Path), version.ID)
+}
+
+// delete removes a version and the collection it was in, once it is empty.
+func (s *VersionService) delete(ctx context.Context, dir, id string) error {
+	if err := s.fileSystem.RemoveAll(ctx, path.Join(dir, id+metadataSuffix)); err != nil {
+		return err
+	}
+	if err := s.fileSystem.RemoveAll(ctx, path.Join(dir, id)); err != nil {
+		return err
+	}
+	if names, err := helper.ReadDirNames(ctx, s.fileSystem, dir); err == nil && len(names) == 0 {
+		return s.fileSystem.RemoveAll(ctx, dir)
+	}
+	return nil
+}
+
+// thinningSteps are the intervals in which thinning keeps one version, by the age of the versions.
+var thinningSteps = []struct {
+	age      time.Duration
+	interval time.Duration
+}{
+	{age: time.Hour, interval: 0},
+	{age: 24 * time.Hour, interval: time.Hour},
+	{age: 30 * 24 * time.Hour, interval: 24 * time.Hour},
+}
+
+const thinningInterval = 7 * 24 * time.Hour
+
+// prune removes the versions of a file the retention does not keep.
+func (s *VersionService) prune(ctx context.Context, name string) {
+	if s.retention.Keep <= 0 && !s.retention.Thin && s.retention.MaxAge <= 0 {
+		return
+	}
+	versions, err := s.List(ctx, name)
+	if err != nil {
+		slog.Error("Failed to prune versions", "path", name, "error", err)
+		return
+	}
+	now := s.now()
+	kept := 0
+	intervals := map[string]bool{}
+	for _, version := range versions {
+		age := now.Sub(version.Created)
+		keep := s.retention.MaxAge <= 0 || age <= s.retention.MaxAge
+		keep = keep && (s.retention.Keep <= 0 || kept < s.retention.Keep)
+		if keep && s.retention.Thin {
+			interval := thinningInterval
+			for _, step := range thinningSteps {
+				if age < step.age {
+					interval = step.interval
+					break
+				}
+			}
+			if interval > 0 {
+				key := fmt.Sprintf("%d/%d", interval, version.Created.Truncate(interval).Unix())
+				keep = !intervals[key]
+				intervals[key] = true
+			}
+		}
+		if keep {
+			kept++
+			continue
+		}
+		if err := s.delete(ctx, versionDir(version.Username, version.Path), version.ID); err != nil {
+			slog.Error("Failed to remove version", "path", name, "id", version.ID, "error", err)
+		}
+	}
+}
+
+// enforceMaxSize removes the oldest versions of a user until they fit into the maximum size.
+func (s *VersionService) enforceMaxSize(ctx context.Context, username string) {
+	maxSize := s.retention.maxSize(username)
+	if maxSize <= 0 {
+		return
+	}
+	type userVersion struct {
+		dir  string
+		id   string
+		size int64
+	}
+	userDir := helper.StatePath("versions", username)
+	keys, err := helper.ReadDirNames(ctx, s.fileSystem, userDir)
+	if err != nil {
+		slog.Error("Failed to read versions", "username", username, "error", err)
+		return
+	}
+	var versions []userVersion
+	var total int64
+	for _, key := range keys {
+		dir := path.Join(userDir, key)
+		file, err := s.fileSystem.OpenFile(ctx, dir, os.O_RDONLY, 0)
+		if err != nil {
+			continue
+		}
+		fileInfos, _ := file.Readdir(0)
+		file.Close()
+		for _, fileInfo := range fileInfos {
+			if strings.HasSuffix(fileInfo.Name(), metadataSuffix) {
+				continue
+			}
+			versions = append(versions, userVersion{dir: dir, id: fileInfo.Name(), size: fileInfo.Size()})
+			total += fileInfo.Size()
+		}
+	}
+	// IDs start with the time the version was created, so they sort oldest first
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].id < versions[j].id
+	})
+	for _, version := range versions {
+		if total <= maxSize {
+			return
+		}
+		if err := s.delete(ctx, version.dir, version.id); err != nil {
+			slog.Error("Failed to remove version", "username", username, "id", version.id, "error", err)
+			continue
+		}
+		total -= version.size
+	}
+}
+
+func (s *VersionService) copyFile(ctx context.Context, name string, source io.Reader) error {
+	target, err := s.fileSystem.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, copyErr := io.Copy(target, source)
+	closeErr := target.Close()
+	return errors.Join(copyErr, closeErr)
+}
+
+func (s *VersionService) readVersion(ctx context.Context, name string) (Version, error) {
+	file, err := s.fileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return Version{}, err
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return Version{}, err
+	}
+	var version Version
+	if err := json.Unmarshal(content, &version); err != nil {
+		return Version{}, fmt.Errorf("invalid version: %w", err)
+	}
+	return version, nil
+}
+
+// versionDir returns the collection holding the versions of a file created by a user.
+func versionDir(username, name string) string {
+	hash := sha256.Sum256([]byte(name))
+	return helper.StatePath("versions", username, hex.EncodeToString(hash[:16]))
+}
+
+func isPathElement(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// newID returns a version ID that sorts by creation time.
+func newID(now time.Time) string {
+	buffer := make([]byte, 4)
+	if _, err := rand.Read(buffer); err != nil {
+		panic(err)
+	}
+	return now.UTC().Format("20060102T150405.000000") + "-" + hex.EncodeToString(buffer)
+}
@@ -0,0 +1,83 @@
+package version
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/triargos/webdav/pkg/helper"
+	"golang.org/x/net/webdav"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVersionRetention(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		retention Retention
+		// saves are the ages of the versions when the last one is saved, oldest first
+		saves    []time.Duration
+		expected int
+	}{
+		{name: "Keep all", saves: []time.Duration{3 * time.Hour, 2 * time.Hour, 0}, expected: 3},
+		{name: "Keep last", retention: Retention{Keep: 2}, saves: []time.Duration{3 * time.Hour, 2 * time.Hour, 0}, expected: 2},
+		{name: "Maximum age", retention: Retention{MaxAge: 24 * time.Hour}, saves: []time.Duration{48 * time.Hour, 2 * time.Hour, 0}, expected: 2},
+		{
+			name:      "Thinning",
+			retention: Retention{Thin: true},
+			// Two on the same day of the month, two in the same hour of the day, two within the last hour
+			saves:    []time.Duration{10*24*time.Hour + 30*time.Minute, 10*24*time.Hour + 10*time.Minute, 5*time.Hour + 30*time.Minute, 5*time.Hour + 10*time.Minute, 10 * time.Minute, 0},
+			expected: 4,
+		},
+		{name: "Maximum size", retention: Retention{MaxSize: 25}, saves: []time.Duration{3 * time.Hour, 2 * time.Hour, 0}, expected: 2},
+		{name: "Quota", retention: Retention{Quota: func(string) int64 { return 15 }}, saves: []time.Duration{3 * time.Hour, 2 * time.Hour, 0}, expected: 1},
+		{name: "Quota above the maximum size", retention: Retention{MaxSize: 25, Quota: func(string) int64 { return 100 }}, saves: []time.Duration{3 * time.Hour, 2 * time.Hour, 0}, expected: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memFs := webdav.NewMemFS()
+			service := NewVersionService(memFs, tt.retention).(*VersionService)
+			// Align the clock to a day, so the thinning intervals are predictable
+			start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).Add(-tt.saves[0])
+			for _, age := range tt.saves {
+				now := start.Add(tt.saves[0] - age)
+				service.now = func() time.Time { return now }
+				assert.NoError(t, helper.WriteFile(ctx, memFs, "/notes.txt", []byte(strings.Repeat("x", 10))))
+				_, err := service.Save(ctx, "alice", "/notes.txt")
+				assert.NoError(t, err)
+			}
+			versions, err := service.List(ctx, "/notes.txt")
+			assert.NoError(t, err)
+			assert.Len(t, versions, tt.expected)
+		})
+	}
+}
+
+func TestVersionRestore(t *testing.T) {
+	ctx := context.Background()
+	memFs := webdav.NewMemFS()
+	service := NewVersionService(memFs, Retention{Keep: 1})
+	assert.NoError(t, helper.WriteFile(ctx, memFs, "/notes.txt", []byte("first")))
+	saved, err := service.Save(ctx, "alice", "/notes.txt")
+	assert.NoError(t, err)
+	assert.NoError(t, helper.WriteFile(ctx, memFs, "/notes.txt", []byte("second")))
+
+	_, err = service.Restore(ctx, "bob", "/notes.txt", saved.ID)
+	assert.NoError(t, err)
+	file, err := memFs.OpenFile(ctx, "/notes.txt", os.O_RDONLY, 0)
+	assert.NoError(t, err)
+	content, _ := io.ReadAll(file)
+	file.Close()
+	assert.Equal(t, "first", string(content))
+
+	// Keeping one version, the replaced content is the only version left
+	versions, err := service.List(ctx, "/notes.txt")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+	assert.Equal(t, "bob", versions[0].Username)
+	assert.Equal(t, int64(len("second")), versions[0].Size)
+	_, err = service.Get(ctx, "/notes.txt", "..")
+	assert.ErrorIs(t, err, ErrNotFound)
+}